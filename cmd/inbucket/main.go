@@ -19,6 +19,7 @@ import (
 	"github.com/inbucket/inbucket/v3/pkg/storage"
 	"github.com/inbucket/inbucket/v3/pkg/storage/file"
 	"github.com/inbucket/inbucket/v3/pkg/storage/mem"
+	"github.com/inbucket/inbucket/v3/pkg/storage/sqlite"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -44,6 +45,7 @@ func init() {
 	// Register storage implementations.
 	storage.Constructors["file"] = file.New
 	storage.Constructors["memory"] = mem.New
+	storage.Constructors["sqlite"] = sqlite.New
 }
 
 func main() {
@@ -53,7 +55,7 @@ func main() {
 	pidfile := flag.String("pidfile", "", "Write our PID into the specified file.")
 	logfile := flag.String("logfile", "stderr", "Write out log into the specified file.")
 	logjson := flag.Bool("logjson", false, "Logs are written in JSON format.")
-	netdebug := flag.Bool("netdebug", false, "Dump SMTP & POP3 network traffic to stdout.")
+	netdebug := flag.Bool("netdebug", false, "Dump SMTP, POP3 & IMAP network traffic to stdout.")
 	flag.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage: inbucket [options]")
 		flag.PrintDefaults()
@@ -80,6 +82,7 @@ func main() {
 	}
 	if *netdebug {
 		conf.POP3.Debug = true
+		conf.IMAP.Debug = true
 		conf.SMTP.Debug = true
 	}
 
@@ -152,8 +155,14 @@ signalLoop:
 	go timedExit(*pidfile)
 	log.Debug().Str("phase", "shutdown").Msg("Draining SMTP connections")
 	services.SMTPServer.Drain()
+	if services.LMTPServer != nil {
+		log.Debug().Str("phase", "shutdown").Msg("Draining LMTP connections")
+		services.LMTPServer.Drain()
+	}
 	log.Debug().Str("phase", "shutdown").Msg("Draining POP3 connections")
 	services.POP3Server.Drain()
+	log.Debug().Str("phase", "shutdown").Msg("Draining IMAP connections")
+	services.IMAPServer.Drain()
 	log.Debug().Str("phase", "shutdown").Msg("Checking retention scanner is stopped")
 	services.RetentionScanner.Join()
 
@@ -9,6 +9,7 @@ IMAGE="inbucket/inbucket:edge"
 PORT_HTTP=9000
 PORT_SMTP=2500
 PORT_POP3=1100
+PORT_IMAP=1430
 
 # Volumes exposed on host:
 VOL_CONFIG="/tmp/inbucket/config"
@@ -47,6 +48,7 @@ main() {
     -p $PORT_HTTP:9000 \
     -p $PORT_SMTP:2500 \
     -p $PORT_POP3:1100 \
+    -p $PORT_IMAP:1430 \
     -v "$VOL_CONFIG:/config" \
     -v "$VOL_DATA:/storage" \
     "$IMAGE"
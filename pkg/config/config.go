@@ -56,75 +56,181 @@ func (n *mbNaming) Decode(v string) error {
 	return nil
 }
 
+// NamedURLs is a map of names to URLs, decoded from a comma separated list of name:URL pairs.
+type NamedURLs map[string]string
+
+// Decode name:URL pairs from string.  Only the first colon of each pair separates the name, as
+// URLs contain colons themselves.
+func (n *NamedURLs) Decode(v string) error {
+	m := make(NamedURLs)
+	for _, pair := range strings.Split(v, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, url, ok := strings.Cut(pair, ":")
+		if !ok || name == "" || url == "" {
+			return fmt.Errorf("invalid name:URL pair: %q", pair)
+		}
+		m[name] = url
+	}
+	*n = m
+	return nil
+}
+
 // Root contains global configuration, and structs with for specific sub-systems.
 type Root struct {
 	LogLevel      string `required:"true" default:"info" desc:"debug, info, warn, or error"`
 	Lua           Lua
+	RPC           RPC
 	MailboxNaming mbNaming `required:"true" default:"local" desc:"Use local, full, or domain addressing"`
 	SMTP          SMTP
+	LMTP          LMTP
 	POP3          POP3
+	IMAP          IMAP
 	Web           Web
 	Storage       Storage
+	MsgAuth       MsgAuth
+	Relay         Relay
+	Webhook       Webhook
 }
 
 // Lua contains the Lua extension host configuration.
 type Lua struct {
-	Path string `required:"false" default:"inbucket.lua" desc:"Lua script path"`
+	Path               string        `required:"false" default:"inbucket.lua" desc:"Lua script path"`
+	MaxBodyBytes       int           `required:"true" default:"1048576" desc:"Max message body size available to Lua"`
+	MaxAttachmentBytes int           `required:"true" default:"1048576" desc:"Max attachment size available to Lua"`
+	WatchInterval      time.Duration `required:"true" default:"2s" desc:"Lua script change poll interval, 0 disables"`
+	Timeout            time.Duration `required:"true" default:"5s" desc:"Max run time of a Lua function call"`
+	MaxCallDepth       int           `required:"true" default:"200" desc:"Max Lua function call depth"`
+	MaxStackSize       int           `required:"true" default:"65536" desc:"Max Lua value stack slots"`
+	MaxInstructions    int           `required:"true" default:"10000000" desc:"Max Lua instructions per call"`
+	MaxMemoryBytes     int           `required:"true" default:"67108864" desc:"Max heap growth during a Lua call"`
+	Modules            []string      `default:"http,json,logger,store" desc:"Lua modules scripts may require"`
+}
+
+// RPC contains the external JSON-RPC extension host configuration.
+type RPC struct {
+	Command string        `desc:"External extension program command line"`
+	Socket  string        `desc:"External extension Unix socket path"`
+	Timeout time.Duration `required:"true" default:"2s" desc:"Max wait for extension before-event replies"`
 }
 
 // SMTP contains the SMTP server configuration.
 type SMTP struct {
-	Addr                string        `required:"true" default:"0.0.0.0:2500" desc:"SMTP server IP4 host:port"`
-	Domain              string        `required:"true" default:"inbucket" desc:"HELO domain"`
-	MaxRecipients       int           `required:"true" default:"200" desc:"Maximum RCPT TO per message"`
-	MaxMessageBytes     int           `required:"true" default:"10240000" desc:"Maximum message size"`
-	DefaultAccept       bool          `required:"true" default:"true" desc:"Accept all mail by default?"`
-	AcceptDomains       []string      `desc:"Domains to accept mail for"`
-	RejectDomains       []string      `desc:"Domains to reject mail for"`
-	DefaultStore        bool          `required:"true" default:"true" desc:"Store all mail by default?"`
-	StoreDomains        []string      `desc:"Domains to store mail for"`
-	DiscardDomains      []string      `desc:"Domains to discard mail for"`
-	RejectOriginDomains []string      `desc:"Domains to reject mail from"`
-	Timeout             time.Duration `required:"true" default:"300s" desc:"Idle network timeout"`
-	TLSEnabled          bool          `default:"false" desc:"Enable STARTTLS option"`
-	TLSPrivKey          string        `default:"cert.key" desc:"X509 Private Key file for TLS Support"`
-	TLSCert             string        `default:"cert.crt" desc:"X509 Public Certificate file for TLS Support"`
-	Debug               bool          `ignored:"true"`
-	ForceTLS            bool          `default:"false" desc:"Listen for connections with TLS."`
+	Addr                 string        `required:"true" default:"0.0.0.0:2500" desc:"SMTP server IP4 host:port"`
+	Domain               string        `required:"true" default:"inbucket" desc:"HELO domain"`
+	MaxRecipients        int           `required:"true" default:"200" desc:"Maximum RCPT TO per message"`
+	MaxMessageBytes      int           `required:"true" default:"10240000" desc:"Maximum message size"`
+	DefaultAccept        bool          `required:"true" default:"true" desc:"Accept all mail by default?"`
+	AcceptDomains        []string      `desc:"Domains to accept mail for"`
+	RejectDomains        []string      `desc:"Domains to reject mail for"`
+	DefaultStore         bool          `required:"true" default:"true" desc:"Store all mail by default?"`
+	StoreDomains         []string      `desc:"Domains to store mail for"`
+	DiscardDomains       []string      `desc:"Domains to discard mail for"`
+	RejectOriginDomains  []string      `desc:"Domains to reject mail from"`
+	Timeout              time.Duration `required:"true" default:"300s" desc:"Idle network timeout"`
+	TLSEnabled           bool          `default:"false" desc:"Enable STARTTLS option"`
+	TLSPrivKey           string        `default:"cert.key" desc:"X509 Private Key file for TLS Support"`
+	TLSCert              string        `default:"cert.crt" desc:"X509 Public Certificate file for TLS Support"`
+	Debug                bool          `ignored:"true"`
+	ForceTLS             bool          `default:"false" desc:"Listen for connections with TLS."`
+	AuthUsers            []string      `desc:"user:password pairs accepted by SMTP AUTH"`
+	AuthFile             string        `desc:"File of user:password lines accepted by SMTP AUTH"`
+	Transcript           bool          `default:"false" desc:"Store SMTP session transcript with messages"`
+	FaultFile            string        `desc:"JSON file of SMTP fault injection rules"`
+	ProxyTrusted         []string      `desc:"CIDRs trusted to send PROXY protocol headers"`
+	MaxConnsPerIP        int           `default:"0" desc:"Maximum concurrent connections per IP, 0 is unlimited"`
+	MaxMessagesPerIP     int           `default:"0" desc:"Maximum messages per minute per IP, 0 is unlimited"`
+	MaxMessagesPerSender int           `default:"0" desc:"Maximum messages per minute per sender, 0 is unlimited"`
+	MaxRecipientsPerIP   int           `default:"0" desc:"Maximum recipients per minute per IP, 0 is unlimited"`
+}
+
+// LMTP contains the LMTP server configuration.  All other settings are shared with SMTP.
+type LMTP struct {
+	Addr string `desc:"LMTP server IP4 host:port, blank to disable"`
 }
 
 // POP3 contains the POP3 server configuration.
 type POP3 struct {
-	Addr       string        `required:"true" default:"0.0.0.0:1100" desc:"POP3 server IP4 host:port"`
-	Domain     string        `required:"true" default:"inbucket" desc:"HELLO domain"`
-	Timeout    time.Duration `required:"true" default:"600s" desc:"Idle network timeout"`
+	Addr         string        `required:"true" default:"0.0.0.0:1100" desc:"POP3 server IP4 host:port"`
+	Domain       string        `required:"true" default:"inbucket" desc:"HELLO domain"`
+	Timeout      time.Duration `required:"true" default:"600s" desc:"Idle network timeout"`
+	Debug        bool          `ignored:"true"`
+	TLSEnabled   bool          `default:"false" desc:"Enable TLS"`
+	TLSPrivKey   string        `default:"cert.key" desc:"X509 Private Key file for TLS Support"`
+	TLSCert      string        `default:"cert.crt" desc:"X509 Public Certificate file for TLS Support"`
+	ForceTLS     bool          `default:"false" desc:"If true, TLS is always on. If false, enable STLS"`
+	ProxyTrusted []string      `desc:"CIDRs trusted to send PROXY protocol headers"`
+}
+
+// IMAP contains the IMAP server configuration.
+type IMAP struct {
+	Addr       string        `required:"true" default:"0.0.0.0:1430" desc:"IMAP server IP4 host:port"`
+	Domain     string        `required:"true" default:"inbucket" desc:"Greeting domain"`
+	Timeout    time.Duration `required:"true" default:"1800s" desc:"Idle network timeout"`
 	Debug      bool          `ignored:"true"`
 	TLSEnabled bool          `default:"false" desc:"Enable TLS"`
 	TLSPrivKey string        `default:"cert.key" desc:"X509 Private Key file for TLS Support"`
 	TLSCert    string        `default:"cert.crt" desc:"X509 Public Certificate file for TLS Support"`
-	ForceTLS   bool          `default:"false" desc:"If true, TLS is always on. If false, enable STLS"`
+	ForceTLS   bool          `default:"false" desc:"If true, TLS is always on. If false, enable STARTTLS"`
 }
 
 // Web contains the HTTP server configuration.
 type Web struct {
-	Addr           string `required:"true" default:"0.0.0.0:9000" desc:"Web server IP4 host:port"`
-	BasePath       string `default:"" desc:"Base path prefix for UI and API URLs"`
-	UIDir          string `required:"true" default:"ui/dist" desc:"User interface dir"`
-	GreetingFile   string `required:"true" default:"ui/greeting.html" desc:"Home page greeting HTML"`
-	MonitorVisible bool   `required:"true" default:"true" desc:"Show monitor tab in UI?"`
-	MonitorHistory int    `required:"true" default:"30" desc:"Monitor remembered messages"`
-	PProf          bool   `required:"true" default:"false" desc:"Expose profiling tools on /debug/pprof"`
+	Addr           string   `required:"true" default:"0.0.0.0:9000" desc:"Web server IP4 host:port"`
+	BasePath       string   `default:"" desc:"Base path prefix for UI and API URLs"`
+	UIDir          string   `required:"true" default:"ui/dist" desc:"User interface dir"`
+	GreetingFile   string   `required:"true" default:"ui/greeting.html" desc:"Home page greeting HTML"`
+	MonitorVisible bool     `required:"true" default:"true" desc:"Show monitor tab in UI?"`
+	MonitorHistory int      `required:"true" default:"30" desc:"Monitor remembered messages"`
+	PProf          bool     `required:"true" default:"false" desc:"Expose profiling tools on /debug/pprof"`
+	ProxyTrusted   []string `desc:"CIDRs trusted to send PROXY protocol headers"`
 }
 
 // Storage contains the mail store configuration.
 type Storage struct {
-	Type            string            `required:"true" default:"memory" desc:"Storage impl: file or memory"`
+	Type            string            `required:"true" default:"memory" desc:"Storage impl: file, memory, or sqlite"`
 	Params          map[string]string `desc:"Storage impl parameters, see docs."`
 	RetentionPeriod time.Duration     `required:"true" default:"24h" desc:"Duration to retain messages"`
 	RetentionSleep  time.Duration     `required:"true" default:"50ms" desc:"Duration to sleep between mailboxes"`
 	MailboxMsgCap   int               `required:"true" default:"500" desc:"Maximum messages per mailbox"`
 }
 
+// MsgAuth contains the message authentication configuration.
+type MsgAuth struct {
+	DKIM      bool   `default:"false" desc:"Verify DKIM signatures on delivery"`
+	SPF       bool   `default:"false" desc:"Evaluate SPF policy on delivery"`
+	DMARC     bool   `default:"false" desc:"Evaluate DMARC alignment on delivery"`
+	DNSZone   string `desc:"DNS zone file to resolve records from, used instead of DNS"`
+	DNSDir    string `desc:"Directory of DNS TXT record files, used instead of DNS"`
+	DNSServer string `desc:"DNS server host:port for lookups, blank for system"`
+}
+
+// Relay contains the configuration for releasing messages to upstream SMTP servers.
+type Relay struct {
+	Targets        NamedURLs         `desc:"name:URL pairs of upstream SMTP servers"`
+	From           string            `desc:"Envelope sender for released messages, blank for original"`
+	Timeout        time.Duration     `default:"30s" desc:"Upstream network timeout"`
+	ForwardDomains map[string]string `desc:"domain:target pairs of recipient domains to forward, * for all"`
+	RetryInterval  time.Duration     `default:"1m" desc:"Delay before first retry of a failed forward"`
+	MaxAttempts    int               `default:"8" desc:"Forward delivery attempts before giving up"`
+	QueueSize      int               `default:"1000" desc:"Maximum forwards waiting for delivery"`
+}
+
+// Webhook contains the configuration for posting message events to HTTP endpoints.
+type Webhook struct {
+	URLs           []string      `desc:"URLs to POST message events to"`
+	Mailboxes      []string      `desc:"Mailboxes to post events for, blank for all"`
+	Subject        string        `desc:"Regexp subjects must match to post events, blank for all"`
+	Secret         string        `desc:"HMAC-SHA256 key used to sign payloads, blank to disable"`
+	IncludeBody    bool          `default:"false" desc:"Include message body in stored events"`
+	Timeout        time.Duration `default:"10s" desc:"Webhook HTTP request timeout"`
+	RetryInterval  time.Duration `default:"10s" desc:"Delay before first retry of a failed post"`
+	MaxAttempts    int           `default:"6" desc:"Post attempts before dead-lettering an event"`
+	QueueSize      int           `default:"1000" desc:"Maximum events waiting to be posted"`
+	DeadLetterSize int           `default:"100" desc:"Failed events retained for inspection"`
+}
+
 // Process loads and parses configuration from the environment.
 func Process() (*Root, error) {
 	c := &Root{}
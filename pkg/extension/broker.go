@@ -28,6 +28,15 @@ func (eb *EventBroker[E, R]) Emit(event *E) *R {
 	return nil
 }
 
+// HasListeners returns true if any listeners are registered, allowing callers to skip building
+// expensive events.
+func (eb *EventBroker[E, R]) HasListeners() bool {
+	eb.RLock()
+	defer eb.RUnlock()
+
+	return len(eb.listenerFuncs) > 0
+}
+
 // AddListener registers the named listener, replacing one with a duplicate
 // name if present.  Listeners should be added in order of priority, most
 // significant first.
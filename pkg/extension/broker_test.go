@@ -132,3 +132,20 @@ func TestBrokerRemovingMissingListener(t *testing.T) {
 	broker := &extension.EventBroker[string, bool]{}
 	broker.RemoveListener("doesn't crash")
 }
+
+func TestBrokerHasListeners(t *testing.T) {
+	broker := &extension.EventBroker[string, bool]{}
+	if broker.HasListeners() {
+		t.Error("HasListeners got true for new broker, want false")
+	}
+
+	broker.AddListener("1", func(s string) *bool { return nil })
+	if !broker.HasListeners() {
+		t.Error("HasListeners got false after AddListener, want true")
+	}
+
+	broker.RemoveListener("1")
+	if broker.HasListeners() {
+		t.Error("HasListeners got true after RemoveListener, want false")
+	}
+}
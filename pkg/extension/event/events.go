@@ -20,6 +20,27 @@ type AddressParts struct {
 	Domain string
 }
 
+// AttachmentInfo describes a MIME attachment or inline part of a message.
+type AttachmentInfo struct {
+	FileName    string
+	ContentType string
+	Size        int64 // Decoded size in bytes.
+}
+
+// DataMessage contains a fully parsed message received via SMTP DATA or BDAT, prior to it being
+// accepted for delivery.
+type DataMessage struct {
+	MailFrom    string   // Envelope MAIL FROM address.
+	RcptTo      []string // Envelope RCPT TO addresses.
+	RemoteAddr  string
+	Header      map[string][]string // Message header, keyed by canonical field name.
+	Subject     string
+	Text        string // Decoded text body.
+	HTML        string // Decoded HTML body.
+	Attachments []AttachmentInfo
+	Size        int64 // Raw message size in bytes.
+}
+
 // InboundMessage contains the basic header and mailbox data for a message being received.
 type InboundMessage struct {
 	Mailboxes []string
@@ -27,6 +48,24 @@ type InboundMessage struct {
 	To        []*mail.Address
 	Subject   string
 	Size      int64
+	// Header holds the received message header, keyed by canonical field name.  Fields added,
+	// removed or replaced by extensions are applied to the stored message; nil leaves the header
+	// unchanged.
+	Header map[string][]string
+	// Body replaces the raw message body (everything after the header) when non-nil.
+	Body []byte
+}
+
+// DeleteResponse describes an extension's decision on a message deletion.
+type DeleteResponse struct {
+	Action int    // ActionDefer, ActionAllow, or ActionDeny.
+	Reason string // Explanation for a denied deletion.
+}
+
+// MailboxPurge describes a mailbox that was purged.
+type MailboxPurge struct {
+	Mailbox string
+	Count   int // Number of messages deleted.
 }
 
 // MessageMetadata contains the basic header data for a message event.
@@ -39,6 +78,46 @@ type MessageMetadata struct {
 	Subject string
 	Size    int64
 	Seen    bool
+	Session *SessionInfo // Nil for messages not received via SMTP.
+	// AuthResults holds the outcome of each message authentication check, ex: one per DKIM
+	// signature.  Empty if verification is disabled.
+	AuthResults []AuthResult
+}
+
+// AuthResult describes the outcome of a message authentication check, such as DKIM.
+type AuthResult struct {
+	Method   string // Authentication method, ex: dkim.
+	Result   string // pass, fail, neutral, none, temperror, or permerror.
+	Domain   string // Domain being authenticated, ex: the DKIM d= tag.
+	Selector string // DKIM selector, empty for other methods.
+	Reason   string // Explanation of the result, typically empty on pass.
+}
+
+// POP3Login describes a client logging in to a POP3 mailbox.
+type POP3Login struct {
+	Mailbox    string
+	RemoteAddr string
+	Messages   int // Number of messages in the mailbox.
+}
+
+// SessionInfo describes the SMTP session a message was received on.
+type SessionInfo struct {
+	AuthUser   string // Username accepted by SMTP AUTH, empty if not authenticated.
+	Helo       string // Domain given in HELO or EHLO.
+	RemoteAddr string // Remote IP address of the client.
+	TLSVersion string // Empty if TLS was not in use.
+	TLSCipher  string
+	MailFrom   string   // Envelope MAIL FROM address.
+	RcptTo     []string // Envelope RCPT TO addresses.
+	Transcript string   // SMTP commands & responses, if enabled.
+}
+
+// SMTPAuth describes an SMTP AUTH attempt, prior to the credentials being accepted.
+type SMTPAuth struct {
+	Mechanism  string // PLAIN, LOGIN, or CRAM-MD5.
+	Username   string
+	Password   string // Not available for CRAM-MD5.
+	RemoteAddr string
 }
 
 // SMTPResponse describes the response to an SMTP policy check.
@@ -48,6 +127,18 @@ type SMTPResponse struct {
 	ErrorMsg  string // SMTP error message to respond with on deny.
 }
 
+// SMTPSessionSummary describes a closed SMTP session.
+type SMTPSessionSummary struct {
+	RemoteAddr string
+	Helo       string // Domain given in HELO or EHLO.
+	AuthUser   string // Username accepted by SMTP AUTH, empty if not authenticated.
+	Messages   int    // Messages accepted for delivery.
+	Recipients int    // Recipients messages were accepted for.
+	Bytes      int64  // Total size of accepted messages.
+	Started    time.Time
+	Duration   time.Duration
+}
+
 // SMTPSession captures SMTP `MAIL FROM` & `RCPT TO` values prior to mail DATA being received.
 type SMTPSession struct {
 	From       *mail.Address
@@ -20,9 +20,16 @@ type Host struct {
 // processed asynchronously with respect to the rest of Inbuckets operation.  However, an event
 // listener will not be called until the one before it completes.
 type Events struct {
+	AfterMailboxPurged     AsyncEventBroker[event.MailboxPurge]
 	AfterMessageDeleted    AsyncEventBroker[event.MessageMetadata]
+	AfterMessageSeen       AsyncEventBroker[event.MessageMetadata]
 	AfterMessageStored     AsyncEventBroker[event.MessageMetadata]
+	AfterPOP3Login         AsyncEventBroker[event.POP3Login]
+	AfterSMTPSessionClosed AsyncEventBroker[event.SMTPSessionSummary]
+	BeforeAuthAccepted     EventBroker[event.SMTPAuth, event.SMTPResponse]
+	BeforeDataAccepted     EventBroker[event.DataMessage, event.SMTPResponse]
 	BeforeMailFromAccepted EventBroker[event.SMTPSession, event.SMTPResponse]
+	BeforeMessageDeleted   EventBroker[event.MessageMetadata, event.DeleteResponse]
 	BeforeMessageStored    EventBroker[event.InboundMessage, event.InboundMessage]
 	BeforeRcptToAccepted   EventBroker[event.SMTPSession, event.SMTPResponse]
 }
@@ -0,0 +1,71 @@
+package luahost
+
+import (
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const authResultName = "auth_result"
+
+func registerAuthResultType(ls *lua.LState) {
+	mt := ls.NewTypeMetatable(authResultName)
+	ls.SetGlobal(authResultName, mt)
+
+	// Static attributes.
+	ls.SetField(mt, "new", ls.NewFunction(newAuthResult))
+
+	// Methods.
+	ls.SetField(mt, "__index", ls.NewFunction(authResultIndex))
+}
+
+func newAuthResult(ls *lua.LState) int {
+	val := &event.AuthResult{}
+	ud := wrapAuthResult(ls, val)
+	ls.Push(ud)
+
+	return 1
+}
+
+func wrapAuthResult(ls *lua.LState, val *event.AuthResult) *lua.LUserData {
+	ud := ls.NewUserData()
+	ud.Value = val
+	ls.SetMetatable(ud, ls.GetTypeMetatable(authResultName))
+
+	return ud
+}
+
+// Checks there is an AuthResult at stack position `pos`, else throws Lua error.
+func checkAuthResult(ls *lua.LState, pos int) *event.AuthResult {
+	ud := ls.CheckUserData(pos)
+	if v, ok := ud.Value.(*event.AuthResult); ok {
+		return v
+	}
+	ls.ArgError(pos, authResultName+" expected")
+	return nil
+}
+
+// Gets a field value from AuthResult user object.  This emulates a Lua table,
+// allowing `result.domain` instead of a Lua object syntax of `result:domain()`.
+func authResultIndex(ls *lua.LState) int {
+	result := checkAuthResult(ls, 1)
+	field := ls.CheckString(2)
+
+	// Push the requested field's value onto the stack.
+	switch field {
+	case "method":
+		ls.Push(lua.LString(result.Method))
+	case "result":
+		ls.Push(lua.LString(result.Result))
+	case "domain":
+		ls.Push(lua.LString(result.Domain))
+	case "selector":
+		ls.Push(lua.LString(result.Selector))
+	case "reason":
+		ls.Push(lua.LString(result.Reason))
+	default:
+		// Unknown field.
+		ls.Push(lua.LNil)
+	}
+
+	return 1
+}
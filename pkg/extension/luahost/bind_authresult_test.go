@@ -0,0 +1,33 @@
+package luahost
+
+import (
+	"testing"
+
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"github.com/inbucket/inbucket/v3/pkg/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthResultGetters(t *testing.T) {
+	want := &event.AuthResult{
+		Method:   "dkim",
+		Result:   "fail",
+		Domain:   "example.com",
+		Selector: "s1",
+		Reason:   "body hash did not verify",
+	}
+	script := `
+		assert(result, "result should not be nil")
+
+		assert_eq(result.method, "dkim", "method")
+		assert_eq(result.result, "fail", "result")
+		assert_eq(result.domain, "example.com", "domain")
+		assert_eq(result.selector, "s1", "selector")
+		assert_eq(result.reason, "body hash did not verify", "reason")
+	`
+
+	ls, _ := test.NewLuaState()
+	registerAuthResultType(ls)
+	ls.SetGlobal("result", wrapAuthResult(ls, want))
+	require.NoError(t, ls.DoString(script))
+}
@@ -0,0 +1,135 @@
+package luahost
+
+import (
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	attachmentInfoName = "attachment_info"
+	dataMessageName    = "data_message"
+)
+
+func registerDataMessageType(ls *lua.LState) {
+	// data_message type.
+	mt := ls.NewTypeMetatable(dataMessageName)
+	ls.SetGlobal(dataMessageName, mt)
+
+	// Static attributes.
+	ls.SetField(mt, "new", ls.NewFunction(newDataMessage))
+
+	// Methods.
+	ls.SetField(mt, "__index", ls.NewFunction(dataMessageIndex))
+
+	// attachment_info type.
+	mt = ls.NewTypeMetatable(attachmentInfoName)
+	ls.SetField(mt, "__index", ls.NewFunction(attachmentInfoIndex))
+}
+
+func newDataMessage(ls *lua.LState) int {
+	val := &event.DataMessage{}
+	ud := wrapDataMessage(ls, val)
+	ls.Push(ud)
+
+	return 1
+}
+
+func wrapDataMessage(ls *lua.LState, val *event.DataMessage) *lua.LUserData {
+	ud := ls.NewUserData()
+	ud.Value = val
+	ls.SetMetatable(ud, ls.GetTypeMetatable(dataMessageName))
+
+	return ud
+}
+
+func wrapAttachmentInfo(ls *lua.LState, val *event.AttachmentInfo) *lua.LUserData {
+	ud := ls.NewUserData()
+	ud.Value = val
+	ls.SetMetatable(ud, ls.GetTypeMetatable(attachmentInfoName))
+
+	return ud
+}
+
+// Checks there is a DataMessage at stack position `pos`, else throws Lua error.
+func checkDataMessage(ls *lua.LState, pos int) *event.DataMessage {
+	ud := ls.CheckUserData(pos)
+	if v, ok := ud.Value.(*event.DataMessage); ok {
+		return v
+	}
+	ls.ArgError(pos, dataMessageName+" expected")
+	return nil
+}
+
+// Checks there is an AttachmentInfo at stack position `pos`, else throws Lua error.
+func checkAttachmentInfo(ls *lua.LState, pos int) *event.AttachmentInfo {
+	ud := ls.CheckUserData(pos)
+	if v, ok := ud.Value.(*event.AttachmentInfo); ok {
+		return v
+	}
+	ls.ArgError(pos, attachmentInfoName+" expected")
+	return nil
+}
+
+// Gets a field value from DataMessage user object.  This emulates a Lua table,
+// allowing `msg.subject` instead of a Lua object syntax of `msg:subject()`.
+func dataMessageIndex(ls *lua.LState) int {
+	m := checkDataMessage(ls, 1)
+	field := ls.CheckString(2)
+
+	// Push the requested field's value onto the stack.
+	switch field {
+	case "mail_from":
+		ls.Push(lua.LString(m.MailFrom))
+	case "rcpt_to":
+		lt := &lua.LTable{}
+		for _, v := range m.RcptTo {
+			lt.Append(lua.LString(v))
+		}
+		ls.Push(lt)
+	case "remote_addr":
+		ls.Push(lua.LString(m.RemoteAddr))
+	case "header":
+		// Field names are canonical, ex: `msg.header["Content-Type"][1]`.
+		ls.Push(wrapHeader(m.Header))
+	case "subject":
+		ls.Push(lua.LString(m.Subject))
+	case "text":
+		ls.Push(lua.LString(m.Text))
+	case "html":
+		ls.Push(lua.LString(m.HTML))
+	case "attachments":
+		lt := &lua.LTable{}
+		for i := range m.Attachments {
+			lt.Append(wrapAttachmentInfo(ls, &m.Attachments[i]))
+		}
+		ls.Push(lt)
+	case "size":
+		ls.Push(lua.LNumber(m.Size))
+	default:
+		// Unknown field.
+		ls.Push(lua.LNil)
+	}
+
+	return 1
+}
+
+// Gets a field value from AttachmentInfo user object.
+func attachmentInfoIndex(ls *lua.LState) int {
+	a := checkAttachmentInfo(ls, 1)
+	field := ls.CheckString(2)
+
+	// Push the requested field's value onto the stack.
+	switch field {
+	case "filename":
+		ls.Push(lua.LString(a.FileName))
+	case "content_type":
+		ls.Push(lua.LString(a.ContentType))
+	case "size":
+		ls.Push(lua.LNumber(a.Size))
+	default:
+		// Unknown field.
+		ls.Push(lua.LNil)
+	}
+
+	return 1
+}
@@ -0,0 +1,54 @@
+package luahost
+
+import (
+	"testing"
+
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"github.com/inbucket/inbucket/v3/pkg/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDataMessageGetters(t *testing.T) {
+	want := &event.DataMessage{
+		MailFrom:   "from@example.com",
+		RcptTo:     []string{"to1@example.com", "to2@example.com"},
+		RemoteAddr: "192.0.2.1",
+		Header: map[string][]string{
+			"Subject":  {"subj1"},
+			"Received": {"hop1", "hop2"},
+		},
+		Subject: "subj1",
+		Text:    "text body",
+		HTML:    "<p>html body</p>",
+		Attachments: []event.AttachmentInfo{
+			{FileName: "a.exe", ContentType: "application/octet-stream", Size: 2},
+			{FileName: "b.png", ContentType: "image/png", Size: 100},
+		},
+		Size: 42,
+	}
+	script := `
+		assert(msg, "msg should not be nil")
+
+		assert_eq(msg.mail_from, "from@example.com")
+		assert_eq(msg.rcpt_to, {"to1@example.com", "to2@example.com"})
+		assert_eq(msg.remote_addr, "192.0.2.1")
+		assert_eq(msg.header["Subject"], {"subj1"})
+		assert_eq(msg.header["Received"], {"hop1", "hop2"})
+		assert_eq(msg.header["Missing"], nil)
+		assert_eq(msg.subject, "subj1")
+		assert_eq(msg.text, "text body")
+		assert_eq(msg.html, "<p>html body</p>")
+		assert_eq(msg.size, 42, "msg.size")
+
+		assert_eq(#msg.attachments, 2, "#msg.attachments")
+		assert_eq(msg.attachments[1].filename, "a.exe")
+		assert_eq(msg.attachments[1].content_type, "application/octet-stream")
+		assert_eq(msg.attachments[1].size, 2)
+		assert_eq(msg.attachments[2].filename, "b.png")
+	`
+
+	ls, _ := test.NewLuaState()
+	registerDataMessageType(ls)
+	ls.SetGlobal("msg", wrapDataMessage(ls, want))
+	require.NoError(t, ls.DoString(script))
+}
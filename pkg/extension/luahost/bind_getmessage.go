@@ -0,0 +1,86 @@
+package luahost
+
+import (
+	"unicode/utf8"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// inbucketGetMessage implements `inbucket.get_message(mailbox, id)`, which returns a table
+// describing a stored message including its bodies and attachments, or nil and an error string.
+//
+// Bodies larger than limits.MaxBodyBytes are truncated, setting `truncated` to true.  Attachment
+// content larger than limits.MaxAttachmentBytes is omitted, leaving `content` nil.
+func inbucketGetMessage(ls *lua.LState, services *Services, limits *Limits) int {
+	mailbox := ls.CheckString(1)
+	id := ls.CheckString(2)
+
+	if services == nil || services.Manager == nil {
+		ls.Push(lua.LNil)
+		ls.Push(lua.LString("message manager unavailable"))
+		return 2
+	}
+	msg, err := services.Manager.GetMessage(mailbox, id)
+	if err != nil {
+		ls.Push(lua.LNil)
+		ls.Push(lua.LString(err.Error()))
+		return 2
+	}
+	if msg == nil {
+		ls.Push(lua.LNil)
+		ls.Push(lua.LString("message not found"))
+		return 2
+	}
+
+	tbl := ls.NewTable()
+	tbl.RawSetString("mailbox", lua.LString(msg.Mailbox))
+	tbl.RawSetString("id", lua.LString(msg.ID))
+	if msg.From != nil {
+		tbl.RawSetString("from", wrapMailAddress(ls, msg.From))
+	}
+	to := ls.NewTable()
+	for _, addr := range msg.To {
+		to.Append(wrapMailAddress(ls, addr))
+	}
+	tbl.RawSetString("to", to)
+	tbl.RawSetString("date", lua.LNumber(msg.Date.Unix()))
+	tbl.RawSetString("subject", lua.LString(msg.Subject))
+	tbl.RawSetString("size", lua.LNumber(msg.Size))
+	tbl.RawSetString("seen", lua.LBool(msg.Seen))
+	tbl.RawSetString("header", wrapHeader(msg.Header()))
+
+	text, textCut := truncateBody(msg.Text(), limits.MaxBodyBytes)
+	html, htmlCut := truncateBody(msg.HTML(), limits.MaxBodyBytes)
+	tbl.RawSetString("text", lua.LString(text))
+	tbl.RawSetString("html", lua.LString(html))
+	tbl.RawSetString("truncated", lua.LBool(textCut || htmlCut))
+
+	attachments := ls.NewTable()
+	for _, part := range msg.Attachments() {
+		att := ls.NewTable()
+		att.RawSetString("filename", lua.LString(part.FileName))
+		att.RawSetString("content_type", lua.LString(part.ContentType))
+		att.RawSetString("content_id", lua.LString(part.ContentID))
+		att.RawSetString("size", lua.LNumber(len(part.Content)))
+		if len(part.Content) <= limits.MaxAttachmentBytes {
+			att.RawSetString("content", lua.LString(part.Content))
+		}
+		attachments.Append(att)
+	}
+	tbl.RawSetString("attachments", attachments)
+
+	ls.Push(tbl)
+	return 1
+}
+
+// truncateBody shortens s to at most limit bytes without splitting a UTF-8 sequence, returning
+// true if it was truncated.
+func truncateBody(s string, limit int) (string, bool) {
+	if len(s) <= limit {
+		return s, false
+	}
+	for limit > 0 && !utf8.RuneStart(s[limit]) {
+		limit--
+	}
+	return s[:limit], true
+}
@@ -0,0 +1,123 @@
+package luahost
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/inbucket/inbucket/v3/pkg/config"
+	"github.com/inbucket/inbucket/v3/pkg/extension"
+	"github.com/inbucket/inbucket/v3/pkg/message"
+	"github.com/inbucket/inbucket/v3/pkg/policy"
+	"github.com/inbucket/inbucket/v3/pkg/storage/mem"
+	"github.com/inbucket/inbucket/v3/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestInbucketGetMessageNotConfigured(t *testing.T) {
+	script := `
+		local msg, err = inbucket.get_message("mailbox", "id")
+		assert_eq(msg, nil)
+		assert_eq(err, "message manager unavailable")
+	`
+
+	ls, _ := test.NewLuaState()
+	registerInbucketTypes(ls)
+	require.NoError(t, ls.DoString(script))
+}
+
+func TestInbucketGetMessage(t *testing.T) {
+	extHost := extension.NewHost()
+	store, err := mem.New(config.Storage{}, extHost)
+	require.NoError(t, err)
+	mm := &message.StoreManager{
+		AddrPolicy: &policy.Addressing{Config: &config.Root{
+			MailboxNaming: config.FullNaming,
+			SMTP:          config.SMTP{DefaultAccept: true, DefaultStore: true},
+		}},
+		Store:   store,
+		ExtHost: extHost,
+	}
+	origin, _ := mm.AddrPolicy.ParseOrigin("from@example.com")
+	recip, _ := mm.AddrPolicy.NewRecipient("to@example.com")
+	err = mm.Deliver(origin, []*policy.Recipient{recip}, "", []byte(
+		"From: Sender <from@example.com>\r\n"+
+			"To: to@example.com\r\n"+
+			"Subject: verify\r\n"+
+			"MIME-Version: 1.0\r\n"+
+			"Content-Type: multipart/mixed; boundary=XYZ\r\n"+
+			"\r\n"+
+			"--XYZ\r\n"+
+			"Content-Type: text/plain\r\n"+
+			"\r\n"+
+			"Visit https://example.com/verify?token=abc\r\n"+
+			"--XYZ\r\n"+
+			"Content-Type: text/plain\r\n"+
+			"Content-Disposition: attachment; filename=small.txt\r\n"+
+			"\r\n"+
+			"tiny\r\n"+
+			"--XYZ\r\n"+
+			"Content-Type: application/octet-stream\r\n"+
+			"Content-Disposition: attachment; filename=large.bin\r\n"+
+			"\r\n"+
+			strings.Repeat("x", 100)+"\r\n"+
+			"--XYZ--\r\n"), nil)
+	require.NoError(t, err)
+	msgs, err := mm.GetMetadata("to@example.com")
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+
+	script := `
+		local msg, err = inbucket.get_message("to@example.com", "missing")
+		assert_eq(msg, nil)
+		assert(err, "err should not be nil")
+
+		msg, err = inbucket.get_message("to@example.com", msg_id)
+		assert_eq(err, nil)
+		assert_eq(msg.mailbox, "to@example.com")
+		assert_eq(msg.id, msg_id)
+		assert_eq(msg.subject, "verify")
+		assert_eq(msg.from.name, "Sender")
+		assert_eq(msg.to[1].address, "to@example.com")
+		assert_eq(msg.header["Subject"], {"verify"})
+		assert_eq(msg.seen, false)
+
+		local link = string.match(msg.text, "(https://%S+)")
+		assert_eq(link, "https://example.com/verify?token=abc")
+		assert_eq(msg.truncated, false)
+
+		assert_eq(#msg.attachments, 2, "#msg.attachments")
+		assert_eq(msg.attachments[1].filename, "small.txt")
+		assert_eq(msg.attachments[1].content, "tiny")
+		assert_eq(msg.attachments[2].filename, "large.bin")
+		assert_eq(msg.attachments[2].content_type, "application/octet-stream")
+		assert_eq(msg.attachments[2].size, 100)
+		assert_eq(msg.attachments[2].content, nil)
+	`
+
+	ls, _ := test.NewLuaState()
+	registerInbucketTypes(ls)
+	registerMailAddressType(ls)
+	ib, err := getInbucket(ls)
+	require.NoError(t, err)
+	ib.services = func() *Services { return &Services{Manager: mm} }
+	ib.limits = func() *Limits { return &Limits{MaxBodyBytes: 1024, MaxAttachmentBytes: 50} }
+	ls.SetGlobal("msg_id", lua.LString(msgs[0].ID))
+	require.NoError(t, ls.DoString(script))
+}
+
+func TestTruncateBody(t *testing.T) {
+	got, cut := truncateBody("hello", 5)
+	assert.Equal(t, "hello", got)
+	assert.False(t, cut)
+
+	got, cut = truncateBody("hello", 3)
+	assert.Equal(t, "hel", got)
+	assert.True(t, cut)
+
+	// Multi-byte characters are not split.
+	got, cut = truncateBody("héllo", 2)
+	assert.Equal(t, "h", got)
+	assert.True(t, cut)
+}
@@ -3,12 +3,22 @@ package luahost
 import (
 	"fmt"
 	"net/mail"
+	"net/textproto"
 
 	"github.com/inbucket/inbucket/v3/pkg/extension/event"
 	lua "github.com/yuin/gopher-lua"
 )
 
-const inboundMessageName = "inbound_message"
+const (
+	inboundMessageName = "inbound_message"
+	inboundHeaderName  = "inbound_message_header"
+)
+
+// inboundHeader is the header of an InboundMessage, exposed to Lua as a table-like object that
+// writes changes through to the message.
+type inboundHeader struct {
+	msg *event.InboundMessage
+}
 
 func registerInboundMessageType(ls *lua.LState) {
 	mt := ls.NewTypeMetatable(inboundMessageName)
@@ -20,6 +30,10 @@ func registerInboundMessageType(ls *lua.LState) {
 	// Methods.
 	ls.SetField(mt, "__index", ls.NewFunction(inboundMessageIndex))
 	ls.SetField(mt, "__newindex", ls.NewFunction(inboundMessageNewIndex))
+
+	mt = ls.NewTypeMetatable(inboundHeaderName)
+	ls.SetField(mt, "__index", ls.NewFunction(inboundHeaderIndex))
+	ls.SetField(mt, "__newindex", ls.NewFunction(inboundHeaderNewIndex))
 }
 
 func newInboundMessage(ls *lua.LState) int {
@@ -85,6 +99,17 @@ func inboundMessageIndex(ls *lua.LState) int {
 		ls.Push(lua.LString(m.Subject))
 	case "size":
 		ls.Push(lua.LNumber(m.Size))
+	case "header":
+		ud := ls.NewUserData()
+		ud.Value = &inboundHeader{msg: m}
+		ls.SetMetatable(ud, ls.GetTypeMetatable(inboundHeaderName))
+		ls.Push(ud)
+	case "body":
+		if m.Body == nil {
+			ls.Push(lua.LNil)
+		} else {
+			ls.Push(lua.LString(m.Body))
+		}
 	default:
 		// Unknown field.
 		ls.Push(lua.LNil)
@@ -127,9 +152,137 @@ func inboundMessageNewIndex(ls *lua.LState) int {
 		m.Subject = ls.CheckString(3)
 	case "size":
 		ls.RaiseError("size is read-only")
+	case "header":
+		m.Header = checkHeader(ls, 3)
+	case "body":
+		if ls.Get(3) == lua.LNil {
+			m.Body = nil
+		} else {
+			m.Body = []byte(ls.CheckString(3))
+		}
 	default:
 		ls.RaiseError("invalid index %q", index)
 	}
 
 	return 0
 }
+
+// wrapHeader converts a message header into a table of field name to a list of values.
+func wrapHeader(header map[string][]string) *lua.LTable {
+	lt := &lua.LTable{}
+	for k, vs := range header {
+		values := &lua.LTable{}
+		for _, v := range vs {
+			values.Append(lua.LString(v))
+		}
+		lt.RawSetString(k, values)
+	}
+	return lt
+}
+
+// Checks there is a header table at stack position `pos`, else throws Lua error.  Field values
+// may be a string, or a list of strings.  The header of another inbound message is also accepted.
+func checkHeader(ls *lua.LState, pos int) map[string][]string {
+	if ud, ok := ls.Get(pos).(*lua.LUserData); ok {
+		if h, ok := ud.Value.(*inboundHeader); ok {
+			header := make(map[string][]string, len(h.msg.Header))
+			for k, vs := range h.msg.Header {
+				header[k] = append([]string(nil), vs...)
+			}
+			return header
+		}
+	}
+	lt := ls.CheckTable(pos)
+	header := make(map[string][]string)
+	lt.ForEach(func(k, lv lua.LValue) {
+		name, ok := k.(lua.LString)
+		if !ok {
+			ls.ArgError(pos, "header field names must be strings")
+		}
+		values, ok := headerValues(lv)
+		if !ok {
+			ls.ArgError(pos, "header field values must be a string or list of strings")
+		}
+		header[string(name)] = append(header[string(name)], values...)
+	})
+	return header
+}
+
+// headerValues converts a string, or list of strings, into header field values.
+func headerValues(lv lua.LValue) ([]string, bool) {
+	switch v := lv.(type) {
+	case lua.LString:
+		return []string{string(v)}, true
+	case *lua.LTable:
+		var values []string
+		v.ForEach(func(_, lv lua.LValue) {
+			if s, ok := lv.(lua.LString); ok {
+				values = append(values, string(s))
+			}
+		})
+		return values, true
+	}
+	return nil, false
+}
+
+// Gets the values of a header field, allowing `msg.header["Subject"]`.  Field names are matched
+// ignoring case.  The returned list is a copy, assign it back to the field to apply changes.
+func inboundHeaderIndex(ls *lua.LState) int {
+	h := checkInboundHeader(ls, 1)
+	name := ls.CheckString(2)
+
+	values, ok := h.msg.Header[name]
+	if !ok {
+		values, ok = h.msg.Header[textproto.CanonicalMIMEHeaderKey(name)]
+	}
+	if !ok {
+		ls.Push(lua.LNil)
+		return 1
+	}
+	lt := &lua.LTable{}
+	for _, v := range values {
+		lt.Append(lua.LString(v))
+	}
+	ls.Push(lt)
+
+	return 1
+}
+
+// Sets the values of a header field, allowing `msg.header["X-Test"] = {"a", "b"}`.  A string
+// sets a single value, and nil removes the field.
+func inboundHeaderNewIndex(ls *lua.LState) int {
+	h := checkInboundHeader(ls, 1)
+	name := textproto.CanonicalMIMEHeaderKey(ls.CheckString(2))
+	lv := ls.Get(3)
+
+	var values []string
+	if lv != lua.LNil {
+		var ok bool
+		if values, ok = headerValues(lv); !ok {
+			ls.ArgError(3, "header field values must be a string or list of strings")
+		}
+	}
+	if h.msg.Header == nil {
+		h.msg.Header = make(map[string][]string)
+	}
+	for k := range h.msg.Header {
+		if textproto.CanonicalMIMEHeaderKey(k) == name {
+			delete(h.msg.Header, k)
+		}
+	}
+	if lv != lua.LNil {
+		h.msg.Header[name] = values
+	}
+
+	return 0
+}
+
+// Checks there is an inbound message header at stack position `pos`, else throws Lua error.
+func checkInboundHeader(ls *lua.LState, pos int) *inboundHeader {
+	ud := ls.CheckUserData(pos)
+	if v, ok := ud.Value.(*inboundHeader); ok {
+		return v
+	}
+	ls.ArgError(pos, inboundHeaderName+" expected")
+	return nil
+}
@@ -20,6 +20,10 @@ func TestInboundMessageGetters(t *testing.T) {
 		},
 		Subject: "subj1",
 		Size:    42,
+		Header: map[string][]string{
+			"Subject":  {"subj1"},
+			"Received": {"hop1", "hop2"},
+		},
 	}
 	script := `
 		assert(msg, "msg should not be nil")
@@ -27,6 +31,9 @@ func TestInboundMessageGetters(t *testing.T) {
 		assert_eq(msg.mailboxes, {"mb1", "mb2"})
 		assert_eq(msg.subject, "subj1")
 		assert_eq(msg.size, 42, "msg.size")
+		assert_eq(msg.header["Subject"], {"subj1"})
+		assert_eq(msg.header["Received"], {"hop1", "hop2"})
+		assert_eq(msg.body, nil)
 
 		assert_eq(msg.from.name, "name1", "from.name")
 		assert_eq(msg.from.address, "addr1", "from.address")
@@ -54,6 +61,11 @@ func TestInboundMessageSetters(t *testing.T) {
 			{Name: "name3", Address: "addr3"},
 		},
 		Subject: "subj1",
+		Header: map[string][]string{
+			"Subject":    {"subj1"},
+			"X-Test-Run": {"42"},
+		},
+		Body: []byte("new body"),
 	}
 	script := `
 		assert(msg, "msg should not be nil")
@@ -62,6 +74,9 @@ func TestInboundMessageSetters(t *testing.T) {
 		msg.subject = "subj1"
 		msg.from = address.new("name1", "addr1")
 		msg.to = { address.new("name2", "addr2"), address.new("name3", "addr3") }
+		msg.header = { ["Subject"] = {"subj1"}, ["X-Test-Run"] = "42" }
+		msg.body = "new body"
+		assert_eq(msg.body, "new body")
 	`
 
 	got := &event.InboundMessage{}
@@ -73,3 +88,57 @@ func TestInboundMessageSetters(t *testing.T) {
 
 	assert.Equal(t, want, got)
 }
+
+func TestInboundMessageHeaderFields(t *testing.T) {
+	got := &event.InboundMessage{
+		Header: map[string][]string{
+			"Subject":  {"subj1"},
+			"Received": {"hop1", "hop2"},
+			"X-Remove": {"gone"},
+		},
+	}
+	script := `
+		assert_eq(msg.header["subject"], {"subj1"})
+		assert_eq(msg.header["Missing"], nil)
+
+		msg.header["X-Foo"] = {"a", "b"}
+		msg.header["x-bar"] = "c"
+		msg.header["SUBJECT"] = "subj2"
+		msg.header["X-Remove"] = nil
+
+		local received = msg.header["Received"]
+		table.insert(received, 1, "hop0")
+		msg.header["Received"] = received
+
+		assert_eq(msg.header["X-Foo"], {"a", "b"})
+		assert_eq(msg.header["X-Remove"], nil)
+	`
+
+	ls, _ := test.NewLuaState()
+	registerInboundMessageType(ls)
+	ls.SetGlobal("msg", wrapInboundMessage(ls, got))
+	require.NoError(t, ls.DoString(script))
+
+	assert.Equal(t, map[string][]string{
+		"Subject":  {"subj2"},
+		"Received": {"hop0", "hop1", "hop2"},
+		"X-Foo":    {"a", "b"},
+		"X-Bar":    {"c"},
+	}, got.Header)
+}
+
+func TestInboundMessageHeaderFieldsNew(t *testing.T) {
+	script := `
+		local m = inbound_message.new()
+		m.header["X-Test"] = "1"
+		other.header = m.header
+	`
+
+	other := &event.InboundMessage{}
+	ls, _ := test.NewLuaState()
+	registerInboundMessageType(ls)
+	ls.SetGlobal("other", wrapInboundMessage(ls, other))
+	require.NoError(t, ls.DoString(script))
+
+	assert.Equal(t, map[string][]string{"X-Test": {"1"}}, other.Header)
+}
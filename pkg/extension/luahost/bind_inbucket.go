@@ -17,19 +17,31 @@ const (
 type Inbucket struct {
 	After  InbucketAfterFuncs
 	Before InbucketBeforeFuncs
+
+	services func() *Services // Returns the services available to Lua, may be nil.
+	limits   func() *Limits   // Returns the resource limits for Lua, may be nil.
+	timers   []*luaTimer      // Callbacks scheduled while loading the script.
+	loaded   bool             // Script has finished loading, timers may no longer be added.
 }
 
 // InbucketAfterFuncs holds references to Lua extension functions to be called async
 // after Inbucket handles an event.
 type InbucketAfterFuncs struct {
-	MessageDeleted *lua.LFunction
-	MessageStored  *lua.LFunction
+	MailboxPurged     *lua.LFunction
+	MessageDeleted    *lua.LFunction
+	MessageSeen       *lua.LFunction
+	MessageStored     *lua.LFunction
+	POP3Login         *lua.LFunction
+	SMTPSessionClosed *lua.LFunction
 }
 
 // InbucketBeforeFuncs holds references to Lua extension functions to be called
 // before Inbucket handles an event.
 type InbucketBeforeFuncs struct {
+	AuthAccepted     *lua.LFunction
+	DataAccepted     *lua.LFunction
 	MailFromAccepted *lua.LFunction
+	MessageDeleted   *lua.LFunction
 	MessageStored    *lua.LFunction
 	RcptToAccepted   *lua.LFunction
 }
@@ -133,8 +145,24 @@ func inbucketIndex(ls *lua.LState) int {
 	switch field {
 	case "after":
 		ls.Push(wrapInbucketAfter(ls, &ib.After))
+	case "after_delay":
+		ls.Push(ls.NewFunction(func(ls *lua.LState) int {
+			return inbucketSchedule(ls, ib, false)
+		}))
 	case "before":
 		ls.Push(wrapInbucketBefore(ls, &ib.Before))
+	case "every":
+		ls.Push(ls.NewFunction(func(ls *lua.LState) int {
+			return inbucketSchedule(ls, ib, true)
+		}))
+	case "get_message":
+		ls.Push(ls.NewFunction(func(ls *lua.LState) int {
+			return inbucketGetMessage(ls, ib.getServices(), ib.getLimits())
+		}))
+	case "release":
+		ls.Push(ls.NewFunction(func(ls *lua.LState) int {
+			return inbucketRelease(ls, ib.getServices())
+		}))
 	default:
 		// Unknown field.
 		ls.Push(lua.LNil)
@@ -150,10 +178,18 @@ func inbucketAfterIndex(ls *lua.LState) int {
 
 	// Push the requested field's value onto the stack.
 	switch field {
+	case "mailbox_purged":
+		ls.Push(funcOrNil(after.MailboxPurged))
 	case "message_deleted":
 		ls.Push(funcOrNil(after.MessageDeleted))
+	case "message_seen":
+		ls.Push(funcOrNil(after.MessageSeen))
 	case "message_stored":
 		ls.Push(funcOrNil(after.MessageStored))
+	case "pop3_login":
+		ls.Push(funcOrNil(after.POP3Login))
+	case "smtp_session_closed":
+		ls.Push(funcOrNil(after.SMTPSessionClosed))
 	default:
 		// Unknown field.
 		ls.Push(lua.LNil)
@@ -168,10 +204,18 @@ func inbucketAfterNewIndex(ls *lua.LState) int {
 	index := ls.CheckString(2)
 
 	switch index {
+	case "mailbox_purged":
+		m.MailboxPurged = ls.CheckFunction(3)
 	case "message_deleted":
 		m.MessageDeleted = ls.CheckFunction(3)
+	case "message_seen":
+		m.MessageSeen = ls.CheckFunction(3)
 	case "message_stored":
 		m.MessageStored = ls.CheckFunction(3)
+	case "pop3_login":
+		m.POP3Login = ls.CheckFunction(3)
+	case "smtp_session_closed":
+		m.SMTPSessionClosed = ls.CheckFunction(3)
 	default:
 		ls.RaiseError("invalid inbucket.after index %q", index)
 	}
@@ -186,8 +230,14 @@ func inbucketBeforeIndex(ls *lua.LState) int {
 
 	// Push the requested field's value onto the stack.
 	switch field {
+	case "auth_accepted":
+		ls.Push(funcOrNil(before.AuthAccepted))
+	case "data_accepted":
+		ls.Push(funcOrNil(before.DataAccepted))
 	case "mail_from_accepted":
 		ls.Push(funcOrNil(before.MailFromAccepted))
+	case "message_deleted":
+		ls.Push(funcOrNil(before.MessageDeleted))
 	case "message_stored":
 		ls.Push(funcOrNil(before.MessageStored))
 	case "rcpt_to_accepted":
@@ -206,8 +256,14 @@ func inbucketBeforeNewIndex(ls *lua.LState) int {
 	index := ls.CheckString(2)
 
 	switch index {
+	case "auth_accepted":
+		m.AuthAccepted = ls.CheckFunction(3)
+	case "data_accepted":
+		m.DataAccepted = ls.CheckFunction(3)
 	case "mail_from_accepted":
 		m.MailFromAccepted = ls.CheckFunction(3)
+	case "message_deleted":
+		m.MessageDeleted = ls.CheckFunction(3)
 	case "message_stored":
 		m.MessageStored = ls.CheckFunction(3)
 	case "rcpt_to_accepted":
@@ -219,6 +275,15 @@ func inbucketBeforeNewIndex(ls *lua.LState) int {
 	return 0
 }
 
+// getServices returns the services available to Lua, or nil if they have not been provided.
+func (ib *Inbucket) getServices() *Services {
+	if ib.services == nil {
+		return nil
+	}
+
+	return ib.services()
+}
+
 func funcOrNil(f *lua.LFunction) lua.LValue {
 	if f == nil {
 		return lua.LNil
@@ -226,3 +291,13 @@ func funcOrNil(f *lua.LFunction) lua.LValue {
 
 	return f
 }
+
+// getLimits returns the resource limits for Lua, or the defaults if they have not been provided.
+func (ib *Inbucket) getLimits() *Limits {
+	if ib.limits != nil {
+		if l := ib.limits(); l != nil {
+			return l
+		}
+	}
+	return &defaultLimits
+}
@@ -15,7 +15,10 @@ func TestInbucketAfterFuncs(t *testing.T) {
 		assert(inbucket, "inbucket should not be nil")
 		assert(inbucket.after, "inbucket.after should not be nil")
 
-		local fns = { "message_deleted", "message_stored" }
+		local fns = {
+			"mailbox_purged", "message_deleted", "message_seen", "message_stored", "pop3_login",
+			"smtp_session_closed",
+		}
 
 		-- Verify functions start off nil.
 		for i, name in ipairs(fns) do
@@ -62,7 +65,10 @@ func TestInbucketBeforeFuncs(t *testing.T) {
 		assert(inbucket, "inbucket should not be nil")
 		assert(inbucket.before, "inbucket.before should not be nil")
 
-		local fns = { "mail_from_accepted", "message_stored", "rcpt_to_accepted" }
+		local fns = {
+			"auth_accepted", "data_accepted", "mail_from_accepted", "message_deleted",
+			"message_stored", "rcpt_to_accepted",
+		}
 
 		-- Verify functions start off nil.
 		for i, name in ipairs(fns) do
@@ -0,0 +1,149 @@
+package luahost
+
+import (
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	mailboxPurgeName       = "mailbox_purge"
+	pop3LoginName          = "pop3_login"
+	smtpSessionSummaryName = "smtp_session_summary"
+)
+
+func registerLifecycleTypes(ls *lua.LState) {
+	mt := ls.NewTypeMetatable(mailboxPurgeName)
+	ls.SetField(mt, "__index", ls.NewFunction(mailboxPurgeIndex))
+
+	mt = ls.NewTypeMetatable(pop3LoginName)
+	ls.SetField(mt, "__index", ls.NewFunction(pop3LoginIndex))
+
+	mt = ls.NewTypeMetatable(smtpSessionSummaryName)
+	ls.SetField(mt, "__index", ls.NewFunction(smtpSessionSummaryIndex))
+}
+
+func wrapMailboxPurge(ls *lua.LState, val *event.MailboxPurge) *lua.LUserData {
+	ud := ls.NewUserData()
+	ud.Value = val
+	ls.SetMetatable(ud, ls.GetTypeMetatable(mailboxPurgeName))
+
+	return ud
+}
+
+func wrapPOP3Login(ls *lua.LState, val *event.POP3Login) *lua.LUserData {
+	ud := ls.NewUserData()
+	ud.Value = val
+	ls.SetMetatable(ud, ls.GetTypeMetatable(pop3LoginName))
+
+	return ud
+}
+
+func wrapSMTPSessionSummary(ls *lua.LState, val *event.SMTPSessionSummary) *lua.LUserData {
+	ud := ls.NewUserData()
+	ud.Value = val
+	ls.SetMetatable(ud, ls.GetTypeMetatable(smtpSessionSummaryName))
+
+	return ud
+}
+
+// Checks there is a MailboxPurge at stack position `pos`, else throws Lua error.
+func checkMailboxPurge(ls *lua.LState, pos int) *event.MailboxPurge {
+	ud := ls.CheckUserData(pos)
+	if v, ok := ud.Value.(*event.MailboxPurge); ok {
+		return v
+	}
+	ls.ArgError(pos, mailboxPurgeName+" expected")
+	return nil
+}
+
+// Checks there is a POP3Login at stack position `pos`, else throws Lua error.
+func checkPOP3Login(ls *lua.LState, pos int) *event.POP3Login {
+	ud := ls.CheckUserData(pos)
+	if v, ok := ud.Value.(*event.POP3Login); ok {
+		return v
+	}
+	ls.ArgError(pos, pop3LoginName+" expected")
+	return nil
+}
+
+// Checks there is an SMTPSessionSummary at stack position `pos`, else throws Lua error.
+func checkSMTPSessionSummary(ls *lua.LState, pos int) *event.SMTPSessionSummary {
+	ud := ls.CheckUserData(pos)
+	if v, ok := ud.Value.(*event.SMTPSessionSummary); ok {
+		return v
+	}
+	ls.ArgError(pos, smtpSessionSummaryName+" expected")
+	return nil
+}
+
+// Gets a field value from MailboxPurge user object.
+func mailboxPurgeIndex(ls *lua.LState) int {
+	p := checkMailboxPurge(ls, 1)
+	field := ls.CheckString(2)
+
+	// Push the requested field's value onto the stack.
+	switch field {
+	case "mailbox":
+		ls.Push(lua.LString(p.Mailbox))
+	case "count":
+		ls.Push(lua.LNumber(p.Count))
+	default:
+		// Unknown field.
+		ls.Push(lua.LNil)
+	}
+
+	return 1
+}
+
+// Gets a field value from POP3Login user object.
+func pop3LoginIndex(ls *lua.LState) int {
+	l := checkPOP3Login(ls, 1)
+	field := ls.CheckString(2)
+
+	// Push the requested field's value onto the stack.
+	switch field {
+	case "mailbox":
+		ls.Push(lua.LString(l.Mailbox))
+	case "remote_addr":
+		ls.Push(lua.LString(l.RemoteAddr))
+	case "messages":
+		ls.Push(lua.LNumber(l.Messages))
+	default:
+		// Unknown field.
+		ls.Push(lua.LNil)
+	}
+
+	return 1
+}
+
+// Gets a field value from SMTPSessionSummary user object.  `started` is in Unix seconds, and
+// `duration` in fractional seconds.
+func smtpSessionSummaryIndex(ls *lua.LState) int {
+	s := checkSMTPSessionSummary(ls, 1)
+	field := ls.CheckString(2)
+
+	// Push the requested field's value onto the stack.
+	switch field {
+	case "remote_addr":
+		ls.Push(lua.LString(s.RemoteAddr))
+	case "helo":
+		ls.Push(lua.LString(s.Helo))
+	case "auth_user":
+		ls.Push(lua.LString(s.AuthUser))
+	case "messages":
+		ls.Push(lua.LNumber(s.Messages))
+	case "recipients":
+		ls.Push(lua.LNumber(s.Recipients))
+	case "bytes":
+		ls.Push(lua.LNumber(s.Bytes))
+	case "started":
+		ls.Push(lua.LNumber(s.Started.Unix()))
+	case "duration":
+		ls.Push(lua.LNumber(s.Duration.Seconds()))
+	default:
+		// Unknown field.
+		ls.Push(lua.LNil)
+	}
+
+	return 1
+}
@@ -73,6 +73,18 @@ func messageMetadataIndex(ls *lua.LState) int {
 		ls.Push(lua.LString(m.Subject))
 	case "size":
 		ls.Push(lua.LNumber(m.Size))
+	case "session":
+		if m.Session == nil {
+			ls.Push(lua.LNil)
+		} else {
+			ls.Push(wrapSessionInfo(ls, m.Session))
+		}
+	case "auth_results":
+		lt := &lua.LTable{}
+		for i := range m.AuthResults {
+			lt.Append(wrapAuthResult(ls, &m.AuthResults[i]))
+		}
+		ls.Push(lt)
 	default:
 		// Unknown field.
 		ls.Push(lua.LNil)
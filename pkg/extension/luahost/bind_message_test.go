@@ -46,6 +46,44 @@ func TestMessageMetadataGetters(t *testing.T) {
 	require.NoError(t, ls.DoString(script))
 }
 
+func TestMessageMetadataSession(t *testing.T) {
+	script := `
+		assert_eq(nosession.session, nil, "nosession.session")
+		assert_eq(msg.session.auth_user, "user1", "session.auth_user")
+		assert_eq(msg.session.rcpt_to[1], "addr2", "session.rcpt_to")
+	`
+
+	ls, _ := test.NewLuaState()
+	registerMessageMetadataType(ls)
+	registerSessionInfoType(ls)
+	ls.SetGlobal("nosession", wrapMessageMetadata(ls, &event.MessageMetadata{}))
+	ls.SetGlobal("msg", wrapMessageMetadata(ls, &event.MessageMetadata{
+		Session: &event.SessionInfo{AuthUser: "user1", RcptTo: []string{"addr2"}},
+	}))
+	require.NoError(t, ls.DoString(script))
+}
+
+func TestMessageMetadataAuthResults(t *testing.T) {
+	script := `
+		assert_eq(#noresults.auth_results, 0, "#noresults.auth_results")
+		assert_eq(#msg.auth_results, 2, "#auth_results")
+		assert_eq(msg.auth_results[1].result, "pass", "auth_results[1].result")
+		assert_eq(msg.auth_results[2].domain, "example.org", "auth_results[2].domain")
+	`
+
+	ls, _ := test.NewLuaState()
+	registerMessageMetadataType(ls)
+	registerAuthResultType(ls)
+	ls.SetGlobal("noresults", wrapMessageMetadata(ls, &event.MessageMetadata{}))
+	ls.SetGlobal("msg", wrapMessageMetadata(ls, &event.MessageMetadata{
+		AuthResults: []event.AuthResult{
+			{Method: "dkim", Result: "pass", Domain: "example.com"},
+			{Method: "dkim", Result: "fail", Domain: "example.org"},
+		},
+	}))
+	require.NoError(t, ls.DoString(script))
+}
+
 func TestMessageMetadataSetters(t *testing.T) {
 	want := &event.MessageMetadata{
 		Mailbox: "mb1",
@@ -0,0 +1,50 @@
+package luahost
+
+import (
+	"github.com/inbucket/inbucket/v3/pkg/relay"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// inbucketRelease implements `inbucket.release(mailbox, id, options)`, which sends a stored
+// message to an upstream SMTP server.  The optional options table may specify `target` and
+// `recipients`.  Returns a result table, and an error string if the release failed.
+func inbucketRelease(ls *lua.LState, services *Services) int {
+	mailbox := ls.CheckString(1)
+	id := ls.CheckString(2)
+	opts := relay.Options{}
+	if tbl := ls.OptTable(3, nil); tbl != nil {
+		opts.Target = lua.LVAsString(tbl.RawGetString("target"))
+		if rcpts, ok := tbl.RawGetString("recipients").(*lua.LTable); ok {
+			rcpts.ForEach(func(_, v lua.LValue) {
+				opts.Recipients = append(opts.Recipients, lua.LVAsString(v))
+			})
+		}
+	}
+
+	if services == nil || services.Relay == nil {
+		ls.Push(lua.LNil)
+		ls.Push(lua.LString("no relay targets configured"))
+		return 2
+	}
+	result, err := services.Relay.Release(mailbox, id, opts)
+	if result == nil {
+		ls.Push(lua.LNil)
+	} else {
+		tbl := ls.NewTable()
+		tbl.RawSetString("target", lua.LString(result.Target))
+		tbl.RawSetString("from", lua.LString(result.From))
+		rcpts := ls.NewTable()
+		for _, rcpt := range result.Recipients {
+			rcpts.Append(lua.LString(rcpt))
+		}
+		tbl.RawSetString("recipients", rcpts)
+		tbl.RawSetString("code", lua.LNumber(result.Code))
+		tbl.RawSetString("message", lua.LString(result.Message))
+		ls.Push(tbl)
+	}
+	if err != nil {
+		ls.Push(lua.LString(err.Error()))
+		return 2
+	}
+	return 1
+}
@@ -0,0 +1,79 @@
+package luahost
+
+import (
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/config"
+	"github.com/inbucket/inbucket/v3/pkg/extension"
+	"github.com/inbucket/inbucket/v3/pkg/message"
+	"github.com/inbucket/inbucket/v3/pkg/policy"
+	"github.com/inbucket/inbucket/v3/pkg/relay"
+	"github.com/inbucket/inbucket/v3/pkg/storage/mem"
+	"github.com/inbucket/inbucket/v3/pkg/test"
+	"github.com/stretchr/testify/require"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestInbucketReleaseNotConfigured(t *testing.T) {
+	script := `
+		local result, err = inbucket.release("mailbox", "id")
+		assert_eq(result, nil)
+		assert_eq(err, "no relay targets configured")
+	`
+
+	ls, _ := test.NewLuaState()
+	registerInbucketTypes(ls)
+	require.NoError(t, ls.DoString(script))
+}
+
+func TestInbucketRelease(t *testing.T) {
+	extHost := extension.NewHost()
+	store, err := mem.New(config.Storage{}, extHost)
+	require.NoError(t, err)
+	mm := &message.StoreManager{
+		AddrPolicy: &policy.Addressing{Config: &config.Root{
+			MailboxNaming: config.FullNaming,
+			SMTP:          config.SMTP{DefaultAccept: true, DefaultStore: true},
+		}},
+		Store:   store,
+		ExtHost: extHost,
+	}
+	origin, _ := mm.AddrPolicy.ParseOrigin("from@example.com")
+	recip, _ := mm.AddrPolicy.NewRecipient("to@example.com")
+	err = mm.Deliver(origin, []*policy.Recipient{recip}, "",
+		[]byte("From: from@example.com\r\nSubject: release\r\n\r\nbody\r\n"), nil)
+	require.NoError(t, err)
+	msgs, err := mm.GetMetadata("to@example.com")
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+
+	// Nothing listens on port 1, so the release will fail after the result is populated.
+	rl, err := relay.New(config.Relay{
+		Targets: map[string]string{"closed": "smtp://127.0.0.1:1"},
+		Timeout: time.Second,
+	}, "inbucket", mm)
+	require.NoError(t, err)
+
+	script := `
+		local result, err = inbucket.release("to@example.com", msg_id, { target = "other" })
+		assert_eq(result, nil)
+		assert_contains(err, "unknown relay target")
+
+		result, err = inbucket.release("to@example.com", msg_id,
+			{ recipients = { "a@real.example", "b@real.example" } })
+		assert(err, "err should not be nil")
+		assert_eq(result.target, "closed")
+		assert_eq(result.from, "from@example.com")
+		assert_eq(result.recipients, { "a@real.example", "b@real.example" })
+		assert_eq(result.code, 0)
+	`
+
+	ls, _ := test.NewLuaState()
+	registerInbucketTypes(ls)
+	ib, err := getInbucket(ls)
+	require.NoError(t, err)
+	ib.services = func() *Services { return &Services{Manager: mm, Relay: rl} }
+	ls.SetGlobal("msg_id", lua.LString(msgs[0].ID))
+	require.NoError(t, ls.DoString(script))
+}
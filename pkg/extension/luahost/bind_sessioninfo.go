@@ -0,0 +1,79 @@
+package luahost
+
+import (
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const sessionInfoName = "session_info"
+
+func registerSessionInfoType(ls *lua.LState) {
+	mt := ls.NewTypeMetatable(sessionInfoName)
+	ls.SetGlobal(sessionInfoName, mt)
+
+	// Static attributes.
+	ls.SetField(mt, "new", ls.NewFunction(newSessionInfo))
+
+	// Methods.
+	ls.SetField(mt, "__index", ls.NewFunction(sessionInfoIndex))
+}
+
+func newSessionInfo(ls *lua.LState) int {
+	val := &event.SessionInfo{}
+	ud := wrapSessionInfo(ls, val)
+	ls.Push(ud)
+
+	return 1
+}
+
+func wrapSessionInfo(ls *lua.LState, val *event.SessionInfo) *lua.LUserData {
+	ud := ls.NewUserData()
+	ud.Value = val
+	ls.SetMetatable(ud, ls.GetTypeMetatable(sessionInfoName))
+
+	return ud
+}
+
+// Checks there is a SessionInfo at stack position `pos`, else throws Lua error.
+func checkSessionInfo(ls *lua.LState, pos int) *event.SessionInfo {
+	ud := ls.CheckUserData(pos)
+	if v, ok := ud.Value.(*event.SessionInfo); ok {
+		return v
+	}
+	ls.ArgError(pos, sessionInfoName+" expected")
+	return nil
+}
+
+// Gets a field value from SessionInfo user object.  This emulates a Lua table,
+// allowing `session.auth_user` instead of a Lua object syntax of `session:auth_user()`.
+func sessionInfoIndex(ls *lua.LState) int {
+	session := checkSessionInfo(ls, 1)
+	field := ls.CheckString(2)
+
+	// Push the requested field's value onto the stack.
+	switch field {
+	case "auth_user":
+		ls.Push(lua.LString(session.AuthUser))
+	case "helo":
+		ls.Push(lua.LString(session.Helo))
+	case "remote_addr":
+		ls.Push(lua.LString(session.RemoteAddr))
+	case "tls_version":
+		ls.Push(lua.LString(session.TLSVersion))
+	case "tls_cipher":
+		ls.Push(lua.LString(session.TLSCipher))
+	case "mail_from":
+		ls.Push(lua.LString(session.MailFrom))
+	case "rcpt_to":
+		lt := &lua.LTable{}
+		for _, v := range session.RcptTo {
+			lt.Append(lua.LString(v))
+		}
+		ls.Push(lt)
+	default:
+		// Unknown field.
+		ls.Push(lua.LNil)
+	}
+
+	return 1
+}
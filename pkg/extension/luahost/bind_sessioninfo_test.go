@@ -0,0 +1,39 @@
+package luahost
+
+import (
+	"testing"
+
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"github.com/inbucket/inbucket/v3/pkg/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionInfoGetters(t *testing.T) {
+	want := &event.SessionInfo{
+		AuthUser:   "user1",
+		Helo:       "client.example.com",
+		RemoteAddr: "1.2.3.4",
+		TLSVersion: "TLS 1.3",
+		TLSCipher:  "TLS_AES_128_GCM_SHA256",
+		MailFrom:   "from@example.com",
+		RcptTo:     []string{"to1@example.com", "to2@example.com"},
+	}
+	script := `
+		assert(session, "session should not be nil")
+
+		assert_eq(session.auth_user, "user1", "auth_user")
+		assert_eq(session.helo, "client.example.com", "helo")
+		assert_eq(session.remote_addr, "1.2.3.4", "remote_addr")
+		assert_eq(session.tls_version, "TLS 1.3", "tls_version")
+		assert_eq(session.tls_cipher, "TLS_AES_128_GCM_SHA256", "tls_cipher")
+		assert_eq(session.mail_from, "from@example.com", "mail_from")
+		assert_eq(#session.rcpt_to, 2, "#rcpt_to")
+		assert_eq(session.rcpt_to[1], "to1@example.com", "rcpt_to[1]")
+		assert_eq(session.rcpt_to[2], "to2@example.com", "rcpt_to[2]")
+	`
+
+	ls, _ := test.NewLuaState()
+	registerSessionInfoType(ls)
+	ls.SetGlobal("session", wrapSessionInfo(ls, want))
+	require.NoError(t, ls.DoString(script))
+}
@@ -0,0 +1,69 @@
+package luahost
+
+import (
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const smtpAuthName = "smtp_auth"
+
+func registerSMTPAuthType(ls *lua.LState) {
+	mt := ls.NewTypeMetatable(smtpAuthName)
+	ls.SetGlobal(smtpAuthName, mt)
+
+	// Static attributes.
+	ls.SetField(mt, "new", ls.NewFunction(newSMTPAuth))
+
+	// Methods.
+	ls.SetField(mt, "__index", ls.NewFunction(smtpAuthIndex))
+}
+
+func newSMTPAuth(ls *lua.LState) int {
+	val := &event.SMTPAuth{}
+	ud := wrapSMTPAuth(ls, val)
+	ls.Push(ud)
+
+	return 1
+}
+
+func wrapSMTPAuth(ls *lua.LState, val *event.SMTPAuth) *lua.LUserData {
+	ud := ls.NewUserData()
+	ud.Value = val
+	ls.SetMetatable(ud, ls.GetTypeMetatable(smtpAuthName))
+
+	return ud
+}
+
+// Checks there is an SMTPAuth at stack position `pos`, else throws Lua error.
+func checkSMTPAuth(ls *lua.LState, pos int) *event.SMTPAuth {
+	ud := ls.CheckUserData(pos)
+	if v, ok := ud.Value.(*event.SMTPAuth); ok {
+		return v
+	}
+	ls.ArgError(pos, smtpAuthName+" expected")
+	return nil
+}
+
+// Gets a field value from SMTPAuth user object.  This emulates a Lua table,
+// allowing `auth.username` instead of a Lua object syntax of `auth:username()`.
+func smtpAuthIndex(ls *lua.LState) int {
+	auth := checkSMTPAuth(ls, 1)
+	field := ls.CheckString(2)
+
+	// Push the requested field's value onto the stack.
+	switch field {
+	case "mechanism":
+		ls.Push(lua.LString(auth.Mechanism))
+	case "username":
+		ls.Push(lua.LString(auth.Username))
+	case "password":
+		ls.Push(lua.LString(auth.Password))
+	case "remote_addr":
+		ls.Push(lua.LString(auth.RemoteAddr))
+	default:
+		// Unknown field.
+		ls.Push(lua.LNil)
+	}
+
+	return 1
+}
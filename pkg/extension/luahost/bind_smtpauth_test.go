@@ -0,0 +1,31 @@
+package luahost
+
+import (
+	"testing"
+
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"github.com/inbucket/inbucket/v3/pkg/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSMTPAuthGetters(t *testing.T) {
+	want := &event.SMTPAuth{
+		Mechanism:  "PLAIN",
+		Username:   "user1",
+		Password:   "pass1",
+		RemoteAddr: "1.2.3.4",
+	}
+	script := `
+		assert(auth, "auth should not be nil")
+
+		assert_eq(auth.mechanism, "PLAIN", "mechanism")
+		assert_eq(auth.username, "user1", "username")
+		assert_eq(auth.password, "pass1", "password")
+		assert_eq(auth.remote_addr, "1.2.3.4", "remote_addr")
+	`
+
+	ls, _ := test.NewLuaState()
+	registerSMTPAuthType(ls)
+	ls.SetGlobal("auth", wrapSMTPAuth(ls, want))
+	require.NoError(t, ls.DoString(script))
+}
@@ -0,0 +1,173 @@
+package luahost
+
+import (
+	"strings"
+
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"github.com/inbucket/inbucket/v3/pkg/message"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// storeLoader returns the loader for the `store` module, which exposes message.Manager operations
+// to Lua scripts.  Each function returns nil and an error string on failure.
+func storeLoader(services func() *Services) lua.LGFunction {
+	return func(ls *lua.LState) int {
+		// bind wraps fn so that it receives the current message manager.
+		bind := func(fn func(*lua.LState, message.Manager) int) *lua.LFunction {
+			return ls.NewFunction(func(ls *lua.LState) int {
+				s := services()
+				if s == nil || s.Manager == nil {
+					ls.Push(lua.LNil)
+					ls.Push(lua.LString("message manager unavailable"))
+					return 2
+				}
+				return fn(ls, s.Manager)
+			})
+		}
+
+		mod := ls.NewTable()
+		mod.RawSetString("list", bind(storeList))
+		mod.RawSetString("search", bind(storeSearch))
+		mod.RawSetString("delete", bind(storeDelete))
+		mod.RawSetString("purge", bind(storePurge))
+		mod.RawSetString("mark_seen", bind(storeMarkSeen))
+		mod.RawSetString("copy", bind(storeCopy))
+		mod.RawSetString("move", bind(storeMove))
+		ls.Push(mod)
+		return 1
+	}
+}
+
+// storeList implements `store.list(mailbox)`, returning a list of message_metadata.
+func storeList(ls *lua.LState, mm message.Manager) int {
+	mailbox := ls.CheckString(1)
+	metas, err := mm.GetMetadata(mailbox)
+	if err != nil {
+		return pushError(ls, err)
+	}
+	ls.Push(wrapMetadataList(ls, metas))
+	return 1
+}
+
+// storeSearch implements `store.search(mailbox, criteria)`, returning a list of message_metadata
+// matching every criterion given.  Criteria fields are `from`, `to` and `subject`, matched as
+// case-insensitive substrings; `seen`, a boolean; and `before` and `after`, Unix seconds.
+func storeSearch(ls *lua.LState, mm message.Manager) int {
+	mailbox := ls.CheckString(1)
+	criteria := ls.OptTable(2, ls.NewTable())
+
+	match := []func(*event.MessageMetadata) bool{}
+	if v, ok := criteria.RawGetString("from").(lua.LString); ok {
+		s := strings.ToLower(string(v))
+		match = append(match, func(m *event.MessageMetadata) bool {
+			return m.From != nil && strings.Contains(strings.ToLower(m.From.String()), s)
+		})
+	}
+	if v, ok := criteria.RawGetString("to").(lua.LString); ok {
+		s := strings.ToLower(string(v))
+		match = append(match, func(m *event.MessageMetadata) bool {
+			for _, addr := range m.To {
+				if strings.Contains(strings.ToLower(addr.String()), s) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	if v, ok := criteria.RawGetString("subject").(lua.LString); ok {
+		s := strings.ToLower(string(v))
+		match = append(match, func(m *event.MessageMetadata) bool {
+			return strings.Contains(strings.ToLower(m.Subject), s)
+		})
+	}
+	if v, ok := criteria.RawGetString("seen").(lua.LBool); ok {
+		match = append(match, func(m *event.MessageMetadata) bool {
+			return m.Seen == bool(v)
+		})
+	}
+	if v, ok := criteria.RawGetString("before").(lua.LNumber); ok {
+		match = append(match, func(m *event.MessageMetadata) bool {
+			return m.Date.Unix() < int64(v)
+		})
+	}
+	if v, ok := criteria.RawGetString("after").(lua.LNumber); ok {
+		match = append(match, func(m *event.MessageMetadata) bool {
+			return m.Date.Unix() > int64(v)
+		})
+	}
+
+	metas, err := mm.GetMetadata(mailbox)
+	if err != nil {
+		return pushError(ls, err)
+	}
+	found := make([]*event.MessageMetadata, 0, len(metas))
+outer:
+	for _, m := range metas {
+		for _, fn := range match {
+			if !fn(m) {
+				continue outer
+			}
+		}
+		found = append(found, m)
+	}
+	ls.Push(wrapMetadataList(ls, found))
+	return 1
+}
+
+// storeDelete implements `store.delete(mailbox, id)`.
+func storeDelete(ls *lua.LState, mm message.Manager) int {
+	return pushResult(ls, mm.RemoveMessage(ls.CheckString(1), ls.CheckString(2)))
+}
+
+// storePurge implements `store.purge(mailbox)`.
+func storePurge(ls *lua.LState, mm message.Manager) int {
+	return pushResult(ls, mm.PurgeMessages(ls.CheckString(1)))
+}
+
+// storeMarkSeen implements `store.mark_seen(mailbox, id)`.
+func storeMarkSeen(ls *lua.LState, mm message.Manager) int {
+	return pushResult(ls, mm.MarkSeen(ls.CheckString(1), ls.CheckString(2)))
+}
+
+// storeCopy implements `store.copy(mailbox, id, to_mailbox)`, returning the ID of the copy.
+func storeCopy(ls *lua.LState, mm message.Manager) int {
+	id, err := mm.CopyMessage(ls.CheckString(1), ls.CheckString(2), ls.CheckString(3))
+	if err != nil {
+		return pushError(ls, err)
+	}
+	ls.Push(lua.LString(id))
+	return 1
+}
+
+// storeMove implements `store.move(mailbox, id, to_mailbox)`, returning the new message ID.
+func storeMove(ls *lua.LState, mm message.Manager) int {
+	id, err := mm.MoveMessage(ls.CheckString(1), ls.CheckString(2), ls.CheckString(3))
+	if err != nil {
+		return pushError(ls, err)
+	}
+	ls.Push(lua.LString(id))
+	return 1
+}
+
+func wrapMetadataList(ls *lua.LState, metas []*event.MessageMetadata) *lua.LTable {
+	tbl := ls.CreateTable(len(metas), 0)
+	for _, m := range metas {
+		tbl.Append(wrapMessageMetadata(ls, m))
+	}
+	return tbl
+}
+
+// pushResult pushes true if err is nil, otherwise nil and the error string.
+func pushResult(ls *lua.LState, err error) int {
+	if err != nil {
+		return pushError(ls, err)
+	}
+	ls.Push(lua.LTrue)
+	return 1
+}
+
+func pushError(ls *lua.LState, err error) int {
+	ls.Push(lua.LNil)
+	ls.Push(lua.LString(err.Error()))
+	return 2
+}
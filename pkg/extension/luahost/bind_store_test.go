@@ -0,0 +1,96 @@
+package luahost
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/config"
+	"github.com/inbucket/inbucket/v3/pkg/extension"
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"github.com/inbucket/inbucket/v3/pkg/message"
+	"github.com/inbucket/inbucket/v3/pkg/storage/mem"
+	"github.com/inbucket/inbucket/v3/pkg/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreModuleNotConfigured(t *testing.T) {
+	script := `
+		local store = require("store")
+		local msgs, err = store.list("mailbox")
+		assert_eq(msgs, nil)
+		assert_eq(err, "message manager unavailable")
+	`
+
+	ls, _ := test.NewLuaState()
+	ls.PreloadModule("store", storeLoader(func() *Services { return nil }))
+	require.NoError(t, ls.DoString(script))
+}
+
+func TestStoreModule(t *testing.T) {
+	extHost := extension.NewHost()
+	store, err := mem.New(config.Storage{}, extHost)
+	require.NoError(t, err)
+	mm := &message.StoreManager{Store: store, ExtHost: extHost}
+	add := func(subject string, date time.Time) {
+		t.Helper()
+		_, err := store.AddMessage(&message.Delivery{
+			Meta: event.MessageMetadata{
+				Mailbox: "box",
+				From:    &mail.Address{Name: "Sender", Address: "from@example.com"},
+				To:      []*mail.Address{{Address: "to@example.com"}},
+				Date:    date,
+				Subject: subject,
+			},
+			Reader: strings.NewReader("Subject: " + subject + "\r\n\r\nbody\r\n"),
+		})
+		require.NoError(t, err)
+	}
+	add("Welcome", time.Unix(1000, 0))
+	add("Daily report", time.Unix(2000, 0))
+	add("Weekly REPORT", time.Unix(3000, 0))
+
+	script := `
+		local store = require("store")
+
+		local msgs, err = store.list("box")
+		assert_eq(err, nil)
+		assert_eq(#msgs, 3, "#msgs")
+
+		-- Search criteria.
+		local daily = store.search("box", { subject = "daily" })[1]
+		assert_eq(store.mark_seen("box", daily.id), true)
+		assert_eq(#store.search("box", { subject = "report" }), 2, "subject")
+		assert_eq(#store.search("box", { subject = "report", seen = false }), 1, "seen")
+		assert_eq(#store.search("box", { from = "SENDER" }), 3, "from")
+		assert_eq(#store.search("box", { to = "nobody" }), 0, "to")
+		assert_eq(#store.search("box", { after = 1500, before = 2500 }), 1, "dates")
+		assert_eq(#store.search("box"), 3, "no criteria")
+
+		-- Copy and move.
+		local welcome = store.search("box", { subject = "welcome" })[1]
+		local copy_id, err = store.copy("box", welcome.id, "archive")
+		assert_eq(err, nil)
+		assert_eq(type(copy_id), "string")
+		local moved_id, err = store.move("box", welcome.id, "archive")
+		assert_eq(err, nil)
+		assert_eq(#store.list("box"), 2, "box after move")
+		assert_eq(#store.list("archive"), 2, "archive after move")
+
+		-- Delete and purge.
+		assert_eq(store.delete("archive", moved_id), true)
+		assert_eq(#store.list("archive"), 1, "archive after delete")
+		assert_eq(store.purge("box"), true)
+		assert_eq(#store.list("box"), 0, "box after purge")
+
+		local id, err = store.copy("box", "missing", "archive")
+		assert_eq(id, nil)
+		assert(err, "err should not be nil")
+	`
+
+	ls, _ := test.NewLuaState()
+	registerMessageMetadataType(ls)
+	ls.PreloadModule("store", storeLoader(func() *Services { return &Services{Manager: mm} }))
+	require.NoError(t, ls.DoString(script))
+}
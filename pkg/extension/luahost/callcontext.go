@@ -0,0 +1,116 @@
+package luahost
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errInstructionLimit = errors.New("lua instruction limit exceeded")
+	errMemoryLimit      = errors.New("lua memory limit exceeded")
+)
+
+// memoryCheckInterval is how often heap growth is sampled during a call into Lua.
+const memoryCheckInterval = 10 * time.Millisecond
+
+// heapMetric is the runtime metric sampled to enforce Limits.MaxMemoryBytes.
+const heapMetric = "/memory/classes/heap/objects:bytes"
+
+// callContext bounds a single call into Lua.  gopher-lua polls Done before executing each VM
+// instruction, allowing it to count instructions, while a watchdog samples heap growth.
+type callContext struct {
+	context.Context               // Parent, enforces the timeout.
+	remaining       atomic.Int64  // Instructions left before the limit, if limited.
+	limited         bool          // Instructions are limited.
+	stopped         chan struct{} // Closed once a limit is exceeded.
+	finished        chan struct{} // Closed when the call completes.
+	once            sync.Once
+	err             error // Limit that was exceeded, set before stopped is closed.
+}
+
+func newCallContext(parent context.Context, maxInstructions, maxMemory int) *callContext {
+	c := &callContext{
+		Context:  parent,
+		limited:  maxInstructions > 0,
+		stopped:  make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	c.remaining.Store(int64(maxInstructions))
+	if maxMemory > 0 {
+		go c.watchMemory(uint64(maxMemory))
+	}
+	return c
+}
+
+// Done counts an instruction, and returns a closed channel once any limit has been exceeded.
+func (c *callContext) Done() <-chan struct{} {
+	if c.limited && c.remaining.Add(-1) < 0 {
+		c.stop(errInstructionLimit)
+	}
+	select {
+	case <-c.stopped:
+		return c.stopped
+	default:
+		return c.Context.Done()
+	}
+}
+
+// Err returns the exceeded limit, or the error of the parent context.
+func (c *callContext) Err() error {
+	select {
+	case <-c.stopped:
+		return c.err
+	default:
+		return c.Context.Err()
+	}
+}
+
+// finish stops the memory watchdog.
+func (c *callContext) finish() {
+	close(c.finished)
+}
+
+func (c *callContext) stop(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.stopped)
+	})
+}
+
+// watchMemory stops the call if the heap grows by more than limit bytes while it runs.  The heap
+// is shared by the whole process, so growth is confirmed after a collection before stopping.
+func (c *callContext) watchMemory(limit uint64) {
+	sample := []metrics.Sample{{Name: heapMetric}}
+	metrics.Read(sample)
+	base := sample[0].Value.Uint64()
+	exceeded := func() bool {
+		metrics.Read(sample)
+		return sample[0].Value.Uint64() > base+limit
+	}
+
+	ticker := time.NewTicker(memoryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.finished:
+			return
+		case <-c.stopped:
+			return
+		case <-ticker.C:
+			if !exceeded() {
+				continue
+			}
+			// Discount garbage before deciding.
+			runtime.GC()
+			if exceeded() {
+				c.stop(errMemoryLimit)
+				return
+			}
+		}
+	}
+}
@@ -2,14 +2,22 @@ package luahost
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/inbucket/inbucket/v3/pkg/config"
 	"github.com/inbucket/inbucket/v3/pkg/extension"
 	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"github.com/inbucket/inbucket/v3/pkg/message"
+	"github.com/inbucket/inbucket/v3/pkg/relay"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	lua "github.com/yuin/gopher-lua"
@@ -21,9 +29,45 @@ var ErrNoScript error = errors.New("no script file present")
 
 // Host of Lua extensions.
 type Host struct {
-	extHost    *extension.Host
-	pool       *statePool
-	logContext zerolog.Context
+	extHost       *extension.Host
+	pool          atomic.Pointer[statePool] // Replaced when the script is reloaded.
+	loadMu        sync.Mutex                // Serializes script loads.
+	logger        zerolog.Logger
+	scriptPath    string        // Empty if the script was not loaded from a file.
+	scriptStat    os.FileInfo   // Script file info when last loaded, used to detect changes.
+	watchInterval time.Duration // Script change polling interval, 0 disables.
+	reloaded      chan struct{} // Signaled after the script is reloaded.
+}
+
+// Services are the Inbucket components made available to Lua scripts.  They are provided after
+// the Host is constructed, as they may themselves depend on the extension host.
+type Services struct {
+	Manager message.Manager
+	Relay   *relay.Relay // nil when no relay targets are configured.
+}
+
+// Limits bound the resources Lua scripts may consume.  Zero values use the gopher-lua defaults.
+type Limits struct {
+	MaxBodyBytes       int           // Text and HTML bodies are truncated to this size.
+	MaxAttachmentBytes int           // Larger attachment content is omitted.
+	Timeout            time.Duration // Max run time of each call into Lua, 0 for no limit.
+	MaxCallDepth       int           // Max call stack depth.
+	MaxStackSize       int           // Max value stack slots.
+	MaxInstructions    int           // Max VM instructions per call into Lua, 0 for no limit.
+	MaxMemoryBytes     int           // Max heap growth during a call into Lua, 0 for no limit.
+	Modules            []string      // Preloaded modules available to scripts.
+}
+
+// defaultLimits apply until SetLimits is called.
+var defaultLimits = Limits{
+	MaxBodyBytes:       1 << 20,
+	MaxAttachmentBytes: 1 << 20,
+	Timeout:            5 * time.Second,
+	MaxCallDepth:       200,
+	MaxStackSize:       1 << 16,
+	MaxInstructions:    10_000_000,
+	MaxMemoryBytes:     64 << 20,
+	Modules:            moduleNames,
 }
 
 // New constructs a new Lua Host, pre-compiling the source.
@@ -44,53 +88,124 @@ func New(conf config.Lua, extHost *extension.Host) (*Host, error) {
 		return nil, fmt.Errorf("lua script %v is a directory", scriptPath)
 	}
 
+	for _, name := range conf.Modules {
+		if !slices.Contains(moduleNames, name) {
+			return nil, fmt.Errorf("unknown lua module %q, available modules are: %s",
+				name, strings.Join(moduleNames, ", "))
+		}
+	}
+	limits := Limits{
+		MaxBodyBytes:       conf.MaxBodyBytes,
+		MaxAttachmentBytes: conf.MaxAttachmentBytes,
+		Timeout:            conf.Timeout,
+		MaxCallDepth:       conf.MaxCallDepth,
+		MaxStackSize:       conf.MaxStackSize,
+		MaxInstructions:    conf.MaxInstructions,
+		MaxMemoryBytes:     conf.MaxMemoryBytes,
+		Modules:            conf.Modules,
+	}
+
 	logger.Info().Msg("Loading script")
 	file, err := os.Open(scriptPath)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
 
-	return NewFromReader(logContext.Logger(), extHost, bufio.NewReader(file), scriptPath)
+	h, err := newFromReader(logContext.Logger(), extHost, bufio.NewReader(file), scriptPath, limits)
+	if err != nil {
+		return nil, err
+	}
+	h.scriptPath = scriptPath
+	h.scriptStat = fi
+	h.watchInterval = conf.WatchInterval
+	return h, nil
 }
 
 // NewFromReader constructs a new Lua Host, loading Lua source from the provided reader.
 // The provided path is used in logging and error messages.
 func NewFromReader(logger zerolog.Logger, extHost *extension.Host, r io.Reader, path string) (*Host, error) {
+	return newFromReader(logger, extHost, r, path, defaultLimits)
+}
+
+func newFromReader(
+	logger zerolog.Logger,
+	extHost *extension.Host,
+	r io.Reader,
+	path string,
+	limits Limits,
+) (*Host, error) {
 	startLogger := logger.With().Str("phase", "startup").Str("path", path).Logger()
+	h := &Host{extHost: extHost, logger: logger, reloaded: make(chan struct{}, 1)}
+	if err := h.load(startLogger, r, path, limits); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// load compiles the Lua source from r, and replaces the running script with it.  The running
+// script is left in place if the source fails to compile or run.
+func (h *Host) load(logger zerolog.Logger, r io.Reader, path string, limits Limits) error {
+	h.loadMu.Lock()
+	defer h.loadMu.Unlock()
 
 	// Pre-parse, and compile script.
 	chunk, err := parse.Parse(r, path)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	proto, err := lua.Compile(chunk, path)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Build the pool and confirm LState is retrievable.
-	pool := newStatePool(logger, proto)
-	h := &Host{extHost: extHost, pool: pool, logContext: logger.With()}
-	if ls, err := pool.getState(); err == nil {
-		h.wireFunctions(startLogger, ls)
+	pool := newStatePool(h.logger, proto)
+	pool.limits.Store(&limits)
+	old := h.pool.Load()
+	if old != nil {
+		pool.inherit(old)
+	}
+	ls, err := pool.getState()
+	if err != nil {
+		return err
+	}
+	h.pool.Store(pool)
+	h.wireFunctions(logger, ls)
 
-		// State creation works, put it back.
-		pool.putState(ls)
-	} else {
-		return nil, err
+	// State creation works, put it back.
+	pool.putState(ls)
+	if old != nil {
+		old.close()
 	}
 
-	return h, nil
+	return nil
 }
 
 // CreateChannel creates a channel and places it into the named global variable
 // in newly created LStates.
 func (h *Host) CreateChannel(name string) chan lua.LValue {
-	return h.pool.createChannel(name)
+	return h.pool.Load().createChannel(name)
 }
 
-// Detects global lua event listener functions and wires them up.
+// SetServices makes Inbucket components available to Lua scripts, ex: `inbucket.release`.
+func (h *Host) SetServices(s Services) {
+	h.pool.Load().services.Store(&s)
+}
+
+// SetLimits bounds the resources available to Lua scripts.  Pooled states are destroyed, so
+// that new states are created with the limits applied.
+func (h *Host) SetLimits(l Limits) {
+	h.pool.Load().setLimits(&l)
+}
+
+// Detects global lua event listener functions and wires them up, removing listeners for functions
+// the script does not define.
 func (h *Host) wireFunctions(logger zerolog.Logger, ls *lua.LState) {
 	ib, err := getInbucket(ls)
 	if err != nil {
@@ -98,31 +213,63 @@ func (h *Host) wireFunctions(logger zerolog.Logger, ls *lua.LState) {
 	}
 
 	events := h.extHost.Events
-	const listenerName string = "lua"
+	wireAsync(&events.AfterMailboxPurged, ib.After.MailboxPurged, h.handleAfterMailboxPurged)
+	wireAsync(&events.AfterMessageDeleted, ib.After.MessageDeleted, h.handleAfterMessageDeleted)
+	wireAsync(&events.AfterMessageSeen, ib.After.MessageSeen, h.handleAfterMessageSeen)
+	wireAsync(&events.AfterMessageStored, ib.After.MessageStored, h.handleAfterMessageStored)
+	wireAsync(&events.AfterPOP3Login, ib.After.POP3Login, h.handleAfterPOP3Login)
+	wireAsync(&events.AfterSMTPSessionClosed, ib.After.SMTPSessionClosed, h.handleAfterSMTPSessionClosed)
+	wireSync(&events.BeforeAuthAccepted, ib.Before.AuthAccepted, h.handleBeforeAuthAccepted)
+	wireSync(&events.BeforeDataAccepted, ib.Before.DataAccepted, h.handleBeforeDataAccepted)
+	wireSync(&events.BeforeMailFromAccepted, ib.Before.MailFromAccepted, h.handleBeforeMailFromAccepted)
+	wireSync(&events.BeforeMessageDeleted, ib.Before.MessageDeleted, h.handleBeforeMessageDeleted)
+	wireSync(&events.BeforeMessageStored, ib.Before.MessageStored, h.handleBeforeMessageStored)
+	wireSync(&events.BeforeRcptToAccepted, ib.Before.RcptToAccepted, h.handleBeforeRcptToAccepted)
+}
 
-	if ib.After.MessageDeleted != nil {
-		events.AfterMessageDeleted.AddListener(listenerName, h.handleAfterMessageDeleted)
-	}
-	if ib.After.MessageStored != nil {
-		events.AfterMessageStored.AddListener(listenerName, h.handleAfterMessageStored)
+const listenerName string = "lua"
+
+// wireAsync adds handler as a listener to broker if fn is defined, otherwise removes it.
+func wireAsync[E any](broker *extension.AsyncEventBroker[E], fn *lua.LFunction, handler func(E)) {
+	if fn != nil {
+		broker.AddListener(listenerName, handler)
+	} else {
+		broker.RemoveListener(listenerName)
 	}
-	if ib.Before.MailFromAccepted != nil {
-		events.BeforeMailFromAccepted.AddListener(listenerName, h.handleBeforeMailFromAccepted)
+}
+
+// wireSync adds handler as a listener to broker if fn is defined, otherwise removes it.
+func wireSync[E, R any](broker *extension.EventBroker[E, R], fn *lua.LFunction, handler func(E) *R) {
+	if fn != nil {
+		broker.AddListener(listenerName, handler)
+	} else {
+		broker.RemoveListener(listenerName)
 	}
-	if ib.Before.MessageStored != nil {
-		events.BeforeMessageStored.AddListener(listenerName, h.handleBeforeMessageStored)
+}
+
+func (h *Host) handleAfterMailboxPurged(purge event.MailboxPurge) {
+	logger, release, ls, ib, ok := h.prepareInbucketFuncCall("after.mailbox_purged")
+	if !ok {
+		return
 	}
-	if ib.Before.RcptToAccepted != nil {
-		events.BeforeRcptToAccepted.AddListener(listenerName, h.handleBeforeRcptToAccepted)
+	defer release()
+
+	// Call lua function.
+	logger.Debug().Msgf("Calling Lua function with %+v", purge)
+	if err := ls.CallByParam(
+		lua.P{Fn: ib.After.MailboxPurged, NRet: 0, Protect: true},
+		wrapMailboxPurge(ls, &purge),
+	); err != nil {
+		logger.Error().Err(err).Msg("Failed to call Lua function")
 	}
 }
 
 func (h *Host) handleAfterMessageDeleted(msg event.MessageMetadata) {
-	logger, ls, ib, ok := h.prepareInbucketFuncCall("after.message_deleted")
+	logger, release, ls, ib, ok := h.prepareInbucketFuncCall("after.message_deleted")
 	if !ok {
 		return
 	}
-	defer h.pool.putState(ls)
+	defer release()
 
 	// Call lua function.
 	logger.Debug().Msgf("Calling Lua function with %+v", msg)
@@ -134,12 +281,29 @@ func (h *Host) handleAfterMessageDeleted(msg event.MessageMetadata) {
 	}
 }
 
+func (h *Host) handleAfterMessageSeen(msg event.MessageMetadata) {
+	logger, release, ls, ib, ok := h.prepareInbucketFuncCall("after.message_seen")
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Call lua function.
+	logger.Debug().Msgf("Calling Lua function with %+v", msg)
+	if err := ls.CallByParam(
+		lua.P{Fn: ib.After.MessageSeen, NRet: 0, Protect: true},
+		wrapMessageMetadata(ls, &msg),
+	); err != nil {
+		logger.Error().Err(err).Msg("Failed to call Lua function")
+	}
+}
+
 func (h *Host) handleAfterMessageStored(msg event.MessageMetadata) {
-	logger, ls, ib, ok := h.prepareInbucketFuncCall("after.message_stored")
+	logger, release, ls, ib, ok := h.prepareInbucketFuncCall("after.message_stored")
 	if !ok {
 		return
 	}
-	defer h.pool.putState(ls)
+	defer release()
 
 	// Call lua function.
 	logger.Debug().Msgf("Calling Lua function with %+v", msg)
@@ -151,20 +315,116 @@ func (h *Host) handleAfterMessageStored(msg event.MessageMetadata) {
 	}
 }
 
+func (h *Host) handleAfterPOP3Login(login event.POP3Login) {
+	logger, release, ls, ib, ok := h.prepareInbucketFuncCall("after.pop3_login")
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Call lua function.
+	logger.Debug().Msgf("Calling Lua function with %+v", login)
+	if err := ls.CallByParam(
+		lua.P{Fn: ib.After.POP3Login, NRet: 0, Protect: true},
+		wrapPOP3Login(ls, &login),
+	); err != nil {
+		logger.Error().Err(err).Msg("Failed to call Lua function")
+	}
+}
+
+func (h *Host) handleAfterSMTPSessionClosed(summary event.SMTPSessionSummary) {
+	logger, release, ls, ib, ok := h.prepareInbucketFuncCall("after.smtp_session_closed")
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Call lua function.
+	logger.Debug().Msgf("Calling Lua function with %+v", summary)
+	if err := ls.CallByParam(
+		lua.P{Fn: ib.After.SMTPSessionClosed, NRet: 0, Protect: true},
+		wrapSMTPSessionSummary(ls, &summary),
+	); err != nil {
+		logger.Error().Err(err).Msg("Failed to call Lua function")
+	}
+}
+
+func (h *Host) handleBeforeAuthAccepted(auth event.SMTPAuth) *event.SMTPResponse {
+	logger, release, ls, ib, ok := h.prepareInbucketFuncCall("before.auth_accepted")
+	if !ok {
+		return nil
+	}
+	defer release()
+
+	// Password is omitted from the log.
+	logger.Debug().Str("mechanism", auth.Mechanism).Str("user", auth.Username).
+		Msg("Calling Lua function")
+	if err := ls.CallByParam(
+		lua.P{Fn: ib.Before.AuthAccepted, NRet: 1, Protect: true},
+		wrapSMTPAuth(ls, &auth),
+	); err != nil {
+		return callFailed(logger, ls, err)
+	}
+
+	lval := ls.Get(-1)
+	ls.Pop(1)
+	logger.Debug().Msgf("Lua function returned %q (%v)", lval, lval.Type().String())
+
+	result, err := unwrapSMTPResponse(lval)
+	if err != nil {
+		logger.Error().Err(err).Msg("Bad response from Lua Function")
+	}
+
+	return result
+}
+
+func (h *Host) handleBeforeDataAccepted(msg event.DataMessage) *event.SMTPResponse {
+	logger, release, ls, ib, ok := h.prepareInbucketFuncCall("before.data_accepted")
+	if !ok {
+		return nil
+	}
+	defer release()
+
+	// Message content is omitted from the log.
+	logger.Debug().Str("from", msg.MailFrom).Strs("to", msg.RcptTo).Int64("size", msg.Size).
+		Msg("Calling Lua function")
+	if err := ls.CallByParam(
+		lua.P{Fn: ib.Before.DataAccepted, NRet: 1, Protect: true},
+		wrapDataMessage(ls, &msg),
+	); err != nil {
+		return callFailed(logger, ls, err)
+	}
+
+	lval := ls.Get(-1)
+	ls.Pop(1)
+	logger.Debug().Msgf("Lua function returned %q (%v)", lval, lval.Type().String())
+
+	if lua.LVIsFalse(lval) {
+		// No objection to the message content.
+		return nil
+	}
+
+	result, err := unwrapSMTPResponse(lval)
+	if err != nil {
+		logger.Error().Err(err).Msg("Bad response from Lua Function")
+	}
+
+	return result
+}
+
 func (h *Host) handleBeforeMailFromAccepted(session event.SMTPSession) *event.SMTPResponse {
-	logger, ls, ib, ok := h.prepareInbucketFuncCall("before.mail_from_accepted")
+	logger, release, ls, ib, ok := h.prepareInbucketFuncCall("before.mail_from_accepted")
 	if !ok {
 		return nil
 	}
-	defer h.pool.putState(ls)
+	defer release()
 
 	logger.Debug().Msgf("Calling Lua function with %+v", session)
 	if err := ls.CallByParam(
 		lua.P{Fn: ib.Before.MailFromAccepted, NRet: 1, Protect: true},
 		wrapSMTPSession(ls, &session),
 	); err != nil {
-		logger.Error().Err(err).Msg("Failed to call Lua function")
-		return nil
+		return callFailed(logger, ls, err)
 	}
 
 	lval := ls.Get(-1)
@@ -180,19 +440,18 @@ func (h *Host) handleBeforeMailFromAccepted(session event.SMTPSession) *event.SM
 }
 
 func (h *Host) handleBeforeRcptToAccepted(session event.SMTPSession) *event.SMTPResponse {
-	logger, ls, ib, ok := h.prepareInbucketFuncCall("before.rcpt_to_accepted")
+	logger, release, ls, ib, ok := h.prepareInbucketFuncCall("before.rcpt_to_accepted")
 	if !ok {
 		return nil
 	}
-	defer h.pool.putState(ls)
+	defer release()
 
 	logger.Debug().Msgf("Calling Lua function with %+v", session)
 	if err := ls.CallByParam(
 		lua.P{Fn: ib.Before.RcptToAccepted, NRet: 1, Protect: true},
 		wrapSMTPSession(ls, &session),
 	); err != nil {
-		logger.Error().Err(err).Msg("Failed to call Lua function")
-		return nil
+		return callFailed(logger, ls, err)
 	}
 
 	lval := ls.Get(-1)
@@ -207,12 +466,45 @@ func (h *Host) handleBeforeRcptToAccepted(session event.SMTPSession) *event.SMTP
 	return result
 }
 
+// handleBeforeMessageDeleted denies deletion when the Lua function returns false, optionally
+// followed by a reason string.
+func (h *Host) handleBeforeMessageDeleted(msg event.MessageMetadata) *event.DeleteResponse {
+	logger, release, ls, ib, ok := h.prepareInbucketFuncCall("before.message_deleted")
+	if !ok {
+		return nil
+	}
+	defer release()
+
+	logger.Debug().Msgf("Calling Lua function with %+v", msg)
+	if err := ls.CallByParam(
+		lua.P{Fn: ib.Before.MessageDeleted, NRet: 2, Protect: true},
+		wrapMessageMetadata(ls, &msg),
+	); err != nil {
+		logger.Error().Err(err).Msg("Failed to call Lua function")
+		return nil
+	}
+
+	lval, lreason := ls.Get(-2), ls.Get(-1)
+	ls.Pop(2)
+	logger.Debug().Msgf("Lua function returned %q (%v)", lval, lval.Type().String())
+
+	if lval != lua.LFalse {
+		// nil or true allows deletion.
+		return nil
+	}
+	result := &event.DeleteResponse{Action: event.ActionDeny}
+	if reason, ok := lreason.(lua.LString); ok {
+		result.Reason = string(reason)
+	}
+	return result
+}
+
 func (h *Host) handleBeforeMessageStored(msg event.InboundMessage) *event.InboundMessage {
-	logger, ls, ib, ok := h.prepareInbucketFuncCall("before.message_stored")
+	logger, release, ls, ib, ok := h.prepareInbucketFuncCall("before.message_stored")
 	if !ok {
 		return nil
 	}
-	defer h.pool.putState(ls)
+	defer release()
 
 	logger.Debug().Msgf("Calling Lua function with %+v", msg)
 	if err := ls.CallByParam(
@@ -239,21 +531,80 @@ func (h *Host) handleBeforeMessageStored(msg event.InboundMessage) *event.Inboun
 	return result
 }
 
-// Common preparation for calling Lua functions.
-func (h *Host) prepareInbucketFuncCall(funcName string) (logger zerolog.Logger, ls *lua.LState, ib *Inbucket, ok bool) {
-	logger = h.logContext.Str("event", funcName).Logger()
+// prepareInbucketFuncCall gets an LState from the current pool, with calls into it bounded by the
+// configured timeout.  The caller must call release once finished with the state.
+func (h *Host) prepareInbucketFuncCall(funcName string) (
+	logger zerolog.Logger, release func(), ls *lua.LState, ib *Inbucket, ok bool,
+) {
+	logger = h.logger.With().Str("event", funcName).Logger()
 
-	ls, err := h.pool.getState()
+	pool := h.pool.Load()
+	ls, err := pool.getState()
 	if err != nil {
 		logger.Error().Err(err).Msg("Failed to get Lua state instance from pool")
-		return logger, nil, nil, false
+		return logger, nil, nil, nil, false
 	}
 
 	ib, err = getInbucket(ls)
 	if err != nil {
 		logger.Error().Err(err).Msg("Failed to obtain Lua inbucket object")
-		return logger, nil, nil, false
+		return logger, nil, nil, nil, false
 	}
 
-	return logger, ls, ib, true
+	cancel := setCallLimits(ls, pool.getLimits())
+	release = func() {
+		timedOut := ls.Context() != nil && ls.Context().Err() != nil
+		cancel()
+		if timedOut && !ls.IsClosed() {
+			// The interrupted script may have left the state inconsistent.
+			ls.Close()
+		}
+		pool.putState(ls)
+	}
+
+	return logger, release, ls, ib, true
+}
+
+// callFailed logs the error from a failed call into ls.  If a resource limit was exceeded the
+// decision is deferred to Inbucket, otherwise nil is returned so other listeners are consulted.
+func callFailed(logger zerolog.Logger, ls *lua.LState, err error) *event.SMTPResponse {
+	if limitExceeded(ls, err) {
+		logger.Error().Err(err).Msg("Lua function exceeded resource limit, deferring to Inbucket")
+		return &event.SMTPResponse{Action: event.ActionDefer}
+	}
+	logger.Error().Err(err).Msg("Failed to call Lua function")
+	return nil
+}
+
+// setCallLimits bounds the run time, instructions and memory of calls into ls, returning a
+// function to remove the bounds.
+func setCallLimits(ls *lua.LState, limits *Limits) (cancel func()) {
+	if limits.Timeout <= 0 && limits.MaxInstructions <= 0 && limits.MaxMemoryBytes <= 0 {
+		return func() {}
+	}
+	parent, parentCancel := context.Background(), context.CancelFunc(func() {})
+	if limits.Timeout > 0 {
+		parent, parentCancel = context.WithTimeout(parent, limits.Timeout)
+	}
+	ctx := newCallContext(parent, limits.MaxInstructions, limits.MaxMemoryBytes)
+	ls.SetContext(ctx)
+
+	return func() {
+		ls.RemoveContext()
+		ctx.finish()
+		parentCancel()
+	}
+}
+
+// limitExceeded returns true if the failed call into ls was stopped by a resource limit.
+func limitExceeded(ls *lua.LState, err error) bool {
+	if ctx := ls.Context(); ctx != nil {
+		err := ctx.Err()
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errInstructionLimit) ||
+			errors.Is(err, errMemoryLimit) {
+			return true
+		}
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "stack overflow") || strings.Contains(msg, "registry overflow")
 }
@@ -1,6 +1,7 @@
 package luahost_test
 
 import (
+	"context"
 	"net/mail"
 	"strings"
 	"testing"
@@ -41,6 +42,28 @@ func TestLogger(t *testing.T) {
 	assert.Contains(t, output.String(), "_test log entry_")
 }
 
+func TestAfterMailboxPurged(t *testing.T) {
+	// Register lua event listener, setup notify channel.
+	script := `
+		async = true
+
+		function inbucket.after.mailbox_purged(purge)
+			assert_eq(purge.mailbox, "mb1")
+			assert_eq(purge.count, 3)
+			notify:send(asserts_ok)
+		end
+	`
+	extHost := extension.NewHost()
+	luaHost, err := luahost.NewFromReader(consoleLogger, extHost,
+		strings.NewReader(test.LuaInit+script), "test.lua")
+	require.NoError(t, err)
+	notify := luaHost.CreateChannel("notify")
+
+	// Send event, check channel response is true.
+	extHost.Events.AfterMailboxPurged.Emit(&event.MailboxPurge{Mailbox: "mb1", Count: 3})
+	test.AssertNotified(t, notify)
+}
+
 func TestAfterMessageDeleted(t *testing.T) {
 	// Register lua event listener, setup notify channel.
 	script := `
@@ -73,6 +96,29 @@ func TestAfterMessageDeleted(t *testing.T) {
 	test.AssertNotified(t, notify)
 }
 
+func TestAfterMessageSeen(t *testing.T) {
+	// Register lua event listener, setup notify channel.
+	script := `
+		async = true
+
+		function inbucket.after.message_seen(msg)
+			-- Full message bindings tested elsewhere.
+			assert_eq(msg.mailbox, "mb1")
+			assert_eq(msg.id, "id1")
+			notify:send(asserts_ok)
+		end
+	`
+	extHost := extension.NewHost()
+	luaHost, err := luahost.NewFromReader(consoleLogger, extHost,
+		strings.NewReader(test.LuaInit+script), "test.lua")
+	require.NoError(t, err)
+	notify := luaHost.CreateChannel("notify")
+
+	// Send event, check channel response is true.
+	extHost.Events.AfterMessageSeen.Emit(&event.MessageMetadata{Mailbox: "mb1", ID: "id1", Seen: true})
+	test.AssertNotified(t, notify)
+}
+
 func TestAfterMessageStored(t *testing.T) {
 	// Register lua event listener, setup notify channel.
 	script := `
@@ -105,6 +151,127 @@ func TestAfterMessageStored(t *testing.T) {
 	test.AssertNotified(t, notify)
 }
 
+func TestAfterPOP3Login(t *testing.T) {
+	// Register lua event listener, setup notify channel.
+	script := `
+		async = true
+
+		function inbucket.after.pop3_login(login)
+			assert_eq(login.mailbox, "mb1")
+			assert_eq(login.remote_addr, "192.0.2.1")
+			assert_eq(login.messages, 2)
+			notify:send(asserts_ok)
+		end
+	`
+	extHost := extension.NewHost()
+	luaHost, err := luahost.NewFromReader(consoleLogger, extHost,
+		strings.NewReader(test.LuaInit+script), "test.lua")
+	require.NoError(t, err)
+	notify := luaHost.CreateChannel("notify")
+
+	// Send event, check channel response is true.
+	extHost.Events.AfterPOP3Login.Emit(
+		&event.POP3Login{Mailbox: "mb1", RemoteAddr: "192.0.2.1", Messages: 2})
+	test.AssertNotified(t, notify)
+}
+
+func TestAfterSMTPSessionClosed(t *testing.T) {
+	// Register lua event listener, setup notify channel.
+	script := `
+		async = true
+
+		function inbucket.after.smtp_session_closed(session)
+			assert_eq(session.remote_addr, "192.0.2.1")
+			assert_eq(session.helo, "client.example.com")
+			assert_eq(session.auth_user, "user1")
+			assert_eq(session.messages, 2)
+			assert_eq(session.recipients, 3)
+			assert_eq(session.bytes, 1024)
+			assert_eq(session.started, 981173106)
+			assert_eq(session.duration, 1.5)
+			notify:send(asserts_ok)
+		end
+	`
+	extHost := extension.NewHost()
+	luaHost, err := luahost.NewFromReader(consoleLogger, extHost,
+		strings.NewReader(test.LuaInit+script), "test.lua")
+	require.NoError(t, err)
+	notify := luaHost.CreateChannel("notify")
+
+	// Send event, check channel response is true.
+	extHost.Events.AfterSMTPSessionClosed.Emit(&event.SMTPSessionSummary{
+		RemoteAddr: "192.0.2.1",
+		Helo:       "client.example.com",
+		AuthUser:   "user1",
+		Messages:   2,
+		Recipients: 3,
+		Bytes:      1024,
+		Started:    time.Date(2001, time.February, 3, 4, 5, 6, 0, time.UTC),
+		Duration:   1500 * time.Millisecond,
+	})
+	test.AssertNotified(t, notify)
+}
+
+func TestBeforeAuthAccepted(t *testing.T) {
+	// Register lua event listener.
+	script := `
+		function inbucket.before.auth_accepted(auth)
+			if auth.username == "user" and auth.password == "secret" then
+				return smtp.allow()
+			end
+			return smtp.deny(535, "Bad credentials")
+		end
+	`
+	extHost := extension.NewHost()
+	_, err := luahost.NewFromReader(
+		consoleLogger, extHost, strings.NewReader(test.LuaInit+script), "test.lua")
+	require.NoError(t, err)
+
+	got := extHost.Events.BeforeAuthAccepted.Emit(
+		&event.SMTPAuth{Mechanism: "PLAIN", Username: "user", Password: "secret"})
+	require.NotNil(t, got, "Expected result from Emit()")
+	assert.Equal(t, event.SMTPResponse{Action: event.ActionAllow}, *got)
+
+	got = extHost.Events.BeforeAuthAccepted.Emit(
+		&event.SMTPAuth{Mechanism: "PLAIN", Username: "user", Password: "wrong"})
+	require.NotNil(t, got, "Expected result from Emit()")
+	want := event.SMTPResponse{Action: event.ActionDeny, ErrorCode: 535, ErrorMsg: "Bad credentials"}
+	assert.Equal(t, want, *got)
+}
+
+func TestBeforeDataAccepted(t *testing.T) {
+	// Register lua event listener.
+	script := `
+		function inbucket.before.data_accepted(msg)
+			for _, a in ipairs(msg.attachments) do
+				if string.find(a.filename, "%.exe$") then
+					return smtp.deny(550, "Executable attachments not accepted")
+				end
+			end
+			return nil
+		end
+	`
+	extHost := extension.NewHost()
+	_, err := luahost.NewFromReader(
+		consoleLogger, extHost, strings.NewReader(test.LuaInit+script), "test.lua")
+	require.NoError(t, err)
+
+	got := extHost.Events.BeforeDataAccepted.Emit(&event.DataMessage{
+		Subject:     "clean",
+		Attachments: []event.AttachmentInfo{{FileName: "report.pdf"}},
+	})
+	assert.Nil(t, got, "Expected no result for clean message")
+
+	got = extHost.Events.BeforeDataAccepted.Emit(&event.DataMessage{
+		Subject:     "dirty",
+		Attachments: []event.AttachmentInfo{{FileName: "report.pdf"}, {FileName: "setup.exe"}},
+	})
+	require.NotNil(t, got, "Expected result from Emit()")
+	want := event.SMTPResponse{
+		Action: event.ActionDeny, ErrorCode: 550, ErrorMsg: "Executable attachments not accepted"}
+	assert.Equal(t, want, *got)
+}
+
 func TestBeforeMailFromAccepted(t *testing.T) {
 	// Register lua event listener.
 	script := `
@@ -150,6 +317,35 @@ func TestBeforeMailFromAccepted(t *testing.T) {
 	}
 }
 
+func TestBeforeMessageDeleted(t *testing.T) {
+	// Register lua event listener.
+	script := `
+		function inbucket.before.message_deleted(msg)
+			if msg.subject == "pinned" then
+				return false, "message is pinned"
+			end
+			if msg.subject == "keep" then
+				return false
+			end
+		end
+	`
+	extHost := extension.NewHost()
+	_, err := luahost.NewFromReader(
+		consoleLogger, extHost, strings.NewReader(test.LuaInit+script), "test.lua")
+	require.NoError(t, err)
+
+	got := extHost.Events.BeforeMessageDeleted.Emit(&event.MessageMetadata{Subject: "other"})
+	assert.Nil(t, got, "Expected no result for unpinned message")
+
+	got = extHost.Events.BeforeMessageDeleted.Emit(&event.MessageMetadata{Subject: "pinned"})
+	require.NotNil(t, got, "Expected result from Emit()")
+	assert.Equal(t, event.DeleteResponse{Action: event.ActionDeny, Reason: "message is pinned"}, *got)
+
+	got = extHost.Events.BeforeMessageDeleted.Emit(&event.MessageMetadata{Subject: "keep"})
+	require.NotNil(t, got, "Expected result from Emit()")
+	assert.Equal(t, event.DeleteResponse{Action: event.ActionDeny}, *got)
+}
+
 func TestBeforeMessageStored(t *testing.T) {
 	// Event to send.
 	msg := event.InboundMessage{
@@ -301,3 +497,69 @@ func TestBeforeRcptToAccepted(t *testing.T) {
 	want := event.SMTPResponse{Action: event.ActionAllow}
 	assert.Equal(t, want, *got)
 }
+
+func TestTimers(t *testing.T) {
+	script := `
+		async = true
+
+		local ticks = 0
+		inbucket.every(0.01, function()
+			ticks = ticks + 1
+			if ticks == 3 then
+				notify:send(asserts_ok)
+			end
+		end)
+
+		inbucket.after_delay("10ms", function()
+			error("errors are logged")
+		end)
+	`
+	extHost := extension.NewHost()
+	luaHost, err := luahost.NewFromReader(consoleLogger, extHost,
+		strings.NewReader(test.LuaInit+script), "test.lua")
+	require.NoError(t, err)
+	notify := luaHost.CreateChannel("notify")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		luaHost.Start(ctx)
+		close(done)
+	}()
+	test.AssertNotified(t, notify)
+
+	// Start returns once cancelled.
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Start did not return after cancel")
+	}
+}
+
+func TestBeforeHandlerLimitExceededDefers(t *testing.T) {
+	script := `
+		function inbucket.before.mail_from_accepted(session)
+			while true do end
+		end
+
+		local function recurse(n) return recurse(n + 1) + 1 end
+		function inbucket.before.rcpt_to_accepted(session)
+			recurse(1)
+		end
+	`
+	extHost := extension.NewHost()
+	luaHost, err := luahost.NewFromReader(consoleLogger, extHost,
+		strings.NewReader(test.LuaInit+script), "test.lua")
+	require.NoError(t, err)
+	luaHost.SetLimits(luahost.Limits{
+		Timeout:      50 * time.Millisecond,
+		MaxCallDepth: 50,
+		Modules:      []string{"logger"},
+	})
+
+	session := event.SMTPSession{From: &mail.Address{Address: "from@example.com"}}
+	want := &event.SMTPResponse{Action: event.ActionDefer}
+	assert.Equal(t, want, extHost.Events.BeforeMailFromAccepted.Emit(&session))
+	assert.Equal(t, want, extHost.Events.BeforeRcptToAccepted.Emit(&session))
+}
@@ -3,6 +3,7 @@ package luahost
 import (
 	"net/http"
 	"sync"
+	"sync/atomic"
 
 	"github.com/cjoudrey/gluahttp"
 	"github.com/cosmotek/loguago"
@@ -17,6 +18,9 @@ type statePool struct {
 	states    []*lua.LState              // Pool of available LStates.
 	channels  map[string]chan lua.LValue // Global interop channels.
 	logger    zerolog.Logger             // Logger exported to Lua scripts.
+	services  atomic.Pointer[Services]   // Services exported to Lua scripts.
+	limits    atomic.Pointer[Limits]     // Resource limits for Lua scripts.
+	closed    bool                       // Pool was replaced, returned states are closed.
 }
 
 func newStatePool(logger zerolog.Logger, funcProto *lua.FunctionProto) *statePool {
@@ -27,16 +31,65 @@ func newStatePool(logger zerolog.Logger, funcProto *lua.FunctionProto) *statePoo
 	}
 }
 
-// newState creates a new LState and configures it. Lock must be held.
-func (lp *statePool) newState() (*lua.LState, error) {
-	ls := lua.NewState()
+// moduleNames lists the supplemental native modules that may be made available to scripts.
+var moduleNames = []string{"http", "json", "logger", "store"}
+
+// sandboxLibs lists the standard libraries opened for scripts, io, os and debug are withheld.
+// package provides require for preloaded modules, and channel the methods of interop channels.
+var sandboxLibs = []struct {
+	name string
+	open lua.LGFunction
+}{
+	{lua.LoadLibName, lua.OpenPackage},
+	{lua.BaseLibName, lua.OpenBase},
+	{lua.TabLibName, lua.OpenTable},
+	{lua.StringLibName, lua.OpenString},
+	{lua.MathLibName, lua.OpenMath},
+	{lua.CoroutineLibName, lua.OpenCoroutine},
+	{lua.ChannelLibName, lua.OpenChannel},
+}
 
-	logger := loguago.NewLogger(lp.logger)
+// openLibs opens the sandboxed standard libraries in ls.
+func openLibs(ls *lua.LState) {
+	for _, lib := range sandboxLibs {
+		ls.Push(ls.NewFunction(lib.open))
+		ls.Push(lua.LString(lib.name))
+		ls.Call(1, 0)
+	}
 
-	// Load supplemental native modules.
-	ls.PreloadModule("http", gluahttp.NewHttpModule(&http.Client{}).Loader)
-	ls.PreloadModule("json", json.Loader)
-	ls.PreloadModule("logger", logger.Loader)
+	// Remove access to the filesystem, require may only load preloaded modules.
+	ls.SetGlobal("dofile", lua.LNil)
+	ls.SetGlobal("loadfile", lua.LNil)
+	if loaders, ok := ls.GetField(ls.Get(lua.RegistryIndex), "_LOADERS").(*lua.LTable); ok {
+		for i := loaders.Len(); i > 1; i-- {
+			loaders.RawSetInt(i, lua.LNil)
+		}
+	}
+}
+
+// newState creates a new LState and configures it. Lock must be held.
+func (lp *statePool) newState() (*lua.LState, error) {
+	limits := lp.getLimits()
+	opts := lua.Options{CallStackSize: limits.MaxCallDepth, SkipOpenLibs: true}
+	if limits.MaxStackSize > 0 {
+		opts.RegistrySize = min(lua.RegistrySize, limits.MaxStackSize)
+		opts.RegistryMaxSize = limits.MaxStackSize
+	}
+	ls := lua.NewState(opts)
+	openLibs(ls)
+
+	// Load permitted supplemental native modules.
+	modules := map[string]lua.LGFunction{
+		"http":   gluahttp.NewHttpModule(&http.Client{Timeout: limits.Timeout}).Loader,
+		"json":   json.Loader,
+		"logger": loguago.NewLogger(lp.logger).Loader,
+		"store":  storeLoader(lp.services.Load),
+	}
+	for _, name := range limits.Modules {
+		if loader, ok := modules[name]; ok {
+			ls.PreloadModule(name, loader)
+		}
+	}
 
 	// Setup channels.
 	for name, ch := range lp.channels {
@@ -44,18 +97,33 @@ func (lp *statePool) newState() (*lua.LState, error) {
 	}
 
 	// Register custom types.
+	registerAuthResultType(ls)
+	registerDataMessageType(ls)
+	registerLifecycleTypes(ls)
 	registerInboundMessageType(ls)
 	registerInbucketTypes(ls)
+	ib, err := getInbucket(ls)
+	if err != nil {
+		return nil, err
+	}
+	ib.services = lp.services.Load
+	ib.limits = lp.limits.Load
 	registerMailAddressType(ls)
 	registerMessageMetadataType(ls)
+	registerSessionInfoType(ls)
+	registerSMTPAuthType(ls)
 	registerSMTPResponseType(ls)
 	registerSMTPSessionType(ls)
 
 	// Run compiled script.
+	cancel := setCallLimits(ls, limits)
+	defer cancel()
 	ls.Push(ls.NewFunctionFromProto(lp.funcProto))
 	if err := ls.PCall(0, lua.MultRet, nil); err != nil {
+		ls.Close()
 		return nil, err
 	}
+	ib.loaded = true
 
 	return ls, nil
 }
@@ -88,9 +156,50 @@ func (lp *statePool) putState(state *lua.LState) {
 	lp.Lock()
 	defer lp.Unlock()
 
+	if lp.closed {
+		state.Close()
+		return
+	}
 	lp.states = append(lp.states, state)
 }
 
+// inherit copies the channels and services of the pool being replaced.
+func (lp *statePool) inherit(old *statePool) {
+	old.Lock()
+	defer old.Unlock()
+
+	for name, ch := range old.channels {
+		lp.channels[name] = ch
+	}
+	lp.services.Store(old.services.Load())
+}
+
+// getLimits returns the resource limits for new states, or the defaults if none were set.
+func (lp *statePool) getLimits() *Limits {
+	if l := lp.limits.Load(); l != nil {
+		return l
+	}
+	return &defaultLimits
+}
+
+// setLimits sets the resource limits for new states, and destroys any pooled states.
+func (lp *statePool) setLimits(l *Limits) {
+	lp.Lock()
+	defer lp.Unlock()
+
+	lp.limits.Store(l)
+	lp.flush()
+}
+
+// close destroys the pooled states, and any states returned later.
+func (lp *statePool) close() {
+	lp.Lock()
+	defer lp.Unlock()
+
+	lp.closed = true
+	lp.flush()
+}
+
 // createChannel creates a new channel, which will become a global variable in
 // newly created LStates.  We also destroy any pooled states.
 //
@@ -102,12 +211,15 @@ func (lp *statePool) createChannel(name string) chan lua.LValue {
 
 	ch := make(chan lua.LValue, 10)
 	lp.channels[name] = ch
+	lp.flush()
 
-	// Flush state pool.
+	return ch
+}
+
+// flush destroys the pooled states. Lock must be held.
+func (lp *statePool) flush() {
 	for _, s := range lp.states {
 		s.Close()
 	}
 	lp.states = lp.states[:0]
-
-	return ch
 }
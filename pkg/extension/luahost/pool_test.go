@@ -1,8 +1,11 @@
 package luahost
 
 import (
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
@@ -100,3 +103,105 @@ func TestPoolSetsChannels(t *testing.T) {
 	assert.Equal(t, lua.LTChannel, got.Type(),
 		"Got global type %v, wanted LTChannel", got.Type().String())
 }
+
+func TestPoolModuleAllowlist(t *testing.T) {
+	pool := makeEmptyPool()
+	pool.setLimits(&Limits{Modules: []string{"json"}})
+
+	ls, err := pool.getState()
+	require.NoError(t, err)
+	require.NoError(t, ls.DoString(`
+		assert(pcall(require, "json"), "json should be available")
+		assert(not pcall(require, "http"), "http should not be available")
+	`))
+}
+
+func TestPoolStateLimits(t *testing.T) {
+	pool := makeEmptyPool()
+	pool.setLimits(&Limits{MaxCallDepth: 50, Timeout: 50 * time.Millisecond})
+
+	ls, err := pool.getState()
+	require.NoError(t, err)
+	err = ls.DoString(`
+		local function recurse(n) return recurse(n + 1) + 1 end
+		recurse(1)
+	`)
+	require.Error(t, err)
+	assert.True(t, limitExceeded(ls, err), "want stack overflow, got: %v", err)
+
+	cancel := setCallLimits(ls, &Limits{Timeout: 50 * time.Millisecond})
+	defer cancel()
+	err = ls.DoString(`while true do end`)
+	require.Error(t, err)
+	assert.True(t, limitExceeded(ls, err), "want timeout, got: %v", err)
+}
+
+func TestPoolInstructionLimit(t *testing.T) {
+	pool := makeEmptyPool()
+	ls, err := pool.getState()
+	require.NoError(t, err)
+
+	cancel := setCallLimits(ls, &Limits{MaxInstructions: 1000})
+	err = ls.DoString(`for i = 1, 100 do end`)
+	cancel()
+	require.NoError(t, err, "short loop should fit within the limit")
+
+	cancel = setCallLimits(ls, &Limits{MaxInstructions: 1000})
+	defer cancel()
+	err = ls.DoString(`while true do end`)
+	require.Error(t, err)
+	assert.ErrorContains(t, err, errInstructionLimit.Error())
+	assert.True(t, limitExceeded(ls, err), "want instruction limit, got: %v", err)
+}
+
+func TestPoolMemoryLimit(t *testing.T) {
+	pool := makeEmptyPool()
+	ls, err := pool.getState()
+	require.NoError(t, err)
+
+	cancel := setCallLimits(ls, &Limits{MaxMemoryBytes: 8 << 20, Timeout: 10 * time.Second})
+	defer cancel()
+	err = ls.DoString(`
+		local t = {}
+		while true do table.insert(t, string.rep("x", 1024) .. #t) end
+	`)
+	require.Error(t, err)
+	assert.ErrorContains(t, err, errMemoryLimit.Error())
+	assert.True(t, limitExceeded(ls, err), "want memory limit, got: %v", err)
+}
+
+func TestPoolSandbox(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "inbucket_test_module.lua"),
+		[]byte("return {}"), 0o600))
+
+	pool := makeEmptyPool()
+	ls, err := pool.getState()
+	require.NoError(t, err)
+	ls.SetGlobal("module_dir", lua.LString(dir))
+	require.NoError(t, ls.DoString(`
+		package.path = module_dir .. "/?.lua"
+		assert(os == nil, "os should be unavailable")
+		assert(io == nil, "io should be unavailable")
+		assert(debug == nil, "debug should be unavailable")
+		assert(dofile == nil, "dofile should be unavailable")
+		assert(loadfile == nil, "loadfile should be unavailable")
+		for _, name in ipairs({"os", "io", "debug", "inbucket_test_module"}) do
+			assert(not pcall(require, name), name .. " should not be loadable")
+		end
+		assert(string.upper("ok") == "OK" and math.max(1, 2) == 2 and table.concat({"a"}) == "a")
+		assert(coroutine.wrap(function() return true end)())
+	`))
+}
+
+func TestPoolScriptTimeout(t *testing.T) {
+	chunk, err := parse.Parse(strings.NewReader("while true do end"), "loop")
+	require.NoError(t, err)
+	proto, err := lua.Compile(chunk, "loop")
+	require.NoError(t, err)
+	pool := newStatePool(zerolog.Nop(), proto)
+	pool.setLimits(&Limits{Timeout: 50 * time.Millisecond})
+
+	_, err = pool.getState()
+	assert.Error(t, err)
+}
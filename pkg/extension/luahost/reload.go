@@ -0,0 +1,106 @@
+package luahost
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Start runs the callbacks scheduled by the script until ctx is cancelled.  When the script was
+// loaded from a file, it is reloaded after the file changes or a SIGHUP is received.
+func (h *Host) Start(ctx context.Context) {
+	var hup chan os.Signal
+	var poll <-chan time.Time
+	if h.scriptPath != "" {
+		hup = make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		if h.watchInterval > 0 {
+			ticker := time.NewTicker(h.watchInterval)
+			defer ticker.Stop()
+			poll = ticker.C
+		}
+	}
+
+	for {
+		stop := h.startTimers(ctx)
+
+		// Wait for shutdown, or a reloaded script.
+		reloaded := false
+		for !reloaded {
+			select {
+			case <-ctx.Done():
+				stop()
+				return
+			case <-h.reloaded:
+				reloaded = true
+			case <-hup:
+				_ = h.Reload()
+			case <-poll:
+				if h.scriptChanged() {
+					_ = h.Reload()
+				}
+			}
+		}
+
+		// Restart timers with the new script.
+		stop()
+	}
+}
+
+// Reload compiles the script file and replaces the running script with it, re-wiring event
+// listeners.  If the new script fails to load the error is logged, and the running script remains
+// active.
+func (h *Host) Reload() error {
+	logger := h.logger.With().Str("phase", "reload").Str("path", h.scriptPath).Logger()
+	if h.scriptPath == "" {
+		return errors.New("lua script was not loaded from a file")
+	}
+
+	logger.Info().Msg("Reloading script")
+	err := h.reloadFile(logger)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to reload script, previous script remains active")
+		return err
+	}
+
+	// Notify Start to restart timers.
+	select {
+	case h.reloaded <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (h *Host) reloadFile(logger zerolog.Logger) error {
+	file, err := os.Open(h.scriptPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return h.load(logger, bufio.NewReader(file), h.scriptPath, *h.pool.Load().getLimits())
+}
+
+// scriptChanged reports whether the script file has been modified since it was last checked.
+func (h *Host) scriptChanged() bool {
+	fi, err := os.Stat(h.scriptPath)
+	if err != nil {
+		// File may be mid-replacement, check again later.
+		return false
+	}
+	if h.scriptStat != nil && fi.ModTime().Equal(h.scriptStat.ModTime()) &&
+		fi.Size() == h.scriptStat.Size() {
+		return false
+	}
+	h.scriptStat = fi
+
+	return true
+}
@@ -0,0 +1,116 @@
+package luahost_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/config"
+	"github.com/inbucket/inbucket/v3/pkg/extension"
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"github.com/inbucket/inbucket/v3/pkg/extension/luahost"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inbucket.lua")
+	writeScript(t, path, `
+		function inbucket.after.message_stored(msg)
+			notify:send("v1 stored")
+		end
+	`)
+	extHost := extension.NewHost()
+	luaHost, err := luahost.New(config.Lua{Path: path}, extHost)
+	require.NoError(t, err)
+	notify := luaHost.CreateChannel("notify")
+
+	extHost.Events.AfterMessageStored.Emit(&event.MessageMetadata{})
+	assert.Equal(t, "v1 stored", receive(t, notify))
+
+	// Previous script remains active when the new one fails to compile.
+	writeScript(t, path, `function inbucket.after.message_stored(msg)`)
+	require.Error(t, luaHost.Reload())
+	extHost.Events.AfterMessageStored.Emit(&event.MessageMetadata{})
+	assert.Equal(t, "v1 stored", receive(t, notify))
+
+	// Listeners are rewired for the new script.
+	writeScript(t, path, `
+		function inbucket.after.message_seen(msg)
+			notify:send("v2 seen")
+		end
+	`)
+	require.NoError(t, luaHost.Reload())
+	extHost.Events.AfterMessageStored.Emit(&event.MessageMetadata{})
+	extHost.Events.AfterMessageSeen.Emit(&event.MessageMetadata{})
+	assert.Equal(t, "v2 seen", receive(t, notify))
+	select {
+	case v := <-notify:
+		t.Errorf("Unexpected notification %v from removed listener", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestReloadWatchesScript(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inbucket.lua")
+	writeScript(t, path, `
+		inbucket.every(0.01, function()
+			notify:send("v1")
+		end)
+	`)
+	extHost := extension.NewHost()
+	luaHost, err := luahost.New(config.Lua{Path: path, WatchInterval: 10 * time.Millisecond}, extHost)
+	require.NoError(t, err)
+	notify := luaHost.CreateChannel("notify")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go luaHost.Start(ctx)
+	assert.Equal(t, "v1", receive(t, notify))
+
+	// Timers from the modified script replace the originals.
+	writeScript(t, path, `
+		inbucket.every(0.01, function()
+			notify:send("version 2")
+		end)
+	`)
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case v := <-notify:
+			if v.String() == "version 2" {
+				return
+			}
+		case <-deadline:
+			t.Fatal("Modified script was not loaded within timeout")
+		}
+	}
+}
+
+func TestNewRejectsUnknownModule(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inbucket.lua")
+	writeScript(t, path, "")
+	_, err := luahost.New(config.Lua{Path: path, Modules: []string{"json", "os"}}, extension.NewHost())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `"os"`)
+}
+
+func writeScript(t *testing.T, path, script string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(script), 0o600))
+}
+
+// receive returns the next value sent to notify.
+func receive(t *testing.T, notify chan lua.LValue) string {
+	t.Helper()
+	select {
+	case v := <-notify:
+		return v.String()
+	case <-time.After(2 * time.Second):
+		t.Fatal("Lua did not respond within timeout")
+	}
+	return ""
+}
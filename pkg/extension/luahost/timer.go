@@ -0,0 +1,151 @@
+package luahost
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// luaTimer is a callback scheduled by `inbucket.every` or `inbucket.after_delay`.
+type luaTimer struct {
+	interval time.Duration
+	repeat   bool
+	fn       *lua.LFunction
+}
+
+// name returns the Lua function used to schedule the timer, for logging.
+func (t *luaTimer) name() string {
+	if t.repeat {
+		return "every"
+	}
+	return "after_delay"
+}
+
+// inbucketSchedule implements `inbucket.every(duration, fn)` and
+// `inbucket.after_delay(duration, fn)`.  The duration is a number of seconds, or a Go duration
+// string such as "10m".  Timers may only be scheduled while the script is loading, as each pooled
+// LState runs the script and must register the same timers.
+func inbucketSchedule(ls *lua.LState, ib *Inbucket, repeat bool) int {
+	interval := checkDuration(ls, 1)
+	fn := ls.CheckFunction(2)
+	if ib.loaded {
+		ls.RaiseError("timers may only be scheduled while the script is loading")
+		return 0
+	}
+	ib.timers = append(ib.timers, &luaTimer{interval: interval, repeat: repeat, fn: fn})
+
+	return 0
+}
+
+// Checks there is a positive duration at stack position `pos`, else throws Lua error.
+func checkDuration(ls *lua.LState, pos int) time.Duration {
+	var d time.Duration
+	switch lv := ls.Get(pos).(type) {
+	case lua.LNumber:
+		d = time.Duration(float64(lv) * float64(time.Second))
+	case lua.LString:
+		var err error
+		if d, err = time.ParseDuration(string(lv)); err != nil {
+			ls.ArgError(pos, err.Error())
+			return 0
+		}
+	default:
+		ls.ArgError(pos, "duration expected")
+		return 0
+	}
+	if d <= 0 {
+		ls.ArgError(pos, "duration must be positive")
+		return 0
+	}
+
+	return d
+}
+
+// startTimers runs the callbacks scheduled by the current script until ctx is cancelled, or the
+// returned stop function is called.  Stop waits for running callbacks to complete.
+func (h *Host) startTimers(ctx context.Context) (stop func()) {
+	logger := h.logger.With().Str("phase", "timers").Logger()
+	pool := h.pool.Load()
+	ls, err := pool.getState()
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to get Lua state instance from pool")
+		return func() {}
+	}
+	ib, err := getInbucket(ls)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to obtain Lua inbucket object")
+		pool.putState(ls)
+		return func() {}
+	}
+	timers := make([]luaTimer, len(ib.timers))
+	for i, t := range ib.timers {
+		timers[i] = luaTimer{interval: t.interval, repeat: t.repeat}
+	}
+	pool.putState(ls)
+
+	if len(timers) > 0 {
+		logger.Info().Int("timers", len(timers)).Msg("Starting Lua timers")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	wg := &sync.WaitGroup{}
+	for i, t := range timers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.runTimer(ctx, i, t)
+		}()
+	}
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// runTimer calls the callback for timer number `index` when due, until ctx is cancelled.
+func (h *Host) runTimer(ctx context.Context, index int, t luaTimer) {
+	timer := time.NewTimer(t.interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		h.callTimer(index, t.name())
+		if !t.repeat {
+			return
+		}
+		timer.Reset(t.interval)
+	}
+}
+
+// callTimer calls the callback for timer number `index` using a pooled LState.  Errors and panics
+// are logged; a state that panicked is discarded rather than returned to the pool.
+func (h *Host) callTimer(index int, name string) {
+	logger, release, ls, ib, ok := h.prepareInbucketFuncCall(name)
+	if !ok {
+		return
+	}
+	logger = logger.With().Int("timer", index).Logger()
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error().Interface("panic", r).Msg("Lua timer callback panicked")
+			ls.Close()
+		}
+		release()
+	}()
+	if index >= len(ib.timers) {
+		logger.Error().Msg("Lua timer not registered by state")
+		return
+	}
+
+	// Call lua function.
+	logger.Debug().Msg("Calling Lua function")
+	if err := ls.CallByParam(lua.P{Fn: ib.timers[index].fn, NRet: 0, Protect: true}); err != nil {
+		logger.Error().Err(err).Msg("Failed to call Lua function")
+	}
+}
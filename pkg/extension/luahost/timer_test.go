@@ -0,0 +1,44 @@
+package luahost
+
+import (
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInbucketSchedule(t *testing.T) {
+	script := `
+		inbucket.every(1.5, function() end)
+		inbucket.after_delay("10m", function() end)
+
+		local ok, err = pcall(inbucket.every, "soon", function() end)
+		assert_eq(ok, false)
+		assert_contains(err, "invalid duration")
+		ok, err = pcall(inbucket.after_delay, 0, function() end)
+		assert_eq(ok, false)
+		assert_contains(err, "duration must be positive")
+		ok, err = pcall(inbucket.every, 1, "fn")
+		assert_eq(ok, false)
+	`
+
+	ls, _ := test.NewLuaState()
+	registerInbucketTypes(ls)
+	require.NoError(t, ls.DoString(script))
+
+	ib, err := getInbucket(ls)
+	require.NoError(t, err)
+	require.Len(t, ib.timers, 2)
+	assert.Equal(t, 1500*time.Millisecond, ib.timers[0].interval)
+	assert.True(t, ib.timers[0].repeat)
+	assert.Equal(t, 10*time.Minute, ib.timers[1].interval)
+	assert.False(t, ib.timers[1].repeat)
+
+	// Timers may not be added after the script has loaded.
+	ib.loaded = true
+	err = ls.DoString(`inbucket.every(1, function() end)`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "while the script is loading")
+}
@@ -0,0 +1,189 @@
+package rpchost
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxMessageBytes limits the size of a single JSON-RPC message received from the extension.
+const maxMessageBytes = 64 << 20
+
+var (
+	// ErrTimeout signals the extension did not reply to a request in time.
+	ErrTimeout = errors.New("extension reply timed out")
+	// ErrWriteTimeout signals the extension did not read a message in time, the connection is
+	// closed as the extension is no longer responsive.
+	ErrWriteTimeout = errors.New("extension write timed out")
+	// ErrClosed signals the connection to the extension was closed.
+	ErrClosed = errors.New("extension connection closed")
+)
+
+// request is a JSON-RPC 2.0 request, or a notification when ID is nil.
+type request struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID      *int64 `json:"id,omitempty"`
+	Method  string `json:"method"`
+	Params  any    `json:"params,omitempty"`
+}
+
+// response is a JSON-RPC 2.0 response.
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *int64          `json:"id"`
+	Result  json.RawMessage `json:"result"`
+	Error   *rpcError       `json:"error"`
+}
+
+// rpcError is a JSON-RPC 2.0 error object returned by the extension.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("extension error %d: %s", e.Code, e.Message)
+}
+
+// conn is a JSON-RPC 2.0 connection to an extension, exchanging newline delimited messages.
+type conn struct {
+	w       io.Writer
+	wsem    chan struct{} // Held while writing, serializes writes.
+	closer  func() error
+	lastID  atomic.Int64
+	mu      sync.Mutex
+	pending map[int64]chan *response // Requests awaiting a reply, by ID.
+	done    chan struct{}            // Closed once the connection can no longer be read.
+	err     error                    // Reason the connection was closed, set before done.
+}
+
+// newConn starts reading responses from r.  Requests are written to w, and closer is called by
+// close.
+func newConn(r io.Reader, w io.Writer, closer func() error) *conn {
+	c := &conn{
+		w:       w,
+		wsem:    make(chan struct{}, 1),
+		closer:  sync.OnceValue(closer),
+		pending: make(map[int64]chan *response),
+		done:    make(chan struct{}),
+	}
+	go c.read(r)
+
+	return c
+}
+
+// read dispatches responses to pending requests until r is exhausted.
+func (c *conn) read(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxMessageBytes)
+	for scanner.Scan() {
+		resp := &response{}
+		if err := json.Unmarshal(scanner.Bytes(), resp); err != nil || resp.ID == nil {
+			// Not a response; requests from the extension are not supported.
+			continue
+		}
+		c.mu.Lock()
+		ch := c.pending[*resp.ID]
+		delete(c.pending, *resp.ID)
+		c.mu.Unlock()
+		if ch != nil {
+			ch <- resp
+		}
+	}
+
+	c.err = scanner.Err()
+	if c.err == nil {
+		c.err = ErrClosed
+	}
+	close(c.done)
+}
+
+// call sends a request and waits for the result, allowing up to timeout for both.
+func (c *conn) call(method string, params any, timeout time.Duration) (json.RawMessage, error) {
+	id := c.lastID.Add(1)
+	ch := make(chan *response, 1)
+	c.mu.Lock()
+	c.pending[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	err := c.send(&request{JSONRPC: "2.0", ID: &id, Method: method, Params: params}, timer.C)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Error != nil {
+			return nil, resp.Error
+		}
+		return resp.Result, nil
+	case <-timer.C:
+		return nil, ErrTimeout
+	case <-c.done:
+		return nil, c.err
+	}
+}
+
+// notify sends a notification, which the extension does not reply to, allowing up to timeout for
+// it to be written.
+func (c *conn) notify(method string, params any, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	return c.send(&request{JSONRPC: "2.0", Method: method, Params: params}, timer.C)
+}
+
+// send writes req to the extension.  If the extension does not read it before expired fires, the
+// connection is closed, as a blocked write would otherwise stall every later request.
+func (c *conn) send(req *request, expired <-chan time.Time) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	select {
+	case c.wsem <- struct{}{}:
+	case <-expired:
+		return ErrWriteTimeout
+	case <-c.done:
+		return c.err
+	}
+	written := make(chan error, 1)
+	go func() {
+		_, err := c.w.Write(data)
+		<-c.wsem
+		written <- err
+	}()
+
+	select {
+	case err := <-written:
+		return err
+	case <-expired:
+		// Closing the connection unblocks the write.
+		_ = c.closer()
+		return ErrWriteTimeout
+	case <-c.done:
+		return c.err
+	}
+}
+
+// close closes the connection, and waits for reading to stop.
+func (c *conn) close() error {
+	err := c.closer()
+	<-c.done
+
+	return err
+}
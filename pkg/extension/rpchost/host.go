@@ -0,0 +1,313 @@
+// Package rpchost forwards extension events to an external program using JSON-RPC 2.0, allowing
+// extensions to be written in any language.
+//
+// Messages are newline delimited JSON, exchanged over the program's stdin and stdout, or a Unix
+// socket.  After connecting, Inbucket sends an `initialize` request listing the available event
+// methods; the extension may reply with `{"events": [...]}` to subscribe to a subset of them.
+// After-events are sent as notifications, before-events as requests whose result is decoded into
+// the matching response type from the event package.  A null result, error, or timeout defers
+// the decision to Inbucket.
+package rpchost
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/config"
+	"github.com/inbucket/inbucket/v3/pkg/extension"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	listenerName    = "rpc"
+	protocolVersion = 1
+	minRetryDelay   = time.Second
+	maxRetryDelay   = 30 * time.Second
+	exitTimeout     = 5 * time.Second // Time allowed for the program to exit once stdin is closed.
+)
+
+// Methods lists the JSON-RPC methods used to deliver each extension event.
+var Methods = []string{
+	"after.mailbox_purged",
+	"after.message_deleted",
+	"after.message_seen",
+	"after.message_stored",
+	"after.pop3_login",
+	"after.smtp_session_closed",
+	"before.auth_accepted",
+	"before.data_accepted",
+	"before.mail_from_accepted",
+	"before.message_deleted",
+	"before.message_stored",
+	"before.rcpt_to_accepted",
+}
+
+// initializeParams are sent with the `initialize` request.
+type initializeParams struct {
+	Version int      `json:"version"`
+	Events  []string `json:"events"` // Available event methods.
+}
+
+// initializeResult is the extension's reply to `initialize`.
+type initializeResult struct {
+	Events []string `json:"events"` // Subscribed event methods, nil for all.
+}
+
+// Host forwards extension events to an external program.
+type Host struct {
+	extHost *extension.Host
+	command []string // Program and arguments, empty if connecting to socket.
+	socket  string
+	timeout time.Duration
+	logger  zerolog.Logger
+	conn    atomic.Pointer[conn] // Nil while disconnected.
+}
+
+// New constructs a new RPC Host, returning nil if no external extension is configured.
+func New(conf config.RPC, extHost *extension.Host) (*Host, error) {
+	command := strings.Fields(conf.Command)
+	if len(command) == 0 && conf.Socket == "" {
+		return nil, nil
+	}
+	if len(command) > 0 && conf.Socket != "" {
+		return nil, errors.New("rpc command and socket may not both be configured")
+	}
+
+	return &Host{
+		extHost: extHost,
+		command: command,
+		socket:  conf.Socket,
+		timeout: conf.Timeout,
+		logger:  log.With().Str("module", "rpc").Logger(),
+	}, nil
+}
+
+// Start connects to the extension and forwards events until ctx is cancelled.  The extension is
+// restarted or reconnected if the connection fails.
+func (h *Host) Start(ctx context.Context) {
+	delay := minRetryDelay
+	for {
+		started := time.Now()
+		if err := h.serve(ctx); err != nil && ctx.Err() == nil {
+			h.logger.Error().Err(err).Msg("Extension connection failed")
+		}
+		if time.Since(started) > maxRetryDelay {
+			delay = minRetryDelay
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
+
+// serve connects to the extension, and forwards events until the connection is closed or ctx is
+// cancelled.
+func (h *Host) serve(ctx context.Context) error {
+	c, wait, err := h.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = c.close()
+		wait()
+	}()
+
+	events, err := h.initialize(c)
+	if err != nil {
+		return err
+	}
+	h.logger.Info().Strs("events", events).Msg("Extension connected")
+	h.conn.Store(c)
+	h.wire(events)
+	defer func() {
+		h.wire(nil)
+		h.conn.Store(nil)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-c.done:
+		return c.err
+	}
+}
+
+// connect starts the extension program, or dials its socket.  The returned wait function must be
+// called after the connection is closed.
+func (h *Host) connect(ctx context.Context) (c *conn, wait func(), err error) {
+	if h.socket != "" {
+		nc, err := (&net.Dialer{}).DialContext(ctx, "unix", h.socket)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newConn(nc, nc, nc.Close), func() {}, nil
+	}
+
+	cmd := exec.CommandContext(ctx, h.command[0], h.command[1:]...)
+	cmd.WaitDelay = time.Second
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	h.logger.Info().Strs("command", h.command).Int("pid", cmd.Process.Pid).Msg("Started extension")
+	go h.logOutput(stderr)
+
+	var killer *time.Timer
+	closer := func() error {
+		err := stdin.Close()
+		killer = time.AfterFunc(exitTimeout, func() { _ = cmd.Process.Kill() })
+		return err
+	}
+	wait = func() {
+		err := cmd.Wait()
+		killer.Stop()
+		if err != nil && ctx.Err() == nil {
+			h.logger.Warn().Err(err).Msg("Extension exited")
+		}
+	}
+
+	return newConn(stdout, stdin, closer), wait, nil
+}
+
+// logOutput logs each line written by the extension to r.
+func (h *Host) logOutput(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		h.logger.Info().Str("source", "stderr").Msg(scanner.Text())
+	}
+}
+
+// initialize performs the protocol handshake, returning the event methods to forward.
+func (h *Host) initialize(c *conn) ([]string, error) {
+	result, err := c.call("initialize",
+		&initializeParams{Version: protocolVersion, Events: Methods}, h.timeout)
+	var rerr *rpcError
+	if errors.As(err, &rerr) {
+		// Extension does not support initialize, forward all events.
+		return Methods, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := &initializeResult{}
+	if !isNull(result) {
+		if err := json.Unmarshal(result, res); err != nil {
+			return nil, err
+		}
+	}
+	if res.Events == nil {
+		return Methods, nil
+	}
+	for _, name := range res.Events {
+		if !slices.Contains(Methods, name) {
+			h.logger.Warn().Str("event", name).Msg("Extension subscribed to unknown event")
+		}
+	}
+
+	return res.Events, nil
+}
+
+// wire registers listeners for the subscribed event methods, and removes the others.
+func (h *Host) wire(events []string) {
+	on := func(method string) bool { return slices.Contains(events, method) }
+	ev := h.extHost.Events
+	wireAsync(h, &ev.AfterMailboxPurged, "after.mailbox_purged", on)
+	wireAsync(h, &ev.AfterMessageDeleted, "after.message_deleted", on)
+	wireAsync(h, &ev.AfterMessageSeen, "after.message_seen", on)
+	wireAsync(h, &ev.AfterMessageStored, "after.message_stored", on)
+	wireAsync(h, &ev.AfterPOP3Login, "after.pop3_login", on)
+	wireAsync(h, &ev.AfterSMTPSessionClosed, "after.smtp_session_closed", on)
+	wireSync(h, &ev.BeforeAuthAccepted, "before.auth_accepted", on)
+	wireSync(h, &ev.BeforeDataAccepted, "before.data_accepted", on)
+	wireSync(h, &ev.BeforeMailFromAccepted, "before.mail_from_accepted", on)
+	wireSync(h, &ev.BeforeMessageDeleted, "before.message_deleted", on)
+	wireSync(h, &ev.BeforeMessageStored, "before.message_stored", on)
+	wireSync(h, &ev.BeforeRcptToAccepted, "before.rcpt_to_accepted", on)
+}
+
+// wireAsync forwards after-events from broker as notifications, if method is subscribed.
+func wireAsync[E any](
+	h *Host,
+	broker *extension.AsyncEventBroker[E],
+	method string,
+	on func(string) bool,
+) {
+	if !on(method) {
+		broker.RemoveListener(listenerName)
+		return
+	}
+	broker.AddListener(listenerName, func(ev E) {
+		c := h.conn.Load()
+		if c == nil {
+			return
+		}
+		if err := c.notify(method, ev, h.timeout); err != nil {
+			h.logger.Error().Str("event", method).Err(err).Msg("Failed to send event to extension")
+		}
+	})
+}
+
+// wireSync forwards before-events from broker as requests, if method is subscribed.  Failures
+// return nil, deferring the decision to Inbucket.
+func wireSync[E, R any](
+	h *Host,
+	broker *extension.EventBroker[E, R],
+	method string,
+	on func(string) bool,
+) {
+	if !on(method) {
+		broker.RemoveListener(listenerName)
+		return
+	}
+	broker.AddListener(listenerName, func(ev E) *R {
+		c := h.conn.Load()
+		if c == nil {
+			return nil
+		}
+		logger := h.logger.With().Str("event", method).Logger()
+		result, err := c.call(method, ev, h.timeout)
+		if err != nil {
+			logger.Error().Err(err).Msg("Extension request failed, deferring to Inbucket")
+			return nil
+		}
+		if isNull(result) {
+			return nil
+		}
+		r := new(R)
+		if err := json.Unmarshal(result, r); err != nil {
+			logger.Error().Err(err).Msg("Bad response from extension")
+			return nil
+		}
+		return r
+	})
+}
+
+func isNull(result json.RawMessage) bool {
+	return len(result) == 0 || string(result) == "null"
+}
@@ -0,0 +1,220 @@
+package rpchost_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/config"
+	"github.com/inbucket/inbucket/v3/pkg/extension"
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"github.com/inbucket/inbucket/v3/pkg/extension/rpchost"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const helperEnv = "INBUCKET_RPCHOST_TEST_HELPER"
+
+func TestNewNotConfigured(t *testing.T) {
+	h, err := rpchost.New(config.RPC{}, extension.NewHost())
+	require.NoError(t, err)
+	assert.Nil(t, h)
+
+	_, err = rpchost.New(config.RPC{Command: "ext", Socket: "ext.sock"}, extension.NewHost())
+	assert.Error(t, err)
+}
+
+func TestSocketExtension(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "ext.sock")
+	ln, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+	defer ln.Close()
+	notified := make(chan string, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		fakeExtension(c, c, []string{
+			"after.message_stored",
+			"before.mail_from_accepted",
+			"before.message_stored",
+			"before.rcpt_to_accepted",
+		}, notified)
+	}()
+
+	extHost := extension.NewHost()
+	h, err := rpchost.New(config.RPC{Socket: sock, Timeout: 100 * time.Millisecond}, extHost)
+	require.NoError(t, err)
+	ctx := t.Context()
+	go h.Start(ctx)
+	awaitConnected(t, extHost)
+
+	// Unsubscribed events have no listener.
+	assert.False(t, extHost.Events.BeforeMessageDeleted.HasListeners())
+
+	// Before-event responses are applied.
+	assertRcptTo(t, extHost)
+	got := extHost.Events.BeforeMessageStored.Emit(&event.InboundMessage{Subject: "subj"})
+	require.NotNil(t, got)
+	assert.Equal(t, []string{"rpc"}, got.Mailboxes)
+	assert.Equal(t, "subj", got.Subject)
+
+	// Extension failing to reply in time defers to Inbucket.
+	start := time.Now()
+	assert.Nil(t, extHost.Events.BeforeMailFromAccepted.Emit(&event.SMTPSession{}))
+	assert.Less(t, time.Since(start), time.Second)
+
+	// After-events are sent as notifications.
+	extHost.Events.AfterMessageStored.Emit(&event.MessageMetadata{Subject: "stored"})
+	select {
+	case subject := <-notified:
+		assert.Equal(t, "stored", subject)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Extension did not receive after.message_stored")
+	}
+}
+
+func TestSocketExtensionNotReading(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "ext.sock")
+	ln, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		// Complete initialize, then stop reading.
+		line, err := bufio.NewReader(c).ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		msg := &struct{ ID *int64 }{}
+		_ = json.Unmarshal(line, msg)
+		_ = json.NewEncoder(c).Encode(map[string]any{"jsonrpc": "2.0", "id": msg.ID,
+			"result": map[string]any{"events": []string{"before.data_accepted"}}})
+		<-t.Context().Done()
+	}()
+
+	extHost := extension.NewHost()
+	h, err := rpchost.New(config.RPC{Socket: sock, Timeout: 100 * time.Millisecond}, extHost)
+	require.NoError(t, err)
+	go h.Start(t.Context())
+	deadline := time.Now().Add(5 * time.Second)
+	for !extHost.Events.BeforeDataAccepted.HasListeners() {
+		require.True(t, time.Now().Before(deadline), "Extension did not connect within timeout")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Requests larger than the socket buffer block writing; they must still defer to Inbucket.
+	msg := &event.DataMessage{Text: strings.Repeat("x", 4<<20)}
+	for range 2 {
+		start := time.Now()
+		assert.Nil(t, extHost.Events.BeforeDataAccepted.Emit(msg))
+		assert.Less(t, time.Since(start), time.Second)
+	}
+}
+
+func TestCommandExtension(t *testing.T) {
+	t.Setenv(helperEnv, "1")
+	extHost := extension.NewHost()
+	h, err := rpchost.New(config.RPC{
+		Command: os.Args[0] + " -test.run=^TestHelperExtension$",
+		Timeout: time.Second,
+	}, extHost)
+	require.NoError(t, err)
+	ctx := t.Context()
+	go h.Start(ctx)
+	awaitConnected(t, extHost)
+
+	assertRcptTo(t, extHost)
+}
+
+// TestHelperExtension is run as the extension program by TestCommandExtension.
+func TestHelperExtension(t *testing.T) {
+	if os.Getenv(helperEnv) != "1" {
+		t.Skip("only run as a helper process")
+	}
+	fakeExtension(os.Stdin, os.Stdout, nil, nil)
+	os.Exit(0)
+}
+
+func assertRcptTo(t *testing.T, extHost *extension.Host) {
+	t.Helper()
+	session := &event.SMTPSession{To: []*mail.Address{{Address: "deny@example.com"}}}
+	got := extHost.Events.BeforeRcptToAccepted.Emit(session)
+	require.NotNil(t, got)
+	assert.Equal(t, event.SMTPResponse{Action: event.ActionDeny, ErrorCode: 550, ErrorMsg: "no"}, *got)
+
+	session = &event.SMTPSession{To: []*mail.Address{{Address: "allow@example.com"}}}
+	assert.Nil(t, extHost.Events.BeforeRcptToAccepted.Emit(session))
+}
+
+func awaitConnected(t *testing.T, extHost *extension.Host) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !extHost.Events.BeforeRcptToAccepted.HasListeners() {
+		if time.Now().After(deadline) {
+			t.Fatal("Extension did not connect within timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// fakeExtension serves JSON-RPC requests read from r, replying to w.  Subscribes to all events if
+// events is nil.  The subject of after.message_stored notifications is sent to notified.
+func fakeExtension(r io.Reader, w io.Writer, events []string, notified chan<- string) {
+	type message struct {
+		ID     *int64          `json:"id"`
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+	enc := json.NewEncoder(w)
+	reply := func(id *int64, result any) {
+		_ = enc.Encode(map[string]any{"jsonrpc": "2.0", "id": id, "result": result})
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		msg := &message{}
+		if err := json.Unmarshal(scanner.Bytes(), msg); err != nil {
+			continue
+		}
+		switch msg.Method {
+		case "initialize":
+			reply(msg.ID, map[string]any{"events": events})
+		case "after.message_stored":
+			meta := &event.MessageMetadata{}
+			_ = json.Unmarshal(msg.Params, meta)
+			notified <- meta.Subject
+		case "before.mail_from_accepted":
+			// Never reply.
+		case "before.message_stored":
+			inbound := &event.InboundMessage{}
+			_ = json.Unmarshal(msg.Params, inbound)
+			inbound.Mailboxes = []string{"rpc"}
+			reply(msg.ID, inbound)
+		case "before.rcpt_to_accepted":
+			session := &event.SMTPSession{}
+			_ = json.Unmarshal(msg.Params, session)
+			if strings.HasPrefix(session.To[0].Address, "deny") {
+				reply(msg.ID, &event.SMTPResponse{Action: event.ActionDeny, ErrorCode: 550, ErrorMsg: "no"})
+			} else {
+				reply(msg.ID, nil)
+			}
+		default:
+			_ = enc.Encode(map[string]any{"jsonrpc": "2.0", "id": msg.ID,
+				"error": map[string]any{"code": -32601, "message": "method not found"}})
+		}
+	}
+}
@@ -2,14 +2,17 @@ package message
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/mail"
 	"strings"
 	"time"
 
 	"github.com/inbucket/inbucket/v3/pkg/extension"
 	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"github.com/inbucket/inbucket/v3/pkg/msgauth"
 	"github.com/inbucket/inbucket/v3/pkg/policy"
 	"github.com/inbucket/inbucket/v3/pkg/storage"
 	"github.com/jhillyerd/enmime/v2"
@@ -19,6 +22,15 @@ import (
 // recvdTimeFmt to use in generated Received header.
 const recvdTimeFmt = "Mon, 02 Jan 2006 15:04:05 -0700 (MST)"
 
+var (
+	// ErrDeleteDenied is returned when an extension denies the deletion of a message.
+	ErrDeleteDenied = errors.New("message deletion denied")
+
+	// ErrSearchUnsupported is returned by Search when the store does not implement
+	// storage.Searcher.
+	ErrSearchUnsupported = errors.New("storage does not support search")
+)
+
 // Manager is the interface controllers use to interact with messages.
 type Manager interface {
 	Deliver(
@@ -26,14 +38,24 @@ type Manager interface {
 		recipients []*policy.Recipient,
 		recvdHeader string,
 		content []byte,
+		session *event.SessionInfo,
 	) error
 	GetMetadata(mailbox string) ([]*event.MessageMetadata, error)
 	GetMessage(mailbox, id string) (*Message, error)
+	CopyMessage(mailbox, id, toMailbox string) (string, error)
+	MoveMessage(mailbox, id, toMailbox string) (string, error)
 	MarkSeen(mailbox, id string) error
 	PurgeMessages(mailbox string) error
 	RemoveMessage(mailbox, id string) error
 	SourceReader(mailbox, id string) (io.ReadCloser, error)
 	MailboxForAddress(address string) (string, error)
+	Search(q storage.Query) (messages []*event.MessageMetadata, total int64, err error)
+}
+
+// Forwarder passes delivered messages on to an upstream mail server.
+type Forwarder interface {
+	// Forward queues source for delivery to recipients, it must not block on delivery.
+	Forward(from string, recipients []string, source []byte)
 }
 
 // StoreManager is a message Manager backed by the storage.Store.
@@ -41,14 +63,20 @@ type StoreManager struct {
 	AddrPolicy *policy.Addressing
 	Store      storage.Store
 	ExtHost    *extension.Host
+	// AuthVerifier checks message authentication on delivery, nil disables verification.
+	AuthVerifier *msgauth.Verifier
+	// Forwarder receives a copy of each delivered message, nil disables forwarding.
+	Forwarder Forwarder
 }
 
-// Deliver submits a new message to the store.
+// Deliver submits a new message to the store.  session describes the SMTP session the message was
+// received on, and may be nil.
 func (s *StoreManager) Deliver(
 	from *policy.Origin,
 	recipients []*policy.Recipient,
 	recvdHeader string,
 	source []byte,
+	session *event.SessionInfo,
 ) error {
 	logger := log.With().Str("module", "message").Logger()
 
@@ -84,13 +112,16 @@ func (s *StoreManager) Deliver(
 		mailboxes = append(mailboxes, recip.Mailbox)
 	}
 
-	// Construct InboundMessage event and process through extensions.
+	// Construct InboundMessage event and process through extensions.  Extensions may modify the
+	// header in place, so they receive a copy.
+	origHeader := parseHeader(source)
 	inbound := &event.InboundMessage{
 		Mailboxes: mailboxes,
 		From:      fromAddrs[0],
 		To:        toAddrs,
 		Subject:   subject,
 		Size:      int64(len(source)),
+		Header:    cloneHeader(origHeader),
 	}
 
 	extResult := s.ExtHost.Events.BeforeMessageStored.Emit(inbound)
@@ -108,6 +139,38 @@ func (s *StoreManager) Deliver(
 		inbound = extResult
 	}
 
+	// Apply header and body changes made by extensions to the stored copy only.
+	content := source
+	if extResult != nil && (inbound.Header != nil || inbound.Body != nil) {
+		header := inbound.Header
+		if header == nil {
+			header = origHeader
+		}
+		content = rewriteSource(source, origHeader, header, inbound.Body)
+		inbound.Size = int64(len(content))
+	}
+
+	// Verify message authentication once, results are shared by all mailboxes.
+	var authResults []event.AuthResult
+	authHeader := ""
+	if s.AuthVerifier != nil {
+		env := msgauth.Envelope{MailFrom: from.Address.Address}
+		if session != nil {
+			env.RemoteIP = net.ParseIP(session.RemoteAddr)
+			env.Helo = session.Helo
+		}
+		authResults = s.AuthVerifier.Verify(source, env)
+		authServID := s.AddrPolicy.Config.SMTP.Domain
+		authHeader = msgauth.ResultsHeader(authServID, authResults)
+
+		// Remove results claiming to be ours from the stored copy, per RFC 8601 section 5.
+		content = removeFields(content, func(key, value string) bool {
+			return key == "Authentication-Results" &&
+				strings.EqualFold(msgauth.ResultsAuthServID(value), authServID)
+		})
+		inbound.Size = int64(len(content))
+	}
+
 	// Deliver to each mailbox.
 	for _, mb := range inbound.Mailboxes {
 		// Append recipient and timestamp to generated Received header.
@@ -117,14 +180,21 @@ func (s *StoreManager) Deliver(
 		logger.Debug().Str("mailbox", mb).Msg("Delivering message")
 		delivery := &Delivery{
 			Meta: event.MessageMetadata{
-				Mailbox: mb,
-				From:    inbound.From,
-				To:      inbound.To,
-				Date:    now,
-				Subject: inbound.Subject,
-				Size:    inbound.Size,
+				Mailbox:     mb,
+				From:        inbound.From,
+				To:          inbound.To,
+				Date:        now,
+				Subject:     inbound.Subject,
+				Size:        inbound.Size,
+				Session:     session,
+				AuthResults: authResults,
 			},
-			Reader: io.MultiReader(strings.NewReader(returnPath), strings.NewReader(recvd), bytes.NewReader(source)),
+			Reader: io.MultiReader(
+				strings.NewReader(returnPath),
+				strings.NewReader(authHeader),
+				strings.NewReader(recvd),
+				bytes.NewReader(content),
+			),
 		}
 		id, err := s.Store.AddMessage(delivery)
 		if err != nil {
@@ -138,6 +208,22 @@ func (s *StoreManager) Deliver(
 		s.ExtHost.Events.AfterMessageStored.Emit(&event)
 	}
 
+	// Forward the message as received, regardless of where it was stored.
+	if s.Forwarder != nil {
+		rcpts := make([]string, len(recipients))
+		for i, recip := range recipients {
+			rcpts[i] = recip.Address.Address
+		}
+		recvd := ""
+		if recvdHeader != "" {
+			recvd = fmt.Sprintf("%s  ; %s\r\n", recvdHeader, tstamp)
+		}
+		// Copy, as the queued message outlives the source buffer.
+		forward := make([]byte, 0, len(recvd)+len(source))
+		forward = append(append(forward, recvd...), source...)
+		s.Forwarder.Forward(from.Address.Address, rcpts, forward)
+	}
+
 	return nil
 }
 
@@ -173,23 +259,135 @@ func (s *StoreManager) GetMessage(mailbox, id string) (*Message, error) {
 	return &Message{MessageMetadata: *header, env: env}, nil
 }
 
+// CopyMessage stores a copy of the specified message in toMailbox, returning the ID of the copy.
+func (s *StoreManager) CopyMessage(mailbox, id, toMailbox string) (string, error) {
+	sm, err := s.Store.GetMessage(mailbox, id)
+	if err != nil {
+		return "", err
+	}
+	if sm == nil {
+		return "", storage.ErrNotExist
+	}
+	r, err := sm.Source()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	delivery := &Delivery{Meta: *MakeMetadata(sm), Reader: r}
+	delivery.Meta.Mailbox = toMailbox
+	delivery.Meta.ID = ""
+	newID, err := s.Store.AddMessage(delivery)
+	if err != nil {
+		return "", err
+	}
+
+	// Emit message stored event.
+	event := delivery.Meta
+	event.ID = newID
+	s.ExtHost.Events.AfterMessageStored.Emit(&event)
+	return newID, nil
+}
+
+// MoveMessage moves the specified message to toMailbox, returning its new ID.  The message is
+// left in place if an extension denies its deletion.
+func (s *StoreManager) MoveMessage(mailbox, id, toMailbox string) (string, error) {
+	// Check deletion is allowed before copying, so a denied move emits no events.
+	if err := s.deleteDenied(mailbox, id); err != nil {
+		return "", err
+	}
+	newID, err := s.CopyMessage(mailbox, id, toMailbox)
+	if err != nil {
+		return "", err
+	}
+	if err := s.Store.RemoveMessage(mailbox, id); err != nil {
+		// Discard the copy, so the message is not duplicated.
+		if rmErr := s.Store.RemoveMessage(toMailbox, newID); rmErr != nil {
+			log.Error().Str("module", "manager").Str("mailbox", toMailbox).Str("id", newID).
+				Err(rmErr).Msg("Failed to remove copy of unmoved message")
+		}
+		return "", err
+	}
+	return newID, nil
+}
+
 // MarkSeen marks the message as having been read.
 func (s *StoreManager) MarkSeen(mailbox, id string) error {
 	log.Debug().Str("module", "manager").Str("mailbox", mailbox).Str("id", id).
 		Msg("Marking as seen")
-	return s.Store.MarkSeen(mailbox, id)
+	sm, err := s.Store.GetMessage(mailbox, id)
+	if err != nil && err != storage.ErrNotExist {
+		return err
+	}
+	var meta *event.MessageMetadata
+	if sm != nil && !sm.Seen() {
+		// Emit event for first viewing only.
+		meta = MakeMetadata(sm)
+		meta.Seen = true
+	}
+	if err := s.Store.MarkSeen(mailbox, id); err != nil {
+		return err
+	}
+	if meta != nil {
+		s.ExtHost.Events.AfterMessageSeen.Emit(meta)
+	}
+	return nil
 }
 
-// PurgeMessages removes all messages from the specified mailbox.
+// PurgeMessages removes all messages from the specified mailbox.  Messages an extension denies
+// deletion of are retained.
 func (s *StoreManager) PurgeMessages(mailbox string) error {
-	return s.Store.PurgeMessages(mailbox)
+	messages, err := s.Store.GetMessages(mailbox)
+	if err != nil {
+		return err
+	}
+	count := 0
+	if s.ExtHost.Events.BeforeMessageDeleted.HasListeners() {
+		// Remove messages individually, to give extensions a chance to deny each deletion.
+		ids := make([]string, 0, len(messages))
+		for _, sm := range messages {
+			if DeleteDenied(s.ExtHost, MakeMetadata(sm)) == nil {
+				ids = append(ids, sm.ID())
+			}
+		}
+		for _, id := range ids {
+			if err := s.Store.RemoveMessage(mailbox, id); err != nil {
+				return err
+			}
+			count++
+		}
+	} else {
+		if err := s.Store.PurgeMessages(mailbox); err != nil {
+			return err
+		}
+		count = len(messages)
+	}
+	s.ExtHost.Events.AfterMailboxPurged.Emit(&event.MailboxPurge{Mailbox: mailbox, Count: count})
+	return nil
 }
 
-// RemoveMessage deletes the specified message.
+// RemoveMessage deletes the specified message.  Returns ErrDeleteDenied if an extension denied
+// the deletion.
 func (s *StoreManager) RemoveMessage(mailbox, id string) error {
+	if err := s.deleteDenied(mailbox, id); err != nil {
+		return err
+	}
 	return s.Store.RemoveMessage(mailbox, id)
 }
 
+// deleteDenied returns an error if the message could not be read, or an extension denies its
+// deletion.
+func (s *StoreManager) deleteDenied(mailbox, id string) error {
+	if !s.ExtHost.Events.BeforeMessageDeleted.HasListeners() {
+		return nil
+	}
+	sm, err := s.Store.GetMessage(mailbox, id)
+	if err != nil || sm == nil {
+		return err
+	}
+	return DeleteDenied(s.ExtHost, MakeMetadata(sm))
+}
+
 // SourceReader allows the stored message source to be read.
 func (s *StoreManager) SourceReader(mailbox, id string) (io.ReadCloser, error) {
 	sm, err := s.Store.GetMessage(mailbox, id)
@@ -204,16 +402,57 @@ func (s *StoreManager) MailboxForAddress(mailbox string) (string, error) {
 	return s.AddrPolicy.ExtractMailbox(mailbox)
 }
 
+// Search returns metadata for the messages matching q from all mailboxes, in delivery order, and
+// the number of matching messages ignoring q.Limit.  Returns ErrSearchUnsupported if the store
+// does not implement storage.Searcher.
+func (s *StoreManager) Search(q storage.Query) ([]*event.MessageMetadata, int64, error) {
+	searcher, ok := s.Store.(storage.Searcher)
+	if !ok {
+		return nil, 0, ErrSearchUnsupported
+	}
+	messages, err := searcher.Find(q)
+	if err != nil {
+		return nil, 0, err
+	}
+	total, err := searcher.Count(q)
+	if err != nil {
+		return nil, 0, err
+	}
+	metas := make([]*event.MessageMetadata, len(messages))
+	for i, sm := range messages {
+		metas[i] = MakeMetadata(sm)
+	}
+	return metas, total, nil
+}
+
 // MakeMetadata populates Metadata from a storage.Message.
 func MakeMetadata(m storage.Message) *event.MessageMetadata {
 	return &event.MessageMetadata{
-		Mailbox: m.Mailbox(),
-		ID:      m.ID(),
-		From:    m.From(),
-		To:      m.To(),
-		Date:    m.Date(),
-		Subject: m.Subject(),
-		Size:    m.Size(),
-		Seen:    m.Seen(),
+		Mailbox:     m.Mailbox(),
+		ID:          m.ID(),
+		From:        m.From(),
+		To:          m.To(),
+		Date:        m.Date(),
+		Subject:     m.Subject(),
+		Size:        m.Size(),
+		Seen:        m.Seen(),
+		Session:     m.Session(),
+		AuthResults: m.AuthResults(),
+	}
+}
+
+// DeleteDenied emits the BeforeMessageDeleted event, returning an error wrapping ErrDeleteDenied
+// if an extension denied deletion of the message.
+func DeleteDenied(extHost *extension.Host, meta *event.MessageMetadata) error {
+	result := extHost.Events.BeforeMessageDeleted.Emit(meta)
+	if result == nil || result.Action != event.ActionDeny {
+		return nil
+	}
+	reason := result.Reason
+	if reason == "" {
+		reason = "denied by extension"
 	}
+	log.Info().Str("module", "manager").Str("mailbox", meta.Mailbox).Str("id", meta.ID).
+		Str("reason", reason).Msg("Message deletion denied")
+	return fmt.Errorf("%w: %s", ErrDeleteDenied, reason)
 }
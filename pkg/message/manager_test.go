@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"net/mail"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -12,7 +13,11 @@ import (
 	"github.com/inbucket/inbucket/v3/pkg/extension"
 	"github.com/inbucket/inbucket/v3/pkg/extension/event"
 	"github.com/inbucket/inbucket/v3/pkg/message"
+	"github.com/inbucket/inbucket/v3/pkg/msgauth"
 	"github.com/inbucket/inbucket/v3/pkg/policy"
+	"github.com/inbucket/inbucket/v3/pkg/storage"
+	"github.com/inbucket/inbucket/v3/pkg/storage/mem"
+	"github.com/inbucket/inbucket/v3/pkg/storage/sqlite"
 	"github.com/inbucket/inbucket/v3/pkg/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -34,6 +39,7 @@ To: u1@example.com, u2@example.com
 Subject: tsub
 
 test email`),
+		nil,
 	)
 	require.NoError(t, err)
 
@@ -56,6 +62,7 @@ func TestDeliverStoresMessageNoFromHeader(t *testing.T) {
 Subject: tsub
 
 test email`),
+		nil,
 	)
 	require.NoError(t, err)
 
@@ -78,6 +85,7 @@ func TestDeliverStoresMessageNoToHeader(t *testing.T) {
 Subject: tsub
 
 test email`),
+		nil,
 	)
 	require.NoError(t, err)
 
@@ -97,6 +105,7 @@ func TestDeliverRespectsRecipientPolicy(t *testing.T) {
 		[]*policy.Recipient{recip1, recip2},
 		"Received: xyz\n",
 		[]byte("From: from@example.com\nSubject: tsub\n\ntest email"),
+		nil,
 	); err != nil {
 		t.Fatal(err)
 	}
@@ -131,6 +140,7 @@ To: u1@example.com, u3@external.com
 Subject: tsub
 
 test email`),
+		nil,
 	); err != nil {
 		t.Fatal(err)
 	}
@@ -167,6 +177,7 @@ func TestDeliverEmitsBeforeMessageStoredEventRcptTo(t *testing.T) {
 		[]*policy.Recipient{recip1, recip2},
 		"Received: xyz\n",
 		[]byte("From: from@example.com\nSubject: tsub\n\ntest email"),
+		nil,
 	); err != nil {
 		t.Fatal(err)
 	}
@@ -204,6 +215,7 @@ func TestDeliverUsesBeforeMessageStoredEventResponseMailboxes(t *testing.T) {
 		[]*policy.Recipient{recip1, recip2},
 		"Received: xyz\r\n",
 		[]byte("From: from@example.com\nSubject: tsub\n\ntest email"),
+		nil,
 	); err != nil {
 		t.Fatal(err)
 	}
@@ -238,6 +250,7 @@ func TestDeliverUsesBeforeMessageStoredEventResponseMailboxesEmpty(t *testing.T)
 		[]*policy.Recipient{recip1, recip2},
 		"Received: xyz\r\n",
 		[]byte("From: from@example.com\nSubject: tsub\n\ntest email"),
+		nil,
 	); err != nil {
 		t.Fatal(err)
 	}
@@ -278,6 +291,7 @@ func TestDeliverUsesBeforeMessageStoredEventResponseFields(t *testing.T) {
 		[]*policy.Recipient{recip1},
 		"Received: xyz\r\n",
 		[]byte("From: from@example.com\nSubject: tsub\n\ntest email"),
+		nil,
 	); err != nil {
 		t.Fatal(err)
 	}
@@ -300,6 +314,103 @@ func TestDeliverUsesBeforeMessageStoredEventResponseFields(t *testing.T) {
 	assert.NotEqual(t, 12345, got.Size, "Size is read only")
 }
 
+func TestDeliverUsesBeforeMessageStoredEventResponseHeader(t *testing.T) {
+	sm, extHost := testStoreManager()
+
+	// Register function to receive event.
+	extHost.Events.BeforeMessageStored.AddListener(
+		"test",
+		func(msg event.InboundMessage) *event.InboundMessage {
+			assert.Equal(t, []string{"tsub"}, msg.Header["Subject"])
+			assert.Equal(t, []string{"one", "two"}, msg.Header["X-Remove"])
+
+			// Replace, add and remove fields.
+			msg.Header = map[string][]string{
+				"From":       msg.Header["From"],
+				"Subject":    {"[TEST] tsub"},
+				"x-test-run": {"42"},
+				"X-Keep":     msg.Header["X-Keep"],
+			}
+			return &msg
+		})
+
+	// Deliver a message to trigger event.
+	origin, _ := sm.AddrPolicy.ParseOrigin("from@example.com")
+	recip1, _ := sm.AddrPolicy.NewRecipient("u1@example.com")
+	err := sm.Deliver(
+		origin,
+		[]*policy.Recipient{recip1},
+		"Received: xyz\r\n",
+		[]byte("From: from@example.com\r\nX-Remove: one\r\nSubject: tsub\r\nX-Keep: a\r\n b\r\n"+
+			"X-Remove: two\r\n\r\ntest email"),
+		nil,
+	)
+	require.NoError(t, err)
+
+	want := "From: from@example.com\r\nSubject: [TEST] tsub\r\nX-Keep: a\r\n b\r\n" +
+		"X-Test-Run: 42\r\n\r\ntest email"
+	got := readOnlySource(t, sm, "u1@example.com")
+	assert.True(t, strings.HasSuffix(got, "\r\n"+want), "got source:\n%s", got)
+}
+
+func TestDeliverUsesBeforeMessageStoredEventHeaderModifiedInPlace(t *testing.T) {
+	sm, extHost := testStoreManager()
+
+	// Register function to receive event.
+	extHost.Events.BeforeMessageStored.AddListener(
+		"test",
+		func(msg event.InboundMessage) *event.InboundMessage {
+			msg.Header["Subject"][0] = "[TEST] tsub"
+			msg.Header["X-Test-Run"] = []string{"42"}
+			return &msg
+		})
+
+	// Deliver a message to trigger event.
+	origin, _ := sm.AddrPolicy.ParseOrigin("from@example.com")
+	recip1, _ := sm.AddrPolicy.NewRecipient("u1@example.com")
+	err := sm.Deliver(
+		origin,
+		[]*policy.Recipient{recip1},
+		"Received: xyz\r\n",
+		[]byte("From: from@example.com\r\nSubject: tsub\r\n\r\ntest email"),
+		nil,
+	)
+	require.NoError(t, err)
+
+	want := "From: from@example.com\r\nSubject: [TEST] tsub\r\nX-Test-Run: 42\r\n\r\ntest email"
+	got := readOnlySource(t, sm, "u1@example.com")
+	assert.True(t, strings.HasSuffix(got, "\r\n"+want), "got source:\n%s", got)
+}
+
+func TestDeliverUsesBeforeMessageStoredEventResponseBody(t *testing.T) {
+	sm, extHost := testStoreManager()
+
+	// Register function to receive event.
+	extHost.Events.BeforeMessageStored.AddListener(
+		"test",
+		func(msg event.InboundMessage) *event.InboundMessage {
+			msg.Body = []byte("replaced body\n")
+			return &msg
+		})
+
+	// Deliver a message to trigger event.
+	origin, _ := sm.AddrPolicy.ParseOrigin("from@example.com")
+	recip1, _ := sm.AddrPolicy.NewRecipient("u1@example.com")
+	err := sm.Deliver(
+		origin,
+		[]*policy.Recipient{recip1},
+		"Received: xyz\n",
+		[]byte("From: from@example.com\nSubject: tsub\n\ntest email"),
+		nil,
+	)
+	require.NoError(t, err)
+
+	got := readOnlySource(t, sm, "u1@example.com")
+	want := "From: from@example.com\nSubject: tsub\n\nreplaced body\n"
+	assert.True(t, strings.HasSuffix(got, "\n"+want), "got source:\n%s", got)
+	assert.NotContains(t, got, "test email")
+}
+
 func TestDeliverEmitsAfterMessageStoredEvent(t *testing.T) {
 	sm, extHost := testStoreManager()
 
@@ -313,6 +424,7 @@ func TestDeliverEmitsAfterMessageStoredEvent(t *testing.T) {
 		[]*policy.Recipient{recip},
 		"Received: xyz\n",
 		[]byte("From: from@example.com\nSubject: events\n\ntest email."),
+		nil,
 	); err != nil {
 		t.Fatal(err)
 	}
@@ -359,6 +471,7 @@ func TestDeliverBeforeAndAfterMessageStoredEvents(t *testing.T) {
 		[]*policy.Recipient{recip1, recip2},
 		"Received: xyz\r\n",
 		[]byte("From: from@example.com\nSubject: tsub\n\ntest email"),
+		nil,
 	); err != nil {
 		t.Fatal(err)
 	}
@@ -457,6 +570,142 @@ func TestPurgeMessages(t *testing.T) {
 	assert.Empty(t, got, "Purge should remove all mailbox messages")
 }
 
+func TestMarkSeenEmitsAfterMessageSeenEvent(t *testing.T) {
+	sm, extHost := testMemStoreManager(t)
+	listener := extHost.Events.AfterMessageSeen.AsyncTestListener("manager", 1)
+
+	id := addTestMessage(sm, "seen-box", "subject 1")
+	require.NoError(t, sm.MarkSeen("seen-box", id))
+
+	got, err := listener()
+	require.NoError(t, err)
+	assert.Equal(t, "seen-box", got.Mailbox)
+	assert.Equal(t, id, got.ID)
+	assert.Equal(t, "subject 1", got.Subject)
+	assert.True(t, got.Seen)
+}
+
+func TestRemoveMessageDeniedByBeforeMessageDeletedEvent(t *testing.T) {
+	sm, extHost := testMemStoreManager(t)
+	extHost.Events.BeforeMessageDeleted.AddListener("test",
+		func(msg event.MessageMetadata) *event.DeleteResponse {
+			if msg.Subject == "pinned" {
+				return &event.DeleteResponse{Action: event.ActionDeny, Reason: "pinned"}
+			}
+			return nil
+		})
+
+	id1 := addTestMessage(sm, "rm-box", "pinned")
+	id2 := addTestMessage(sm, "rm-box", "other")
+
+	err := sm.RemoveMessage("rm-box", id1)
+	require.ErrorIs(t, err, message.ErrDeleteDenied)
+	assert.Contains(t, err.Error(), "pinned")
+	require.NoError(t, sm.RemoveMessage("rm-box", id2))
+
+	got, err := sm.GetMetadata("rm-box")
+	require.NoError(t, err)
+	require.Len(t, got, 1, "Should be 1 message remaining")
+	assert.Equal(t, id1, got[0].ID)
+}
+
+func TestPurgeMessagesEmitsAfterMailboxPurgedEvent(t *testing.T) {
+	sm, extHost := testMemStoreManager(t)
+	listener := extHost.Events.AfterMailboxPurged.AsyncTestListener("manager", 1)
+	extHost.Events.BeforeMessageDeleted.AddListener("test",
+		func(msg event.MessageMetadata) *event.DeleteResponse {
+			if msg.Subject == "pinned" {
+				return &event.DeleteResponse{Action: event.ActionDeny}
+			}
+			return nil
+		})
+
+	_ = addTestMessage(sm, "purge-box", "subject 1")
+	_ = addTestMessage(sm, "purge-box", "pinned")
+	_ = addTestMessage(sm, "purge-box", "subject 3")
+	require.NoError(t, sm.PurgeMessages("purge-box"))
+
+	got, err := listener()
+	require.NoError(t, err)
+	assert.Equal(t, &event.MailboxPurge{Mailbox: "purge-box", Count: 2}, got)
+
+	remaining, err := sm.GetMetadata("purge-box")
+	require.NoError(t, err)
+	require.Len(t, remaining, 1, "Pinned message should be retained")
+	assert.Equal(t, "pinned", remaining[0].Subject)
+}
+
+func TestCopyMessage(t *testing.T) {
+	sm, extHost := testMemStoreManager(t)
+	listener := extHost.Events.AfterMessageStored.AsyncTestListener("manager", 1)
+
+	id := addTestMessage(sm, "src-box", "copied")
+	newID, err := sm.CopyMessage("src-box", id, "dest-box")
+	require.NoError(t, err)
+
+	got, err := listener()
+	require.NoError(t, err)
+	assert.Equal(t, "dest-box", got.Mailbox)
+	assert.Equal(t, newID, got.ID)
+
+	src, err := sm.GetMetadata("src-box")
+	require.NoError(t, err)
+	assert.Len(t, src, 1, "Source message should remain")
+	msg, err := sm.GetMessage("dest-box", newID)
+	require.NoError(t, err)
+	assert.Equal(t, "copied", msg.Subject)
+	assert.Contains(t, msg.Text(), "Test message about")
+
+	_, err = sm.CopyMessage("src-box", "missing", "dest-box")
+	assert.Error(t, err)
+}
+
+func TestMoveMessage(t *testing.T) {
+	sm, extHost := testMemStoreManager(t)
+	extHost.Events.BeforeMessageDeleted.AddListener("test",
+		func(msg event.MessageMetadata) *event.DeleteResponse {
+			if msg.Subject == "pinned" {
+				return &event.DeleteResponse{Action: event.ActionDeny}
+			}
+			return nil
+		})
+	stored := make(chan event.MessageMetadata, 10)
+	extHost.Events.AfterMessageStored.AddListener("test", func(msg event.MessageMetadata) {
+		stored <- msg
+	})
+
+	id := addTestMessage(sm, "src-box", "moved")
+	newID, err := sm.MoveMessage("src-box", id, "dest-box")
+	require.NoError(t, err)
+	msg, err := sm.GetMessage("dest-box", newID)
+	require.NoError(t, err)
+	assert.Equal(t, "moved", msg.Subject)
+	select {
+	case got := <-stored:
+		assert.Equal(t, newID, got.ID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for AfterMessageStored event")
+	}
+
+	// A message that may not be deleted is not moved, or copied.
+	pinned := addTestMessage(sm, "src-box", "pinned")
+	_, err = sm.MoveMessage("src-box", pinned, "dest-box")
+	require.ErrorIs(t, err, message.ErrDeleteDenied)
+	select {
+	case got := <-stored:
+		t.Errorf("Unexpected AfterMessageStored event for denied move: %+v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	src, err := sm.GetMetadata("src-box")
+	require.NoError(t, err)
+	require.Len(t, src, 1)
+	assert.Equal(t, pinned, src[0].ID)
+	dest, err := sm.GetMetadata("dest-box")
+	require.NoError(t, err)
+	assert.Len(t, dest, 1, "Copy of unmoved message should be removed")
+}
+
 func TestSourceReader(t *testing.T) {
 	sm, _ := testStoreManager()
 
@@ -470,7 +719,7 @@ test email`
 	// Deliver mesage.
 	origin, _ := sm.AddrPolicy.ParseOrigin("from@example.com")
 	recip1, _ := sm.AddrPolicy.NewRecipient("u1@example.com")
-	err := sm.Deliver(origin, []*policy.Recipient{recip1}, recvdHeader, []byte(msgSource))
+	err := sm.Deliver(origin, []*policy.Recipient{recip1}, recvdHeader, []byte(msgSource), nil)
 	require.NoError(t, err)
 
 	// Find message ID.
@@ -501,6 +750,35 @@ func TestMailboxForAddress(t *testing.T) {
 	assert.Equal(t, addr, got, "FullNaming mode should return a full address for mailbox")
 }
 
+func TestSearch(t *testing.T) {
+	sm, extHost := testStoreManager()
+	_, _, err := sm.Search(storage.Query{})
+	require.ErrorIs(t, err, message.ErrSearchUnsupported)
+
+	store, err := sqlite.New(config.Storage{
+		Params: map[string]string{"path": filepath.Join(t.TempDir(), "inbucket.db")},
+	}, extHost)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = store.(*sqlite.Store).Close() })
+	sm.Store = store
+	addTestMessage(sm, "box1", "report one")
+	addTestMessage(sm, "box2", "other")
+	id := addTestMessage(sm, "box2", "report two")
+
+	got, total, err := sm.Search(storage.Query{Subject: "report", Limit: 1})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), total)
+	require.Len(t, got, 1)
+	assert.Equal(t, "box1", got[0].Mailbox)
+
+	got, total, err = sm.Search(storage.Query{Mailbox: "box2", To: "To Test <to@"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), total)
+	require.Len(t, got, 2)
+	assert.Equal(t, id, got[1].ID)
+	assert.Equal(t, "report two", got[1].Subject)
+}
+
 func TestReturnPath(t *testing.T) {
 	sm, _ := testStoreManager()
 
@@ -514,7 +792,7 @@ test email`
 	// Deliver message.
 	origin, _ := sm.AddrPolicy.ParseOrigin("821from@example.com")
 	recipient, _ := sm.AddrPolicy.NewRecipient("u1@example.com")
-	err := sm.Deliver(origin, []*policy.Recipient{recipient}, recvdHeader, []byte(msgSource))
+	err := sm.Deliver(origin, []*policy.Recipient{recipient}, recvdHeader, []byte(msgSource), nil)
 	require.NoError(t, err)
 
 	// Find message ID.
@@ -533,6 +811,150 @@ test email`
 	assert.Contains(t, got, "Return-Path: <821from@example.com>\r\n", "Source should contain return-path")
 }
 
+func TestDeliverRecordsAuthResults(t *testing.T) {
+	sm, extHost := testStoreManager()
+	sm.AuthVerifier = &msgauth.Verifier{Resolver: msgauth.StaticResolver{}, DKIM: true}
+
+	listener := extHost.Events.AfterMessageStored.AsyncTestListener("manager", 1)
+
+	// Body hash is checked before the key is looked up.
+	msgSource := "DKIM-Signature: v=1; a=ed25519-sha256; d=example.com; s=sel; h=from;\n" +
+		" bh=AA==; b=AA==\nFrom: from@example.com\nTo: u1@example.com\n\ntest email\n"
+	origin, _ := sm.AddrPolicy.ParseOrigin("from@example.com")
+	recipient, _ := sm.AddrPolicy.NewRecipient("u1@example.com")
+	err := sm.Deliver(origin, []*policy.Recipient{recipient}, "Received: xyz\n", []byte(msgSource), nil)
+	require.NoError(t, err)
+
+	want := []event.AuthResult{{
+		Method:   "dkim",
+		Result:   "fail",
+		Domain:   "example.com",
+		Selector: "sel",
+		Reason:   "body hash did not verify",
+	}}
+	got, err := listener()
+	require.NoError(t, err)
+	require.NotNil(t, got, "No event received, or it was nil")
+	assert.Equal(t, want, got.AuthResults)
+
+	msgs, err := sm.GetMetadata("u1@example.com")
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, want, msgs[0].AuthResults)
+}
+
+func TestDeliverAddsAuthenticationResults(t *testing.T) {
+	sm, _ := testStoreManager()
+	sm.AddrPolicy.Config.SMTP.Domain = "inbucket.test"
+	zone, err := msgauth.ParseZone(strings.NewReader(
+		`example.com. IN TXT "v=spf1 ip4:192.0.2.0/24 -all"`), "")
+	require.NoError(t, err)
+	sm.AuthVerifier = &msgauth.Verifier{Resolver: zone, SPF: true}
+
+	msgSource := "From: from@example.com\nTo: u1@example.com\n\ntest email\n"
+	origin, _ := sm.AddrPolicy.ParseOrigin("from@example.com")
+	recipient, _ := sm.AddrPolicy.NewRecipient("u1@example.com")
+	session := &event.SessionInfo{RemoteAddr: "192.0.2.1", Helo: "client.example.com"}
+	err = sm.Deliver(origin, []*policy.Recipient{recipient}, "Received: xyz", []byte(msgSource), session)
+	require.NoError(t, err)
+
+	msgs, err := sm.GetMetadata("u1@example.com")
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	r, err := sm.SourceReader("u1@example.com", msgs[0].ID)
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+
+	want := "Return-Path: <from@example.com>\r\n" +
+		"Authentication-Results: inbucket.test;\r\n" +
+		"\tspf=pass smtp.mailfrom=example.com\r\n" +
+		"Received: xyz  for <u1@example.com>; "
+	assert.True(t, strings.HasPrefix(string(got), want), "got source:\n%s", got)
+}
+
+func TestDeliverRemovesForgedAuthenticationResults(t *testing.T) {
+	sm, _ := testStoreManager()
+	sm.AddrPolicy.Config.SMTP.Domain = "inbucket.test"
+	sm.AuthVerifier = &msgauth.Verifier{Resolver: msgauth.StaticResolver{}, SPF: true}
+
+	msgSource := "Authentication-Results: INBUCKET.test;\n\tdkim=pass header.d=example.com\n" +
+		"Authentication-Results: mx.example.com; dkim=pass header.d=example.com\n" +
+		"From: from@example.com\nTo: u1@example.com\n\ntest email\n"
+	origin, _ := sm.AddrPolicy.ParseOrigin("from@example.com")
+	recipient, _ := sm.AddrPolicy.NewRecipient("u1@example.com")
+	err := sm.Deliver(origin, []*policy.Recipient{recipient}, "Received: xyz", []byte(msgSource), nil)
+	require.NoError(t, err)
+
+	msgs, err := sm.GetMetadata("u1@example.com")
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	r, err := sm.SourceReader("u1@example.com", msgs[0].ID)
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+
+	// Our own results remain, along with those from other servers.
+	assert.Equal(t, 1, strings.Count(string(got), "Authentication-Results: inbucket.test;"))
+	assert.NotContains(t, string(got), "INBUCKET.test")
+	assert.Contains(t, string(got),
+		"\r\nAuthentication-Results: mx.example.com; dkim=pass header.d=example.com\nFrom:")
+}
+
+func TestRemoveLocalFields(t *testing.T) {
+	source := "Return-Path: <from@example.com>\r\n" +
+		"Authentication-Results: inbucket.test;\r\n\tspf=pass smtp.mailfrom=example.com\r\n" +
+		"Received: xyz\r\n" +
+		"Authentication-Results: mx.example.com; dkim=pass header.d=example.com\r\n" +
+		"Subject: Return-Path: <x@example.com>\r\n\r\nReturn-Path: <body@example.com>\r\n"
+	want := "Received: xyz\r\n" +
+		"Authentication-Results: mx.example.com; dkim=pass header.d=example.com\r\n" +
+		"Subject: Return-Path: <x@example.com>\r\n\r\nReturn-Path: <body@example.com>\r\n"
+	got := message.RemoveLocalFields([]byte(source), "INBUCKET.test")
+	assert.Equal(t, want, string(got))
+}
+
+func TestDeliverForwards(t *testing.T) {
+	sm, _ := testStoreManager()
+	fwd := &forwarderStub{}
+	sm.Forwarder = fwd
+
+	// Forwarding includes recipients that are not stored.
+	msgSource := "From: from@example.com\r\nTo: u1@example.com\r\n\r\ntest email\r\n"
+	origin, _ := sm.AddrPolicy.ParseOrigin("from@example.com")
+	recip1, _ := sm.AddrPolicy.NewRecipient("u1@example.com")
+	recip2, _ := sm.AddrPolicy.NewRecipient("u2@nostore.com")
+	err := sm.Deliver(origin, []*policy.Recipient{recip1, recip2}, "Received: xyz\r\n",
+		[]byte(msgSource), nil)
+	require.NoError(t, err)
+	assertMessageCount(t, sm, "u1@example.com", 1)
+	assertMessageCount(t, sm, "u2@nostore.com", 0)
+
+	require.Len(t, fwd.calls, 1)
+	got := fwd.calls[0]
+	assert.Equal(t, "from@example.com", got.from)
+	assert.Equal(t, []string{"u1@example.com", "u2@nostore.com"}, got.recipients)
+	assert.True(t, strings.HasPrefix(string(got.source), "Received: xyz\r\n  ; "),
+		"got source:\n%s", got.source)
+	assert.True(t, strings.HasSuffix(string(got.source), "\r\n"+msgSource),
+		"got source:\n%s", got.source)
+}
+
+// forwarderStub records calls to Forward.
+type forwarderStub struct {
+	calls []forwardCall
+}
+
+type forwardCall struct {
+	from       string
+	recipients []string
+	source     []byte
+}
+
+func (f *forwarderStub) Forward(from string, recipients []string, source []byte) {
+	f.calls = append(f.calls, forwardCall{from, recipients, source})
+}
+
 // Returns an empty StoreManager and extension Host pair, configured for testing.
 func testStoreManager() (*message.StoreManager, *extension.Host) {
 	extHost := extension.NewHost()
@@ -556,6 +978,16 @@ func testStoreManager() (*message.StoreManager, *extension.Host) {
 	return sm, extHost
 }
 
+// testMemStoreManager returns a StoreManager backed by a mem store, which assigns message IDs.
+func testMemStoreManager(t *testing.T) (*message.StoreManager, *extension.Host) {
+	t.Helper()
+	sm, extHost := testStoreManager()
+	store, err := mem.New(config.Storage{}, extHost)
+	require.NoError(t, err)
+	sm.Store = store
+	return sm, extHost
+}
+
 // Adds a test message to the provided store, returning the new message ID.
 func addTestMessage(sm *message.StoreManager, mailbox string, subject string) string {
 	from := mail.Address{Name: "From Test", Address: "from@example.com"}
@@ -593,3 +1025,17 @@ func assertMessageCount(t *testing.T, sm *message.StoreManager, mailbox string,
 		t.Errorf("Mailbox %q got %v messages, wanted %v", mailbox, got, count)
 	}
 }
+
+// readOnlySource returns the source of the only message in mailbox.
+func readOnlySource(t *testing.T, sm *message.StoreManager, mailbox string) string {
+	t.Helper()
+	msgs, err := sm.GetMetadata(mailbox)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1, "mailbox has incorrect # of messages")
+	r, err := sm.SourceReader(mailbox, msgs[0].ID)
+	require.NoError(t, err)
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(b)
+}
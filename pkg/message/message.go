@@ -105,3 +105,13 @@ func (d *Delivery) Source() (io.ReadCloser, error) {
 func (d *Delivery) Seen() bool {
 	return d.Meta.Seen
 }
+
+// Session getter.
+func (d *Delivery) Session() *event.SessionInfo {
+	return d.Meta.Session
+}
+
+// AuthResults getter.
+func (d *Delivery) AuthResults() []event.AuthResult {
+	return d.Meta.AuthResults
+}
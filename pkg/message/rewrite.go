@@ -0,0 +1,183 @@
+package message
+
+import (
+	"bytes"
+	"mime"
+	"net/textproto"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/inbucket/inbucket/v3/pkg/msgauth"
+)
+
+// headerField is a single, possibly folded, field from a raw message header.
+type headerField struct {
+	key   string // Canonical field name.
+	value string // Unfolded field value.
+	raw   []byte // Complete field including continuation lines and line endings.
+}
+
+// splitHeader parses the header fields from source, returning them along with the remainder of
+// the message, which begins with the blank line separating the header from the body.
+func splitHeader(source []byte) (fields []headerField, rest []byte) {
+	pos := 0
+	for pos < len(source) {
+		end := bytes.IndexByte(source[pos:], '\n')
+		if end < 0 {
+			end = len(source)
+		} else {
+			end += pos + 1
+		}
+		line := source[pos:end]
+		text := strings.TrimRight(string(line), "\r\n")
+		switch {
+		case text == "":
+			// Blank line, the body follows.
+			return fields, source[pos:]
+		case (text[0] == ' ' || text[0] == '\t') && len(fields) > 0:
+			// Continuation of the previous field.
+			f := &fields[len(fields)-1]
+			f.value += text
+			f.raw = source[pos-len(f.raw) : end]
+		default:
+			colon := strings.IndexByte(text, ':')
+			if colon <= 0 {
+				// Not a header field, treat the remainder as body.
+				return fields, source[pos:]
+			}
+			fields = append(fields, headerField{
+				key:   textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(text[:colon])),
+				value: text[colon+1:],
+				raw:   line,
+			})
+		}
+		pos = end
+	}
+	return fields, nil
+}
+
+// parseHeader returns the header fields of source keyed by canonical field name.
+func parseHeader(source []byte) map[string][]string {
+	fields, _ := splitHeader(source)
+	header := make(map[string][]string, len(fields))
+	for _, f := range fields {
+		header[f.key] = append(header[f.key], strings.TrimSpace(f.value))
+	}
+	return header
+}
+
+// cloneHeader returns a deep copy of header.
+func cloneHeader(header map[string][]string) map[string][]string {
+	clone := make(map[string][]string, len(header))
+	for k, vs := range header {
+		clone[k] = slices.Clone(vs)
+	}
+	return clone
+}
+
+// removeFields returns source without the header fields matched by drop, which is passed the
+// canonical field name and unfolded value.
+func removeFields(source []byte, drop func(key, value string) bool) []byte {
+	fields, rest := splitHeader(source)
+	if !slices.ContainsFunc(fields, func(f headerField) bool { return drop(f.key, f.value) }) {
+		return source
+	}
+	buf := &bytes.Buffer{}
+	buf.Grow(len(source))
+	for _, f := range fields {
+		if !drop(f.key, f.value) {
+			buf.Write(f.raw)
+		}
+	}
+	buf.Write(rest)
+	return buf.Bytes()
+}
+
+// RemoveLocalFields returns source without the Return-Path field, and the Authentication-Results
+// fields reporting on behalf of authServID, that Deliver prepends to stored messages.  This
+// restores the header of a stored message as received, so that it may be sent on.
+func RemoveLocalFields(source []byte, authServID string) []byte {
+	return removeFields(source, func(key, value string) bool {
+		return key == "Return-Path" || key == "Authentication-Results" &&
+			strings.EqualFold(msgauth.ResultsAuthServID(value), authServID)
+	})
+}
+
+// rewriteSource applies the differences between the orig and header field maps to source, and
+// replaces the body if body is non-nil.  Replaced fields keep the position of their first
+// occurrence, new fields are appended to the header.
+func rewriteSource(source []byte, orig, header map[string][]string, body []byte) []byte {
+	// Determine which fields changed, allowing for non-canonical names in header.
+	want := make(map[string][]string, len(header))
+	for k, vs := range header {
+		k = textproto.CanonicalMIMEHeaderKey(k)
+		want[k] = append(want[k], vs...)
+	}
+	changed := make(map[string]bool)
+	for k, vs := range want {
+		if !slices.Equal(orig[k], vs) {
+			changed[k] = true
+		}
+	}
+	for k := range orig {
+		if _, ok := want[k]; !ok {
+			changed[k] = true
+		}
+	}
+	if len(changed) == 0 && body == nil {
+		return source
+	}
+
+	fields, rest := splitHeader(source)
+	eol := "\r\n"
+	if len(fields) > 0 && !bytes.HasSuffix(fields[0].raw, []byte("\r\n")) {
+		eol = "\n"
+	}
+	buf := &bytes.Buffer{}
+	buf.Grow(len(source) + len(body))
+	written := make(map[string]bool, len(changed))
+	writeField := func(key string) {
+		for _, v := range want[key] {
+			buf.WriteString(key + ": " + encodeHeaderValue(v) + eol)
+		}
+		written[key] = true
+	}
+	for _, f := range fields {
+		switch {
+		case !changed[f.key]:
+			buf.Write(f.raw)
+		case !written[f.key]:
+			writeField(f.key)
+		}
+	}
+	// Fields not present in the original header.
+	added := make([]string, 0, len(changed))
+	for k := range changed {
+		if !written[k] {
+			added = append(added, k)
+		}
+	}
+	sort.Strings(added)
+	for _, k := range added {
+		writeField(k)
+	}
+
+	if body != nil {
+		buf.WriteString(eol)
+		buf.Write(body)
+	} else {
+		buf.Write(rest)
+	}
+	return buf.Bytes()
+}
+
+// encodeHeaderValue RFC 2047 encodes values containing non-ASCII characters.
+func encodeHeaderValue(v string) string {
+	for i := 0; i < len(v); i++ {
+		if v[i] >= 0x80 {
+			return mime.QEncoding.Encode("utf-8", v)
+		}
+	}
+	return v
+}
@@ -0,0 +1,400 @@
+package msgauth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+)
+
+// MethodDKIM identifies DKIM results.
+const MethodDKIM = "dkim"
+
+// maxSignatures limits the number of DKIM signatures verified per message.
+const maxSignatures = 10
+
+// minRSABits is the smallest RSA key accepted, RFC 8301.
+const minRSABits = 1024
+
+// sigBValueRegex matches the value of the b= tag, but not bh=, in a DKIM-Signature.
+var sigBValueRegex = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+
+// headerField is a raw header field, including any folding and the trailing CRLF.
+type headerField struct {
+	name string // Lower case field name.
+	raw  string
+}
+
+// verifyDKIM checks each DKIM-Signature in the message, returning one result per signature.
+func verifyDKIM(ctx context.Context, resolver Resolver, source []byte, now time.Time) []event.AuthResult {
+	header, body := splitMessage(toCRLF(source))
+	fields := parseHeader(header)
+	var results []event.AuthResult
+	for _, field := range fields {
+		if field.name != "dkim-signature" {
+			continue
+		}
+		if len(results) == maxSignatures {
+			break
+		}
+		result := event.AuthResult{Method: MethodDKIM, Result: ResultPass}
+		sig, err := parseSignature(field.raw)
+		if sig != nil {
+			result.Domain = sig.domain
+			result.Selector = sig.selector
+		}
+		if err == nil {
+			err = sig.verify(ctx, resolver, fields, body, now)
+		}
+		if err != nil {
+			setError(&result, err)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// signature holds the parsed tags of a DKIM-Signature header.
+type signature struct {
+	raw        string   // The original header field.
+	algorithm  string   // a= tag, ex: rsa-sha256.
+	sig        []byte   // b= tag.
+	bodyHash   []byte   // bh= tag.
+	headerC    string   // Header canonicalization, simple or relaxed.
+	bodyC      string   // Body canonicalization, simple or relaxed.
+	domain     string   // d= tag.
+	headers    []string // h= tag, lower cased.
+	bodyLength int64    // l= tag, -1 if not present.
+	selector   string   // s= tag.
+	expires    int64    // x= tag, 0 if not present.
+}
+
+// parseSignature parses a raw DKIM-Signature header field.  A partially populated signature may
+// be returned with an error, to allow the domain and selector to be reported.
+func parseSignature(raw string) (*signature, error) {
+	_, value, _ := strings.Cut(raw, ":")
+	tags, err := parseTags(value)
+	if err != nil {
+		return nil, permErr("malformed signature: %v", err)
+	}
+	sig := &signature{
+		raw:        raw,
+		domain:     strings.ToLower(tags["d"]),
+		selector:   tags["s"],
+		bodyLength: -1,
+	}
+	for _, required := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if tags[required] == "" {
+			return sig, permErr("signature missing required tag %s=", required)
+		}
+	}
+	if tags["v"] != "1" {
+		return sig, permErr("unsupported signature version %q", tags["v"])
+	}
+	sig.algorithm = strings.ToLower(tags["a"])
+	if sig.algorithm != "rsa-sha256" && sig.algorithm != "ed25519-sha256" {
+		return sig, permErr("unsupported algorithm %q", tags["a"])
+	}
+	if sig.sig, err = base64.StdEncoding.DecodeString(stripSpace(tags["b"])); err != nil {
+		return sig, permErr("malformed b= tag")
+	}
+	if sig.bodyHash, err = base64.StdEncoding.DecodeString(stripSpace(tags["bh"])); err != nil {
+		return sig, permErr("malformed bh= tag")
+	}
+	sig.headerC, sig.bodyC = "simple", "simple"
+	if c := strings.ToLower(tags["c"]); c != "" {
+		hc, bc, found := strings.Cut(c, "/")
+		sig.headerC = hc
+		if found {
+			sig.bodyC = bc
+		}
+	}
+	for _, c := range []string{sig.headerC, sig.bodyC} {
+		if c != "simple" && c != "relaxed" {
+			return sig, permErr("unsupported canonicalization %q", tags["c"])
+		}
+	}
+	for _, h := range strings.Split(tags["h"], ":") {
+		sig.headers = append(sig.headers, strings.ToLower(strings.TrimSpace(h)))
+	}
+	hasFrom := false
+	for _, h := range sig.headers {
+		hasFrom = hasFrom || h == "from"
+	}
+	if !hasFrom {
+		return sig, permErr("From field not signed")
+	}
+	if l := tags["l"]; l != "" {
+		if sig.bodyLength, err = strconv.ParseInt(l, 10, 64); err != nil || sig.bodyLength < 0 {
+			return sig, permErr("malformed l= tag")
+		}
+	}
+	if x := tags["x"]; x != "" {
+		if sig.expires, err = strconv.ParseInt(x, 10, 64); err != nil {
+			return sig, permErr("malformed x= tag")
+		}
+	}
+	if q := tags["q"]; q != "" && !strings.Contains(strings.ToLower(q), "dns/txt") {
+		return sig, permErr("unsupported query method %q", q)
+	}
+	return sig, nil
+}
+
+// verify checks the signature against the message and the public key from DNS.
+func (sig *signature) verify(
+	ctx context.Context,
+	resolver Resolver,
+	fields []headerField,
+	body []byte,
+	now time.Time,
+) error {
+	if sig.expires > 0 && now.Unix() > sig.expires {
+		return failErr("signature expired")
+	}
+
+	// Check body hash.
+	cbody := canonicalBody(sig.bodyC, body)
+	if sig.bodyLength >= 0 {
+		if sig.bodyLength > int64(len(cbody)) {
+			return failErr("l= tag exceeds body length")
+		}
+		cbody = cbody[:sig.bodyLength]
+	}
+	bodyHash := sha256.Sum256(cbody)
+	if subtle.ConstantTimeCompare(bodyHash[:], sig.bodyHash) != 1 {
+		return failErr("body hash did not verify")
+	}
+
+	// Hash the signed header fields, bottom-up per RFC 6376 section 5.4.2, then the signature
+	// itself with an empty b= value.
+	h := sha256.New()
+	used := make(map[int]bool)
+	for _, name := range sig.headers {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || fields[i].name != name {
+				continue
+			}
+			used[i] = true
+			h.Write([]byte(canonicalHeader(sig.headerC, fields[i].raw)))
+			break
+		}
+	}
+	name, value, _ := strings.Cut(sig.raw, ":")
+	unsigned := name + ":" + sigBValueRegex.ReplaceAllString(value, "$1$2")
+	h.Write([]byte(strings.TrimSuffix(canonicalHeader(sig.headerC, unsigned), "\r\n")))
+	hashed := h.Sum(nil)
+
+	key, err := lookupKey(ctx, resolver, sig)
+	if err != nil {
+		return err
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, hashed, sig.sig); err != nil {
+			return failErr("signature did not verify")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, hashed, sig.sig) {
+			return failErr("signature did not verify")
+		}
+	}
+	return nil
+}
+
+// lookupKey fetches and parses the public key for the signature.
+func lookupKey(ctx context.Context, resolver Resolver, sig *signature) (crypto.PublicKey, error) {
+	name := sig.selector + "._domainkey." + sig.domain
+	txts, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, permErr("no key for signature at %s", name)
+		}
+		return nil, tempErr("key lookup failed: %v", err)
+	}
+	if len(txts) == 0 {
+		return nil, permErr("no key for signature at %s", name)
+	}
+	tags, err := parseTags(txts[0])
+	if err != nil {
+		return nil, permErr("malformed key record: %v", err)
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, permErr("unsupported key version %q", v)
+	}
+	keyAlg, _, _ := strings.Cut(sig.algorithm, "-")
+	if k := strings.ToLower(tags["k"]); (k == "" && keyAlg != "rsa") || (k != "" && k != keyAlg) {
+		return nil, permErr("key type does not match algorithm %s", sig.algorithm)
+	}
+	if hashes, ok := tags["h"]; ok && !strings.Contains(strings.ToLower(hashes), "sha256") {
+		return nil, permErr("key does not permit sha256")
+	}
+	p := stripSpace(tags["p"])
+	if p == "" {
+		return nil, permErr("key revoked")
+	}
+	der, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, permErr("malformed key data")
+	}
+
+	if keyAlg == "ed25519" {
+		if len(der) != ed25519.PublicKeySize {
+			return nil, permErr("malformed ed25519 key")
+		}
+		return ed25519.PublicKey(der), nil
+	}
+	var rsaKey *rsa.PublicKey
+	if pub, err := x509.ParsePKIXPublicKey(der); err == nil {
+		var ok bool
+		if rsaKey, ok = pub.(*rsa.PublicKey); !ok {
+			return nil, permErr("key is not RSA")
+		}
+	} else if rsaKey, err = x509.ParsePKCS1PublicKey(der); err != nil {
+		return nil, permErr("malformed RSA key")
+	}
+	if rsaKey.N.BitLen() < minRSABits {
+		return nil, permErr("RSA key too short")
+	}
+	return rsaKey, nil
+}
+
+// parseTags parses a DKIM tag=value list, RFC 6376 section 3.2.
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(s, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("tag %q missing value", strings.TrimSpace(spec))
+		}
+		name = strings.TrimSpace(name)
+		if _, dup := tags[name]; dup {
+			return nil, fmt.Errorf("duplicate tag %q", name)
+		}
+		tags[name] = strings.TrimSpace(unfold(value))
+	}
+	return tags, nil
+}
+
+// toCRLF normalizes line endings to CRLF.  Messages received via SMTP DATA are stored with LF
+// line endings, but DKIM is computed over CRLF.
+func toCRLF(b []byte) []byte {
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))
+}
+
+// splitMessage returns the header, including the final field's CRLF, and body of the message.
+func splitMessage(b []byte) (header, body []byte) {
+	if bytes.HasPrefix(b, []byte("\r\n")) {
+		return nil, b[2:]
+	}
+	if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 {
+		return b[:i+2], b[i+4:]
+	}
+	return b, nil
+}
+
+// parseHeader splits the header into fields, preserving folding.
+func parseHeader(header []byte) []headerField {
+	var fields []headerField
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += line
+			continue
+		}
+		name, _, _ := strings.Cut(line, ":")
+		fields = append(fields, headerField{name: strings.ToLower(strings.TrimSpace(name)), raw: line})
+	}
+	return fields
+}
+
+// canonicalHeader applies the simple or relaxed header canonicalization to a raw field.
+func canonicalHeader(c, raw string) string {
+	if c == "simple" {
+		return raw
+	}
+	name, value, _ := strings.Cut(raw, ":")
+	value = strings.TrimSpace(collapseSpace(unfold(value)))
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value + "\r\n"
+}
+
+// canonicalBody applies the simple or relaxed body canonicalization.
+func canonicalBody(c string, body []byte) []byte {
+	if c == "relaxed" {
+		lines := bytes.SplitAfter(body, []byte("\r\n"))
+		var buf bytes.Buffer
+		for _, line := range lines {
+			content := bytes.TrimSuffix(line, []byte("\r\n"))
+			content = bytes.TrimRight([]byte(collapseSpace(string(content))), " ")
+			buf.Write(content)
+			if len(line) != len(content) || bytes.HasSuffix(line, []byte("\r\n")) {
+				buf.WriteString("\r\n")
+			}
+		}
+		body = buf.Bytes()
+	}
+	// Remove trailing empty lines.
+	for bytes.HasSuffix(body, []byte("\r\n\r\n")) {
+		body = body[:len(body)-2]
+	}
+	if len(body) > 0 && !bytes.HasSuffix(body, []byte("\r\n")) {
+		body = append(body, "\r\n"...)
+	}
+	if c == "simple" && (len(body) == 0 || bytes.Equal(body, []byte("\r\n"))) {
+		return []byte("\r\n")
+	}
+	if c == "relaxed" && bytes.Equal(body, []byte("\r\n")) {
+		return nil
+	}
+	return body
+}
+
+// unfold removes CRLF line folding.
+func unfold(s string) string {
+	return strings.ReplaceAll(s, "\r\n", "")
+}
+
+// collapseSpace reduces each run of spaces and tabs to a single space.
+func collapseSpace(s string) string {
+	var sb strings.Builder
+	inSpace := false
+	for _, c := range s {
+		if c == ' ' || c == '\t' {
+			if !inSpace {
+				sb.WriteByte(' ')
+			}
+			inSpace = true
+			continue
+		}
+		inSpace = false
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
+
+// stripSpace removes all whitespace, as permitted within base64 tag values.
+func stripSpace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,290 @@
+package msgauth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rfc8463Message is the signed example message from RFC 8463 appendix A.
+const rfc8463Message = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; i=@football.example.com;\r\n" +
+	" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+	" subject : date : message-id : from : subject : date;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+	" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+	"DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; i=@football.example.com;\r\n" +
+	" q=dns/txt; s=test; t=1528637909; h=from : to : subject :\r\n" +
+	" date : message-id : from : subject : date;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=F45dVWDfMbQDGHJFlXUNB2HKfbCeLRyhDXgFpEL8GwpsRe0IeIixNTe3\r\n" +
+	" DhCVlUrSjV4BwcVcOF6+FF3Zo9Rpo1tFOeS9mPYQTnGdaSGsgeefOsk2Jz\r\n" +
+	" dA+L10TeYt9BgDfQNZtKdN1WO//KgIqXP7OdEFE4LjFYNcUxZQ4FADY+8=\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+// rfc8463Keys holds the public keys for rfc8463Message.
+var rfc8463Keys = StaticResolver{
+	"brisbane._domainkey.football.example.com": {
+		"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=",
+	},
+	"test._domainkey.football.example.com": {
+		"v=DKIM1; k=rsa; " +
+			"p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDkHlOQoBTzWRiGs5V6NpP3idY6Wk08a5qhdR6wy5bdOK" +
+			"b2jLQiY/J16JYi0Qvx/byYzCNb3W91y3FutACDfzwQ/BC/e/8uBsCR+yz1Lxj+PL6lHvqMKrM3rG4hstT5Q" +
+			"jvHO9PzoxZyVYLzBfO2EeC3Ip3G+2kryOTIKT+l/K4w3QIDAQAB",
+	},
+}
+
+func TestVerifyDKIMRFC8463(t *testing.T) {
+	want := []event.AuthResult{
+		{Method: "dkim", Result: "pass", Domain: "football.example.com", Selector: "brisbane"},
+		{Method: "dkim", Result: "pass", Domain: "football.example.com", Selector: "test"},
+	}
+
+	got := verifyDKIM(context.Background(), rfc8463Keys, []byte(rfc8463Message), time.Now())
+	assert.Equal(t, want, got)
+
+	// Messages received via SMTP DATA are stored with bare LF line endings.
+	lf := strings.ReplaceAll(rfc8463Message, "\r\n", "\n")
+	got = verifyDKIM(context.Background(), rfc8463Keys, []byte(lf), time.Now())
+	assert.Equal(t, want, got, "LF line endings")
+}
+
+func TestVerifyDKIMFailures(t *testing.T) {
+	tests := map[string]struct {
+		source   string
+		resolver Resolver
+		result   string
+		reason   string
+	}{
+		"body modified": {
+			source:   strings.Replace(rfc8463Message, "hungry", "thirsty", 1),
+			resolver: rfc8463Keys,
+			result:   ResultFail,
+			reason:   "body hash did not verify",
+		},
+		"header modified": {
+			source:   strings.Replace(rfc8463Message, "dinner", "lunch", 1),
+			resolver: rfc8463Keys,
+			result:   ResultFail,
+			reason:   "signature did not verify",
+		},
+		"no key": {
+			source:   rfc8463Message,
+			resolver: StaticResolver{},
+			result:   ResultPermError,
+			reason:   "no key for signature at brisbane._domainkey.football.example.com",
+		},
+		"revoked key": {
+			source: rfc8463Message,
+			resolver: StaticResolver{
+				"brisbane._domainkey.football.example.com": {"v=DKIM1; k=ed25519; p="},
+			},
+			result: ResultPermError,
+			reason: "key revoked",
+		},
+		"wrong key type": {
+			source:   rfc8463Message,
+			resolver: StaticResolver{"brisbane._domainkey.football.example.com": rfc8463Keys["test._domainkey.football.example.com"]},
+			result:   ResultPermError,
+			reason:   "key type does not match algorithm ed25519-sha256",
+		},
+		"lookup failure": {
+			source:   rfc8463Message,
+			resolver: errResolver{},
+			result:   ResultTempError,
+			reason:   "key lookup failed: server unavailable",
+		},
+		"unsupported algorithm": {
+			source:   strings.Replace(rfc8463Message, "ed25519-sha256", "rsa-sha1", 1),
+			resolver: rfc8463Keys,
+			result:   ResultPermError,
+			reason:   `unsupported algorithm "rsa-sha1"`,
+		},
+		"from not signed": {
+			source: strings.Replace(rfc8463Message, "h=from : to :\r\n subject : date : message-id : from :",
+				"h=to :\r\n subject : date : message-id :", 1),
+			resolver: rfc8463Keys,
+			result:   ResultPermError,
+			reason:   "From field not signed",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := verifyDKIM(context.Background(), tc.resolver, []byte(tc.source), time.Now())
+			require.Len(t, got, 2)
+			assert.Equal(t, "brisbane", got[0].Selector)
+			assert.Equal(t, tc.result, got[0].Result)
+			assert.Equal(t, tc.reason, got[0].Reason)
+		})
+	}
+}
+
+func TestVerifyDKIMSigned(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	resolver := StaticResolver{
+		"sel._domainkey.example.com": {
+			"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub),
+		},
+	}
+	header := "From: from@example.com\r\nTo: to@example.com\r\nSubject:  Folded\r\n\tsubject\r\n"
+	body := "Line one  \r\nLine two\r\n\r\n\r\n"
+	now := time.Unix(1700000000, 0)
+
+	tests := map[string]struct {
+		tags   string
+		body   string // Body appended after signing, blank to use body.
+		result string
+		reason string
+	}{
+		"simple": {
+			tags:   "c=simple/simple;",
+			result: ResultPass,
+		},
+		"relaxed": {
+			tags:   "c=relaxed/relaxed;",
+			result: ResultPass,
+		},
+		"relaxed whitespace": {
+			tags:   "c=relaxed/relaxed;",
+			body:   "Line  one\r\nLine two  \r\n",
+			result: ResultPass,
+		},
+		"simple whitespace": {
+			tags:   "c=simple/simple;",
+			body:   "Line  one\r\nLine two  \r\n",
+			result: ResultFail,
+			reason: "body hash did not verify",
+		},
+		"body length": {
+			tags:   "c=simple/simple; l=10;",
+			body:   body + "Appended\r\n",
+			result: ResultPass,
+		},
+		"expired": {
+			tags:   "x=1600000000;",
+			result: ResultFail,
+			reason: "signature expired",
+		},
+		"not expired": {
+			tags:   "x=1800000000;",
+			result: ResultPass,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			source := signEd25519(t, priv, tc.tags, header, body)
+			if tc.body != "" {
+				source = source[:len(source)-len(body)] + tc.body
+			}
+			got := verifyDKIM(context.Background(), resolver, []byte(source), now)
+			require.Len(t, got, 1)
+			assert.Equal(t, tc.result, got[0].Result)
+			assert.Equal(t, tc.reason, got[0].Reason)
+		})
+	}
+}
+
+func TestVerifyDKIMUnsigned(t *testing.T) {
+	source := "From: from@example.com\r\nSubject: unsigned\r\n\r\nHello\r\n"
+	assert.Empty(t, verifyDKIM(context.Background(), rfc8463Keys, []byte(source), time.Now()))
+}
+
+func TestVerifyDKIMMalformed(t *testing.T) {
+	source := "DKIM-Signature: v=1; a=ed25519-sha256; d=example.com; s=sel\r\n" +
+		"From: from@example.com\r\n\r\nHello\r\n"
+	got := verifyDKIM(context.Background(), rfc8463Keys, []byte(source), time.Now())
+	require.Len(t, got, 1)
+	assert.Equal(t, ResultPermError, got[0].Result)
+	assert.Equal(t, "example.com", got[0].Domain)
+	assert.Equal(t, "sel", got[0].Selector)
+	assert.Equal(t, "signature missing required tag b=", got[0].Reason)
+}
+
+func TestCanonicalBody(t *testing.T) {
+	tests := []struct {
+		c, input, want string
+	}{
+		{"simple", "", "\r\n"},
+		{"simple", "\r\n\r\n", "\r\n"},
+		{"simple", "a \r\n\r\n", "a \r\n"},
+		{"simple", "a", "a\r\n"},
+		{"relaxed", "", ""},
+		{"relaxed", "\r\n\r\n", ""},
+		{"relaxed", " C \r\nD \t E\r\n\r\n\r\n", " C\r\nD E\r\n"},
+	}
+	for _, tc := range tests {
+		got := canonicalBody(tc.c, []byte(tc.input))
+		assert.Equal(t, tc.want, string(got), "%s body %q", tc.c, tc.input)
+	}
+}
+
+func TestCanonicalHeader(t *testing.T) {
+	raw := "SubJect : Hello \r\n\t  World \r\n"
+	assert.Equal(t, raw, canonicalHeader("simple", raw))
+	assert.Equal(t, "subject:Hello World\r\n", canonicalHeader("relaxed", raw))
+}
+
+// signEd25519 signs the message with an ed25519-sha256 DKIM signature for sel._domainkey.example.com,
+// returning the signed source.  The additional tags must end with a semicolon.
+func signEd25519(t *testing.T, priv ed25519.PrivateKey, tags, header, body string) string {
+	t.Helper()
+	sig, err := parseSignature("DKIM-Signature: v=1; a=ed25519-sha256; d=example.com; s=sel; " + tags +
+		" h=from:to:subject; bh=AA==; b=AA==\r\n")
+	require.NoError(t, err)
+
+	cbody := canonicalBody(sig.bodyC, []byte(body))
+	if sig.bodyLength >= 0 {
+		cbody = cbody[:sig.bodyLength]
+	}
+	bh := sha256.Sum256(cbody)
+	field := "DKIM-Signature: v=1; a=ed25519-sha256; d=example.com; s=sel; " + tags +
+		" h=from:to:subject; bh=" + base64.StdEncoding.EncodeToString(bh[:]) + "; b="
+
+	h := sha256.New()
+	for _, f := range parseHeader([]byte(header)) {
+		h.Write([]byte(canonicalHeader(sig.headerC, f.raw)))
+	}
+	h.Write([]byte(strings.TrimSuffix(canonicalHeader(sig.headerC, field+"\r\n"), "\r\n")))
+	b := ed25519.Sign(priv, h.Sum(nil))
+
+	return field + base64.StdEncoding.EncodeToString(b) + "\r\n" + header + "\r\n" + body
+}
+
+// errResolver fails every lookup with a temporary error.
+type errResolver struct{}
+
+func (errResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return nil, errors.New("server unavailable")
+}
+
+func (errResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return nil, errors.New("server unavailable")
+}
+
+func (errResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, errors.New("server unavailable")
+}
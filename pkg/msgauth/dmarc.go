@@ -0,0 +1,166 @@
+package msgauth
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"golang.org/x/net/publicsuffix"
+)
+
+// MethodDMARC identifies DMARC results.
+const MethodDMARC = "dmarc"
+
+// dmarcRecord holds the tags of a DMARC record that affect evaluation.
+type dmarcRecord struct {
+	policy     string // p= tag.
+	subdomain  string // sp= tag.
+	strictDKIM bool   // adkim=s
+	strictSPF  bool   // aspf=s
+}
+
+// checkDMARC evaluates DMARC alignment of the RFC5322.From domain with the passing DKIM and SPF
+// results, RFC 7489.
+func checkDMARC(
+	ctx context.Context,
+	resolver Resolver,
+	fields []headerField,
+	results []event.AuthResult,
+) event.AuthResult {
+	result := event.AuthResult{Method: MethodDMARC}
+	fromDomain, err := headerFromDomain(fields)
+	if err != nil {
+		setError(&result, err)
+		return result
+	}
+	result.Domain = fromDomain
+
+	orgDomain := organizationalDomain(fromDomain)
+	policy, err := lookupDMARC(ctx, resolver, fromDomain)
+	if err == nil && policy == nil && orgDomain != fromDomain {
+		// Fall back to the organizational domain, which may specify a subdomain policy.
+		policy, err = lookupDMARC(ctx, resolver, orgDomain)
+		if policy != nil && policy.subdomain != "" {
+			policy.policy = policy.subdomain
+		}
+	}
+	if err != nil {
+		setError(&result, err)
+		return result
+	}
+	if policy == nil {
+		result.Result = ResultNone
+		return result
+	}
+
+	aligned := func(domain string, strict bool) bool {
+		domain = canonicalName(domain)
+		if strict {
+			return domain == fromDomain
+		}
+		return organizationalDomain(domain) == orgDomain
+	}
+	for _, r := range results {
+		if r.Result != ResultPass {
+			continue
+		}
+		if (r.Method == MethodDKIM && aligned(r.Domain, policy.strictDKIM)) ||
+			(r.Method == MethodSPF && aligned(r.Domain, policy.strictSPF)) {
+			result.Result = ResultPass
+			return result
+		}
+	}
+	result.Result = ResultFail
+	result.Reason = "no aligned DKIM or SPF pass, p=" + policy.policy
+	return result
+}
+
+// lookupDMARC returns the DMARC policy published for domain, or nil if there is none.
+func lookupDMARC(ctx context.Context, resolver Resolver, domain string) (*dmarcRecord, error) {
+	name := "_dmarc." + domain
+	txts, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, tempErr("lookup %s: %v", name, err)
+	}
+	var record string
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=DMARC1") {
+			if record != "" {
+				// RFC 7489 section 6.6.3: multiple records are treated as none.
+				return nil, nil
+			}
+			record = txt
+		}
+	}
+	if record == "" {
+		return nil, nil
+	}
+	tags, err := parseTags(record)
+	if err != nil {
+		return nil, permErr("malformed DMARC record at %s: %v", name, err)
+	}
+	rec := &dmarcRecord{
+		policy:     strings.ToLower(tags["p"]),
+		subdomain:  strings.ToLower(tags["sp"]),
+		strictDKIM: strings.EqualFold(tags["adkim"], "s"),
+		strictSPF:  strings.EqualFold(tags["aspf"], "s"),
+	}
+	if !validDMARCPolicy(rec.policy) {
+		return nil, permErr("invalid DMARC policy %q at %s", tags["p"], name)
+	}
+	if rec.subdomain != "" && !validDMARCPolicy(rec.subdomain) {
+		return nil, permErr("invalid DMARC subdomain policy %q at %s", tags["sp"], name)
+	}
+	return rec, nil
+}
+
+func validDMARCPolicy(p string) bool {
+	return p == "none" || p == "quarantine" || p == "reject"
+}
+
+// headerFromDomain returns the domain of the single RFC5322.From address.
+func headerFromDomain(fields []headerField) (string, error) {
+	var from string
+	for _, f := range fields {
+		if f.name == "from" {
+			if from != "" {
+				return "", fmt.Errorf("multiple From fields")
+			}
+			_, from, _ = strings.Cut(unfold(f.raw), ":")
+		}
+	}
+	if from == "" {
+		return "", fmt.Errorf("From field missing")
+	}
+	addrs, err := mail.ParseAddressList(strings.TrimSpace(from))
+	if err != nil || len(addrs) == 0 {
+		return "", fmt.Errorf("malformed From field")
+	}
+	domain := ""
+	for _, addr := range addrs {
+		_, d, _ := strings.Cut(addr.Address, "@")
+		d = canonicalName(d)
+		if domain != "" && d != domain {
+			return "", fmt.Errorf("From field has multiple domains")
+		}
+		domain = d
+	}
+	if domain == "" {
+		return "", fmt.Errorf("From address has no domain")
+	}
+	return domain, nil
+}
+
+// organizationalDomain returns the registered domain for domain, using the public suffix list.
+func organizationalDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return org
+}
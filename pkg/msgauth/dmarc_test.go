@@ -0,0 +1,116 @@
+package msgauth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckDMARC(t *testing.T) {
+	zone, err := LoadZone("testdata/example.zone")
+	require.NoError(t, err)
+	pass := func(method, domain string) event.AuthResult {
+		return event.AuthResult{Method: method, Result: ResultPass, Domain: domain}
+	}
+
+	tests := []struct {
+		name    string
+		from    string
+		results []event.AuthResult
+		result  string
+		reason  string
+	}{
+		{
+			name:    "dkim aligned",
+			from:    "joe@example.com",
+			results: []event.AuthResult{pass(MethodDKIM, "example.com")},
+			result:  ResultPass,
+		},
+		{
+			name:    "spf relaxed",
+			from:    "joe@example.com",
+			results: []event.AuthResult{pass(MethodSPF, "bounce.example.com")},
+			result:  ResultPass,
+		},
+		{
+			name:    "not aligned",
+			from:    "joe@example.com",
+			results: []event.AuthResult{pass(MethodDKIM, "example.net"), pass(MethodSPF, "example.org")},
+			result:  ResultFail,
+			reason:  "no aligned DKIM or SPF pass, p=reject",
+		},
+		{
+			name: "aligned not passing",
+			from: "joe@example.com",
+			results: []event.AuthResult{
+				{Method: MethodDKIM, Result: ResultFail, Domain: "example.com"},
+			},
+			result: ResultFail,
+			reason: "no aligned DKIM or SPF pass, p=reject",
+		},
+		{
+			name:    "subdomain policy",
+			from:    "joe@other.example.com",
+			results: nil,
+			result:  ResultFail,
+			reason:  "no aligned DKIM or SPF pass, p=quarantine",
+		},
+		{
+			name:    "strict dkim",
+			from:    "joe@strict.example.com",
+			results: []event.AuthResult{pass(MethodDKIM, "example.com")},
+			result:  ResultFail,
+			reason:  "no aligned DKIM or SPF pass, p=quarantine",
+		},
+		{
+			name:    "strict spf",
+			from:    "joe@strict.example.com",
+			results: []event.AuthResult{pass(MethodSPF, "strict.example.com")},
+			result:  ResultPass,
+		},
+		{
+			name:   "no policy",
+			from:   "joe@example.org",
+			result: ResultNone,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			header := "From: Joe <" + tc.from + ">\r\nSubject: test\r\n"
+			got := checkDMARC(context.Background(), zone, parseHeader([]byte(header)), tc.results)
+			assert.Equal(t, MethodDMARC, got.Method)
+			assert.Equal(t, tc.result, got.Result)
+			assert.Equal(t, tc.reason, got.Reason)
+		})
+	}
+}
+
+func TestHeaderFromDomain(t *testing.T) {
+	tests := map[string]struct {
+		header string
+		want   string
+		err    bool
+	}{
+		"simple":    {header: "From: joe@Example.COM\r\n", want: "example.com"},
+		"folded":    {header: "From: Joe\r\n <joe@example.com>\r\n", want: "example.com"},
+		"same":      {header: "From: a@example.com, b@example.com\r\n", want: "example.com"},
+		"missing":   {header: "To: joe@example.com\r\n", err: true},
+		"multiple":  {header: "From: a@example.com\r\nFrom: b@example.com\r\n", err: true},
+		"domains":   {header: "From: a@example.com, b@example.net\r\n", err: true},
+		"malformed": {header: "From: <<>>\r\n", err: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := headerFromDomain(parseHeader([]byte(tc.header)))
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package msgauth
+
+import (
+	"strings"
+
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+)
+
+// ResultsHeader formats an RFC 8601 Authentication-Results header field, including the trailing
+// CRLF, reporting results on behalf of authServID.
+func ResultsHeader(authServID string, results []event.AuthResult) string {
+	var sb strings.Builder
+	sb.WriteString("Authentication-Results: ")
+	sb.WriteString(authServID)
+	if len(results) == 0 {
+		sb.WriteString("; none\r\n")
+		return sb.String()
+	}
+	for _, r := range results {
+		sb.WriteString(";\r\n\t")
+		sb.WriteString(r.Method + "=" + r.Result)
+		if r.Reason != "" {
+			sb.WriteString(" reason=" + quoteValue(r.Reason))
+		}
+		if r.Domain == "" {
+			continue
+		}
+		switch r.Method {
+		case MethodDKIM:
+			sb.WriteString(" header.d=" + r.Domain)
+			if r.Selector != "" {
+				sb.WriteString(" header.s=" + quoteValue(r.Selector))
+			}
+		case MethodSPF:
+			sb.WriteString(" smtp.mailfrom=" + r.Domain)
+		case MethodDMARC:
+			sb.WriteString(" header.from=" + r.Domain)
+		}
+	}
+	sb.WriteString("\r\n")
+	return sb.String()
+}
+
+// ResultsAuthServID returns the authserv-id an Authentication-Results header field value reports
+// results on behalf of.
+func ResultsAuthServID(value string) string {
+	id, _, _ := strings.Cut(value, ";")
+	id = strings.TrimSpace(id)
+	if i := strings.IndexAny(id, " \t"); i >= 0 {
+		// Drop the optional version number.
+		id = id[:i]
+	}
+	return strings.Trim(id, `"`)
+}
+
+// quoteValue returns s as a MIME token if possible, otherwise as a quoted string.
+func quoteValue(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\"\\()<>@,;:/[]?=") {
+		return s
+	}
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\r", "", "\n", "").Replace(s)
+	return `"` + s + `"`
+}
@@ -0,0 +1,39 @@
+package msgauth
+
+import (
+	"testing"
+
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResultsHeader(t *testing.T) {
+	assert.Equal(t, "Authentication-Results: mx.example.com; none\r\n",
+		ResultsHeader("mx.example.com", nil))
+
+	results := []event.AuthResult{
+		{Method: "dkim", Result: "pass", Domain: "example.com", Selector: "sel"},
+		{Method: "dkim", Result: "fail", Domain: "example.org", Selector: "s2",
+			Reason: `body "hash" did not verify`},
+		{Method: "spf", Result: "softfail", Domain: "example.com"},
+		{Method: "dmarc", Result: "permerror", Reason: "From field missing"},
+	}
+	want := "Authentication-Results: mx.example.com;\r\n" +
+		"\tdkim=pass header.d=example.com header.s=sel;\r\n" +
+		"\tdkim=fail reason=\"body \\\"hash\\\" did not verify\" header.d=example.org header.s=s2;\r\n" +
+		"\tspf=softfail smtp.mailfrom=example.com;\r\n" +
+		"\tdmarc=permerror reason=\"From field missing\"\r\n"
+	assert.Equal(t, want, ResultsHeader("mx.example.com", results))
+}
+
+func TestResultsAuthServID(t *testing.T) {
+	for value, want := range map[string]string{
+		" mx.example.com; none":            "mx.example.com",
+		"mx.example.com 1;\r\n\tdkim=pass": "mx.example.com",
+		`"mx.example.com"; spf=pass`:       "mx.example.com",
+		"mx.example.com":                   "mx.example.com",
+		"":                                 "",
+	} {
+		assert.Equal(t, want, ResultsAuthServID(value), "value %q", value)
+	}
+}
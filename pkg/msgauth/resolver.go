@@ -0,0 +1,139 @@
+package msgauth
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Resolver looks up the DNS records needed for message authentication.  *net.Resolver satisfies
+// this interface.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+var _ Resolver = &net.Resolver{}
+
+// StaticResolver is a Resolver backed by a map of DNS names to TXT records, useful as a stub in
+// tests and extensions.  It holds no address or MX records.
+type StaticResolver map[string][]string
+
+var _ Resolver = StaticResolver{}
+
+// LookupTXT returns the TXT records for name.
+func (r StaticResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	name = canonicalName(name)
+	if txts, ok := r[name]; ok {
+		return txts, nil
+	}
+	return nil, notFound(name)
+}
+
+// LookupIPAddr always reports that host does not exist.
+func (r StaticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return nil, notFound(canonicalName(host))
+}
+
+// LookupMX always reports that name does not exist.
+func (r StaticResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, notFound(canonicalName(name))
+}
+
+// DirResolver is a Resolver backed by a directory of TXT record files, each named after the DNS
+// name it holds records for, ex: `selector._domainkey.example.com`.  Each non-blank line of a
+// file is a TXT record, and may be split into several double quoted strings as in a DNS zone
+// file.  Lines starting with `#` are ignored.  It holds no address or MX records, use a
+// ZoneResolver to evaluate SPF policies that depend on them.
+type DirResolver string
+
+var _ Resolver = DirResolver("")
+
+// LookupTXT returns the TXT records for name.
+func (r DirResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	name = canonicalName(name)
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return nil, notFound(name)
+	}
+	f, err := os.Open(filepath.Join(string(r), name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, notFound(name)
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var txts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		txts = append(txts, unquoteTXT(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(txts) == 0 {
+		return nil, notFound(name)
+	}
+	return txts, nil
+}
+
+// LookupIPAddr always reports that host does not exist.
+func (r DirResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return nil, notFound(canonicalName(host))
+}
+
+// LookupMX always reports that name does not exist.
+func (r DirResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, notFound(canonicalName(name))
+}
+
+// isNotFound returns true if err indicates the DNS name does not exist, as opposed to a temporary
+// lookup failure.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// notFound builds the error returned for names without records.
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// canonicalName lower cases name and removes any trailing dot.
+func canonicalName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// unquoteTXT joins the double quoted strings of a zone file style TXT record, lines without quotes
+// are returned unmodified.
+func unquoteTXT(line string) string {
+	if line[0] != '"' {
+		return line
+	}
+	var sb strings.Builder
+	inQuote, escaped := false, false
+	for _, c := range line {
+		switch {
+		case escaped:
+			sb.WriteRune(c)
+			escaped = false
+		case c == '\\' && inQuote:
+			escaped = true
+		case c == '"':
+			inQuote = !inQuote
+		case inQuote:
+			sb.WriteRune(c)
+		}
+	}
+	return sb.String()
+}
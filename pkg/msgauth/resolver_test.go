@@ -0,0 +1,41 @@
+package msgauth
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticResolver(t *testing.T) {
+	r := StaticResolver{"sel._domainkey.example.com": {"v=DKIM1; p=abc"}}
+
+	got, err := r.LookupTXT(context.Background(), "SEL._domainkey.Example.com.")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v=DKIM1; p=abc"}, got)
+
+	_, err = r.LookupTXT(context.Background(), "other.example.com")
+	assert.True(t, isNotFound(err), "got %v, want not found", err)
+}
+
+func TestDirResolver(t *testing.T) {
+	dir := t.TempDir()
+	content := "# Comment line\n\n" +
+		"v=spf1 -all\n" +
+		`"v=DKIM1; k=rsa; " "p=abc\"def"` + "\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sel._domainkey.example.com"), []byte(content), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "empty.example.com"), []byte("# none\n"), 0o600))
+	r := DirResolver(dir)
+
+	got, err := r.LookupTXT(context.Background(), "Sel._DomainKey.example.com.")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v=spf1 -all", `v=DKIM1; k=rsa; p=abc"def`}, got)
+
+	for _, name := range []string{"missing.example.com", "empty.example.com", "../etc/passwd", ".", ""} {
+		_, err = r.LookupTXT(context.Background(), name)
+		assert.True(t, isNotFound(err), "name %q: got %v, want not found", name, err)
+	}
+}
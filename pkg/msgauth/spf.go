@@ -0,0 +1,493 @@
+package msgauth
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+)
+
+// MethodSPF identifies SPF results.
+const MethodSPF = "spf"
+
+// SPF processing limits, RFC 7208 section 4.6.4.
+const (
+	spfMaxLookups     = 10 // Mechanisms and modifiers that cause DNS lookups.
+	spfMaxVoidLookups = 2  // Lookups returning no records.
+	spfMaxMXHosts     = 10 // Address lookups per mx mechanism.
+)
+
+// spfCheck holds the state of a single SPF evaluation.
+type spfCheck struct {
+	resolver Resolver
+	ip       net.IP
+	sender   string // Full sender address, local@domain.
+	helo     string
+	lookups  int
+	voids    int
+}
+
+// checkSPF evaluates the SPF policy for the client ip and envelope sender, RFC 7208.  If sender
+// is empty, the HELO identity is checked instead.
+func checkSPF(ctx context.Context, resolver Resolver, ip net.IP, helo, sender string) event.AuthResult {
+	if sender == "" || !strings.Contains(sender, "@") {
+		sender = "postmaster@" + helo
+	}
+	_, domain, _ := strings.Cut(sender, "@")
+	domain = canonicalName(domain)
+	result := event.AuthResult{Method: MethodSPF, Domain: domain}
+
+	c := &spfCheck{resolver: resolver, ip: ip, sender: sender, helo: helo}
+	res, err := c.checkHost(ctx, domain)
+	result.Result = res
+	if err != nil {
+		setError(&result, err)
+	}
+	return result
+}
+
+// checkHost implements the check_host() function of RFC 7208 section 4.
+func (c *spfCheck) checkHost(ctx context.Context, domain string) (string, error) {
+	if !validSPFDomain(domain) {
+		return ResultNone, nil
+	}
+	record, err := c.lookupRecord(ctx, domain)
+	if err != nil || record == "" {
+		return ResultNone, err
+	}
+
+	terms := strings.Fields(record)[1:]
+	var redirect string
+	for _, term := range terms {
+		// Modifiers.
+		if name, value, ok := strings.Cut(term, "="); ok && isSPFName(name) {
+			switch strings.ToLower(name) {
+			case "redirect":
+				if redirect != "" {
+					return "", permErr("multiple redirect modifiers")
+				}
+				redirect = value
+			case "exp":
+				// Explanations are not used.
+			}
+			continue
+		}
+
+		// Mechanisms.
+		qualifier := ResultPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = ResultFail, term[1:]
+		case '~':
+			qualifier, term = ResultSoftFail, term[1:]
+		case '?':
+			qualifier, term = ResultNeutral, term[1:]
+		}
+		match, err := c.mechanism(ctx, domain, term)
+		if err != nil {
+			return "", err
+		}
+		if match {
+			return qualifier, nil
+		}
+	}
+
+	if redirect != "" {
+		if err := c.countLookup(); err != nil {
+			return "", err
+		}
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return "", err
+		}
+		res, err := c.checkHost(ctx, target)
+		if err == nil && res == ResultNone {
+			return "", permErr("redirect to %s has no SPF record", target)
+		}
+		return res, err
+	}
+	return ResultNeutral, nil
+}
+
+// lookupRecord returns the SPF record for domain, or blank if there is none.
+func (c *spfCheck) lookupRecord(ctx context.Context, domain string) (string, error) {
+	txts, err := c.resolver.LookupTXT(ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return "", nil
+		}
+		return "", tempErr("lookup %s: %v", domain, err)
+	}
+	var record string
+	for _, txt := range txts {
+		lower := strings.ToLower(txt)
+		if lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			if record != "" {
+				return "", permErr("multiple SPF records for %s", domain)
+			}
+			record = txt
+		}
+	}
+	return record, nil
+}
+
+// mechanism evaluates a single mechanism, without its qualifier, returning true if it matches.
+func (c *spfCheck) mechanism(ctx context.Context, domain, term string) (bool, error) {
+	name, arg, _ := strings.Cut(term, ":")
+	name = strings.ToLower(name)
+	cidr4, cidr6 := 32, 128
+	if name == "a" || name == "mx" || strings.HasPrefix(name, "a/") || strings.HasPrefix(name, "mx/") {
+		// Dual CIDR length may follow the mechanism name or its domain.
+		var cidrs string
+		if arg == "" {
+			name, cidrs, _ = strings.Cut(name, "/")
+			if cidrs != "" {
+				cidrs = "/" + cidrs
+			}
+		} else if i := strings.Index(arg, "/"); i >= 0 {
+			arg, cidrs = arg[:i], arg[i:]
+		}
+		var err error
+		if cidr4, cidr6, err = parseDualCIDR(cidrs); err != nil {
+			return false, err
+		}
+	}
+
+	switch name {
+	case "all":
+		return true, nil
+
+	case "include":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		res, err := c.checkHost(ctx, target)
+		if err != nil {
+			return false, err
+		}
+		switch res {
+		case ResultPass:
+			return true, nil
+		case ResultNone:
+			return false, permErr("include of %s has no SPF record", target)
+		}
+		return false, nil
+
+	case "a":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.targetName(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		return c.matchHost(ctx, target, cidr4, cidr6)
+
+	case "mx":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.targetName(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		mxs, err := c.resolver.LookupMX(ctx, target)
+		if err != nil {
+			return false, c.lookupErr(target, err)
+		}
+		if len(mxs) > spfMaxMXHosts {
+			return false, permErr("too many MX records for %s", target)
+		}
+		for _, mx := range mxs {
+			match, err := c.matchHost(ctx, mx.Host, cidr4, cidr6)
+			if match || err != nil {
+				return match, err
+			}
+		}
+		return false, nil
+
+	case "ptr":
+		// Deprecated by RFC 7208, and not useful without reverse DNS; never matches.
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		return false, nil
+
+	case "ip4", "ip6":
+		if arg == "" {
+			return false, permErr("%s mechanism missing network", name)
+		}
+		if !strings.Contains(arg, "/") {
+			if name == "ip4" {
+				arg += "/32"
+			} else {
+				arg += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(arg)
+		if err != nil || (name == "ip4") != (ipnet.IP.To4() != nil) {
+			return false, permErr("invalid %s network %q", name, arg)
+		}
+		return ipnet.Contains(c.ip), nil
+
+	case "exists":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		ips, err := c.resolver.LookupIPAddr(ctx, target)
+		if err != nil {
+			return false, c.lookupErr(target, err)
+		}
+		for _, ip := range ips {
+			if ip.IP.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	return false, permErr("unknown mechanism %q", term)
+}
+
+// matchHost returns true if any address of host is within the CIDR length of the client IP.
+func (c *spfCheck) matchHost(ctx context.Context, host string, cidr4, cidr6 int) (bool, error) {
+	ips, err := c.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return false, c.lookupErr(host, err)
+	}
+	for _, ip := range ips {
+		if ip4 := ip.IP.To4(); ip4 != nil {
+			if client4 := c.ip.To4(); client4 != nil {
+				mask := net.CIDRMask(cidr4, 32)
+				if client4.Mask(mask).Equal(ip4.Mask(mask)) {
+					return true, nil
+				}
+			}
+			continue
+		}
+		if c.ip.To4() == nil {
+			mask := net.CIDRMask(cidr6, 128)
+			if c.ip.Mask(mask).Equal(ip.IP.Mask(mask)) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// lookupErr converts a DNS error into an SPF error.  Names that do not exist count against the
+// void lookup limit, but are otherwise not an error.
+func (c *spfCheck) lookupErr(name string, err error) error {
+	if isNotFound(err) {
+		c.voids++
+		if c.voids > spfMaxVoidLookups {
+			return permErr("too many void DNS lookups")
+		}
+		return nil
+	}
+	return tempErr("lookup %s: %v", name, err)
+}
+
+// countLookup records a mechanism or modifier requiring DNS, enforcing the lookup limit.
+func (c *spfCheck) countLookup() error {
+	c.lookups++
+	if c.lookups > spfMaxLookups {
+		return permErr("too many DNS lookups")
+	}
+	return nil
+}
+
+// targetName returns the macro expanded domain-spec, or domain if spec is blank.
+func (c *spfCheck) targetName(spec, domain string) (string, error) {
+	if spec == "" {
+		return domain, nil
+	}
+	return c.expand(spec, domain)
+}
+
+// expand performs macro expansion of a domain-spec, RFC 7208 section 7.
+func (c *spfCheck) expand(spec, domain string) (string, error) {
+	if spec == "" {
+		return "", permErr("missing domain")
+	}
+	var sb strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			sb.WriteByte(spec[i])
+			continue
+		}
+		i++
+		if i == len(spec) {
+			return "", permErr("malformed macro in %q", spec)
+		}
+		switch spec[i] {
+		case '%':
+			sb.WriteByte('%')
+			continue
+		case '_':
+			sb.WriteByte(' ')
+			continue
+		case '-':
+			sb.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", permErr("malformed macro in %q", spec)
+		}
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", permErr("malformed macro in %q", spec)
+		}
+		value, err := c.macro(spec[i+1:i+end], domain)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(value)
+		i += end
+	}
+	return sb.String(), nil
+}
+
+// macro expands the body of a single %{...} macro.
+func (c *spfCheck) macro(body, domain string) (string, error) {
+	local, senderDomain, _ := strings.Cut(c.sender, "@")
+	var value string
+	switch body[0] | 0x20 {
+	case 's':
+		value = c.sender
+	case 'l':
+		value = local
+	case 'o':
+		value = senderDomain
+	case 'd':
+		value = domain
+	case 'i':
+		if ip4 := c.ip.To4(); ip4 != nil {
+			value = ip4.String()
+		} else {
+			nibbles := make([]string, 0, 32)
+			for _, b := range c.ip.To16() {
+				nibbles = append(nibbles, strconv.FormatUint(uint64(b>>4), 16), strconv.FormatUint(uint64(b&0xf), 16))
+			}
+			value = strings.Join(nibbles, ".")
+		}
+	case 'v':
+		value = "in-addr"
+		if c.ip.To4() == nil {
+			value = "ip6"
+		}
+	case 'h':
+		value = c.helo
+	case 'p':
+		value = "unknown"
+	default:
+		return "", permErr("unknown macro %q", body)
+	}
+
+	// Transformers: digits, reverse flag, then delimiters.
+	rest := body[1:]
+	digits := 0
+	for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	keep := 0
+	if digits > 0 {
+		n, err := strconv.Atoi(rest[:digits])
+		if err != nil || n == 0 {
+			return "", permErr("invalid macro transformer %q", body)
+		}
+		keep = n
+	}
+	rest = rest[digits:]
+	reverse := false
+	if rest != "" && rest[0]|0x20 == 'r' {
+		reverse, rest = true, rest[1:]
+	}
+	delims := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", permErr("invalid macro delimiter %q", body)
+		}
+		delims = rest
+	}
+	if digits == 0 && !reverse && rest == "" {
+		return value, nil
+	}
+	parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delims, r) })
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// parseDualCIDR parses the optional `/cidr4//cidr6` suffix of a and mx mechanisms.
+func parseDualCIDR(s string) (int, int, error) {
+	cidr4, cidr6 := 32, 128
+	if s == "" {
+		return cidr4, cidr6, nil
+	}
+	v4, v6, dual := strings.Cut(s, "//")
+	if dual {
+		n, err := strconv.Atoi(v6)
+		if err != nil || n < 0 || n > 128 {
+			return 0, 0, permErr("invalid ip6 CIDR length %q", s)
+		}
+		cidr6 = n
+	}
+	if v4 != "" {
+		n, err := strconv.Atoi(strings.TrimPrefix(v4, "/"))
+		if err != nil || !strings.HasPrefix(v4, "/") || n < 0 || n > 32 {
+			return 0, 0, permErr("invalid ip4 CIDR length %q", s)
+		}
+		cidr4 = n
+	}
+	return cidr4, cidr6, nil
+}
+
+// isSPFName returns true if s is a valid modifier name.
+func isSPFName(s string) bool {
+	if s == "" || !isAlpha(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if !isAlpha(c) && !(c >= '0' && c <= '9') && c != '-' && c != '_' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// validSPFDomain returns false for domains that cannot have an SPF record, RFC 7208 section 4.3.
+func validSPFDomain(domain string) bool {
+	if domain == "" || len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
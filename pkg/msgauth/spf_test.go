@@ -0,0 +1,108 @@
+package msgauth
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckSPF(t *testing.T) {
+	zone, err := LoadZone("testdata/example.zone")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		ip     string
+		sender string
+		result string
+		reason string
+	}{
+		{name: "mx", ip: "192.0.2.25", sender: "user@example.com", result: ResultPass},
+		{name: "a domain", ip: "192.0.2.50", sender: "user@example.com", result: ResultPass},
+		{name: "ip4", ip: "198.51.100.99", sender: "user@example.com", result: ResultPass},
+		{name: "include ip6", ip: "2001:db8:1::99", sender: "user@example.com", result: ResultPass},
+		{name: "all", ip: "192.0.2.99", sender: "user@example.com", result: ResultFail},
+		{name: "a cidr", ip: "203.0.113.200", sender: "user@strict.example.com", result: ResultPass},
+		{name: "a cidr miss", ip: "203.0.114.1", sender: "user@strict.example.com", result: ResultFail},
+		{name: "softfail", ip: "192.0.2.99", sender: "user@soft.example.com", result: ResultSoftFail},
+		{name: "redirect", ip: "192.0.2.25", sender: "user@redirect.example.com", result: ResultPass},
+		{name: "macro exists", ip: "192.0.2.4", sender: "other@macro.example.com", result: ResultFail},
+		{name: "macro match", ip: "192.0.2.4", sender: "x-user@macro.example.com", result: ResultPass},
+		{name: "no record", ip: "192.0.2.99", sender: "user@missing.example.com", result: ResultNone},
+		{name: "helo", ip: "192.0.2.25", sender: "", result: ResultPass},
+		{
+			name: "multiple records", ip: "192.0.2.99", sender: "user@double.example.com",
+			result: ResultPermError, reason: "multiple SPF records for double.example.com",
+		},
+		{
+			name: "include loop", ip: "192.0.2.99", sender: "user@loop.example.com",
+			result: ResultPermError, reason: "too many DNS lookups",
+		},
+		{
+			name: "unknown mechanism", ip: "192.0.2.99", sender: "user@bad.example.com",
+			result: ResultPermError, reason: `unknown mechanism "foo:bar"`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := checkSPF(context.Background(), zone, net.ParseIP(tc.ip), "example.com", tc.sender)
+			assert.Equal(t, MethodSPF, got.Method)
+			assert.Equal(t, tc.result, got.Result, "reason: %s", got.Reason)
+			assert.Equal(t, tc.reason, got.Reason)
+		})
+	}
+}
+
+func TestCheckSPFTempError(t *testing.T) {
+	got := checkSPF(context.Background(), errResolver{}, net.ParseIP("192.0.2.1"), "", "a@example.com")
+	assert.Equal(t, ResultTempError, got.Result)
+	assert.Equal(t, "example.com", got.Domain)
+}
+
+func TestSPFMacroExpand(t *testing.T) {
+	c := &spfCheck{
+		ip:     net.ParseIP("192.0.2.3"),
+		sender: "strong-bad@email.example.com",
+		helo:   "mx.example.org",
+	}
+	tests := map[string]string{
+		"%{s}":                      "strong-bad@email.example.com",
+		"%{o}":                      "email.example.com",
+		"%{d}":                      "email.example.com",
+		"%{d4}":                     "email.example.com",
+		"%{d3}":                     "email.example.com",
+		"%{d2}":                     "example.com",
+		"%{d1}":                     "com",
+		"%{dr}":                     "com.example.email",
+		"%{d2r}":                    "example.email",
+		"%{l}":                      "strong-bad",
+		"%{l-}":                     "strong.bad",
+		"%{lr}":                     "strong-bad",
+		"%{lr-}":                    "bad.strong",
+		"%{l1r-}":                   "strong",
+		"%{ir}.%{v}._spf.%{d2}":     "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":      "bad.strong.lp._spf.example.com",
+		"%{d2}.trusted-domains.net": "example.com.trusted-domains.net",
+		"%{h}%%%_%-":                "mx.example.org% %20",
+	}
+	for spec, want := range tests {
+		got, err := c.expand(spec, "email.example.com")
+		require.NoError(t, err, spec)
+		assert.Equal(t, want, got, spec)
+	}
+
+	c.ip = net.ParseIP("2001:db8::cb01")
+	got, err := c.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com")
+	require.NoError(t, err)
+	assert.Equal(t,
+		"1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com",
+		got)
+
+	for _, bad := range []string{"%", "%x", "%{", "%{q}", "%{d0}"} {
+		_, err := c.expand(bad, "email.example.com")
+		assert.Error(t, err, "spec %q", bad)
+	}
+}
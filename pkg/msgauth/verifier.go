@@ -0,0 +1,145 @@
+// Package msgauth verifies message authentication (DKIM, SPF and DMARC) of inbound mail against a
+// pluggable DNS resolver, which may be backed by local records so that tests do not depend on live
+// DNS.
+package msgauth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/config"
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+)
+
+// Authentication results, RFC 8601 and RFC 7208.
+const (
+	ResultPass      = "pass"
+	ResultFail      = "fail"
+	ResultSoftFail  = "softfail"
+	ResultNeutral   = "neutral"
+	ResultNone      = "none"
+	ResultTempError = "temperror"
+	ResultPermError = "permerror"
+)
+
+// lookupTimeout limits the time spent on DNS lookups for a single message.
+const lookupTimeout = 10 * time.Second
+
+// Envelope describes the SMTP transaction a message was received in, used to evaluate SPF.
+type Envelope struct {
+	RemoteIP net.IP // Client IP address, SPF is not evaluated if nil.
+	Helo     string // HELO/EHLO domain.
+	MailFrom string // MAIL FROM address, blank for the null reverse-path.
+}
+
+// Verifier checks the authentication of inbound messages.
+type Verifier struct {
+	Resolver Resolver         // Source of DNS records.
+	DKIM     bool             // Verify DKIM signatures.
+	SPF      bool             // Evaluate the SPF policy of the envelope sender.
+	DMARC    bool             // Evaluate DMARC alignment, requires DKIM and SPF.
+	now      func() time.Time // Clock, replaced by tests.
+}
+
+// NewVerifier creates a Verifier from the configuration, returning nil if verification is
+// disabled.
+func NewVerifier(conf config.MsgAuth) (*Verifier, error) {
+	if !conf.DKIM && !conf.SPF && !conf.DMARC {
+		return nil, nil
+	}
+	var resolver Resolver = net.DefaultResolver
+	switch {
+	case conf.DNSZone != "":
+		zone, err := LoadZone(conf.DNSZone)
+		if err != nil {
+			return nil, fmt.Errorf("msgauth DNS zone: %w", err)
+		}
+		resolver = zone
+	case conf.DNSDir != "":
+		info, err := os.Stat(conf.DNSDir)
+		if err != nil {
+			return nil, fmt.Errorf("msgauth DNS directory: %w", err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("msgauth DNS directory %q is not a directory", conf.DNSDir)
+		}
+		resolver = DirResolver(conf.DNSDir)
+	case conf.DNSServer != "":
+		server := conf.DNSServer
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return &Verifier{
+		Resolver: resolver,
+		DKIM:     conf.DKIM || conf.DMARC,
+		SPF:      conf.SPF || conf.DMARC,
+		DMARC:    conf.DMARC,
+		now:      time.Now,
+	}, nil
+}
+
+// Verify checks the authentication of the message source received within env, returning a result
+// for each check performed.  A nil Verifier performs no checks.
+func (v *Verifier) Verify(source []byte, env Envelope) []event.AuthResult {
+	if v == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	now := time.Now
+	if v.now != nil {
+		now = v.now
+	}
+
+	var results []event.AuthResult
+	if v.DKIM {
+		results = append(results, verifyDKIM(ctx, v.Resolver, source, now())...)
+	}
+	if v.SPF && env.RemoteIP != nil {
+		results = append(results, checkSPF(ctx, v.Resolver, env.RemoteIP, env.Helo, env.MailFrom))
+	}
+	if v.DMARC {
+		header, _ := splitMessage(toCRLF(source))
+		results = append(results, checkDMARC(ctx, v.Resolver, parseHeader(header), results))
+	}
+	return results
+}
+
+// resultError is a verification failure, carrying the result it should be reported as.
+type resultError struct {
+	result string
+	reason string
+}
+
+func (e *resultError) Error() string { return e.result + ": " + e.reason }
+
+func permErr(format string, args ...any) error {
+	return &resultError{result: ResultPermError, reason: fmt.Sprintf(format, args...)}
+}
+
+func tempErr(format string, args ...any) error {
+	return &resultError{result: ResultTempError, reason: fmt.Sprintf(format, args...)}
+}
+
+func failErr(format string, args ...any) error {
+	return &resultError{result: ResultFail, reason: fmt.Sprintf(format, args...)}
+}
+
+// setError sets the result and reason of r from err.
+func setError(r *event.AuthResult, err error) {
+	if re, ok := err.(*resultError); ok {
+		r.Result = re.result
+		r.Reason = re.reason
+		return
+	}
+	r.Result = ResultPermError
+	r.Reason = err.Error()
+}
@@ -0,0 +1,81 @@
+package msgauth
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/inbucket/inbucket/v3/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewVerifier(t *testing.T) {
+	v, err := NewVerifier(config.MsgAuth{DNSDir: "/does/not/exist"})
+	require.NoError(t, err)
+	assert.Nil(t, v, "should be nil when disabled")
+	assert.Nil(t, v.Verify([]byte(rfc8463Message), Envelope{}), "nil verifier should not check")
+
+	_, err = NewVerifier(config.MsgAuth{DKIM: true, DNSDir: "/does/not/exist"})
+	assert.Error(t, err)
+	_, err = NewVerifier(config.MsgAuth{SPF: true, DNSZone: "/does/not/exist"})
+	assert.Error(t, err)
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(file, nil, 0o600))
+	_, err = NewVerifier(config.MsgAuth{DKIM: true, DNSDir: file})
+	assert.Error(t, err, "DNSDir must be a directory")
+
+	v, err = NewVerifier(config.MsgAuth{DKIM: true, DNSDir: dir})
+	require.NoError(t, err)
+	assert.Equal(t, DirResolver(dir), v.Resolver)
+
+	v, err = NewVerifier(config.MsgAuth{DKIM: true, DNSServer: "127.0.0.1:5353"})
+	require.NoError(t, err)
+	assert.NotNil(t, v.Resolver)
+
+	v, err = NewVerifier(config.MsgAuth{DMARC: true, DNSZone: "testdata/example.zone", DNSDir: dir})
+	require.NoError(t, err)
+	assert.IsType(t, &ZoneResolver{}, v.Resolver, "zone should take precedence")
+	assert.True(t, v.DKIM, "DMARC requires DKIM")
+	assert.True(t, v.SPF, "DMARC requires SPF")
+}
+
+func TestVerifierVerify(t *testing.T) {
+	v := &Verifier{Resolver: rfc8463Keys, DKIM: true}
+	got := v.Verify([]byte(rfc8463Message), Envelope{})
+	require.Len(t, got, 2)
+	assert.Equal(t, ResultPass, got[0].Result)
+	assert.Equal(t, ResultPass, got[1].Result)
+
+	v.DKIM = false
+	assert.Empty(t, v.Verify([]byte(rfc8463Message), Envelope{}))
+}
+
+func TestVerifierVerifyDMARC(t *testing.T) {
+	zone, err := LoadZone("testdata/example.zone")
+	require.NoError(t, err)
+	v := &Verifier{Resolver: zone, DKIM: true, SPF: true, DMARC: true}
+	source := []byte("From: Joe <joe@sub.example.com>\nSubject: test\n\nHello\n")
+
+	// SPF pass for example.com aligns with sub.example.com in relaxed mode.
+	got := v.Verify(source, Envelope{
+		RemoteIP: net.ParseIP("192.0.2.25"),
+		Helo:     "mail.example.com",
+		MailFrom: "bounce@example.com",
+	})
+	require.Len(t, got, 2)
+	assert.Equal(t, MethodSPF, got[0].Method)
+	assert.Equal(t, ResultPass, got[0].Result)
+	assert.Equal(t, MethodDMARC, got[1].Method)
+	assert.Equal(t, ResultPass, got[1].Result)
+	assert.Equal(t, "sub.example.com", got[1].Domain)
+
+	// SPF is skipped without a client IP, so DMARC fails with the subdomain policy.
+	got = v.Verify(source, Envelope{MailFrom: "bounce@example.com"})
+	require.Len(t, got, 1)
+	assert.Equal(t, ResultFail, got[0].Result)
+	assert.Equal(t, "no aligned DKIM or SPF pass, p=quarantine", got[0].Reason)
+}
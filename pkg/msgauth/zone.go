@@ -0,0 +1,248 @@
+package msgauth
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ZoneResolver is a Resolver backed by the records of a DNS zone file, in the RFC 1035 master file
+// format used by BIND.  TXT, A, AAAA and MX records are loaded, other record types are ignored.
+type ZoneResolver struct {
+	txt map[string][]string
+	ip  map[string][]net.IPAddr
+	mx  map[string][]*net.MX
+}
+
+var _ Resolver = &ZoneResolver{}
+
+// LoadZone reads the zone file at path.
+func LoadZone(path string) (*ZoneResolver, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	z, err := ParseZone(f, "")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return z, nil
+}
+
+// ParseZone parses zone file records from r.  Relative names are qualified with origin, which
+// may be overridden by `$ORIGIN` directives.
+func ParseZone(r io.Reader, origin string) (*ZoneResolver, error) {
+	z := &ZoneResolver{
+		txt: make(map[string][]string),
+		ip:  make(map[string][]net.IPAddr),
+		mx:  make(map[string][]*net.MX),
+	}
+	origin = canonicalName(origin)
+	owner := ""
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		fields, open, err := zoneFields(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		// Join lines within parentheses.
+		startLine := lineNum
+		for open {
+			if !scanner.Scan() {
+				return nil, fmt.Errorf("line %d: unclosed parenthesis", startLine)
+			}
+			lineNum++
+			var more []string
+			more, open, err = zoneFields("(" + scanner.Text())
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			fields = append(fields, more...)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		// Directives.
+		switch strings.ToUpper(fields[0]) {
+		case "$ORIGIN":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: malformed $ORIGIN", startLine)
+			}
+			origin = canonicalName(fields[1])
+			continue
+		case "$TTL":
+			continue
+		case "$INCLUDE":
+			return nil, fmt.Errorf("line %d: $INCLUDE is not supported", startLine)
+		}
+
+		// Owner name, blank when the line begins with whitespace.
+		if line != "" && line[0] != ' ' && line[0] != '\t' {
+			owner = qualifyName(fields[0], origin)
+			fields = fields[1:]
+		}
+		if owner == "" {
+			return nil, fmt.Errorf("line %d: record has no owner name", startLine)
+		}
+
+		// Optional TTL and class, in either order.
+		for len(fields) > 0 {
+			if _, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+				fields = fields[1:]
+				continue
+			}
+			if c := strings.ToUpper(fields[0]); c == "IN" || c == "CH" || c == "HS" {
+				fields = fields[1:]
+				continue
+			}
+			break
+		}
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("line %d: record has no type", startLine)
+		}
+		if err := z.addRecord(owner, origin, strings.ToUpper(fields[0]), fields[1:]); err != nil {
+			return nil, fmt.Errorf("line %d: %w", startLine, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// addRecord adds a record of type rrtype, with the specified rdata fields.
+func (z *ZoneResolver) addRecord(owner, origin, rrtype string, rdata []string) error {
+	switch rrtype {
+	case "TXT":
+		if len(rdata) == 0 {
+			return fmt.Errorf("TXT record missing data")
+		}
+		z.txt[owner] = append(z.txt[owner], strings.Join(rdata, ""))
+	case "A", "AAAA":
+		if len(rdata) != 1 {
+			return fmt.Errorf("malformed %s record", rrtype)
+		}
+		ip := net.ParseIP(rdata[0])
+		if ip == nil || (rrtype == "A") != (ip.To4() != nil) {
+			return fmt.Errorf("invalid %s address %q", rrtype, rdata[0])
+		}
+		z.ip[owner] = append(z.ip[owner], net.IPAddr{IP: ip})
+	case "MX":
+		if len(rdata) != 2 {
+			return fmt.Errorf("malformed MX record")
+		}
+		pref, err := strconv.ParseUint(rdata[0], 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid MX preference %q", rdata[0])
+		}
+		host := qualifyName(rdata[1], origin) + "."
+		z.mx[owner] = append(z.mx[owner], &net.MX{Host: host, Pref: uint16(pref)})
+	}
+	return nil
+}
+
+// LookupTXT returns the TXT records for name.
+func (z *ZoneResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	name = canonicalName(name)
+	if txts, ok := z.txt[name]; ok {
+		return txts, nil
+	}
+	return nil, notFound(name)
+}
+
+// LookupIPAddr returns the A and AAAA records for host.
+func (z *ZoneResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	host = canonicalName(host)
+	if ips, ok := z.ip[host]; ok {
+		return ips, nil
+	}
+	return nil, notFound(host)
+}
+
+// LookupMX returns the MX records for name.
+func (z *ZoneResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	name = canonicalName(name)
+	if mxs, ok := z.mx[name]; ok {
+		return mxs, nil
+	}
+	return nil, notFound(name)
+}
+
+// qualifyName converts a zone file name to a canonical absolute name.
+func qualifyName(name, origin string) string {
+	if name == "@" {
+		return origin
+	}
+	if strings.HasSuffix(name, ".") || origin == "" {
+		return canonicalName(name)
+	}
+	return canonicalName(name + "." + origin)
+}
+
+// zoneFields splits a zone file line into fields, removing comments and unquoting strings.  open
+// is true if the line leaves a parenthesis unclosed.
+func zoneFields(line string) (fields []string, open bool, err error) {
+	var sb strings.Builder
+	inField, inQuote, escaped := false, false, false
+	flush := func() {
+		if inField {
+			fields = append(fields, sb.String())
+			sb.Reset()
+			inField = false
+		}
+	}
+	for _, c := range line {
+		switch {
+		case escaped:
+			sb.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped, inField = true, true
+		case inQuote:
+			if c == '"' {
+				inQuote = false
+			} else {
+				sb.WriteRune(c)
+			}
+		case c == '"':
+			// Each quoted string is a separate field, even if empty.
+			flush()
+			inQuote, inField = true, true
+		case c == ';':
+			flush()
+			return fields, open, nil
+		case c == '(':
+			flush()
+			if open {
+				return nil, false, fmt.Errorf("nested parenthesis")
+			}
+			open = true
+		case c == ')':
+			flush()
+			if !open {
+				return nil, false, fmt.Errorf("unbalanced parenthesis")
+			}
+			open = false
+		case c == ' ' || c == '\t':
+			flush()
+		default:
+			sb.WriteRune(c)
+			inField = true
+		}
+	}
+	if inQuote {
+		return nil, false, fmt.Errorf("unterminated quoted string")
+	}
+	flush()
+	return fields, open, nil
+}
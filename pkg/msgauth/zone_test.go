@@ -0,0 +1,69 @@
+package msgauth
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadZone(t *testing.T) {
+	z, err := LoadZone("testdata/example.zone")
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	txts, err := z.LookupTXT(ctx, "Example.COM.")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"v=spf1 mx a:relay.example.com ip4:198.51.100.0/24 include:_spf.example.net -all",
+	}, txts)
+
+	txts, err = z.LookupTXT(ctx, "_dmarc.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v=DMARC1; p=reject; sp=quarantine; aspf=r"}, txts)
+
+	txts, err = z.LookupTXT(ctx, "_spf.example.net")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v=spf1 ip6:2001:db8:1::/48 ?all"}, txts)
+
+	ips, err := z.LookupIPAddr(ctx, "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []net.IPAddr{{IP: net.ParseIP("192.0.2.10")}, {IP: net.ParseIP("2001:db8::10")}}, ips)
+
+	ips, err = z.LookupIPAddr(ctx, "relay.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []net.IPAddr{{IP: net.ParseIP("192.0.2.50")}}, ips)
+
+	mxs, err := z.LookupMX(ctx, "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []*net.MX{{Host: "mail.example.com.", Pref: 10}}, mxs)
+
+	_, err = z.LookupTXT(ctx, "missing.example.com")
+	assert.True(t, isNotFound(err), "got %v, want not found", err)
+	_, err = z.LookupIPAddr(ctx, "missing.example.com")
+	assert.True(t, isNotFound(err), "got %v, want not found", err)
+	_, err = z.LookupMX(ctx, "relay.example.com")
+	assert.True(t, isNotFound(err), "got %v, want not found", err)
+}
+
+func TestParseZoneErrors(t *testing.T) {
+	tests := map[string]string{
+		"no owner":       " IN TXT \"x\"",
+		"no type":        "example.com. 300 IN",
+		"bad A":          "example.com. A 2001:db8::1",
+		"bad MX":         "example.com. MX ten mail.example.com.",
+		"unclosed paren": "example.com. TXT ( \"x\"",
+		"unbalanced":     "example.com. TXT \"x\" )",
+		"unterminated":   "example.com. TXT \"x",
+		"include":        "$INCLUDE other.zone",
+	}
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseZone(strings.NewReader(input), "")
+			assert.Error(t, err)
+		})
+	}
+}
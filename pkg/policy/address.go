@@ -7,9 +7,12 @@ import (
 	"net"
 	"net/mail"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/inbucket/inbucket/v3/pkg/config"
 	"github.com/inbucket/inbucket/v3/pkg/stringutil"
+	"golang.org/x/net/idna"
 )
 
 // Addressing handles email address policy.
@@ -148,8 +151,15 @@ func ParseEmailAddress(address string) (local string, domain string, err error)
 }
 
 // ValidateDomainPart returns true if the domain part complies to RFC3696, RFC1035. Used by
-// ParseEmailAddress().
+// ParseEmailAddress().  Internationalized domains are validated in their A-label form, RFC 5891.
 func ValidateDomainPart(domain string) bool {
+	if !isASCII(domain) {
+		ascii, err := idna.Lookup.ToASCII(domain)
+		if err != nil {
+			return false
+		}
+		domain = ascii
+	}
 	ln := len(domain)
 	if ln == 0 {
 		return false
@@ -171,9 +181,10 @@ func ValidateDomainPart(domain string) bool {
 		domain += "."
 	}
 	prev := '.'
+	labelStart := 0
 	labelLen := 0
 	hasAlphaNum := false
-	for _, c := range domain {
+	for i, c := range domain {
 		switch {
 		case ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') ||
 			('0' <= c && c <= '9') || c == '_':
@@ -181,6 +192,10 @@ func ValidateDomainPart(domain string) bool {
 			hasAlphaNum = true
 			labelLen++
 		case c == '-':
+			if i == labelStart+3 && strings.EqualFold(domain[labelStart:i+1], "xn--") {
+				// Permit the A-label prefix of an internationalized domain.
+				break
+			}
 			if prev == '.' || prev == '-' {
 				// Cannot lead with hyphen or double hyphen.
 				return false
@@ -196,6 +211,7 @@ func ValidateDomainPart(domain string) bool {
 			if !hasAlphaNum {
 				return false
 			}
+			labelStart = i + 1
 			labelLen = 0
 			hasAlphaNum = false
 		default:
@@ -248,6 +264,9 @@ func parseEmailAddress(address string) (local string, domain string, err error)
 	if address == "" {
 		return "", "", errors.New("empty address")
 	}
+	if !utf8.ValidString(address) {
+		return "", "", errors.New("address is not valid UTF-8")
+	}
 	if len(address) > 320 {
 		return "", "", errors.New("address exceeds 320 characters")
 	}
@@ -347,7 +366,12 @@ LOOP:
 				break LOOP
 			}
 		case c > 127:
-			return "", "", errors.New("characters outside of US-ASCII range not permitted")
+			// UTF-8 encoded characters are permitted in internationalized addresses, RFC 6531.
+			err = buf.WriteByte(c)
+			if err != nil {
+				return
+			}
+			inCharQuote = false
 		default:
 			if inCharQuote || inStringQuote {
 				err = buf.WriteByte(c)
@@ -379,22 +403,34 @@ func parseMailboxName(localPart string) (result string, err error) {
 		return "", errors.New("mailbox name cannot be empty")
 	}
 	result = strings.ToLower(localPart)
-	invalid := make([]byte, 0, 10)
-	for i := range len(result) {
-		c := result[i]
+	invalid := make([]rune, 0, 10)
+	for _, c := range result {
 		switch {
 		case 'a' <= c && c <= 'z':
 		case '0' <= c && c <= '9':
-		case strings.IndexByte("!#$%&'*+-=/?^_`.{|}~", c) >= 0:
+		case strings.ContainsRune("!#$%&'*+-=/?^_`.{|}~", c):
+		case c > unicode.MaxASCII &&
+			(unicode.IsLetter(c) || unicode.IsDigit(c) || unicode.IsMark(c)):
+			// Internationalized mailbox names, RFC 6531.
 		default:
 			invalid = append(invalid, c)
 		}
 	}
 	if len(invalid) > 0 {
-		return "", fmt.Errorf("mailbox name contained invalid character(s): %q", invalid)
+		return "", fmt.Errorf("mailbox name contained invalid character(s): %q", string(invalid))
 	}
 	if idx := strings.Index(result, "+"); idx > -1 {
 		result = result[0:idx]
 	}
 	return result, nil
 }
+
+// isASCII returns true if s contains only US-ASCII characters.
+func isASCII(s string) bool {
+	for i := range len(s) {
+		if s[i] > unicode.MaxASCII {
+			return false
+		}
+	}
+	return true
+}
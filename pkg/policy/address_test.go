@@ -279,6 +279,18 @@ func TestExtractMailboxValid(t *testing.T) {
 			full:   "u@[IPv6:2001:db8:aaaa:1::100]",
 			domain: "[IPv6:2001:db8:aaaa:1::100]",
 		},
+		{
+			input:  "Jöran+label@bücher.example",
+			local:  "jöran",
+			full:   "jöran@bücher.example",
+			domain: "bücher.example",
+		},
+		{
+			input:  "用户@例子.广告",
+			local:  "用户",
+			full:   "用户@例子.广告",
+			domain: "例子.广告",
+		},
 	}
 	for _, tc := range testTable {
 		if result, err := localPolicy.ExtractMailbox(tc.input); err != nil {
@@ -341,6 +353,8 @@ func TestExtractMailboxInvalid(t *testing.T) {
 		{"first last", "Space not permitted"},
 		{"first\"last", "Double quote not permitted"},
 		{"first\nlast", "Control chars not permitted"},
+		{"snow☃man", "Non-ASCII symbols not permitted"},
+		{"bad\xffutf8", "Invalid UTF-8 not permitted"},
 	}
 	for _, tt := range localInvalidTable {
 		if _, err := localPolicy.ExtractMailbox(tt.input); err == nil {
@@ -415,6 +429,10 @@ func TestValidateDomain(t *testing.T) {
 		{"[123.123.123.123]", true, "Multiple digit octet IP addr is valid"},
 		{"[IPv6:2001:0db8:aaaa:0001:0000:0000:0000:0200]", true, "Full IPv6 addr is valid"},
 		{"[IPv6:::1]", true, "Abbr IPv6 addr is valid"},
+		{"bücher.example", true, "Internationalized domain is valid"},
+		{"例子.广告", true, "Internationalized domain is valid"},
+		{"xn--bcher-kva.example", true, "A-label of internationalized domain is valid"},
+		{"bü cher.example", false, "Space not allowed in internationalized domain"},
 	}
 	for _, tt := range testTable {
 		if policy.ValidateDomainPart(tt.input) != tt.expect {
@@ -456,6 +474,9 @@ func TestValidateLocal(t *testing.T) {
 		{"one\\$\\|", true, "Should be able to quote plain specials"},
 		{"return\\\r", true, "Should be able to quote ASCII control chars"},
 		{"high\\\x80", false, "Should not accept > 7-bit quoted chars"},
+		{"jöran", true, "UTF-8 characters are permitted"},
+		{"用户", true, "UTF-8 characters are permitted"},
+		{"\xc3", false, "Invalid UTF-8 is not permitted"},
 		{"quote\\\"", true, "Quoted double quote is permitted"},
 		{"\"james\"", true, "Quoted a-z is permitted"},
 		{"\"first last\"", true, "Quoted space is permitted"},
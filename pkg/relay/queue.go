@@ -0,0 +1,119 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/textproto"
+	"slices"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/retryqueue"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// QueueEntry is a forwarded message awaiting delivery to an upstream server.
+type QueueEntry struct {
+	ID          string
+	Target      string
+	From        string
+	Recipients  []string
+	Created     time.Time
+	Attempts    int       // Delivery attempts made so far.
+	NextAttempt time.Time // Time of the next delivery attempt.
+	LastError   string    // Error from the most recent attempt, if any.
+}
+
+// QueueStatus describes the forwarding queue.
+type QueueStatus struct {
+	Entries   []QueueEntry // Entries awaiting delivery, ordered by next attempt.
+	Delivered int64        // Forwards accepted by the upstream server.
+	Failed    int64        // Forwards rejected by the upstream server, or out of attempts.
+	Dropped   int64        // Forwards discarded because the queue was full.
+}
+
+// forward is a message queued for delivery to a target.
+type forward struct {
+	target     string
+	from       string
+	recipients []string
+	source     []byte
+}
+
+// Forward queues source for delivery to the upstream target configured for each recipient's
+// domain.  Recipients without a forwarding route are ignored.  Forward does not block on
+// delivery.
+func (r *Relay) Forward(from string, recipients []string, source []byte) {
+	// Group recipients by target, preserving recipient order.
+	var targets []string
+	byTarget := make(map[string][]string)
+	for _, rcpt := range recipients {
+		target := r.route(rcpt)
+		if target == "" {
+			continue
+		}
+		if _, ok := byTarget[target]; !ok {
+			targets = append(targets, target)
+		}
+		byTarget[target] = append(byTarget[target], rcpt)
+	}
+
+	for _, target := range targets {
+		fwd := forward{target: target, from: from, recipients: byTarget[target], source: source}
+		if !r.queue.Add(fwd) {
+			log.Warn().Str("module", "relay").Str("target", target).
+				Strs("recipients", fwd.recipients).Msg("Forward queue full, dropping message")
+		}
+	}
+}
+
+// QueueStatus returns a snapshot of the forwarding queue.
+func (r *Relay) QueueStatus() QueueStatus {
+	qs := r.queue.Status()
+	status := QueueStatus{
+		Entries:   make([]QueueEntry, len(qs.Pending)),
+		Delivered: qs.Delivered,
+		Failed:    qs.Failed,
+		Dropped:   qs.Dropped,
+	}
+	for i, e := range qs.Pending {
+		status.Entries[i] = QueueEntry{
+			ID:          e.ID,
+			Target:      e.Item.target,
+			From:        e.Item.from,
+			Recipients:  slices.Clone(e.Item.recipients),
+			Created:     e.Created,
+			Attempts:    e.Attempts,
+			NextAttempt: e.NextAttempt,
+			LastError:   e.LastError,
+		}
+	}
+	return status
+}
+
+// Start delivers queued forwards until the context is cancelled.
+func (r *Relay) Start(ctx context.Context) {
+	r.queue.Start(ctx)
+}
+
+// attempt delivers entry to its target.
+func (r *Relay) attempt(_ context.Context, entry retryqueue.Entry[forward]) error {
+	fwd := entry.Item
+	_, _, err := r.send(r.targets[fwd.target], fwd.from, fwd.recipients,
+		bytes.NewReader(fwd.source))
+	return err
+}
+
+// permanent returns true if the upstream server rejected the forward, and it should not be
+// retried.
+func permanent(err error) bool {
+	var tpErr *textproto.Error
+	return errors.As(err, &tpErr) && tpErr.Code >= 500
+}
+
+// forwardLogger returns a logger describing a queued forward.
+func forwardLogger(entry retryqueue.Entry[forward]) zerolog.Logger {
+	return log.With().Str("module", "relay").Str("target", entry.Item.target).
+		Str("queue-id", entry.ID).Strs("recipients", entry.Item.recipients).Logger()
+}
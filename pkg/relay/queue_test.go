@@ -0,0 +1,184 @@
+package relay_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/config"
+	"github.com/inbucket/inbucket/v3/pkg/relay"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const closedTarget = "smtp://127.0.0.1:1"
+
+func TestForwardRoutes(t *testing.T) {
+	r, err := relay.New(config.Relay{
+		Targets:        map[string]string{"a": closedTarget, "b": closedTarget},
+		ForwardDomains: map[string]string{"a.example": "a", "B.example": "b"},
+	}, "inbucket", nil)
+	require.NoError(t, err)
+	assert.True(t, r.Forwarding())
+
+	r.Forward("from@example.com",
+		[]string{"x@a.example", "y@b.example", "z@A.example", "w@other.example"}, []byte("msg"))
+
+	status := r.QueueStatus()
+	require.Len(t, status.Entries, 2)
+	assert.Equal(t, "a", status.Entries[0].Target)
+	assert.Equal(t, []string{"x@a.example", "z@A.example"}, status.Entries[0].Recipients)
+	assert.Equal(t, "b", status.Entries[1].Target)
+	assert.Equal(t, []string{"y@b.example"}, status.Entries[1].Recipients)
+	assert.Equal(t, "from@example.com", status.Entries[1].From)
+	assert.Equal(t, 0, status.Entries[1].Attempts)
+}
+
+func TestForwardWildcardRoute(t *testing.T) {
+	r, err := relay.New(config.Relay{
+		Targets:        map[string]string{"a": closedTarget, "b": closedTarget},
+		ForwardDomains: map[string]string{"b.example": "b", "*": "a"},
+	}, "inbucket", nil)
+	require.NoError(t, err)
+
+	r.Forward("from@example.com", []string{"x@b.example", "y@other.example"}, []byte("msg"))
+
+	status := r.QueueStatus()
+	require.Len(t, status.Entries, 2)
+	assert.Equal(t, "b", status.Entries[0].Target)
+	assert.Equal(t, "a", status.Entries[1].Target)
+	assert.Equal(t, []string{"y@other.example"}, status.Entries[1].Recipients)
+}
+
+func TestForwardNoRoutes(t *testing.T) {
+	r, err := relay.New(config.Relay{Targets: map[string]string{"a": closedTarget}},
+		"inbucket", nil)
+	require.NoError(t, err)
+	assert.False(t, r.Forwarding())
+
+	r.Forward("from@example.com", []string{"x@a.example"}, []byte("msg"))
+	assert.Empty(t, r.QueueStatus().Entries)
+}
+
+func TestForwardUnknownTarget(t *testing.T) {
+	_, err := relay.New(config.Relay{
+		Targets:        map[string]string{"a": closedTarget},
+		ForwardDomains: map[string]string{"a.example": "b"},
+	}, "inbucket", nil)
+	assert.ErrorIs(t, err, relay.ErrUnknownTarget)
+}
+
+func TestForwardRetries(t *testing.T) {
+	upstream := startUpstream(t, "451 4.3.0 Try again later", "250 2.0.0 Ok")
+	r := startForwarder(t, config.Relay{
+		Targets:        map[string]string{"up": "smtp://" + upstream.addr},
+		ForwardDomains: map[string]string{"*": "up"},
+		RetryInterval:  10 * time.Millisecond,
+		MaxAttempts:    3,
+	})
+
+	r.Forward("from@example.com", []string{"to@example.com"}, []byte("Subject: fwd\r\n\r\nbody\r\n"))
+
+	first := upstream.wait(t)
+	second := upstream.wait(t)
+	assert.Equal(t, first, second)
+	assert.Equal(t, "Subject: fwd\r\n\r\nbody\r\n", second.data)
+	require.Eventually(t, func() bool { return r.QueueStatus().Delivered == 1 },
+		5*time.Second, 10*time.Millisecond)
+	status := r.QueueStatus()
+	assert.Empty(t, status.Entries)
+	assert.Equal(t, int64(0), status.Failed)
+}
+
+func TestForwardDeliversInQueueOrder(t *testing.T) {
+	upstream := startUpstream(t, "250 2.0.0 Ok")
+	r, err := relay.New(config.Relay{
+		Targets:        map[string]string{"up": "smtp://" + upstream.addr},
+		ForwardDomains: map[string]string{"*": "up"},
+		Timeout:        5 * time.Second,
+	}, "inbucket", nil)
+	require.NoError(t, err)
+
+	// Queue forwards before starting the worker, so they are all due together.
+	var want []string
+	for i := range 8 {
+		rcpt := fmt.Sprintf("to%d@example.com", i)
+		want = append(want, rcpt)
+		r.Forward("from@example.com", []string{rcpt}, []byte("body\r\n"))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go r.Start(ctx)
+
+	var got []string
+	for range want {
+		got = append(got, upstream.wait(t).rcpts...)
+	}
+	assert.Equal(t, want, got)
+}
+
+func TestForwardPermanentFailure(t *testing.T) {
+	upstream := startUpstream(t, "554 5.7.1 Rejected")
+	r := startForwarder(t, config.Relay{
+		Targets:        map[string]string{"up": "smtp://" + upstream.addr},
+		ForwardDomains: map[string]string{"*": "up"},
+		RetryInterval:  10 * time.Millisecond,
+		MaxAttempts:    3,
+	})
+
+	r.Forward("from@example.com", []string{"to@example.com"}, []byte("body\r\n"))
+
+	upstream.wait(t)
+	require.Eventually(t, func() bool { return r.QueueStatus().Failed == 1 },
+		5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, r.QueueStatus().Entries)
+	select {
+	case <-upstream.done:
+		t.Error("Rejected message should not be retried")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestForwardGivesUp(t *testing.T) {
+	r := startForwarder(t, config.Relay{
+		Targets:        map[string]string{"closed": closedTarget},
+		ForwardDomains: map[string]string{"*": "closed"},
+		RetryInterval:  10 * time.Millisecond,
+		MaxAttempts:    2,
+	})
+
+	r.Forward("from@example.com", []string{"to@example.com"}, []byte("body\r\n"))
+
+	require.Eventually(t, func() bool { return r.QueueStatus().Failed == 1 },
+		5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, r.QueueStatus().Entries)
+}
+
+func TestForwardQueueFull(t *testing.T) {
+	r, err := relay.New(config.Relay{
+		Targets:        map[string]string{"a": closedTarget},
+		ForwardDomains: map[string]string{"*": "a"},
+		QueueSize:      1,
+	}, "inbucket", nil)
+	require.NoError(t, err)
+
+	r.Forward("from@example.com", []string{"x@a.example"}, []byte("msg"))
+	r.Forward("from@example.com", []string{"y@a.example"}, []byte("msg"))
+
+	status := r.QueueStatus()
+	assert.Len(t, status.Entries, 1)
+	assert.Equal(t, int64(1), status.Dropped)
+}
+
+// startForwarder creates a Relay and starts its queue worker for the duration of the test.
+func startForwarder(t *testing.T, conf config.Relay) *relay.Relay {
+	t.Helper()
+	conf.Timeout = 5 * time.Second
+	r, err := relay.New(conf, "inbucket", nil)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go r.Start(ctx)
+	return r
+}
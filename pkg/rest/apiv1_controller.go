@@ -1,6 +1,7 @@
 package rest
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 	"encoding/json"
 	"strconv"
 
+	"github.com/inbucket/inbucket/v3/pkg/message"
 	"github.com/inbucket/inbucket/v3/pkg/rest/model"
 	"github.com/inbucket/inbucket/v3/pkg/server/web"
 	"github.com/inbucket/inbucket/v3/pkg/storage"
@@ -77,6 +79,29 @@ func MailboxShowV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (
 			MD5:          hex.EncodeToString(checksum[:]),
 		}
 	}
+	var session *model.JSONSessionInfoV1
+	if si := msg.Session; si != nil {
+		session = &model.JSONSessionInfoV1{
+			AuthUser:   si.AuthUser,
+			Helo:       si.Helo,
+			RemoteAddr: si.RemoteAddr,
+			TLSVersion: si.TLSVersion,
+			TLSCipher:  si.TLSCipher,
+			MailFrom:   si.MailFrom,
+			RcptTo:     si.RcptTo,
+			Transcript: si.Transcript != "",
+		}
+	}
+	var authResults []*model.JSONAuthResultV1
+	for _, ar := range msg.AuthResults {
+		authResults = append(authResults, &model.JSONAuthResultV1{
+			Method:   ar.Method,
+			Result:   ar.Result,
+			Domain:   ar.Domain,
+			Selector: ar.Selector,
+			Reason:   ar.Reason,
+		})
+	}
 	return web.RenderJSON(w,
 		&model.JSONMessageV1{
 			Mailbox:     name,
@@ -88,6 +113,8 @@ func MailboxShowV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (
 			PosixMillis: msg.Date.UnixNano() / 1000000,
 			Size:        msg.Size,
 			Seen:        msg.Seen,
+			Session:     session,
+			AuthResults: authResults,
 			Header:      msg.Header(),
 			Body: &model.JSONMessageBodyV1{
 				Text: msg.Text(),
@@ -161,6 +188,28 @@ func MailboxSourceV1(w http.ResponseWriter, req *http.Request, ctx *web.Context)
 	return err
 }
 
+// MailboxTranscriptV1 displays the SMTP session transcript of a message
+func MailboxTranscriptV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := ctx.Manager.MailboxForAddress(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	msg, err := ctx.Manager.GetMessage(name, id)
+	if err != nil && err != storage.ErrNotExist {
+		return fmt.Errorf("GetMessage(%q) failed: %v", id, err)
+	}
+	if msg == nil || msg.Session == nil || msg.Session.Transcript == "" {
+		http.NotFound(w, req)
+		return nil
+	}
+	// Output session transcript
+	w.Header().Set("Content-Type", "text/plain")
+	_, err = io.WriteString(w, msg.Session.Transcript)
+	return err
+}
+
 // MailboxDeleteV1 removes a particular message from a mailbox
 func MailboxDeleteV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
 	// Don't have to validate these aren't empty, Gorilla returns 404
@@ -174,6 +223,10 @@ func MailboxDeleteV1(w http.ResponseWriter, req *http.Request, ctx *web.Context)
 		http.NotFound(w, req)
 		return nil
 	}
+	if errors.Is(err, message.ErrDeleteDenied) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil
+	}
 	if err != nil {
 		// This doesn't indicate missing, likely an IO error
 		return fmt.Errorf("RemoveMessage(%q) failed: %v", id, err)
@@ -172,6 +172,18 @@ func TestRestMessage(t *testing.T) {
 			Subject: "subject 1",
 			Date:    time.Date(2012, 2, 1, 10, 11, 12, 253, tzPST),
 			Seen:    true,
+			Session: &event.SessionInfo{
+				AuthUser:   "user1",
+				Helo:       "client.host",
+				RemoteAddr: "192.0.2.1",
+				TLSVersion: "TLS 1.3",
+				TLSCipher:  "TLS_AES_128_GCM_SHA256",
+				MailFrom:   "from1@host",
+				RcptTo:     []string{"to1@host"},
+			},
+			AuthResults: []event.AuthResult{
+				{Method: "dkim", Result: "fail", Domain: "host", Selector: "s1", Reason: "bad signature"},
+			},
 		},
 		&enmime.Envelope{
 			Text: "This is some text",
@@ -220,6 +232,19 @@ func TestRestMessage(t *testing.T) {
 	decodedNumberEquals(t, result, "posix-millis", 1328119872000)
 	decodedNumberEquals(t, result, "size", 0)
 	decodedBoolEquals(t, result, "seen", true)
+	decodedStringEquals(t, result, "session/auth-user", "user1")
+	decodedStringEquals(t, result, "session/helo", "client.host")
+	decodedStringEquals(t, result, "session/remote-addr", "192.0.2.1")
+	decodedStringEquals(t, result, "session/tls-version", "TLS 1.3")
+	decodedStringEquals(t, result, "session/tls-cipher", "TLS_AES_128_GCM_SHA256")
+	decodedStringEquals(t, result, "session/mail-from", "from1@host")
+	decodedStringEquals(t, result, "session/rcpt-to/[0]", "to1@host")
+	decodedBoolEquals(t, result, "session/transcript", false)
+	decodedStringEquals(t, result, "auth-results/[0]/method", "dkim")
+	decodedStringEquals(t, result, "auth-results/[0]/result", "fail")
+	decodedStringEquals(t, result, "auth-results/[0]/domain", "host")
+	decodedStringEquals(t, result, "auth-results/[0]/selector", "s1")
+	decodedStringEquals(t, result, "auth-results/[0]/reason", "bad signature")
 	decodedStringEquals(t, result, "body/text", "This is some text")
 	decodedStringEquals(t, result, "body/html", "This is some HTML")
 	decodedStringEquals(t, result, "header/To/[0]", "fred@fish.com")
@@ -305,3 +330,44 @@ func TestRestMarkSeen(t *testing.T) {
 		_, _ = io.Copy(os.Stderr, logbuf)
 	}
 }
+
+func TestRestTranscript(t *testing.T) {
+	mm := test.NewManager()
+	logbuf := setupWebServer(mm)
+	transcript := "S: 220 inbucket\r\nC: QUIT\r\n"
+	mm.AddMessage("good", &message.Message{MessageMetadata: event.MessageMetadata{
+		Mailbox: "good",
+		ID:      "0001",
+		Session: &event.SessionInfo{Transcript: transcript},
+	}})
+	mm.AddMessage("good", &message.Message{MessageMetadata: event.MessageMetadata{
+		Mailbox: "good",
+		ID:      "0002",
+	}})
+
+	tcs := map[string]int{
+		"http://localhost/api/v1/mailbox/good/0001/transcript":       200,
+		"http://localhost/api/v1/mailbox/good/0002/transcript":       404,
+		"http://localhost/api/v1/mailbox/good/0003/transcript":       404,
+		"http://localhost/api/v1/mailbox/messageerr/0001/transcript": 500,
+	}
+	for url, expectCode := range tcs {
+		w, err := testRestGet(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != expectCode {
+			t.Errorf("GET %v: Expected code %v, got %v", url, expectCode, w.Code)
+		}
+		if expectCode == 200 && w.Body.String() != transcript {
+			t.Errorf("GET %v: got body %q, want: %q", url, w.Body.String(), transcript)
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
@@ -0,0 +1,93 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/inbucket/inbucket/v3/pkg/relay"
+	"github.com/inbucket/inbucket/v3/pkg/rest/model"
+	"github.com/inbucket/inbucket/v3/pkg/server/web"
+	"github.com/inbucket/inbucket/v3/pkg/storage"
+)
+
+// MailboxReleaseV1 sends a message to an upstream SMTP server, and renders the server's response
+func MailboxReleaseV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := ctx.Manager.MailboxForAddress(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	if ctx.Relay == nil {
+		http.Error(w, "No relay targets configured", http.StatusNotImplemented)
+		return nil
+	}
+	var rr model.JSONReleaseRequestV1
+	if err := json.NewDecoder(req.Body).Decode(&rr); err != nil && err != io.EOF {
+		http.Error(w, "Failed to decode JSON: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	result, err := ctx.Relay.Release(name, id, relay.Options{
+		Target:     rr.Target,
+		Recipients: rr.Recipients,
+	})
+	switch {
+	case err == storage.ErrNotExist:
+		http.NotFound(w, req)
+		return nil
+	case errors.Is(err, relay.ErrNoTarget), errors.Is(err, relay.ErrUnknownTarget),
+		errors.Is(err, relay.ErrNoRecipients):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	case err != nil && result == nil:
+		return fmt.Errorf("Release(%q) failed: %v", id, err)
+	}
+
+	jresult := &model.JSONReleaseResultV1{
+		Target:     result.Target,
+		From:       result.From,
+		Recipients: result.Recipients,
+		Code:       result.Code,
+		Message:    result.Message,
+	}
+	if err != nil {
+		// Upstream server failed or rejected the message.
+		jresult.Error = err.Error()
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusBadGateway)
+		return json.NewEncoder(w).Encode(jresult)
+	}
+	return web.RenderJSON(w, jresult)
+}
+
+// RelayQueueV1 renders the queue of messages being forwarded to upstream servers
+func RelayQueueV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	if ctx.Relay == nil {
+		http.Error(w, "No relay targets configured", http.StatusNotImplemented)
+		return nil
+	}
+	status := ctx.Relay.QueueStatus()
+	jqueue := &model.JSONRelayQueueV1{
+		Entries:   make([]*model.JSONRelayQueueEntryV1, len(status.Entries)),
+		Delivered: status.Delivered,
+		Failed:    status.Failed,
+		Dropped:   status.Dropped,
+	}
+	for i, e := range status.Entries {
+		jqueue.Entries[i] = &model.JSONRelayQueueEntryV1{
+			ID:          e.ID,
+			Target:      e.Target,
+			From:        e.From,
+			Recipients:  e.Recipients,
+			Created:     e.Created,
+			Attempts:    e.Attempts,
+			NextAttempt: e.NextAttempt,
+			LastError:   e.LastError,
+		}
+	}
+	return web.RenderJSON(w, jqueue)
+}
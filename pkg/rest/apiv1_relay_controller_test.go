@@ -0,0 +1,162 @@
+package rest
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/config"
+	"github.com/inbucket/inbucket/v3/pkg/extension"
+	"github.com/inbucket/inbucket/v3/pkg/message"
+	"github.com/inbucket/inbucket/v3/pkg/policy"
+	"github.com/inbucket/inbucket/v3/pkg/relay"
+	"github.com/inbucket/inbucket/v3/pkg/storage/mem"
+	"github.com/inbucket/inbucket/v3/pkg/test"
+)
+
+func TestRestMailboxRelease(t *testing.T) {
+	// Reserve a port with nothing listening on it.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := ln.Addr().String()
+	_ = ln.Close()
+
+	// Relay reads message source, so a real store is used.
+	extHost := extension.NewHost()
+	store, err := mem.New(config.Storage{}, extHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := &message.StoreManager{
+		AddrPolicy: &policy.Addressing{Config: &config.Root{
+			MailboxNaming: config.FullNaming,
+			SMTP:          config.SMTP{DefaultAccept: true, DefaultStore: true},
+		}},
+		Store:   store,
+		ExtHost: extHost,
+	}
+	origin, _ := mm.AddrPolicy.ParseOrigin("from@example.com")
+	recip, _ := mm.AddrPolicy.NewRecipient("good@example.com")
+	err = mm.Deliver(origin, []*policy.Recipient{recip}, "",
+		[]byte("From: from@example.com\r\nSubject: release\r\n\r\nbody\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := mm.GetMetadata("good@example.com")
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Expected 1 message, got %v (err %v)", len(msgs), err)
+	}
+	logbuf := setupWebServer(mm)
+	url := "http://localhost/api/v1/mailbox/good@example.com/" + msgs[0].ID + "/release"
+
+	// No relay configured.
+	w, err := testRestPost(url, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 501 {
+		t.Errorf("Expected code %v, got %v", 501, w.Code)
+	}
+
+	rl, err := relay.New(config.Relay{
+		Targets: map[string]string{"closed": "smtp://" + closedAddr},
+		Timeout: time.Second,
+	}, "inbucket", mm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupWebServerWithRelay(mm, rl)
+
+	tcs := []struct {
+		url, body  string
+		expectCode int
+	}{
+		{url, `{"target":"unknown"}`, 400},
+		{url, `not json`, 400},
+		{"http://localhost/api/v1/mailbox/good@example.com/9999/release", "", 404},
+		{url, `{"recipients":["real@example.com"]}`, 502},
+	}
+	for _, tc := range tcs {
+		w, err = testRestPost(tc.url, tc.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tc.expectCode {
+			t.Errorf("POST %v %v: Expected code %v, got %v", tc.url, tc.body, tc.expectCode, w.Code)
+		}
+	}
+
+	// Last response describes the failed release.
+	var result interface{}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Errorf("Failed to decode JSON: %v", err)
+	}
+	decodedStringEquals(t, result, "target", "closed")
+	decodedStringEquals(t, result, "from", "from@example.com")
+	decodedStringEquals(t, result, "recipients/[0]", "real@example.com")
+	decodedNumberEquals(t, result, "code", 0)
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestRestRelayQueue(t *testing.T) {
+	mm := test.NewManager()
+	logbuf := setupWebServer(mm)
+	const url = "http://localhost/api/v1/relay/queue"
+
+	// No relay configured.
+	w, err := testRestGet(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 501 {
+		t.Errorf("Expected code %v, got %v", 501, w.Code)
+	}
+
+	// Queue worker is not started, so forwards remain queued.
+	rl, err := relay.New(config.Relay{
+		Targets:        map[string]string{"up": "smtp://127.0.0.1:1"},
+		ForwardDomains: map[string]string{"example.com": "up"},
+	}, "inbucket", mm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.Forward("from@example.org", []string{"a@example.com", "b@example.org"}, []byte("body"))
+	setupWebServerWithRelay(mm, rl)
+
+	w, err = testRestGet(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code %v, got %v", 200, w.Code)
+	}
+	var result interface{}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Errorf("Failed to decode JSON: %v", err)
+	}
+	decodedStringEquals(t, result, "entries/[0]/id", "1")
+	decodedStringEquals(t, result, "entries/[0]/target", "up")
+	decodedStringEquals(t, result, "entries/[0]/from", "from@example.org")
+	decodedStringEquals(t, result, "entries/[0]/recipients/[0]", "a@example.com")
+	decodedNumberEquals(t, result, "entries/[0]/attempts", 0)
+	decodedNumberEquals(t, result, "delivered", 0)
+	decodedNumberEquals(t, result, "dropped", 0)
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
@@ -0,0 +1,89 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/message"
+	"github.com/inbucket/inbucket/v3/pkg/rest/model"
+	"github.com/inbucket/inbucket/v3/pkg/server/web"
+	"github.com/inbucket/inbucket/v3/pkg/storage"
+	"github.com/inbucket/inbucket/v3/pkg/stringutil"
+)
+
+// SearchV1 renders the messages from all mailboxes matching the query parameters
+func SearchV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	q, err := parseSearchQuery(req.URL.Query(), ctx.Manager)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	messages, total, err := ctx.Manager.Search(q)
+	if errors.Is(err, message.ErrSearchUnsupported) {
+		http.Error(w, "Search requires the sqlite storage type", http.StatusNotImplemented)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("search failed: %v", err)
+	}
+	jresult := &model.JSONSearchResultV1{
+		Messages: make([]*model.JSONMessageHeaderV1, len(messages)),
+		Total:    total,
+	}
+	for i, msg := range messages {
+		jresult.Messages[i] = &model.JSONMessageHeaderV1{
+			Mailbox:     msg.Mailbox,
+			ID:          msg.ID,
+			From:        stringutil.StringAddress(msg.From),
+			To:          stringutil.StringAddressList(msg.To),
+			Subject:     msg.Subject,
+			Date:        msg.Date,
+			PosixMillis: msg.Date.UnixNano() / 1000000,
+			Size:        msg.Size,
+			Seen:        msg.Seen,
+		}
+	}
+	return web.RenderJSON(w, jresult)
+}
+
+// parseSearchQuery builds a storage.Query from the search request parameters.
+func parseSearchQuery(params url.Values, manager message.Manager) (storage.Query, error) {
+	q := storage.Query{
+		From:    params.Get("from"),
+		To:      params.Get("to"),
+		Subject: params.Get("subject"),
+	}
+	var err error
+	if v := params.Get("mailbox"); v != "" {
+		if q.Mailbox, err = manager.MailboxForAddress(v); err != nil {
+			return q, fmt.Errorf("invalid mailbox: %v", err)
+		}
+	}
+	if v := params.Get("seen"); v != "" {
+		seen, err := strconv.ParseBool(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid seen: %q", v)
+		}
+		q.Seen = &seen
+	}
+	if v := params.Get("after"); v != "" {
+		if q.After, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, fmt.Errorf("invalid after, expected RFC 3339 time: %q", v)
+		}
+	}
+	if v := params.Get("before"); v != "" {
+		if q.Before, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, fmt.Errorf("invalid before, expected RFC 3339 time: %q", v)
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 0 {
+			return q, fmt.Errorf("invalid limit: %q", v)
+		}
+	}
+	return q, nil
+}
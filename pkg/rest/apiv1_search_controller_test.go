@@ -0,0 +1,101 @@
+package rest
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/config"
+	"github.com/inbucket/inbucket/v3/pkg/extension"
+	"github.com/inbucket/inbucket/v3/pkg/message"
+	"github.com/inbucket/inbucket/v3/pkg/policy"
+	"github.com/inbucket/inbucket/v3/pkg/storage/sqlite"
+	"github.com/inbucket/inbucket/v3/pkg/test"
+)
+
+func TestRestSearch(t *testing.T) {
+	// Store does not support search.
+	logbuf := setupWebServer(test.NewManager())
+	w, err := testRestGet("http://localhost/api/v1/search?subject=x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 501 {
+		t.Errorf("Expected code %v, got %v", 501, w.Code)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "sqlite storage") {
+		t.Errorf("Expected body to explain sqlite storage is required, got %q", body)
+	}
+
+	extHost := extension.NewHost()
+	store, err := sqlite.New(config.Storage{
+		Params: map[string]string{"path": filepath.Join(t.TempDir(), "inbucket.db")},
+	}, extHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.(*sqlite.Store).Close()
+	mm := &message.StoreManager{
+		AddrPolicy: &policy.Addressing{Config: &config.Root{
+			MailboxNaming: config.FullNaming,
+			SMTP:          config.SMTP{DefaultAccept: true, DefaultStore: true},
+		}},
+		Store:   store,
+		ExtHost: extHost,
+	}
+	now := time.Now()
+	test.DeliverToStore(t, store, "alice@example.com", "Password Reset", now.Add(-time.Hour))
+	test.DeliverToStore(t, store, "bob@example.com", "Welcome", now)
+	test.DeliverToStore(t, store, "bob@example.com", "password reset", now)
+	logbuf = setupWebServer(mm)
+
+	w, err = testRestGet("http://localhost/api/v1/search?subject=reset&to=%3Csomebody@&limit=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code %v, got %v", 200, w.Code)
+	}
+	var result interface{}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Errorf("Failed to decode JSON: %v", err)
+	}
+	decodedNumberEquals(t, result, "total", 2)
+	decodedStringEquals(t, result, "messages/[0]/mailbox", "alice@example.com")
+	decodedStringEquals(t, result, "messages/[0]/subject", "Password Reset")
+	decodedStringEquals(t, result, "messages/[0]/to/[0]", "Some Body <somebody@host>")
+
+	w, err = testRestGet("http://localhost/api/v1/search?mailbox=BOB@example.com&after=" +
+		now.Add(-time.Minute).UTC().Format(time.RFC3339))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result = nil
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Errorf("Failed to decode JSON: %v", err)
+	}
+	decodedNumberEquals(t, result, "total", 2)
+	decodedStringEquals(t, result, "messages/[1]/subject", "password reset")
+
+	// Invalid parameters.
+	for _, params := range []string{"seen=maybe", "after=yesterday", "limit=-1"} {
+		w, err = testRestGet("http://localhost/api/v1/search?" + params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 400 {
+			t.Errorf("%v: expected code %v, got %v", params, 400, w.Code)
+		}
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
@@ -0,0 +1,44 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/inbucket/inbucket/v3/pkg/server/smtp"
+	"github.com/inbucket/inbucket/v3/pkg/server/web"
+)
+
+// SMTPFaultsListV1 renders the active SMTP fault injection rules
+func SMTPFaultsListV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	return web.RenderJSON(w, ctx.SMTPFaults.Rules())
+}
+
+// SMTPFaultsAddV1 adds an SMTP fault injection rule, and renders it with its assigned ID
+func SMTPFaultsAddV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	var rule smtp.FaultRule
+	if err := json.NewDecoder(req.Body).Decode(&rule); err != nil {
+		http.Error(w, "Failed to decode JSON: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	rule, err = ctx.SMTPFaults.Add(rule)
+	if err != nil {
+		http.Error(w, "Invalid fault rule: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	return web.RenderJSON(w, rule)
+}
+
+// SMTPFaultsClearV1 removes all SMTP fault injection rules
+func SMTPFaultsClearV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	ctx.SMTPFaults.Clear()
+	return web.RenderJSON(w, "OK")
+}
+
+// SMTPFaultsDeleteV1 removes a particular SMTP fault injection rule
+func SMTPFaultsDeleteV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	if !ctx.SMTPFaults.Remove(ctx.Vars["id"]) {
+		http.NotFound(w, req)
+		return nil
+	}
+	return web.RenderJSON(w, "OK")
+}
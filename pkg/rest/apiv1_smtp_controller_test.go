@@ -0,0 +1,87 @@
+package rest
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/test"
+)
+
+func TestRestSMTPFaults(t *testing.T) {
+	mm := test.NewManager()
+	logbuf := setupWebServer(mm)
+	const url = "http://localhost/api/v1/smtp/faults"
+
+	// Add valid and invalid rules.
+	w, err := testRestPost(url, `{"stage":"rcpt","action":"tempfail","pattern":"*@retry.com"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code %v, got %v", 200, w.Code)
+	}
+	var result interface{}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Errorf("Failed to decode JSON: %v", err)
+	}
+	decodedStringEquals(t, result, "id", "1")
+	decodedNumberEquals(t, result, "code", 451)
+
+	for _, body := range []string{`{"stage":"rcpt","action":"explode"}`, `not json`} {
+		w, err = testRestPost(url, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 400 {
+			t.Errorf("POST %v: Expected code %v, got %v", body, 400, w.Code)
+		}
+	}
+	_, _ = testRestPost(url, `{"stage":"data","action":"drop"}`)
+
+	// List rules.
+	w, err = testRestGet(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rules []interface{}
+	if err := json.NewDecoder(w.Body).Decode(&rules); err != nil {
+		t.Errorf("Failed to decode JSON: %v", err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("Expected 2 rules, got %v", len(rules))
+	}
+	decodedStringEquals(t, rules, "[0]/pattern", "*@retry.com")
+	decodedStringEquals(t, rules, "[1]/action", "drop")
+
+	// Delete rules.
+	deletes := []struct {
+		path       string
+		expectCode int
+	}{{"/1", 200}, {"/1", 404}, {"", 200}}
+	for _, tc := range deletes {
+		w, err = testRestDelete(url + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tc.expectCode {
+			t.Errorf("DELETE %q: Expected code %v, got %v", tc.path, tc.expectCode, w.Code)
+		}
+	}
+	w, err = testRestGet(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := w.Body.String(); body != "[]\n" {
+		t.Errorf("Expected empty rule list, got %q", body)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
@@ -0,0 +1,48 @@
+package rest
+
+import (
+	"net/http"
+
+	"github.com/inbucket/inbucket/v3/pkg/rest/model"
+	"github.com/inbucket/inbucket/v3/pkg/server/web"
+)
+
+// WebhookDeadLettersV1 renders the webhook posts that failed, along with delivery statistics
+func WebhookDeadLettersV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	if ctx.Webhooks == nil {
+		http.Error(w, "No webhook URLs configured", http.StatusNotImplemented)
+		return nil
+	}
+	status := ctx.Webhooks.Status()
+	jdead := &model.JSONWebhookDeadLettersV1{
+		Entries:   make([]*model.JSONWebhookDeliveryV1, len(status.DeadLetters)),
+		Pending:   len(status.Pending),
+		Delivered: status.Delivered,
+		Failed:    status.Failed,
+		Dropped:   status.Dropped,
+	}
+	for i, d := range status.DeadLetters {
+		jdead.Entries[i] = &model.JSONWebhookDeliveryV1{
+			ID:        d.ID,
+			URL:       d.URL,
+			Event:     d.Event,
+			Mailbox:   d.Mailbox,
+			MessageID: d.MessageID,
+			Created:   d.Created,
+			Attempts:  d.Attempts,
+			LastError: d.LastError,
+			Payload:   d.Payload,
+		}
+	}
+	return web.RenderJSON(w, jdead)
+}
+
+// WebhookDeadLettersClearV1 empties the webhook dead-letter list
+func WebhookDeadLettersClearV1(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	if ctx.Webhooks == nil {
+		http.Error(w, "No webhook URLs configured", http.StatusNotImplemented)
+		return nil
+	}
+	ctx.Webhooks.ClearDeadLetters()
+	return web.RenderJSON(w, "OK")
+}
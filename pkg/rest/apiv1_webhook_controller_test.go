@@ -0,0 +1,103 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/config"
+	"github.com/inbucket/inbucket/v3/pkg/extension"
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"github.com/inbucket/inbucket/v3/pkg/test"
+	"github.com/inbucket/inbucket/v3/pkg/webhook"
+)
+
+func TestRestWebhookDeadLetters(t *testing.T) {
+	mm := test.NewManager()
+	logbuf := setupWebServer(mm)
+	const url = "http://localhost/api/v1/webhook/dead-letters"
+
+	// No webhooks configured.
+	w, err := testRestGet(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 501 {
+		t.Errorf("Expected code %v, got %v", 501, w.Code)
+	}
+
+	// Endpoint rejects all posts.
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer endpoint.Close()
+	extHost := extension.NewHost()
+	wh, err := webhook.New(config.Webhook{
+		URLs:           []string{endpoint.URL},
+		MaxAttempts:    1,
+		DeadLetterSize: 10,
+	}, extHost, mm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wh.Start(ctx)
+	setupWebServerWithWebhooks(mm, wh)
+
+	wh.Notify(webhook.EventMessageStored,
+		event.MessageMetadata{Mailbox: "good", ID: "0001", Subject: "hook"})
+	deadline := time.Now().Add(5 * time.Second)
+	for wh.Status().Failed == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Webhook post did not fail within timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w, err = testRestGet(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Fatalf("Expected code %v, got %v", 200, w.Code)
+	}
+	var result interface{}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Errorf("Failed to decode JSON: %v", err)
+	}
+	decodedStringEquals(t, result, "entries/[0]/id", "1")
+	decodedStringEquals(t, result, "entries/[0]/url", endpoint.URL)
+	decodedStringEquals(t, result, "entries/[0]/event", "message-stored")
+	decodedStringEquals(t, result, "entries/[0]/mailbox", "good")
+	decodedStringEquals(t, result, "entries/[0]/message-id", "0001")
+	decodedNumberEquals(t, result, "entries/[0]/attempts", 1)
+	decodedStringEquals(t, result, "entries/[0]/last-error", "webhook endpoint replied 403 Forbidden")
+	decodedStringEquals(t, result, "entries/[0]/payload/subject", "hook")
+	decodedNumberEquals(t, result, "pending", 0)
+	decodedNumberEquals(t, result, "failed", 1)
+
+	// Clear the dead-letter list.
+	w, err = testRestDelete(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Errorf("Expected code %v, got %v", 200, w.Code)
+	}
+	if n := len(wh.Status().DeadLetters); n != 0 {
+		t.Errorf("Expected dead-letter list to be empty, got %v entries", n)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		_, _ = io.Copy(os.Stderr, logbuf)
+	}
+}
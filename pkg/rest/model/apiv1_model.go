@@ -1,6 +1,7 @@
 package model
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -28,11 +29,34 @@ type JSONMessageV1 struct {
 	PosixMillis int64                      `json:"posix-millis"`
 	Size        int64                      `json:"size"`
 	Seen        bool                       `json:"seen"`
+	Session     *JSONSessionInfoV1         `json:"session,omitempty"`
+	AuthResults []*JSONAuthResultV1        `json:"auth-results,omitempty"`
 	Body        *JSONMessageBodyV1         `json:"body"`
 	Header      map[string][]string        `json:"header"`
 	Attachments []*JSONMessageAttachmentV1 `json:"attachments"`
 }
 
+// JSONSessionInfoV1 contains details of the SMTP session a message was received on.
+type JSONSessionInfoV1 struct {
+	AuthUser   string   `json:"auth-user"`
+	Helo       string   `json:"helo"`
+	RemoteAddr string   `json:"remote-addr"`
+	TLSVersion string   `json:"tls-version"`
+	TLSCipher  string   `json:"tls-cipher"`
+	MailFrom   string   `json:"mail-from"`
+	RcptTo     []string `json:"rcpt-to"`
+	Transcript bool     `json:"transcript"` // True if a transcript is available.
+}
+
+// JSONAuthResultV1 contains the outcome of a message authentication check, such as DKIM.
+type JSONAuthResultV1 struct {
+	Method   string `json:"method"`
+	Result   string `json:"result"`
+	Domain   string `json:"domain"`
+	Selector string `json:"selector"`
+	Reason   string `json:"reason"`
+}
+
 // JSONMessageAttachmentV1 contains information about a MIME attachment.
 type JSONMessageAttachmentV1 struct {
 	FileName     string `json:"filename"`
@@ -47,3 +71,67 @@ type JSONMessageBodyV1 struct {
 	Text string `json:"text"`
 	HTML string `json:"html"`
 }
+
+// JSONReleaseRequestV1 specifies where a released message will be sent, all fields are optional.
+type JSONReleaseRequestV1 struct {
+	Target     string   `json:"target"`
+	Recipients []string `json:"recipients"`
+}
+
+// JSONReleaseResultV1 contains the upstream server's response to a released message.
+type JSONReleaseResultV1 struct {
+	Target     string   `json:"target"`
+	From       string   `json:"from"`
+	Recipients []string `json:"recipients"`
+	Code       int      `json:"code"`
+	Message    string   `json:"message"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// JSONRelayQueueV1 describes the queue of messages being forwarded to upstream servers.
+type JSONRelayQueueV1 struct {
+	Entries   []*JSONRelayQueueEntryV1 `json:"entries"`
+	Delivered int64                    `json:"delivered"`
+	Failed    int64                    `json:"failed"`
+	Dropped   int64                    `json:"dropped"`
+}
+
+// JSONRelayQueueEntryV1 is a message awaiting delivery to an upstream server.
+type JSONRelayQueueEntryV1 struct {
+	ID          string    `json:"id"`
+	Target      string    `json:"target"`
+	From        string    `json:"from"`
+	Recipients  []string  `json:"recipients"`
+	Created     time.Time `json:"created"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next-attempt"`
+	LastError   string    `json:"last-error"`
+}
+
+// JSONWebhookDeadLettersV1 describes the webhook posts that failed, and the delivery statistics.
+type JSONWebhookDeadLettersV1 struct {
+	Entries   []*JSONWebhookDeliveryV1 `json:"entries"`
+	Pending   int                      `json:"pending"`
+	Delivered int64                    `json:"delivered"`
+	Failed    int64                    `json:"failed"`
+	Dropped   int64                    `json:"dropped"`
+}
+
+// JSONWebhookDeliveryV1 is a message event posted to a webhook URL.
+type JSONWebhookDeliveryV1 struct {
+	ID        string          `json:"id"`
+	URL       string          `json:"url"`
+	Event     string          `json:"event"`
+	Mailbox   string          `json:"mailbox"`
+	MessageID string          `json:"message-id"`
+	Created   time.Time       `json:"created"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last-error"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// JSONSearchResultV1 lists the messages matching a search of all mailboxes.
+type JSONSearchResultV1 struct {
+	Messages []*JSONMessageHeaderV1 `json:"messages"`
+	Total    int64                  `json:"total"` // Matching messages, ignoring the limit.
+}
@@ -18,8 +18,28 @@ func SetupRoutes(r *mux.Router) {
 		web.Handler(MailboxMarkSeenV1)).Name("MailboxMarkSeenV1").Methods("PATCH")
 	r.Path("/v1/mailbox/{name}/{id}").Handler(
 		web.Handler(MailboxDeleteV1)).Name("MailboxDeleteV1").Methods("DELETE")
+	r.Path("/v1/mailbox/{name}/{id}/release").Handler(
+		web.Handler(MailboxReleaseV1)).Name("MailboxReleaseV1").Methods("POST")
 	r.Path("/v1/mailbox/{name}/{id}/source").Handler(
 		web.Handler(MailboxSourceV1)).Name("MailboxSourceV1").Methods("GET")
+	r.Path("/v1/mailbox/{name}/{id}/transcript").Handler(
+		web.Handler(MailboxTranscriptV1)).Name("MailboxTranscriptV1").Methods("GET")
+	r.Path("/v1/relay/queue").Handler(
+		web.Handler(RelayQueueV1)).Name("RelayQueueV1").Methods("GET")
+	r.Path("/v1/search").Handler(
+		web.Handler(SearchV1)).Name("SearchV1").Methods("GET")
+	r.Path("/v1/smtp/faults").Handler(
+		web.Handler(SMTPFaultsListV1)).Name("SMTPFaultsListV1").Methods("GET")
+	r.Path("/v1/smtp/faults").Handler(
+		web.Handler(SMTPFaultsAddV1)).Name("SMTPFaultsAddV1").Methods("POST")
+	r.Path("/v1/smtp/faults").Handler(
+		web.Handler(SMTPFaultsClearV1)).Name("SMTPFaultsClearV1").Methods("DELETE")
+	r.Path("/v1/smtp/faults/{id}").Handler(
+		web.Handler(SMTPFaultsDeleteV1)).Name("SMTPFaultsDeleteV1").Methods("DELETE")
+	r.Path("/v1/webhook/dead-letters").Handler(
+		web.Handler(WebhookDeadLettersV1)).Name("WebhookDeadLettersV1").Methods("GET")
+	r.Path("/v1/webhook/dead-letters").Handler(
+		web.Handler(WebhookDeadLettersClearV1)).Name("WebhookDeadLettersClearV1").Methods("DELETE")
 	r.Path("/v1/monitor/messages").Handler(
 		web.Handler(MonitorAllMessagesV1)).Name("MonitorAllMessagesV1").Methods("GET")
 	r.Path("/v1/monitor/messages/{name}").Handler(
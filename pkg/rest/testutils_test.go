@@ -14,7 +14,10 @@ import (
 	"github.com/inbucket/inbucket/v3/pkg/config"
 	"github.com/inbucket/inbucket/v3/pkg/message"
 	"github.com/inbucket/inbucket/v3/pkg/msghub"
+	"github.com/inbucket/inbucket/v3/pkg/relay"
+	"github.com/inbucket/inbucket/v3/pkg/server/smtp"
 	"github.com/inbucket/inbucket/v3/pkg/server/web"
+	"github.com/inbucket/inbucket/v3/pkg/webhook"
 )
 
 func testRestGet(url string) (*httptest.ResponseRecorder, error) {
@@ -51,7 +54,53 @@ func testRestPatch(url string, body string) (*httptest.ResponseRecorder, error)
 	return w, nil
 }
 
+func testRestPost(url string, body string) (*httptest.ResponseRecorder, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(body))
+	req.Header.Add("Accept", "application/json")
+	if err != nil {
+		return nil, err
+	}
+
+	// Pass request to handlers directly.
+	w := httptest.NewRecorder()
+	web.Router.ServeHTTP(w, req)
+
+	return w, nil
+}
+
+func testRestDelete(url string) (*httptest.ResponseRecorder, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, nil)
+	req.Header.Add("Accept", "application/json")
+	if err != nil {
+		return nil, err
+	}
+
+	// Pass request to handlers directly.
+	w := httptest.NewRecorder()
+	web.Router.ServeHTTP(w, req)
+
+	return w, nil
+}
+
 func setupWebServer(mm message.Manager) *bytes.Buffer {
+	return setupWebServerWithRelay(mm, nil)
+}
+
+func setupWebServerWithRelay(mm message.Manager, rl *relay.Relay) *bytes.Buffer {
+	return setupWebServerWith(mm, rl, nil)
+}
+
+func setupWebServerWithWebhooks(mm message.Manager, wh *webhook.Dispatcher) *bytes.Buffer {
+	return setupWebServerWith(mm, nil, wh)
+}
+
+func setupWebServerWith(mm message.Manager, rl *relay.Relay, wh *webhook.Dispatcher) *bytes.Buffer {
 	// Capture log output
 	buf := new(bytes.Buffer)
 	log.SetOutput(buf)
@@ -63,7 +112,7 @@ func setupWebServer(mm message.Manager) *bytes.Buffer {
 		},
 	}
 	SetupRoutes(web.Router.PathPrefix("/api/").Subrouter())
-	web.NewServer(cfg, mm, &msghub.Hub{})
+	web.NewServer(cfg, mm, &msghub.Hub{}, smtp.NewFaults(), rl, wh)
 
 	return buf
 }
@@ -0,0 +1,259 @@
+// Package retryqueue delivers queued items in the background, retrying failed attempts with
+// exponential backoff.
+package retryqueue
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// maxRetryDelay caps the exponential backoff between delivery attempts.
+const maxRetryDelay = time.Hour
+
+// Entry is an item awaiting delivery.
+type Entry[T any] struct {
+	ID          string
+	Created     time.Time
+	Attempts    int       // Delivery attempts made so far.
+	NextAttempt time.Time // Time of the next delivery attempt, zero once dead-lettered.
+	LastError   string    // Error from the most recent attempt, if any.
+	Item        T
+	seq         int64 // Queue order, for entries due at the same time.
+}
+
+// Status describes the queue and dead-letter list.
+type Status[T any] struct {
+	Pending     []Entry[T] // Entries awaiting delivery, ordered by next attempt.
+	DeadLetters []Entry[T] // Failed entries, oldest first.
+	Delivered   int64      // Items delivered successfully.
+	Failed      int64      // Items rejected permanently, or out of attempts.
+	Dropped     int64      // Items discarded because the queue was full.
+}
+
+// Options configures a Queue.
+type Options[T any] struct {
+	Size           int           // Maximum number of entries awaiting delivery.
+	RetryInterval  time.Duration // Delay before the first retry, doubling after each failure.
+	MaxAttempts    int           // Delivery attempts before giving up.
+	DeadLetterSize int           // Failed entries to retain, zero to discard them.
+
+	// Send attempts delivery of entry, it should return promptly once ctx is cancelled.
+	Send func(ctx context.Context, entry Entry[T]) error
+	// Permanent returns true if a Send error should not be retried, nil retries all errors.
+	Permanent func(err error) bool
+	// Logger returns a logger describing entry.
+	Logger func(entry Entry[T]) zerolog.Logger
+}
+
+// Queue holds entries awaiting delivery, the dead-letter list, and delivery statistics.
+type Queue[T any] struct {
+	opts    Options[T]
+	mu      sync.Mutex
+	entries map[string]*Entry[T]
+	dead    []*Entry[T]
+	lastID  int64
+	status  Status[T]
+	wake    chan struct{} // Signals the worker that an entry was added.
+}
+
+// New creates an empty Queue, call Start to begin delivery.
+func New[T any](opts Options[T]) *Queue[T] {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 1
+	}
+	if opts.DeadLetterSize < 0 {
+		opts.DeadLetterSize = 0
+	}
+	if opts.Permanent == nil {
+		opts.Permanent = func(error) bool { return false }
+	}
+	return &Queue[T]{
+		opts:    opts,
+		entries: make(map[string]*Entry[T]),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Add queues item for delivery, returning false if the queue is full.
+func (q *Queue[T]) Add(item T) bool {
+	q.mu.Lock()
+	if len(q.entries) >= q.opts.Size {
+		q.status.Dropped++
+		q.mu.Unlock()
+		return false
+	}
+	now := time.Now()
+	q.lastID++
+	id := strconv.FormatInt(q.lastID, 10)
+	q.entries[id] = &Entry[T]{
+		ID:          id,
+		Created:     now,
+		NextAttempt: now,
+		Item:        item,
+		seq:         q.lastID,
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Status returns a snapshot of the queue and dead-letter list.
+func (q *Queue[T]) Status() Status[T] {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	status := q.status
+	status.Pending = make([]Entry[T], 0, len(q.entries))
+	for _, e := range q.entries {
+		status.Pending = append(status.Pending, *e)
+	}
+	sort.Slice(status.Pending, func(i, j int) bool {
+		return status.Pending[i].before(&status.Pending[j])
+	})
+	status.DeadLetters = make([]Entry[T], len(q.dead))
+	for i, e := range q.dead {
+		status.DeadLetters[i] = *e
+	}
+	return status
+}
+
+// ClearDeadLetters empties the dead-letter list.
+func (q *Queue[T]) ClearDeadLetters() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.dead = nil
+}
+
+// Start delivers queued entries until the context is cancelled.
+func (q *Queue[T]) Start(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-timer.C:
+		}
+
+		if next := q.deliverDue(ctx); next.IsZero() {
+			timer.Stop()
+		} else {
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+// deliverDue attempts delivery of each entry that is due, returning the time of the next attempt,
+// or zero if the queue is empty.
+func (q *Queue[T]) deliverDue(ctx context.Context) time.Time {
+	for ctx.Err() == nil {
+		entry, next := q.nextDue()
+		if entry == nil {
+			return next
+		}
+		q.attempt(ctx, entry)
+	}
+	return time.Time{}
+}
+
+// nextDue returns the entry that has been due for delivery longest, or the time the next entry
+// will be due.  Entries due at the same time are returned in queue order.
+func (q *Queue[T]) nextDue() (*Entry[T], time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var first *Entry[T]
+	for _, e := range q.entries {
+		if first == nil || e.before(first) {
+			first = e
+		}
+	}
+	if first == nil {
+		return nil, time.Time{}
+	}
+	if first.NextAttempt.After(time.Now()) {
+		return nil, first.NextAttempt
+	}
+	return first, time.Time{}
+}
+
+// attempt delivers entry, then removes it from the queue or schedules a retry.
+func (q *Queue[T]) attempt(ctx context.Context, entry *Entry[T]) {
+	q.mu.Lock()
+	snapshot := *entry
+	q.mu.Unlock()
+	err := q.opts.Send(ctx, snapshot)
+	if ctx.Err() != nil {
+		// Shutting down, leave entry queued.
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entry.Attempts++
+	logger := q.logger(*entry)
+	if err == nil {
+		delete(q.entries, entry.ID)
+		q.status.Delivered++
+		logger.Info().Int("attempts", entry.Attempts).Msg("Delivered")
+		return
+	}
+
+	entry.LastError = strings.ReplaceAll(err.Error(), "\n", " ")
+	if q.opts.Permanent(err) || entry.Attempts >= q.opts.MaxAttempts {
+		delete(q.entries, entry.ID)
+		entry.NextAttempt = time.Time{}
+		q.status.Failed++
+		if q.opts.DeadLetterSize > 0 {
+			q.dead = append(q.dead, entry)
+			if len(q.dead) > q.opts.DeadLetterSize {
+				q.dead = q.dead[len(q.dead)-q.opts.DeadLetterSize:]
+			}
+		}
+		logger.Warn().Err(err).Int("attempts", entry.Attempts).Msg("Delivery failed, giving up")
+		return
+	}
+
+	delay := retryDelay(q.opts.RetryInterval, entry.Attempts)
+	entry.NextAttempt = time.Now().Add(delay)
+	logger.Info().Err(err).Int("attempts", entry.Attempts).Dur("retry-in", delay).
+		Msg("Delivery failed, will retry")
+}
+
+// logger returns the configured logger for entry, or a disabled logger.
+func (q *Queue[T]) logger(entry Entry[T]) zerolog.Logger {
+	if q.opts.Logger == nil {
+		return zerolog.Nop()
+	}
+	return q.opts.Logger(entry)
+}
+
+// before returns true if e is due before other, or was queued first when both are due together.
+func (e *Entry[T]) before(other *Entry[T]) bool {
+	if e.NextAttempt.Equal(other.NextAttempt) {
+		return e.seq < other.seq
+	}
+	return e.NextAttempt.Before(other.NextAttempt)
+}
+
+// retryDelay returns the delay before retrying after the given number of failed attempts.  It
+// backs off exponentially: interval, 2x interval, 4x interval... up to maxRetryDelay.
+func retryDelay(interval time.Duration, attempts int) time.Duration {
+	delay := interval
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay = min(2*delay, maxRetryDelay)
+	}
+	return delay
+}
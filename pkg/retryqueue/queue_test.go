@@ -0,0 +1,151 @@
+package retryqueue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errPermanent = errors.New("permanent")
+
+// recorder is a Send function that records each item, failing items present in fail.
+type recorder struct {
+	sync.Mutex
+	sent []string
+	fail map[string]error
+}
+
+func (r *recorder) send(_ context.Context, entry Entry[string]) error {
+	r.Lock()
+	defer r.Unlock()
+	r.sent = append(r.sent, entry.Item)
+	return r.fail[entry.Item]
+}
+
+func (r *recorder) items() []string {
+	r.Lock()
+	defer r.Unlock()
+	return append([]string(nil), r.sent...)
+}
+
+func newTestQueue(r *recorder, opts Options[string]) *Queue[string] {
+	opts.Send = r.send
+	opts.Permanent = func(err error) bool { return errors.Is(err, errPermanent) }
+	return New(opts)
+}
+
+// awaitStatus polls the queue until cond returns true.
+func awaitStatus(t *testing.T, q *Queue[string], cond func(Status[string]) bool) Status[string] {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := q.Status()
+		if cond(status) {
+			return status
+		}
+		require.True(t, time.Now().Before(deadline), "Queue did not reach expected state: %+v", status)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeliversInQueueOrder(t *testing.T) {
+	r := &recorder{}
+	q := newTestQueue(r, Options[string]{Size: 10, RetryInterval: time.Minute, MaxAttempts: 1})
+	want := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, item := range want {
+		require.True(t, q.Add(item))
+	}
+
+	pending := q.Status().Pending
+	require.Len(t, pending, len(want))
+	for i, e := range pending {
+		assert.Equal(t, want[i], e.Item)
+	}
+
+	go q.Start(t.Context())
+	awaitStatus(t, q, func(s Status[string]) bool { return s.Delivered == int64(len(want)) })
+	assert.Equal(t, want, r.items())
+}
+
+func TestNextDueOrder(t *testing.T) {
+	q := New(Options[string]{Size: 10})
+	for _, item := range []string{"a", "b", "c", "d"} {
+		q.Add(item)
+	}
+	// Retried entries due at the same time are delivered in queue order, after earlier entries.
+	due := time.Now().Add(-time.Minute)
+	for _, e := range q.entries {
+		e.NextAttempt = due
+	}
+	q.entries["3"].NextAttempt = due.Add(-time.Second)
+	q.entries["4"].NextAttempt = time.Now().Add(time.Hour)
+
+	var got []string
+	for {
+		entry, next := q.nextDue()
+		if entry == nil {
+			assert.Equal(t, q.entries["4"].NextAttempt, next)
+			break
+		}
+		got = append(got, entry.Item)
+		delete(q.entries, entry.ID)
+	}
+	assert.Equal(t, []string{"c", "a", "b"}, got)
+}
+
+func TestQueueFull(t *testing.T) {
+	r := &recorder{}
+	q := newTestQueue(r, Options[string]{Size: 2, RetryInterval: time.Minute})
+	assert.True(t, q.Add("a"))
+	assert.True(t, q.Add("b"))
+	assert.False(t, q.Add("c"))
+
+	status := q.Status()
+	assert.Len(t, status.Pending, 2)
+	assert.Equal(t, int64(1), status.Dropped)
+}
+
+func TestRetryAndDeadLetters(t *testing.T) {
+	r := &recorder{fail: map[string]error{
+		"temp": errors.New("temporary"),
+		"perm": errPermanent,
+	}}
+	q := newTestQueue(r, Options[string]{
+		Size:           10,
+		RetryInterval:  10 * time.Millisecond,
+		MaxAttempts:    3,
+		DeadLetterSize: 1,
+	})
+	q.Add("perm")
+	q.Add("temp")
+	go q.Start(t.Context())
+
+	status := awaitStatus(t, q, func(s Status[string]) bool { return s.Failed == 2 })
+	assert.Empty(t, status.Pending)
+	assert.Equal(t, []string{"perm", "temp", "temp", "temp"}, r.items())
+
+	// Oldest dead letter was trimmed.
+	require.Len(t, status.DeadLetters, 1)
+	dead := status.DeadLetters[0]
+	assert.Equal(t, "temp", dead.Item)
+	assert.Equal(t, 3, dead.Attempts)
+	assert.Equal(t, "temporary", dead.LastError)
+	assert.True(t, dead.NextAttempt.IsZero())
+
+	q.ClearDeadLetters()
+	assert.Empty(t, q.Status().DeadLetters)
+}
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, time.Minute, retryDelay(time.Minute, 1))
+	assert.Equal(t, 2*time.Minute, retryDelay(time.Minute, 2))
+	assert.Equal(t, 32*time.Minute, retryDelay(time.Minute, 6))
+	assert.Equal(t, maxRetryDelay, retryDelay(time.Minute, 7))
+	assert.Equal(t, maxRetryDelay, retryDelay(time.Minute, 1000))
+	assert.Equal(t, 2*time.Hour, retryDelay(2*time.Hour, 5), "interval is not capped")
+}
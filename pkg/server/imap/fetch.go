@@ -0,0 +1,248 @@
+package imap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// internalDateFmt is the layout of the INTERNALDATE FETCH item.
+const internalDateFmt = "02-Jan-2006 15:04:05 -0700"
+
+// fetchItem is a single data item requested by FETCH, ie: `BODY.PEEK[HEADER]<0.100>`.
+type fetchItem struct {
+	name       string // Upper case item name, ie: BODY.PEEK.
+	section    string // Section specifier within brackets.
+	hasSection bool   // Brackets were present.
+	partial    bool   // A <offset.length> partial range was requested.
+	offset     int
+	length     int
+}
+
+// fetchMacros expand to multiple items.
+var fetchMacros = map[string][]string{
+	"ALL":  {"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"},
+	"FAST": {"FLAGS", "INTERNALDATE", "RFC822.SIZE"},
+	"FULL": {"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY"},
+}
+
+// parseFetchItems parses the item list argument of FETCH.
+func parseFetchItems(a arg) ([]fetchItem, error) {
+	var atoms []string
+	if a.isList {
+		for _, v := range a.list {
+			if v.isList || v.isString {
+				return nil, fmt.Errorf("unexpected FETCH item %v", v)
+			}
+			atoms = append(atoms, v.value)
+		}
+	} else {
+		if macro, ok := fetchMacros[strings.ToUpper(a.value)]; ok {
+			atoms = macro
+		} else {
+			atoms = []string{a.value}
+		}
+	}
+
+	items := make([]fetchItem, 0, len(atoms))
+	for _, atom := range atoms {
+		item, err := parseFetchItem(atom)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func parseFetchItem(atom string) (fetchItem, error) {
+	item := fetchItem{name: strings.ToUpper(atom)}
+	open := strings.IndexByte(atom, '[')
+	if open < 0 {
+		switch item.name {
+		case "BODY", "BODYSTRUCTURE", "ENVELOPE", "FLAGS", "INTERNALDATE", "RFC822",
+			"RFC822.HEADER", "RFC822.SIZE", "RFC822.TEXT", "UID":
+			return item, nil
+		}
+		return item, fmt.Errorf("unknown FETCH item %q", atom)
+	}
+
+	item.name = strings.ToUpper(atom[:open])
+	if item.name != "BODY" && item.name != "BODY.PEEK" {
+		return item, fmt.Errorf("unexpected section on FETCH item %q", atom)
+	}
+	closing := strings.LastIndexByte(atom, ']')
+	if closing < open {
+		return item, fmt.Errorf("unterminated section in FETCH item %q", atom)
+	}
+	item.hasSection = true
+	item.section = atom[open+1 : closing]
+
+	if rest := atom[closing+1:]; rest != "" {
+		if !strings.HasPrefix(rest, "<") || !strings.HasSuffix(rest, ">") {
+			return item, fmt.Errorf("malformed partial in FETCH item %q", atom)
+		}
+		offset, length, ok := strings.Cut(rest[1:len(rest)-1], ".")
+		var err1, err2 error
+		item.offset, err1 = strconv.Atoi(offset)
+		item.length, err2 = strconv.Atoi(length)
+		if !ok || err1 != nil || err2 != nil || item.offset < 0 || item.length < 0 {
+			return item, fmt.Errorf("malformed partial in FETCH item %q", atom)
+		}
+		item.partial = true
+	}
+	return item, nil
+}
+
+// needsSource returns true if the item requires the message content to be loaded.
+func (f fetchItem) needsSource() bool {
+	switch f.name {
+	case "FLAGS", "INTERNALDATE", "UID":
+		return false
+	}
+	return true
+}
+
+// setsSeen returns true if fetching the item implicitly sets the \Seen flag.
+func (f fetchItem) setsSeen() bool {
+	switch f.name {
+	case "BODY":
+		return f.hasSection
+	case "RFC822", "RFC822.TEXT":
+		return true
+	}
+	return false
+}
+
+// fetchMessage writes the untagged FETCH response for a single message.
+func (s *Session) fetchMessage(seq int, msg *imapMessage, items []fetchItem, byUID bool) error {
+	var root *part
+	for _, item := range items {
+		if item.needsSource() {
+			src, err := s.loadSource(msg)
+			if err != nil {
+				return err
+			}
+			root = parsePart(src)
+			break
+		}
+	}
+
+	// Mark seen before rendering, so FLAGS reflects the change.
+	sendFlags := false
+	if !s.readOnly && !msg.Seen {
+		for _, item := range items {
+			if item.setsSeen() {
+				if err := s.manager.MarkSeen(s.user, msg.ID); err != nil {
+					return err
+				}
+				msg.Seen = true
+				sendFlags = true
+				break
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "* %d FETCH (", seq)
+	sep := ""
+	wrote := make(map[string]bool)
+	write := func(format string, a ...interface{}) {
+		buf.WriteString(sep)
+		fmt.Fprintf(&buf, format, a...)
+		sep = " "
+	}
+	if byUID {
+		write("UID %d", msg.uid)
+		wrote["UID"] = true
+	}
+	for _, item := range items {
+		switch item.name {
+		case "UID":
+			if !wrote["UID"] {
+				write("UID %d", msg.uid)
+				wrote["UID"] = true
+			}
+		case "FLAGS":
+			write("FLAGS (%s)", strings.Join(s.uids.flags(s.user, msg), " "))
+			wrote["FLAGS"] = true
+		case "INTERNALDATE":
+			write("INTERNALDATE %q", msg.Date.Format(internalDateFmt))
+		case "RFC822.SIZE":
+			write("RFC822.SIZE %d", len(root.raw()))
+		case "ENVELOPE":
+			write("ENVELOPE %s", envelope(root.header))
+		case "BODYSTRUCTURE":
+			write("BODYSTRUCTURE %s", root.structure(true))
+		case "RFC822":
+			write("RFC822 %s", literal(root.raw()))
+		case "RFC822.HEADER":
+			write("RFC822.HEADER %s", literal(root.rawHeader))
+		case "RFC822.TEXT":
+			write("RFC822.TEXT %s", literal(root.body))
+		case "BODY", "BODY.PEEK":
+			if !item.hasSection {
+				write("BODY %s", root.structure(false))
+				continue
+			}
+			content, err := root.section(item.section)
+			if err != nil {
+				// Non-existent sections are returned empty.
+				s.logger.Debug().Err(err).Msg("FETCH section")
+				content = nil
+			}
+			name := "BODY[" + item.section + "]"
+			if item.partial {
+				name += "<" + strconv.Itoa(item.offset) + ">"
+				content = partial(content, item.offset, item.length)
+			}
+			write("%s %s", name, literal(content))
+		}
+	}
+	if sendFlags && !wrote["FLAGS"] {
+		write("FLAGS (%s)", strings.Join(s.uids.flags(s.user, msg), " "))
+	}
+	buf.WriteString(")\r\n")
+	s.sendRaw(buf.Bytes())
+	return nil
+}
+
+// loadSource reads the CRLF normalized source of a message.
+func (s *Session) loadSource(msg *imapMessage) ([]byte, error) {
+	r, err := s.manager.SourceReader(s.user, msg.ID)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, fmt.Errorf("message %v not found", msg.ID)
+	}
+	defer func() {
+		if err := r.Close(); err != nil {
+			s.logger.Warn().Err(err).Msg("Failed to close message")
+		}
+	}()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return normalizeCRLF(b), nil
+}
+
+// literal formats content as an IMAP literal.
+func literal(b []byte) string {
+	return "{" + strconv.Itoa(len(b)) + "}\r\n" + string(b)
+}
+
+// partial returns the requested substring of b.
+func partial(b []byte, offset, length int) []byte {
+	if offset >= len(b) {
+		return nil
+	}
+	b = b[offset:]
+	if length < len(b) {
+		b = b[:length]
+	}
+	return b
+}
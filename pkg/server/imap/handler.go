@@ -0,0 +1,845 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/message"
+	"github.com/inbucket/inbucket/v3/pkg/storage"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// State tracks the current mode of our IMAP state machine
+type State int
+
+const (
+	// NOTAUTH state: the client must now identify and authenticate
+	NOTAUTH State = iota
+	// AUTH state: client has authenticated, and must select a mailbox
+	AUTH
+	// SELECTED state: mailbox open, client may now issue message commands
+	SELECTED
+	// LOGOUT state: client requests us to end session
+	LOGOUT
+)
+
+// inboxName is the only mailbox Inbucket presents to IMAP clients.
+const inboxName = "INBOX"
+
+// maxLiteral limits the size of literals accepted from clients; Inbucket does not support APPEND.
+const maxLiteral = 64 * 1024
+
+// maxCommand limits the total size of a command, including all of its literals.
+const maxCommand = 256 * 1024
+
+func (s State) String() string {
+	switch s {
+	case NOTAUTH:
+		return "NOTAUTH"
+	case AUTH:
+		return "AUTH"
+	case SELECTED:
+		return "SELECTED"
+	case LOGOUT:
+		return "LOGOUT"
+	}
+	return "Unknown"
+}
+
+// Session defines an active IMAP session
+type Session struct {
+	*Server                   // Reference to the server we belong to.
+	id         int            // Session ID number.
+	conn       net.Conn       // Our network connection.
+	remoteHost string         // IP address of client.
+	sendError  error          // Used to bail out of read loop on send error.
+	state      State          // Current session state.
+	reader     *bufio.Reader  // Buffered reader for our net conn.
+	user       string         // Mailbox name.
+	readOnly   bool           // Mailbox was opened with EXAMINE.
+	messages   []*imapMessage // Messages in selected mailbox, in sequence number order.
+	logger     zerolog.Logger // Session specific logger.
+	debug      bool           // Print network traffic to stdout.
+	tlsState   *tls.ConnectionState
+}
+
+// NewSession creates a new IMAP session
+func NewSession(server *Server, id int, conn net.Conn, logger zerolog.Logger) *Session {
+	reader := bufio.NewReader(conn)
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	return &Session{
+		Server:     server,
+		id:         id,
+		conn:       conn,
+		state:      NOTAUTH,
+		reader:     reader,
+		remoteHost: host,
+		logger:     logger,
+		debug:      server.config.Debug,
+	}
+}
+
+func (s *Session) String() string {
+	return fmt.Sprintf("Session{id: %v, state: %v}", s.id, s.state)
+}
+
+/* Session flow:
+ *  1. Send initial greeting
+ *  2. Receive tagged cmd
+ *  3. If good cmd, respond, optionally change state
+ *  4. If bad cmd, respond error
+ *  5. Goto 2
+ */
+func (s *Server) startSession(ctx context.Context, id int, conn net.Conn) {
+	logger := log.With().Str("module", "imap").Str("remote", conn.RemoteAddr().String()).
+		Int("session", id).Logger()
+	connToClose := conn
+	var tlsState *tls.ConnectionState
+	if s.config.ForceTLS {
+		logger.Debug().Msg("Setting up TLS for ForceTLS")
+		conn = tls.Server(conn, s.tlsConfig)
+	}
+
+	logger.Info().Msg("Starting IMAP session")
+	defer func() {
+		// Closing the tlsConn hangs.
+		if err := connToClose.Close(); err != nil {
+			logger.Warn().Err(err).Msg("Closing connection")
+		}
+		logger.Debug().Msg("End of session")
+		s.wg.Done()
+	}()
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// Complete the handshake before capturing the negotiated connection state.
+		tlsCtx, cancel := context.WithTimeout(ctx, s.config.Timeout)
+		err := tlsConn.HandshakeContext(tlsCtx)
+		cancel()
+		if err != nil {
+			logger.Warn().Err(err).Msg("TLS handshake failed")
+			return
+		}
+		tlsState = new(tls.ConnectionState)
+		*tlsState = tlsConn.ConnectionState()
+	}
+
+	ssn := NewSession(s, id, conn, logger)
+	ssn.tlsState = tlsState
+	ssn.send(fmt.Sprintf("* OK [CAPABILITY %s] %v Inbucket IMAP4rev1 server ready",
+		ssn.capabilities(), s.config.Domain))
+
+	// This is our command reading loop
+	for ssn.state != LOGOUT && ssn.sendError == nil {
+		line, err := ssn.readCommand()
+		if err == nil {
+			tag, cmd, args, perr := ssn.parseCmd(line)
+			if tag == "" {
+				ssn.send("* BAD Missing command tag")
+				continue
+			}
+			if cmd == "" {
+				ssn.send(tag + " BAD Missing command")
+				continue
+			}
+			if perr != nil {
+				ssn.send(fmt.Sprintf("%s BAD %v", tag, perr))
+				ssn.logger.Warn().Err(perr).Msgf("Failed to parse %v arguments", cmd)
+				continue
+			}
+
+			// Commands we handle in any state
+			switch cmd {
+			case "CAPABILITY":
+				ssn.send("* CAPABILITY " + ssn.capabilities())
+				ssn.send(tag + " OK CAPABILITY completed")
+				continue
+			case "NOOP":
+				if ssn.state == SELECTED {
+					ssn.refresh()
+				}
+				ssn.send(tag + " OK NOOP completed")
+				continue
+			case "LOGOUT":
+				ssn.send("* BYE Goodnight and good luck")
+				ssn.send(tag + " OK LOGOUT completed")
+				ssn.enterState(LOGOUT)
+				continue
+			}
+
+			// Send command to handler for current state
+			switch ssn.state {
+			case NOTAUTH:
+				ssn.notAuthHandler(ctx, tag, cmd, args)
+				continue
+			case AUTH:
+				ssn.authHandler(tag, cmd, args)
+				continue
+			case SELECTED:
+				ssn.selectedHandler(tag, cmd, args)
+				continue
+			}
+
+			ssn.logger.Error().Msgf("Session entered unexpected state %v", ssn.state)
+			break
+		} else {
+			// readCommand() returned an error
+			if err == io.EOF {
+				switch ssn.state {
+				case NOTAUTH, AUTH:
+					// EOF is common here
+					ssn.logger.Info().Msgf("Client closed connection (state %v)", ssn.state)
+				default:
+					ssn.logger.Warn().Msgf("Got EOF while in state %v", ssn.state)
+				}
+				break
+			}
+
+			// not an EOF
+			ssn.logger.Warn().Msgf("Connection error: %v", err)
+			if netErr, ok := err.(net.Error); ok {
+				if netErr.Timeout() {
+					ssn.send("* BYE Idle timeout, bye bye")
+					break
+				}
+			}
+			ssn.send("* BYE Connection error, sorry")
+			break
+		}
+	}
+	if ssn.sendError != nil {
+		ssn.logger.Warn().Msgf("Network send error: %v", ssn.sendError)
+	}
+	ssn.logger.Info().Msgf("Closing connection")
+}
+
+// NOTAUTH state
+func (s *Session) notAuthHandler(ctx context.Context, tag, cmd string, args []arg) {
+	switch cmd {
+	case "STARTTLS":
+		if s.tlsConfig == nil || s.config.ForceTLS {
+			// Invalid command since TLS unconfigured.
+			s.logger.Debug().Msgf("BAD TLS unavailable on the server")
+			s.send(tag + " BAD TLS unavailable on the server")
+			return
+		}
+		if s.tlsState != nil {
+			// TLS state previously valid.
+			s.logger.Debug().Msg("BAD A TLS session already agreed upon.")
+			s.send(tag + " BAD A TLS session already agreed upon")
+			return
+		}
+		s.logger.Debug().Msg("Initiating TLS context.")
+
+		// Start TLS connection handshake.
+		tlsCtx, cancel := context.WithTimeout(ctx, s.config.Timeout)
+		defer cancel()
+		s.send(tag + " OK Begin TLS negotiation now")
+		tlsConn := tls.Server(s.conn, s.tlsConfig)
+		if err := tlsConn.HandshakeContext(tlsCtx); err != nil {
+			s.logger.Error().Msgf("TLS handshake failed %v", err)
+			s.enterState(LOGOUT)
+			return
+		}
+		s.conn = tlsConn
+		s.reader = bufio.NewReader(tlsConn)
+		s.tlsState = new(tls.ConnectionState)
+		*s.tlsState = tlsConn.ConnectionState()
+		s.logger.Debug().Msgf("TLS set %v", *s.tlsState)
+
+	case "LOGIN":
+		if len(args) != 2 || args[0].isList || args[1].isList {
+			s.send(tag + " BAD LOGIN requires a username and password")
+			return
+		}
+		s.login(tag, "LOGIN", args[0].value)
+
+	case "AUTHENTICATE":
+		if len(args) < 1 || !strings.EqualFold(args[0].value, "PLAIN") {
+			s.send(tag + " NO [CANNOT] Unsupported authentication mechanism")
+			return
+		}
+		var response string
+		if len(args) > 1 {
+			response = args[1].value
+		} else {
+			s.send("+ ")
+			line, err := s.readLine()
+			if err != nil {
+				s.sendError = err
+				return
+			}
+			response = strings.TrimRight(line, "\r\n")
+		}
+		if response == "*" {
+			s.send(tag + " BAD AUTHENTICATE cancelled")
+			return
+		}
+		creds, err := base64.StdEncoding.DecodeString(response)
+		if err != nil {
+			s.send(tag + " BAD Invalid base64 response")
+			return
+		}
+		fields := bytes.Split(creds, []byte{0})
+		if len(fields) != 3 {
+			s.send(tag + " BAD Invalid PLAIN response")
+			return
+		}
+		// Password content is ignored.
+		s.login(tag, "AUTHENTICATE", string(fields[1]))
+
+	default:
+		s.ooSeq(tag, cmd)
+	}
+}
+
+// login opens the mailbox for user, the password is not checked.
+func (s *Session) login(tag, cmd, user string) {
+	mailbox, err := s.manager.MailboxForAddress(user)
+	if err != nil || mailbox == "" {
+		s.logger.Warn().Str("user", user).Err(err).Msg("Invalid mailbox name")
+		s.send(tag + " NO [AUTHENTICATIONFAILED] Invalid mailbox name")
+		return
+	}
+	s.user = mailbox
+	s.logger = s.logger.With().Str("mailbox", s.user).Logger()
+	s.logger.Info().Msg("Login")
+	s.send(fmt.Sprintf("%s OK [CAPABILITY %s] %s completed", tag, s.capabilities(), cmd))
+	s.enterState(AUTH)
+}
+
+// AUTH state
+func (s *Session) authHandler(tag, cmd string, args []arg) {
+	switch cmd {
+	case "SELECT", "EXAMINE":
+		if len(args) != 1 || args[0].isList {
+			s.send(fmt.Sprintf("%s BAD %s requires a mailbox name", tag, cmd))
+			return
+		}
+		if s.state == SELECTED {
+			// Selecting deselects the current mailbox, even on failure.
+			s.messages = nil
+			s.enterState(AUTH)
+		}
+		if !strings.EqualFold(args[0].value, inboxName) {
+			s.send(tag + " NO [NONEXISTENT] Only INBOX is available")
+			return
+		}
+		s.readOnly = cmd == "EXAMINE"
+		if err := s.selectInbox(); err != nil {
+			s.logger.Error().Err(err).Msg("Failed to load mailbox")
+			s.send(tag + " NO Failed to load mailbox, internal error")
+			return
+		}
+		mode := "READ-WRITE"
+		if s.readOnly {
+			mode = "READ-ONLY"
+		}
+		s.send(fmt.Sprintf("%s OK [%s] %s completed", tag, mode, cmd))
+		s.enterState(SELECTED)
+
+	case "LIST", "LSUB":
+		if len(args) != 2 || args[0].isList || args[1].isList {
+			s.send(fmt.Sprintf("%s BAD %s requires a reference and mailbox pattern", tag, cmd))
+			return
+		}
+		pattern := args[0].value + args[1].value
+		if args[1].value == "" {
+			// Request for the hierarchy delimiter.
+			s.send(fmt.Sprintf(`* %s (\Noselect) "/" ""`, cmd))
+		} else if listMatch(pattern, inboxName) {
+			s.send(fmt.Sprintf(`* %s (\HasNoChildren) "/" %s`, cmd, inboxName))
+		}
+		s.send(fmt.Sprintf("%s OK %s completed", tag, cmd))
+
+	case "STATUS":
+		if len(args) != 2 || !args[1].isList {
+			s.send(tag + " BAD STATUS requires a mailbox name and item list")
+			return
+		}
+		if !strings.EqualFold(args[0].value, inboxName) {
+			s.send(tag + " NO [NONEXISTENT] Only INBOX is available")
+			return
+		}
+		metas, err := s.manager.GetMetadata(s.user)
+		if err != nil {
+			s.logger.Error().Err(err).Msg("Failed to load mailbox")
+			s.send(tag + " NO Failed to load mailbox, internal error")
+			return
+		}
+		msgs := s.uids.assign(s.user, metas)
+		items := make([]string, 0, len(args[1].list))
+		for _, item := range args[1].list {
+			name := strings.ToUpper(item.value)
+			switch name {
+			case "MESSAGES":
+				items = append(items, fmt.Sprintf("MESSAGES %d", len(msgs)))
+			case "RECENT":
+				items = append(items, "RECENT 0")
+			case "UIDNEXT":
+				items = append(items, fmt.Sprintf("UIDNEXT %d", s.uids.uidNext(s.user)))
+			case "UIDVALIDITY":
+				items = append(items, fmt.Sprintf("UIDVALIDITY %d", s.uids.validity))
+			case "UNSEEN":
+				unseen := 0
+				for _, m := range msgs {
+					if !m.Seen {
+						unseen++
+					}
+				}
+				items = append(items, fmt.Sprintf("UNSEEN %d", unseen))
+			default:
+				s.send(fmt.Sprintf("%s BAD Unknown STATUS item %q", tag, item.value))
+				return
+			}
+		}
+		s.send(fmt.Sprintf("* STATUS %s (%s)", inboxName, strings.Join(items, " ")))
+		s.send(tag + " OK STATUS completed")
+
+	case "SUBSCRIBE", "UNSUBSCRIBE":
+		s.send(fmt.Sprintf("%s OK %s completed", tag, cmd))
+
+	case "CREATE", "DELETE", "RENAME", "APPEND":
+		s.logger.Warn().Msgf("Command %v not supported by Inbucket", cmd)
+		s.send(fmt.Sprintf("%s NO [CANNOT] %s is not supported by Inbucket", tag, cmd))
+
+	default:
+		s.ooSeq(tag, cmd)
+	}
+}
+
+// SELECTED state
+func (s *Session) selectedHandler(tag, cmd string, args []arg) {
+	switch cmd {
+	case "CHECK":
+		s.refresh()
+		s.send(tag + " OK CHECK completed")
+
+	case "CLOSE", "UNSELECT":
+		if cmd == "CLOSE" && !s.readOnly {
+			if err := s.expunge(true); err != nil {
+				s.logger.Error().Err(err).Msg("Failed to expunge messages")
+			}
+		}
+		s.messages = nil
+		s.send(fmt.Sprintf("%s OK %s completed", tag, cmd))
+		s.enterState(AUTH)
+
+	case "EXPUNGE":
+		if s.readOnly {
+			s.send(tag + " NO Mailbox is read-only")
+			return
+		}
+		if err := s.expunge(false); err != nil {
+			s.logger.Error().Err(err).Msg("Failed to expunge messages")
+			s.send(tag + " NO Failed to EXPUNGE, internal error")
+			return
+		}
+		s.send(tag + " OK EXPUNGE completed")
+
+	case "FETCH", "STORE", "SEARCH", "COPY":
+		s.messageHandler(tag, cmd, args, false)
+
+	case "UID":
+		if len(args) == 0 || args[0].isList {
+			s.send(tag + " BAD UID requires a command")
+			return
+		}
+		sub := strings.ToUpper(args[0].value)
+		switch sub {
+		case "FETCH", "STORE", "SEARCH", "COPY":
+			s.messageHandler(tag, "UID "+sub, args[1:], true)
+		default:
+			s.send(fmt.Sprintf("%s BAD Unknown UID command %q", tag, args[0].value))
+		}
+
+	default:
+		s.authHandler(tag, cmd, args)
+	}
+}
+
+// messageHandler handles commands operating on a set of messages, by sequence number or UID.
+func (s *Session) messageHandler(tag, cmd string, args []arg, byUID bool) {
+	name := strings.TrimPrefix(cmd, "UID ")
+	if name == "SEARCH" {
+		s.search(tag, cmd, args, byUID)
+		return
+	}
+	if name == "COPY" {
+		s.logger.Warn().Msgf("Command %v not supported by Inbucket", cmd)
+		s.send(fmt.Sprintf("%s NO [CANNOT] %s is not supported by Inbucket", tag, cmd))
+		return
+	}
+	if len(args) < 2 || args[0].isList {
+		s.send(fmt.Sprintf("%s BAD %s requires a sequence set and items", tag, cmd))
+		return
+	}
+	set, err := parseSeqSet(args[0].value)
+	if err != nil {
+		s.send(fmt.Sprintf("%s BAD %v", tag, err))
+		return
+	}
+	seqs, err := s.resolveSeqSet(set, byUID)
+	if err != nil {
+		s.send(fmt.Sprintf("%s BAD %v", tag, err))
+		return
+	}
+
+	switch name {
+	case "FETCH":
+		items, err := parseFetchItems(args[1])
+		if err != nil {
+			s.send(fmt.Sprintf("%s BAD %v", tag, err))
+			return
+		}
+		for _, seq := range seqs {
+			if err := s.fetchMessage(seq, s.messages[seq-1], items, byUID); err != nil {
+				s.logger.Error().Err(err).Str("id", s.messages[seq-1].ID).Msg("Failed to FETCH")
+				s.send(fmt.Sprintf("%s NO Failed to %s that message, internal error", tag, cmd))
+				return
+			}
+		}
+		s.send(fmt.Sprintf("%s OK %s completed", tag, cmd))
+
+	case "STORE":
+		if s.readOnly {
+			s.send(tag + " NO Mailbox is read-only")
+			return
+		}
+		if err := s.store(seqs, args[1], args[2:], byUID); err != nil {
+			s.send(fmt.Sprintf("%s BAD %v", tag, err))
+			return
+		}
+		s.send(fmt.Sprintf("%s OK %s completed", tag, cmd))
+	}
+}
+
+// resolveSeqSet converts a sequence set into the matching message sequence numbers.
+func (s *Session) resolveSeqSet(set seqSet, byUID bool) ([]int, error) {
+	count := uint32(len(s.messages))
+	if !byUID {
+		for _, r := range set {
+			if r.start > count || r.stop > count {
+				return nil, errors.New("invalid message sequence number")
+			}
+		}
+	}
+	var maxUID uint32
+	if count > 0 {
+		maxUID = s.messages[count-1].uid
+	}
+	seqs := make([]int, 0)
+	for i, msg := range s.messages {
+		seq := uint32(i + 1)
+		if (byUID && set.contains(msg.uid, maxUID)) || (!byUID && set.contains(seq, count)) {
+			seqs = append(seqs, i+1)
+		}
+	}
+	return seqs, nil
+}
+
+// store updates message flags as requested by STORE.
+func (s *Session) store(seqs []int, item arg, flagArgs []arg, byUID bool) error {
+	op := strings.ToUpper(item.value)
+	silent := strings.HasSuffix(op, ".SILENT")
+	op = strings.TrimSuffix(op, ".SILENT")
+	if op != "FLAGS" && op != "+FLAGS" && op != "-FLAGS" {
+		return fmt.Errorf("unknown STORE item %q", item.value)
+	}
+	if len(flagArgs) == 1 && flagArgs[0].isList {
+		flagArgs = flagArgs[0].list
+	}
+	flags := make(map[string]bool, len(flagArgs))
+	for _, f := range flagArgs {
+		if f.isList || f.value == "" {
+			return fmt.Errorf("bad flag %v", f)
+		}
+		flags[canonicalFlag(f.value)] = true
+	}
+
+	for _, seq := range seqs {
+		msg := s.messages[seq-1]
+		if op == "FLAGS" {
+			// Replace all flags, seen cannot be cleared.
+			for _, f := range s.uids.flags(s.user, msg) {
+				if !flags[f] {
+					s.uids.setFlag(s.user, msg, f, false)
+				}
+			}
+		}
+		for f := range flags {
+			if f == flagSeen && op != "-FLAGS" && !msg.Seen {
+				if err := s.manager.MarkSeen(s.user, msg.ID); err != nil {
+					s.logger.Warn().Str("id", msg.ID).Err(err).Msg("Failed to mark message seen")
+					continue
+				}
+				msg.Seen = true
+			}
+			s.uids.setFlag(s.user, msg, f, op != "-FLAGS")
+		}
+		if !silent {
+			flagList := strings.Join(s.uids.flags(s.user, msg), " ")
+			if byUID {
+				s.send(fmt.Sprintf("* %d FETCH (UID %d FLAGS (%s))", seq, msg.uid, flagList))
+			} else {
+				s.send(fmt.Sprintf("* %d FETCH (FLAGS (%s))", seq, flagList))
+			}
+		}
+	}
+	return nil
+}
+
+// search handles SEARCH and UID SEARCH.
+func (s *Session) search(tag, cmd string, args []arg, byUID bool) {
+	key, err := parseSearch(args)
+	if err == errBadCharset {
+		s.send(tag + " NO [BADCHARSET (US-ASCII UTF-8)] Unsupported charset")
+		return
+	}
+	if err != nil {
+		s.send(fmt.Sprintf("%s BAD %v", tag, err))
+		return
+	}
+
+	count := uint32(len(s.messages))
+	var maxUID uint32
+	if count > 0 {
+		maxUID = s.messages[count-1].uid
+	}
+	results := make([]string, 0)
+	for i, msg := range s.messages {
+		t := &searchTarget{ssn: s, msg: msg, seq: uint32(i + 1), maxSeq: count, maxUID: maxUID}
+		match := key(t)
+		if t.err != nil {
+			s.logger.Error().Err(t.err).Str("id", msg.ID).Msg("Failed to SEARCH message")
+			s.send(fmt.Sprintf("%s NO Failed to %s, internal error", tag, cmd))
+			return
+		}
+		if match {
+			if byUID {
+				results = append(results, fmt.Sprint(msg.uid))
+			} else {
+				results = append(results, fmt.Sprint(i+1))
+			}
+		}
+	}
+	s.send(strings.TrimSpace("* SEARCH " + strings.Join(results, " ")))
+	s.send(fmt.Sprintf("%s OK %s completed", tag, cmd))
+}
+
+// selectInbox loads the users mailbox and sends the untagged SELECT responses.
+func (s *Session) selectInbox() error {
+	metas, err := s.manager.GetMetadata(s.user)
+	if err != nil {
+		return err
+	}
+	s.messages = s.uids.assign(s.user, metas)
+
+	s.send("* FLAGS (" + strings.Join(systemFlags, " ") + ")")
+	s.send("* OK [PERMANENTFLAGS (" + strings.Join(systemFlags, " ") + ` \*)] Flags permitted`)
+	s.send(fmt.Sprintf("* %d EXISTS", len(s.messages)))
+	s.send("* 0 RECENT")
+	for i, msg := range s.messages {
+		if !msg.Seen {
+			s.send(fmt.Sprintf("* OK [UNSEEN %d] First unseen message", i+1))
+			break
+		}
+	}
+	s.send(fmt.Sprintf("* OK [UIDVALIDITY %d] UIDs valid", s.uids.validity))
+	s.send(fmt.Sprintf("* OK [UIDNEXT %d] Predicted next UID", s.uids.uidNext(s.user)))
+	return nil
+}
+
+// refresh reloads the selected mailbox, informing the client of removed and new messages.
+func (s *Session) refresh() {
+	metas, err := s.manager.GetMetadata(s.user)
+	if err != nil {
+		s.logger.Warn().Err(err).Msg("Failed to reload mailbox")
+		return
+	}
+	current := s.uids.assign(s.user, metas)
+	present := make(map[uint32]bool, len(current))
+	for _, msg := range current {
+		present[msg.uid] = true
+	}
+
+	// Report messages removed elsewhere, highest sequence number first.
+	remaining := len(s.messages)
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		if !present[s.messages[i].uid] {
+			s.send(fmt.Sprintf("* %d EXPUNGE", i+1))
+			remaining--
+		}
+	}
+	s.messages = current
+	if len(current) != remaining {
+		s.send(fmt.Sprintf("* %d EXISTS", len(current)))
+	}
+}
+
+// expunge removes messages flagged as deleted.
+func (s *Session) expunge(silent bool) error {
+	kept := make([]*imapMessage, 0, len(s.messages))
+	removed := 0
+	for i, msg := range s.messages {
+		if !s.uids.hasFlag(s.user, msg, flagDeleted) {
+			kept = append(kept, msg)
+			continue
+		}
+		s.logger.Debug().Str("id", msg.ID).Msg("Deleting message")
+		err := s.manager.RemoveMessage(s.user, msg.ID)
+		if errors.Is(err, message.ErrDeleteDenied) {
+			// Retained at the request of an extension.
+			kept = append(kept, msg)
+			continue
+		}
+		if err != nil && err != storage.ErrNotExist {
+			// Keep the remaining messages consistent with what the client has been told.
+			s.messages = append(kept, s.messages[i:]...)
+			return err
+		}
+		if !silent {
+			s.send(fmt.Sprintf("* %d EXPUNGE", i+1-removed))
+		}
+		removed++
+	}
+	s.messages = kept
+	return nil
+}
+
+// capabilities lists the capabilities of the server in the current session state.
+func (s *Session) capabilities() string {
+	caps := []string{"IMAP4rev1", "LITERAL+", "UNSELECT", "AUTH=PLAIN"}
+	if s.tlsConfig != nil && s.tlsState == nil && !s.config.ForceTLS {
+		caps = append(caps, "STARTTLS")
+	}
+	return strings.Join(caps, " ")
+}
+
+// listMatch matches a mailbox name against a LIST pattern, with `*` and `%` wildcards.
+func listMatch(pattern, name string) bool {
+	pattern = strings.NewReplacer("*", "*", "%", "*", "[", `\[`, "?", `\?`).Replace(pattern)
+	ok, err := path.Match(strings.ToUpper(pattern), strings.ToUpper(name))
+	return err == nil && ok
+}
+
+func (s *Session) enterState(state State) {
+	s.state = state
+	s.logger.Debug().Msgf("Entering state %v", state)
+}
+
+// nextDeadline calculates the next read or write deadline based on configured timeout.
+func (s *Session) nextDeadline() time.Time {
+	return time.Now().Add(s.config.Timeout)
+}
+
+// Send requested message, store errors in Session.sendError
+func (s *Session) send(msg string) {
+	s.sendRaw([]byte(msg + "\r\n"))
+}
+
+// sendRaw sends pre-formatted response data, store errors in Session.sendError
+func (s *Session) sendRaw(data []byte) {
+	if err := s.conn.SetWriteDeadline(s.nextDeadline()); err != nil {
+		s.sendError = err
+		return
+	}
+	if _, err := s.conn.Write(data); err != nil {
+		s.sendError = err
+		s.logger.Warn().Msgf("Failed to send %d bytes", len(data))
+		return
+	}
+	if s.debug {
+		line, _, _ := bytes.Cut(data, crlf)
+		if len(line)+2 < len(data) {
+			fmt.Printf("%04d > %s (%d bytes)\n", s.id, line, len(data))
+		} else {
+			fmt.Printf("%04d > %s\n", s.id, line)
+		}
+	}
+}
+
+// Reads a line of input
+func (s *Session) readLine() (line string, err error) {
+	if err = s.conn.SetReadDeadline(s.nextDeadline()); err != nil {
+		return "", err
+	}
+	line, err = s.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if s.debug {
+		fmt.Printf("%04d   %v\n", s.id, strings.TrimRight(line, "\r\n"))
+	}
+	return line, nil
+}
+
+// readCommand reads a complete command, including any literals announced at line endings.
+func (s *Session) readCommand() (string, error) {
+	var sb strings.Builder
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		sb.WriteString(line)
+		if sb.Len() > maxCommand {
+			s.send("* BYE Command too large")
+			return "", fmt.Errorf("client command of over %d bytes too large", maxCommand)
+		}
+
+		n, sync, ok := literalLength(line)
+		if !ok {
+			return sb.String(), nil
+		}
+		if n > maxLiteral {
+			s.send("* BYE Literal too large")
+			return "", fmt.Errorf("client literal of %d bytes too large", n)
+		}
+		if sb.Len()+n > maxCommand {
+			s.send("* BYE Command too large")
+			return "", fmt.Errorf("client command of over %d bytes too large", maxCommand)
+		}
+		if sync {
+			s.send("+ Ready for literal data")
+		}
+		data := make([]byte, n)
+		if err := s.conn.SetReadDeadline(s.nextDeadline()); err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(s.reader, data); err != nil {
+			return "", err
+		}
+		sb.WriteString("\r\n")
+		sb.Write(data)
+	}
+}
+
+// parseCmd splits a command line into tag, upper case command name, and arguments.
+func (s *Session) parseCmd(line string) (tag, cmd string, args []arg, err error) {
+	s.logger.Debug().Msgf("Line received: %v", strings.SplitN(line, "\r\n", 2)[0])
+	tag, rest, _ := strings.Cut(line, " ")
+	cmd, rest, _ = strings.Cut(rest, " ")
+	cmd = strings.ToUpper(cmd)
+	if tag == "" || cmd == "" {
+		return tag, cmd, nil, nil
+	}
+	args, err = parseArgs(rest)
+	return tag, cmd, args, err
+}
+
+func (s *Session) ooSeq(tag, cmd string) {
+	s.send(fmt.Sprintf("%s BAD Command %v is unknown or out of sequence", tag, cmd))
+	s.logger.Warn().Msgf("Wasn't expecting %v here", cmd)
+}
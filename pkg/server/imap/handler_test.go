@@ -0,0 +1,495 @@
+package imap
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/config"
+	"github.com/inbucket/inbucket/v3/pkg/extension"
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"github.com/inbucket/inbucket/v3/pkg/message"
+	"github.com/inbucket/inbucket/v3/pkg/policy"
+	"github.com/inbucket/inbucket/v3/pkg/storage/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testMessage = "From: Sender <sender@example.com>\r\n" +
+	"To: recipient@example.com\r\n" +
+	"Subject: %s\r\n" +
+	"Date: Mon, 02 Jan 2006 15:04:05 -0700\r\n" +
+	"Message-ID: <%d@example.com>\r\n" +
+	"\r\n" +
+	"Body of message %d.\r\n"
+
+func TestNoTLS(t *testing.T) {
+	server, _ := setupIMAPServer(t, false, false)
+	c := setupIMAPSession(t, server)
+
+	lines := command(t, c, "a1", "CAPABILITY")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], "IMAP4rev1")
+	assert.NotContains(t, lines[0], "STARTTLS")
+
+	lines = command(t, c, "a2", "STARTTLS")
+	assert.True(t, strings.HasPrefix(lines[0], "a2 BAD"), "STARTTLS should have failed: %v", lines)
+}
+
+func TestLoginRequired(t *testing.T) {
+	server, _ := setupIMAPServer(t, false, false)
+	c := setupIMAPSession(t, server)
+
+	lines := command(t, c, "a1", "SELECT INBOX")
+	assert.True(t, strings.HasPrefix(lines[0], "a1 BAD"), "got: %v", lines)
+
+	lines = command(t, c, "a2", "LOGOUT")
+	assert.Equal(t, []string{"* BYE Goodnight and good luck", "a2 OK LOGOUT completed"}, lines)
+}
+
+func TestAuthenticatePlain(t *testing.T) {
+	server, _ := setupIMAPServer(t, false, false)
+	c := setupIMAPSession(t, server)
+
+	creds := base64.StdEncoding.EncodeToString([]byte("\x00recipient@example.com\x00secret"))
+	lines := command(t, c, "a1", "AUTHENTICATE PLAIN "+creds)
+	assert.True(t, strings.HasPrefix(lines[0], "a1 OK"), "got: %v", lines)
+
+	lines = command(t, c, "a2", "SELECT INBOX")
+	assert.True(t, strings.HasPrefix(lines[len(lines)-1], "a2 OK"), "got: %v", lines)
+}
+
+func TestSelectAndFetch(t *testing.T) {
+	server, manager := setupIMAPServer(t, false, false)
+	addMessage(t, manager, "recipient", "first", 1)
+	addMessage(t, manager, "recipient", "second", 2)
+	c := setupIMAPSession(t, server)
+
+	command(t, c, "a1", `LOGIN recipient@example.com "any password"`)
+	lines := command(t, c, "a2", "SELECT INBOX")
+	assert.Contains(t, lines, "* 2 EXISTS")
+	assert.Contains(t, lines, "* OK [UNSEEN 1] First unseen message")
+	assert.Contains(t, lines, "* OK [UIDNEXT 3] Predicted next UID")
+	assert.Equal(t, "a2 OK [READ-WRITE] SELECT completed", lines[len(lines)-1])
+
+	lines = command(t, c, "a3", "FETCH 1:* (UID FLAGS)")
+	assert.Equal(t, []string{
+		"* 1 FETCH (UID 1 FLAGS ())",
+		"* 2 FETCH (UID 2 FLAGS ())",
+		"a3 OK FETCH completed",
+	}, lines)
+
+	lines = command(t, c, "a4", "FETCH 2 BODY.PEEK[HEADER.FIELDS (SUBJECT)]")
+	assert.Equal(t, []string{
+		"* 2 FETCH (BODY[HEADER.FIELDS (SUBJECT)] {19}",
+		"Subject: second",
+		"",
+		")",
+		"a4 OK FETCH completed",
+	}, lines)
+
+	// PEEK must not set seen.
+	metas, err := manager.GetMetadata("recipient")
+	require.NoError(t, err)
+	assert.False(t, metas[1].Seen)
+
+	lines = command(t, c, "a5", "UID FETCH 2 (BODY[TEXT])")
+	assert.Equal(t, []string{
+		"* 2 FETCH (UID 2 BODY[TEXT] {20}",
+		"Body of message 2.",
+		" FLAGS (\\Seen))",
+		"a5 OK UID FETCH completed",
+	}, lines)
+	metas, err = manager.GetMetadata("recipient")
+	require.NoError(t, err)
+	assert.True(t, metas[1].Seen)
+
+	lines = command(t, c, "a6", "FETCH 1 (ENVELOPE)")
+	assert.Equal(t, `* 1 FETCH (ENVELOPE ("Mon, 02 Jan 2006 15:04:05 -0700" "first" `+
+		`(("Sender" NIL "sender" "example.com")) (("Sender" NIL "sender" "example.com")) `+
+		`(("Sender" NIL "sender" "example.com")) ((NIL NIL "recipient" "example.com")) `+
+		`NIL NIL NIL "<1@example.com>"))`, lines[0])
+
+	lines = command(t, c, "a7", "FETCH 3 FLAGS")
+	assert.True(t, strings.HasPrefix(lines[0], "a7 BAD"), "got: %v", lines)
+}
+
+func TestSearch(t *testing.T) {
+	server, manager := setupIMAPServer(t, false, false)
+	addMessage(t, manager, "recipient", "apple", 1)
+	addMessage(t, manager, "recipient", "banana", 2)
+	addMessage(t, manager, "recipient", "apple pie", 3)
+	c := setupIMAPSession(t, server)
+
+	command(t, c, "a1", "LOGIN recipient pass")
+	command(t, c, "a2", "SELECT INBOX")
+
+	tcs := []struct {
+		criteria string
+		want     string
+	}{
+		{"ALL", "* SEARCH 1 2 3"},
+		{"SUBJECT apple", "* SEARCH 1 3"},
+		{`NOT SUBJECT "apple"`, "* SEARCH 2"},
+		{"OR SUBJECT banana 3", "* SEARCH 2 3"},
+		{"BODY \"message 2\"", "* SEARCH 2"},
+		{"2:*", "* SEARCH 2 3"},
+		{"SEEN", "* SEARCH"},
+		{"CHARSET UTF-8 FROM sender", "* SEARCH 1 2 3"},
+		{"SENTON 2-Jan-2006", "* SEARCH 1 2 3"},
+	}
+	for i, tc := range tcs {
+		tag := fmt.Sprintf("s%d", i)
+		lines := command(t, c, tag, "SEARCH "+tc.criteria)
+		assert.Equal(t, []string{tc.want, tag + " OK SEARCH completed"}, lines, tc.criteria)
+	}
+
+	lines := command(t, c, "a3", "SEARCH CHARSET KOI8-R ALL")
+	assert.True(t, strings.HasPrefix(lines[0], "a3 NO [BADCHARSET"), "got: %v", lines)
+}
+
+func TestStoreAndExpunge(t *testing.T) {
+	server, manager := setupIMAPServer(t, false, false)
+	addMessage(t, manager, "recipient", "first", 1)
+	addMessage(t, manager, "recipient", "second", 2)
+	addMessage(t, manager, "recipient", "third", 3)
+	c := setupIMAPSession(t, server)
+
+	command(t, c, "a1", "LOGIN recipient pass")
+	command(t, c, "a2", "SELECT INBOX")
+
+	lines := command(t, c, "a3", `STORE 1 +FLAGS (\Flagged \Seen)`)
+	assert.Equal(t, []string{
+		`* 1 FETCH (FLAGS (\Flagged \Seen))`,
+		"a3 OK STORE completed",
+	}, lines)
+	metas, err := manager.GetMetadata("recipient")
+	require.NoError(t, err)
+	assert.True(t, metas[0].Seen)
+
+	lines = command(t, c, "a4", `UID STORE 2:3 +FLAGS.SILENT (\Deleted)`)
+	assert.Equal(t, []string{"a4 OK UID STORE completed"}, lines)
+
+	lines = command(t, c, "a5", "SEARCH DELETED")
+	assert.Equal(t, []string{"* SEARCH 2 3", "a5 OK SEARCH completed"}, lines)
+
+	lines = command(t, c, "a6", "EXPUNGE")
+	assert.Equal(t, []string{"* 2 EXPUNGE", "* 2 EXPUNGE", "a6 OK EXPUNGE completed"}, lines)
+
+	metas, err = manager.GetMetadata("recipient")
+	require.NoError(t, err)
+	require.Len(t, metas, 1)
+	assert.Equal(t, "first", metas[0].Subject)
+
+	// New messages are reported on NOOP, with the next UID.
+	addMessage(t, manager, "recipient", "fourth", 4)
+	lines = command(t, c, "a7", "NOOP")
+	assert.Equal(t, []string{"* 2 EXISTS", "a7 OK NOOP completed"}, lines)
+	lines = command(t, c, "a8", "FETCH 2 UID")
+	assert.Equal(t, "* 2 FETCH (UID 4)", lines[0])
+}
+
+func TestExamineReadOnly(t *testing.T) {
+	server, manager := setupIMAPServer(t, false, false)
+	addMessage(t, manager, "recipient", "first", 1)
+	c := setupIMAPSession(t, server)
+
+	command(t, c, "a1", "LOGIN recipient pass")
+	lines := command(t, c, "a2", "EXAMINE INBOX")
+	assert.Equal(t, "a2 OK [READ-ONLY] EXAMINE completed", lines[len(lines)-1])
+
+	lines = command(t, c, "a3", `STORE 1 +FLAGS (\Deleted)`)
+	assert.Equal(t, []string{"a3 NO Mailbox is read-only"}, lines)
+
+	command(t, c, "a4", "FETCH 1 BODY[]")
+	metas, err := manager.GetMetadata("recipient")
+	require.NoError(t, err)
+	assert.False(t, metas[0].Seen, "EXAMINE must not set seen")
+}
+
+func TestListAndStatus(t *testing.T) {
+	server, manager := setupIMAPServer(t, false, false)
+	addMessage(t, manager, "recipient", "first", 1)
+	c := setupIMAPSession(t, server)
+
+	command(t, c, "a1", "LOGIN recipient pass")
+	lines := command(t, c, "a2", `LIST "" "*"`)
+	assert.Equal(t, []string{`* LIST (\HasNoChildren) "/" INBOX`, "a2 OK LIST completed"}, lines)
+
+	lines = command(t, c, "a3", `LIST "" "Trash"`)
+	assert.Equal(t, []string{"a3 OK LIST completed"}, lines)
+
+	lines = command(t, c, "a4", "STATUS INBOX (MESSAGES UNSEEN UIDNEXT)")
+	assert.Equal(t, []string{
+		"* STATUS INBOX (MESSAGES 1 UNSEEN 1 UIDNEXT 2)",
+		"a4 OK STATUS completed",
+	}, lines)
+
+	lines = command(t, c, "a5", "CREATE Trash")
+	assert.True(t, strings.HasPrefix(lines[0], "a5 NO"), "got: %v", lines)
+}
+
+func TestLiteralArguments(t *testing.T) {
+	server, _ := setupIMAPServer(t, false, false)
+	c := setupIMAPSession(t, server)
+
+	require.NoError(t, c.PrintfLine("a1 LOGIN {9}"))
+	line, err := c.ReadLine()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(line, "+ "), "expected continuation, got: %v", line)
+
+	// LITERAL+ does not wait for a continuation.
+	require.NoError(t, c.PrintfLine("recipient {4+}"))
+	require.NoError(t, c.PrintfLine("pass"))
+	line, err = c.ReadLine()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(line, "a1 OK"), "got: %v", line)
+}
+
+func TestCommandTooLarge(t *testing.T) {
+	server, _ := setupIMAPServer(t, false, false)
+	c := setupIMAPSession(t, server)
+
+	// Each literal is within maxLiteral, but together they exceed maxCommand.
+	// The pipe is unbuffered, so write from another goroutine while reading the response.
+	go func() {
+		literal := strings.Repeat("x", maxLiteral)
+		if c.PrintfLine("a1 LOGIN {%d+}", maxLiteral) != nil {
+			return
+		}
+		for range maxCommand / maxLiteral {
+			if c.PrintfLine("%s {%d+}", literal, maxLiteral) != nil {
+				return
+			}
+		}
+	}()
+	line, err := c.ReadLine()
+	require.NoError(t, err)
+	assert.Equal(t, "* BYE Command too large", line)
+}
+
+func TestStartTLS(t *testing.T) {
+	server, _ := setupIMAPServer(t, true, false)
+	pipe := setupIMAPPipe(t, server)
+	c := textproto.NewConn(pipe)
+	_, err := c.ReadLine()
+	require.NoError(t, err)
+
+	lines := command(t, c, "a1", "CAPABILITY")
+	assert.Contains(t, lines[0], "STARTTLS")
+
+	lines = command(t, c, "a2", "STARTTLS")
+	require.Equal(t, []string{"a2 OK Begin TLS negotiation now"}, lines)
+
+	tlsConn := tls.Client(pipe, &tls.Config{InsecureSkipVerify: true})
+	ctx, toCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer toCancel()
+	require.NoError(t, tlsConn.HandshakeContext(ctx), "TLS handshake failed")
+	c = textproto.NewConn(tlsConn)
+
+	lines = command(t, c, "a3", "CAPABILITY")
+	assert.NotContains(t, lines[0], "STARTTLS")
+
+	lines = command(t, c, "a4", "STARTTLS")
+	assert.True(t, strings.HasPrefix(lines[0], "a4 BAD"), "got: %v", lines)
+
+	lines = command(t, c, "a5", "LOGIN recipient pass")
+	assert.True(t, strings.HasPrefix(lines[0], "a5 OK"), "got: %v", lines)
+}
+
+func TestForceTLS(t *testing.T) {
+	server, _ := setupIMAPServer(t, true, true)
+	pipe := setupIMAPPipe(t, server)
+
+	tlsConn := tls.Client(pipe, &tls.Config{InsecureSkipVerify: true})
+	ctx, toCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer toCancel()
+	require.NoError(t, tlsConn.HandshakeContext(ctx), "TLS handshake failed")
+	c := textproto.NewConn(tlsConn)
+
+	line, err := c.ReadLine()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(line, "* OK"), "got: %v", line)
+	assert.NotContains(t, line, "STARTTLS")
+}
+
+// command sends a tagged command and returns the response lines, up to and including the tagged
+// completion.
+func command(t *testing.T, c *textproto.Conn, tag, cmd string) []string {
+	t.Helper()
+	if err := c.PrintfLine("%s %s", tag, cmd); err != nil {
+		t.Fatalf("Failed to send %q: %v", cmd, err)
+	}
+	var lines []string
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			t.Fatalf("Failed to read response to %q: %v", cmd, err)
+		}
+		lines = append(lines, line)
+		if strings.HasPrefix(line, tag+" ") {
+			return lines
+		}
+	}
+}
+
+func addMessage(t *testing.T, manager *message.StoreManager, mailbox, subject string, n int) {
+	t.Helper()
+	delivery := &message.Delivery{
+		Meta: event.MessageMetadata{
+			Mailbox: mailbox,
+			From:    &mail.Address{Name: "Sender", Address: "sender@example.com"},
+			To:      []*mail.Address{{Address: "recipient@example.com"}},
+			Date:    time.Now(),
+			Subject: subject,
+		},
+		Reader: strings.NewReader(fmt.Sprintf(testMessage, subject, n, n)),
+	}
+	if _, err := manager.Store.AddMessage(delivery); err != nil {
+		t.Fatalf("Failed to add message: %v", err)
+	}
+}
+
+// net.Pipe does not implement deadlines
+type mockConn struct {
+	net.Conn
+}
+
+func (m *mockConn) SetDeadline(t time.Time) error      { return nil }
+func (m *mockConn) SetReadDeadline(t time.Time) error  { return nil }
+func (m *mockConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func setupIMAPServer(t *testing.T, tls bool, forceTLS bool) (*Server, *message.StoreManager) {
+	t.Helper()
+	cfg := config.IMAP{
+		Addr:     "127.0.0.1:1430",
+		Domain:   "inbucket.local",
+		Timeout:  5 * time.Second,
+		Debug:    false,
+		ForceTLS: forceTLS,
+	}
+	if tls {
+		cert, privKey, err := generateCertificate(t)
+		if err != nil {
+			t.Fatalf("Failed to generate x.509 certificate; %v", err)
+		}
+
+		cfg.TLSEnabled = true
+		td := t.TempDir()
+		certPath := path.Join(td, "cert.pem")
+		keyPath := path.Join(td, "key.pem")
+		if err := os.WriteFile(certPath, certToPem(cert), 0700); err != nil {
+			t.Fatalf("Failed to write cert PEM file; %v", err)
+		}
+		if err := os.WriteFile(keyPath, privKeyToPem(privKey), 0700); err != nil {
+			t.Fatalf("Failed to write privKey PEM file; %v", err)
+		}
+		cfg.TLSCert = certPath
+		cfg.TLSPrivKey = keyPath
+	}
+
+	extHost := extension.NewHost()
+	ds, err := mem.New(config.Storage{}, extHost)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	manager := &message.StoreManager{
+		AddrPolicy: &policy.Addressing{Config: &config.Root{MailboxNaming: config.LocalNaming}},
+		Store:      ds,
+		ExtHost:    extHost,
+	}
+
+	s, err := NewServer(cfg, manager)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v.", err)
+	}
+	return s, manager
+}
+
+var sessionNum int
+
+// setupIMAPSession starts a session and consumes the greeting.
+func setupIMAPSession(t *testing.T, server *Server) *textproto.Conn {
+	t.Helper()
+	c := textproto.NewConn(setupIMAPPipe(t, server))
+	line, err := c.ReadLine()
+	if err != nil {
+		t.Fatalf("Reading greeting failed %v", err)
+	}
+	if !strings.HasPrefix(line, "* OK") {
+		t.Fatalf("Greeting is not OK: %v", line)
+	}
+	return c
+}
+
+func setupIMAPPipe(t *testing.T, server *Server) net.Conn {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = clientConn.Close()
+		server.Drain()
+	})
+
+	// Start the session.
+	server.wg.Add(1)
+	sessionNum++
+	go server.startSession(context.Background(), sessionNum, &mockConn{serverConn})
+
+	return clientConn
+}
+
+func privKeyToPem(privkey *rsa.PrivateKey) []byte {
+	privkeyBytes := x509.MarshalPKCS1PrivateKey(privkey)
+	return pem.EncodeToMemory(
+		&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: privkeyBytes,
+		},
+	)
+}
+
+func certToPem(cert []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+}
+
+func generateCertificate(t *testing.T) ([]byte, *rsa.PrivateKey, error) {
+	t.Helper()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key; %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: "localhost.local",
+		},
+		DNSNames:              []string{"localhost", "127.0.0.1", "inbucket.local"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageDataEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("certificate generation failed; %v", err)
+	}
+	return cert, priv, nil
+}
@@ -0,0 +1,178 @@
+package imap
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+)
+
+// IMAP system flags.
+const (
+	flagAnswered = `\Answered`
+	flagDeleted  = `\Deleted`
+	flagDraft    = `\Draft`
+	flagFlagged  = `\Flagged`
+	flagSeen     = `\Seen`
+)
+
+// systemFlags lists the flags advertised by SELECT, in display order.
+var systemFlags = []string{flagAnswered, flagFlagged, flagDeleted, flagSeen, flagDraft}
+
+// uidRegistry assigns stable IMAP UIDs to Inbucket message IDs, and holds the flags that the
+// message store has no place for.  UIDs are only stable for the lifetime of the server, which is
+// reflected in the UIDVALIDITY value.
+type uidRegistry struct {
+	sync.Mutex
+	validity uint32
+	boxes    map[string]*uidMailbox
+}
+
+// uidMailbox tracks UID and flag state for a single mailbox.
+type uidMailbox struct {
+	next  uint32                     // Next UID to be assigned.
+	uids  map[string]uint32          // UIDs by message ID.
+	flags map[string]map[string]bool // Non-seen flags by message ID.
+}
+
+func newUIDRegistry(now time.Time) *uidRegistry {
+	return &uidRegistry{
+		validity: uint32(now.Unix()),
+		boxes:    make(map[string]*uidMailbox),
+	}
+}
+
+// mailbox gets or creates the state for the named mailbox. Lock must be held.
+func (r *uidRegistry) mailbox(name string) *uidMailbox {
+	mb, ok := r.boxes[name]
+	if !ok {
+		mb = &uidMailbox{
+			next:  1,
+			uids:  make(map[string]uint32),
+			flags: make(map[string]map[string]bool),
+		}
+		r.boxes[name] = mb
+	}
+	return mb
+}
+
+// assign returns messages with UIDs for the provided metadata, which must be in delivery order.
+// State for messages no longer present in the mailbox is discarded.
+func (r *uidRegistry) assign(mailbox string, metas []*event.MessageMetadata) []*imapMessage {
+	r.Lock()
+	defer r.Unlock()
+
+	mb := r.mailbox(mailbox)
+	present := make(map[string]bool, len(metas))
+	msgs := make([]*imapMessage, 0, len(metas))
+	for _, meta := range metas {
+		uid, ok := mb.uids[meta.ID]
+		if !ok {
+			uid = mb.next
+			mb.next++
+			mb.uids[meta.ID] = uid
+		}
+		present[meta.ID] = true
+		msgs = append(msgs, &imapMessage{MessageMetadata: meta, uid: uid})
+	}
+	for id := range mb.uids {
+		if !present[id] {
+			delete(mb.uids, id)
+			delete(mb.flags, id)
+		}
+	}
+
+	// Stores list messages in delivery order, but be defensive about it.
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].uid < msgs[j].uid })
+	return msgs
+}
+
+// uidNext returns the UID that will be assigned to the next message in the mailbox.
+func (r *uidRegistry) uidNext(mailbox string) uint32 {
+	r.Lock()
+	defer r.Unlock()
+	return r.mailbox(mailbox).next
+}
+
+// flags returns the flags set on the message, including seen.
+func (r *uidRegistry) flags(mailbox string, msg *imapMessage) []string {
+	r.Lock()
+	defer r.Unlock()
+
+	set := r.mailbox(mailbox).flags[msg.ID]
+	flags := make([]string, 0, len(set)+1)
+	for _, f := range systemFlags {
+		if f == flagSeen {
+			if msg.Seen {
+				flags = append(flags, f)
+			}
+			continue
+		}
+		if set[f] {
+			flags = append(flags, f)
+		}
+	}
+
+	// Keywords, sorted for stable output.
+	keywords := make([]string, 0)
+	for f, on := range set {
+		if on && !strings.HasPrefix(f, `\`) {
+			keywords = append(keywords, f)
+		}
+	}
+	sort.Strings(keywords)
+	return append(flags, keywords...)
+}
+
+// hasFlag returns true if the named flag is set on the message.
+func (r *uidRegistry) hasFlag(mailbox string, msg *imapMessage, flag string) bool {
+	if strings.EqualFold(flag, flagSeen) {
+		return msg.Seen
+	}
+	r.Lock()
+	defer r.Unlock()
+	return r.mailbox(mailbox).flags[msg.ID][canonicalFlag(flag)]
+}
+
+// setFlag sets or clears the named flag on the message; seen is ignored, as it lives in the store.
+func (r *uidRegistry) setFlag(mailbox string, msg *imapMessage, flag string, on bool) {
+	flag = canonicalFlag(flag)
+	if flag == flagSeen {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	mb := r.mailbox(mailbox)
+	set := mb.flags[msg.ID]
+	if set == nil {
+		if !on {
+			return
+		}
+		set = make(map[string]bool)
+		mb.flags[msg.ID] = set
+	}
+	if on {
+		set[flag] = true
+	} else {
+		delete(set, flag)
+	}
+}
+
+// canonicalFlag returns the conventional capitalization of system flags.
+func canonicalFlag(flag string) string {
+	for _, f := range systemFlags {
+		if strings.EqualFold(f, flag) {
+			return f
+		}
+	}
+	return flag
+}
+
+// imapMessage is a message within a selected mailbox.
+type imapMessage struct {
+	*event.MessageMetadata
+	uid uint32
+}
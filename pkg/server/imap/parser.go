@@ -0,0 +1,267 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// arg is a parsed IMAP command argument: an atom, a string, or a parenthesized list.
+type arg struct {
+	value    string // Atom or string value.
+	isString bool   // Value was a quoted string or literal.
+	list     []arg  // Members of a parenthesized list.
+	isList   bool   // Argument is a parenthesized list.
+}
+
+// String renders the argument for logging and error messages.
+func (a arg) String() string {
+	if a.isList {
+		parts := make([]string, len(a.list))
+		for i, v := range a.list {
+			parts[i] = v.String()
+		}
+		return "(" + strings.Join(parts, " ") + ")"
+	}
+	return a.value
+}
+
+// isNIL returns true if the argument is the atom NIL.
+func (a arg) isNIL() bool {
+	return !a.isList && !a.isString && strings.EqualFold(a.value, "NIL")
+}
+
+// parseArgs splits a command line (with literals already inlined) into arguments.
+func parseArgs(line string) ([]arg, error) {
+	p := &argParser{s: line}
+	args, err := p.parseList(false)
+	if err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// argParser is a simple recursive descent parser for IMAP command arguments.
+type argParser struct {
+	s   string
+	pos int
+}
+
+// parseList parses arguments until end of input, or a closing paren when nested.
+func (p *argParser) parseList(nested bool) ([]arg, error) {
+	args := make([]arg, 0)
+	for {
+		// Skip separating spaces.
+		for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+			p.pos++
+		}
+		if p.pos >= len(p.s) {
+			if nested {
+				return nil, errors.New("unterminated list")
+			}
+			return args, nil
+		}
+
+		switch c := p.s[p.pos]; c {
+		case '(':
+			p.pos++
+			list, err := p.parseList(true)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg{list: list, isList: true})
+		case ')':
+			if !nested {
+				return nil, errors.New("unexpected ')'")
+			}
+			p.pos++
+			return args, nil
+		case '"':
+			v, err := p.parseQuoted()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg{value: v, isString: true})
+		case '{':
+			v, err := p.parseLiteral()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg{value: v, isString: true})
+		default:
+			args = append(args, arg{value: p.parseAtom()})
+		}
+	}
+}
+
+// parseQuoted parses a quoted string, handling backslash escapes.
+func (p *argParser) parseQuoted() (string, error) {
+	var sb strings.Builder
+	p.pos++ // Opening quote.
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return sb.String(), nil
+		case '\\':
+			if p.pos >= len(p.s) {
+				return "", errors.New("unterminated quoted string")
+			}
+			sb.WriteByte(p.s[p.pos])
+			p.pos++
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", errors.New("unterminated quoted string")
+}
+
+// parseLiteral parses a `{n}` literal, the octets of which follow a CRLF.
+func (p *argParser) parseLiteral() (string, error) {
+	end := strings.IndexByte(p.s[p.pos:], '}')
+	if end < 0 {
+		return "", errors.New("malformed literal")
+	}
+	spec := strings.TrimSuffix(p.s[p.pos+1:p.pos+end], "+")
+	n, err := strconv.Atoi(spec)
+	if err != nil || n < 0 {
+		return "", fmt.Errorf("malformed literal length %q", spec)
+	}
+	start := p.pos + end + 1
+	if !strings.HasPrefix(p.s[start:], "\r\n") || len(p.s) < start+2+n {
+		return "", errors.New("literal data missing")
+	}
+	start += 2
+	p.pos = start + n
+	return p.s[start:p.pos], nil
+}
+
+// parseAtom parses an atom.  Square bracketed sections, as used by FETCH, may contain spaces and
+// parens, and are included in the atom.
+func (p *argParser) parseAtom() string {
+	start := p.pos
+	depth := 0
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		if depth == 0 && (c == ' ' || c == '(' || c == ')') {
+			break
+		}
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			if depth > 0 {
+				depth--
+			}
+		}
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// literalLength returns the length of a literal announced at the end of a line, and whether the
+// client expects a continuation request before sending it.
+func literalLength(line string) (n int, sync bool, ok bool) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, false, false
+	}
+	open := strings.LastIndexByte(line, '{')
+	if open < 0 {
+		return 0, false, false
+	}
+	spec := line[open+1 : len(line)-1]
+	sync = true
+	if strings.HasSuffix(spec, "+") {
+		// LITERAL+ non-synchronizing literal.
+		spec = spec[:len(spec)-1]
+		sync = false
+	}
+	n, err := strconv.Atoi(spec)
+	if err != nil || n < 0 {
+		return 0, false, false
+	}
+	return n, sync, true
+}
+
+// seqRange is an inclusive range of sequence numbers or UIDs; zero represents `*`.
+type seqRange struct {
+	start, stop uint32
+}
+
+// seqSet is an IMAP sequence set, such as `1:3,7,9:*`.
+type seqSet []seqRange
+
+// parseSeqSet parses an IMAP sequence set.
+func parseSeqSet(s string) (seqSet, error) {
+	if s == "" {
+		return nil, errors.New("empty sequence set")
+	}
+	var set seqSet
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(part, ":", 2)
+		start, err := parseSeqNumber(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		stop := start
+		if len(bounds) == 2 {
+			if stop, err = parseSeqNumber(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+		set = append(set, seqRange{start: start, stop: stop})
+	}
+	return set, nil
+}
+
+func parseSeqNumber(s string) (uint32, error) {
+	if s == "*" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid sequence number %q", s)
+	}
+	return uint32(n), nil
+}
+
+// contains returns true if n is within the set, max is the value of `*`.
+func (set seqSet) contains(n, max uint32) bool {
+	for _, r := range set {
+		start, stop := r.start, r.stop
+		if start == 0 {
+			start = max
+		}
+		if stop == 0 {
+			stop = max
+		}
+		if start > stop {
+			start, stop = stop, start
+		}
+		if n >= start && n <= stop {
+			return true
+		}
+	}
+	return false
+}
+
+// quote formats s as an IMAP quoted string, falling back to a literal for content that may not
+// be quoted.
+func quote(s string) string {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '\r' || c == '\n' || c == 0 || c >= 0x80 {
+			return fmt.Sprintf("{%d}\r\n%s", len(s), s)
+		}
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// nstring formats s as a quoted string, or NIL if empty.
+func nstring(s string) string {
+	if s == "" {
+		return "NIL"
+	}
+	return quote(s)
+}
@@ -0,0 +1,266 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// searchDateFmt is the layout of dates in SEARCH criteria.
+const searchDateFmt = "2-Jan-2006"
+
+// errBadCharset is returned for SEARCH CHARSET values we do not support.
+var errBadCharset = errors.New("unsupported charset")
+
+// searchTarget holds a candidate message during SEARCH evaluation, loading content on demand.
+type searchTarget struct {
+	ssn    *Session
+	msg    *imapMessage
+	seq    uint32
+	maxSeq uint32
+	maxUID uint32
+	root   *part
+	text   *string
+	err    error
+}
+
+// searchKey is a compiled SEARCH criterion.
+type searchKey func(t *searchTarget) bool
+
+// content loads and parses the message source.
+func (t *searchTarget) content() *part {
+	if t.root == nil && t.err == nil {
+		var src []byte
+		if src, t.err = t.ssn.loadSource(t.msg); t.err == nil {
+			t.root = parsePart(src)
+		}
+	}
+	if t.root == nil {
+		return &part{}
+	}
+	return t.root
+}
+
+// bodyText returns the decoded text and HTML bodies of the message.
+func (t *searchTarget) bodyText() string {
+	if t.text == nil && t.err == nil {
+		m, err := t.ssn.manager.GetMessage(t.ssn.user, t.msg.ID)
+		if err != nil || m == nil {
+			t.err = fmt.Errorf("failed to load message %v: %v", t.msg.ID, err)
+			return ""
+		}
+		text := m.Text() + "\n" + m.HTML()
+		t.text = &text
+	}
+	if t.text == nil {
+		return ""
+	}
+	return *t.text
+}
+
+// header returns the decoded value of the named header.
+func (t *searchTarget) header(name string) string {
+	values := t.content().header.Values(name)
+	dec := new(mime.WordDecoder)
+	for i, v := range values {
+		if d, err := dec.DecodeHeader(v); err == nil {
+			values[i] = d
+		}
+	}
+	return strings.Join(values, ", ")
+}
+
+// parseSearch compiles the arguments of a SEARCH command into a single key.
+func parseSearch(args []arg) (searchKey, error) {
+	if len(args) >= 2 && strings.EqualFold(args[0].value, "CHARSET") {
+		switch strings.ToUpper(args[1].value) {
+		case "US-ASCII", "UTF-8":
+		default:
+			return nil, errBadCharset
+		}
+		args = args[2:]
+	}
+	if len(args) == 0 {
+		return nil, errors.New("missing search criteria")
+	}
+	return parseSearchList(args)
+}
+
+// parseSearchList compiles a list of keys, all of which must match.
+func parseSearchList(args []arg) (searchKey, error) {
+	var keys []searchKey
+	for len(args) > 0 {
+		key, rest, err := parseSearchKey(args)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		args = rest
+	}
+	return func(t *searchTarget) bool {
+		for _, k := range keys {
+			if !k(t) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// parseSearchKey compiles the key at the head of args, returning the remaining args.
+func parseSearchKey(args []arg) (searchKey, []arg, error) {
+	head := args[0]
+	args = args[1:]
+	if head.isList {
+		key, err := parseSearchList(head.list)
+		return key, args, err
+	}
+
+	// Pops a string argument.
+	var popErr error
+	pop := func() string {
+		if len(args) == 0 {
+			popErr = fmt.Errorf("missing argument to %v", head.value)
+			return ""
+		}
+		v := args[0].value
+		args = args[1:]
+		return v
+	}
+	popDate := func() time.Time {
+		v := pop()
+		d, err := time.Parse(searchDateFmt, v)
+		if err != nil && popErr == nil {
+			popErr = fmt.Errorf("bad date %q", v)
+		}
+		return d
+	}
+	flag := func(name string, want bool) searchKey {
+		return func(t *searchTarget) bool {
+			return t.ssn.uids.hasFlag(t.ssn.user, t.msg, name) == want
+		}
+	}
+	contains := func(got, want string) bool {
+		return strings.Contains(strings.ToLower(got), strings.ToLower(want))
+	}
+	headerKey := func(name string) searchKey {
+		want := pop()
+		return func(t *searchTarget) bool { return contains(t.header(name), want) }
+	}
+
+	var key searchKey
+	switch name := strings.ToUpper(head.value); name {
+	case "ALL":
+		key = func(*searchTarget) bool { return true }
+	case "ANSWERED", "DELETED", "DRAFT", "FLAGGED", "SEEN":
+		key = flag(`\`+name, true)
+	case "UNANSWERED", "UNDELETED", "UNDRAFT", "UNFLAGGED", "UNSEEN":
+		key = flag(`\`+name[2:], false)
+	case "KEYWORD":
+		key = flag(pop(), true)
+	case "UNKEYWORD":
+		key = flag(pop(), false)
+	case "NEW", "RECENT":
+		// Inbucket does not track the recent flag.
+		key = func(*searchTarget) bool { return false }
+	case "OLD":
+		key = func(*searchTarget) bool { return true }
+	case "BCC", "CC", "FROM", "SUBJECT", "TO":
+		key = headerKey(name)
+	case "HEADER":
+		key = headerKey(pop())
+	case "BODY":
+		want := pop()
+		key = func(t *searchTarget) bool { return contains(t.bodyText(), want) }
+	case "TEXT":
+		want := pop()
+		key = func(t *searchTarget) bool {
+			return contains(string(t.content().rawHeader), want) || contains(t.bodyText(), want)
+		}
+	case "BEFORE", "ON", "SINCE":
+		want := popDate()
+		key = func(t *searchTarget) bool { return compareDate(t.msg.Date, want, name) }
+	case "SENTBEFORE", "SENTON", "SENTSINCE":
+		want := popDate()
+		key = func(t *searchTarget) bool {
+			sent, err := mail.ParseDate(t.content().header.Get("Date"))
+			return err == nil && compareDate(sent, want, strings.TrimPrefix(name, "SENT"))
+		}
+	case "LARGER", "SMALLER":
+		v := pop()
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil && popErr == nil {
+			popErr = fmt.Errorf("bad size %q", v)
+		}
+		key = func(t *searchTarget) bool {
+			size := int64(len(t.content().raw()))
+			if name == "LARGER" {
+				return size > n
+			}
+			return size < n
+		}
+	case "UID":
+		set, err := parseSeqSet(pop())
+		if err != nil && popErr == nil {
+			popErr = err
+		}
+		key = func(t *searchTarget) bool { return set.contains(t.msg.uid, t.maxUID) }
+	case "NOT":
+		if len(args) == 0 {
+			return nil, nil, errors.New("missing argument to NOT")
+		}
+		inner, rest, err := parseSearchKey(args)
+		if err != nil {
+			return nil, nil, err
+		}
+		args = rest
+		key = func(t *searchTarget) bool { return !inner(t) }
+	case "OR":
+		if len(args) < 2 {
+			return nil, nil, errors.New("missing arguments to OR")
+		}
+		left, rest, err := parseSearchKey(args)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rest) == 0 {
+			return nil, nil, errors.New("missing arguments to OR")
+		}
+		right, rest, err := parseSearchKey(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		args = rest
+		key = func(t *searchTarget) bool { return left(t) || right(t) }
+	default:
+		// Sequence sets may appear as a bare key.
+		set, err := parseSeqSet(head.value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unknown search key %q", head.value)
+		}
+		key = func(t *searchTarget) bool { return set.contains(t.seq, t.maxSeq) }
+	}
+	if popErr != nil {
+		return nil, nil, popErr
+	}
+	return key, args, nil
+}
+
+// compareDate compares the calendar date of got to want, ignoring time and timezone.
+func compareDate(got, want time.Time, op string) bool {
+	gy, gm, gd := got.Date()
+	day := time.Date(gy, gm, gd, 0, 0, 0, 0, time.UTC)
+	switch op {
+	case "BEFORE":
+		return day.Before(want)
+	case "ON":
+		return day.Equal(want)
+	default:
+		// SINCE
+		return !day.Before(want)
+	}
+}
@@ -0,0 +1,376 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var crlf = []byte("\r\n")
+
+// part is a node in the MIME structure of a message, used to answer FETCH BODY[section] and
+// BODYSTRUCTURE requests.
+type part struct {
+	header    textproto.MIMEHeader
+	rawHeader []byte            // Header including the terminating blank line.
+	body      []byte            // Content following the header.
+	mediaType string            // Lower case media type, ie: text/plain.
+	params    map[string]string // Content-Type parameters.
+	children  []*part           // Parts of a multipart.
+	message   *part             // Embedded message of a message/rfc822 part.
+}
+
+// parsePart parses the raw (CRLF normalized) content of a message or MIME part.
+func parsePart(raw []byte) *part {
+	p := &part{}
+	switch {
+	case bytes.HasPrefix(raw, crlf):
+		// No header present.
+		p.rawHeader = raw[:2]
+		p.body = raw[2:]
+	default:
+		if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+			p.rawHeader = raw[:i+4]
+			p.body = raw[i+4:]
+		} else {
+			p.rawHeader = raw
+		}
+	}
+
+	// Partial headers are preferable to no headers.
+	tr := textproto.NewReader(bufio.NewReader(bytes.NewReader(p.rawHeader)))
+	p.header, _ = tr.ReadMIMEHeader()
+	if p.header == nil {
+		p.header = make(textproto.MIMEHeader)
+	}
+
+	p.mediaType = "text/plain"
+	p.params = map[string]string{}
+	if ct := p.header.Get("Content-Type"); ct != "" {
+		if mt, params, err := mime.ParseMediaType(ct); err == nil {
+			p.mediaType = mt
+			p.params = params
+		}
+	}
+	if p.mediaType == "text/plain" && p.params["charset"] == "" {
+		p.params["charset"] = "us-ascii"
+	}
+
+	switch {
+	case strings.HasPrefix(p.mediaType, "multipart/") && p.params["boundary"] != "":
+		for _, content := range splitMultipart(p.body, p.params["boundary"]) {
+			p.children = append(p.children, parsePart(content))
+		}
+	case p.mediaType == "message/rfc822":
+		p.message = parsePart(p.body)
+	}
+
+	return p
+}
+
+// splitMultipart returns the raw content of each part within a multipart body.
+func splitMultipart(body []byte, boundary string) [][]byte {
+	delim := []byte("--" + boundary)
+	var parts [][]byte
+	start := -1
+	for pos := 0; pos < len(body); {
+		next := len(body)
+		lineEnd := len(body)
+		if i := bytes.Index(body[pos:], crlf); i >= 0 {
+			lineEnd = pos + i
+			next = lineEnd + 2
+		}
+		line := body[pos:lineEnd]
+		if bytes.HasPrefix(line, delim) {
+			rest := bytes.TrimRight(line[len(delim):], " \t")
+			closing := bytes.Equal(rest, []byte("--"))
+			if len(rest) == 0 || closing {
+				if start >= 0 {
+					// The CRLF preceding a delimiter belongs to the delimiter.
+					end := pos - 2
+					if end < start {
+						end = start
+					}
+					parts = append(parts, body[start:end])
+				}
+				if closing {
+					return parts
+				}
+				start = next
+			}
+		}
+		pos = next
+	}
+	if start >= 0 && start <= len(body) {
+		// Missing closing delimiter.
+		parts = append(parts, body[start:])
+	}
+	return parts
+}
+
+// normalizeCRLF converts bare LF line endings to CRLF, as IMAP requires.
+func normalizeCRLF(b []byte) []byte {
+	if bytes.Count(b, []byte("\n")) == bytes.Count(b, crlf) {
+		return b
+	}
+	out := make([]byte, 0, len(b)+len(b)/32)
+	for i, c := range b {
+		if c == '\n' && (i == 0 || b[i-1] != '\r') {
+			out = append(out, '\r')
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// raw returns the full content of the part, including its header.
+func (p *part) raw() []byte {
+	b := make([]byte, 0, len(p.rawHeader)+len(p.body))
+	b = append(b, p.rawHeader...)
+	return append(b, p.body...)
+}
+
+// resolve walks a part path such as [1 2], returning nil if it does not exist.
+func (p *part) resolve(path []int) *part {
+	cur := p
+	for _, n := range path {
+		// A message/rfc822 part contains the parts of the embedded message.
+		if cur.message != nil {
+			cur = cur.message
+		}
+		if len(cur.children) == 0 {
+			// Non-multipart bodies have a single part, themselves.
+			if n == 1 {
+				continue
+			}
+			return nil
+		}
+		if n < 1 || n > len(cur.children) {
+			return nil
+		}
+		cur = cur.children[n-1]
+	}
+	return cur
+}
+
+// section returns the content of a FETCH BODY[section] specifier, ie: `1.2.MIME` or
+// `HEADER.FIELDS (FROM TO)`.
+func (p *part) section(spec string) ([]byte, error) {
+	// Split the numeric part path from the text specifier.
+	var path []int
+	rest := spec
+	for rest != "" {
+		end := strings.IndexByte(rest, '.')
+		if end < 0 {
+			end = len(rest)
+		}
+		n, err := strconv.Atoi(rest[:end])
+		if err != nil {
+			break
+		}
+		path = append(path, n)
+		rest = strings.TrimPrefix(rest[end:], ".")
+	}
+
+	target := p.resolve(path)
+	if target == nil {
+		return nil, fmt.Errorf("no such section %q", spec)
+	}
+
+	words := strings.SplitN(rest, " ", 2)
+	switch strings.ToUpper(words[0]) {
+	case "":
+		if len(path) == 0 {
+			return p.raw(), nil
+		}
+		return target.body, nil
+	case "MIME":
+		if len(path) == 0 {
+			return nil, fmt.Errorf("MIME requires a part number")
+		}
+		return target.rawHeader, nil
+	}
+
+	// Remaining specifiers apply to a message, either the root or an embedded message/rfc822.
+	msg := target
+	if len(path) > 0 {
+		if target.message == nil {
+			return nil, fmt.Errorf("section %q is not a message", spec)
+		}
+		msg = target.message
+	}
+	switch strings.ToUpper(words[0]) {
+	case "HEADER":
+		return msg.rawHeader, nil
+	case "TEXT":
+		return msg.body, nil
+	case "HEADER.FIELDS", "HEADER.FIELDS.NOT":
+		if len(words) != 2 {
+			return nil, fmt.Errorf("missing header field list in %q", spec)
+		}
+		fields, err := parseArgs(words[1])
+		if err != nil || len(fields) != 1 || !fields[0].isList {
+			return nil, fmt.Errorf("bad header field list in %q", spec)
+		}
+		names := make(map[string]bool)
+		for _, f := range fields[0].list {
+			names[textproto.CanonicalMIMEHeaderKey(f.value)] = true
+		}
+		return msg.headerFields(names, strings.ToUpper(words[0]) == "HEADER.FIELDS"), nil
+	}
+	return nil, fmt.Errorf("unknown section %q", spec)
+}
+
+// headerFields returns the raw header lines that are (or are not, when include is false) present
+// in names, followed by a blank line.
+func (p *part) headerFields(names map[string]bool, include bool) []byte {
+	var out bytes.Buffer
+	keep := false
+	for _, line := range bytes.SplitAfter(p.rawHeader, crlf) {
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			// Start of a new field, continuation lines follow its fate.
+			name := line
+			if i := bytes.IndexByte(line, ':'); i >= 0 {
+				name = line[:i]
+			}
+			key := textproto.CanonicalMIMEHeaderKey(string(bytes.TrimSpace(name)))
+			keep = names[key] == include
+		}
+		if keep {
+			out.Write(line)
+		}
+	}
+	out.Write(crlf)
+	return out.Bytes()
+}
+
+// structure renders the BODY or BODYSTRUCTURE (when extended) of the part.
+func (p *part) structure(extended bool) string {
+	var sb strings.Builder
+	sb.WriteString("(")
+	mtype, subtype, _ := strings.Cut(strings.ToUpper(p.mediaType), "/")
+	if len(p.children) > 0 {
+		for _, c := range p.children {
+			sb.WriteString(c.structure(extended))
+		}
+		sb.WriteString(" " + quote(subtype))
+		if extended {
+			sb.WriteString(" " + paramList(p.params) + " " + p.disposition())
+		}
+		sb.WriteString(")")
+		return sb.String()
+	}
+
+	encoding := strings.ToUpper(strings.TrimSpace(p.header.Get("Content-Transfer-Encoding")))
+	if encoding == "" {
+		encoding = "7BIT"
+	}
+	fmt.Fprintf(&sb, "%s %s %s %s %s %s %d", quote(mtype), quote(subtype), paramList(p.params),
+		nstring(p.header.Get("Content-Id")), nstring(p.header.Get("Content-Description")),
+		quote(encoding), len(p.body))
+	switch {
+	case p.message != nil:
+		fmt.Fprintf(&sb, " %s %s %d", envelope(p.message.header), p.message.structure(extended),
+			lineCount(p.body))
+	case mtype == "TEXT":
+		fmt.Fprintf(&sb, " %d", lineCount(p.body))
+	}
+	if extended {
+		sb.WriteString(" NIL " + p.disposition())
+	}
+	sb.WriteString(")")
+	return sb.String()
+}
+
+// disposition renders the Content-Disposition of the part.
+func (p *part) disposition() string {
+	v := p.header.Get("Content-Disposition")
+	if v == "" {
+		return "NIL"
+	}
+	disp, params, err := mime.ParseMediaType(v)
+	if err != nil {
+		return "NIL"
+	}
+	return "(" + quote(strings.ToUpper(disp)) + " " + paramList(params) + ")"
+}
+
+// paramList renders a parameter list, sorted by key.
+func paramList(params map[string]string) string {
+	if len(params) == 0 {
+		return "NIL"
+	}
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fields := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		fields = append(fields, quote(strings.ToUpper(k)), quote(params[k]))
+	}
+	return "(" + strings.Join(fields, " ") + ")"
+}
+
+func lineCount(b []byte) int {
+	return bytes.Count(b, []byte("\n"))
+}
+
+// envelope renders the ENVELOPE structure for a message header.
+func envelope(h textproto.MIMEHeader) string {
+	from := h.Get("From")
+	sender := h.Get("Sender")
+	if sender == "" {
+		sender = from
+	}
+	replyTo := h.Get("Reply-To")
+	if replyTo == "" {
+		replyTo = from
+	}
+	fields := []string{
+		nstring(h.Get("Date")),
+		nstring(h.Get("Subject")),
+		addressList(from),
+		addressList(sender),
+		addressList(replyTo),
+		addressList(h.Get("To")),
+		addressList(h.Get("Cc")),
+		addressList(h.Get("Bcc")),
+		nstring(h.Get("In-Reply-To")),
+		nstring(h.Get("Message-Id")),
+	}
+	return "(" + strings.Join(fields, " ") + ")"
+}
+
+// addressList renders an address header as an IMAP address list.
+func addressList(v string) string {
+	if v == "" {
+		return "NIL"
+	}
+	addrs, err := mail.ParseAddressList(v)
+	if err != nil || len(addrs) == 0 {
+		return "NIL"
+	}
+	var sb strings.Builder
+	sb.WriteString("(")
+	for _, a := range addrs {
+		local, domain := a.Address, ""
+		if i := strings.LastIndexByte(a.Address, '@'); i >= 0 {
+			local, domain = a.Address[:i], a.Address[i+1:]
+		}
+		// Names are re-encoded to keep the response 7-bit clean.
+		fmt.Fprintf(&sb, "(%s NIL %s %s)", nstring(mime.QEncoding.Encode("utf-8", a.Name)),
+			nstring(local), nstring(domain))
+	}
+	sb.WriteString(")")
+	return sb.String()
+}
@@ -0,0 +1,70 @@
+package imap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const multipartMessage = "From: a@example.com\n" +
+	"Subject: multi\n" +
+	"Content-Type: multipart/mixed; boundary=\"XX\"\n" +
+	"\n" +
+	"preamble\n" +
+	"--XX\n" +
+	"Content-Type: text/plain; charset=utf-8\n" +
+	"\n" +
+	"hello\n" +
+	"--XX\n" +
+	"Content-Type: text/html\n" +
+	"Content-Transfer-Encoding: base64\n" +
+	"\n" +
+	"PGI+aGk8L2I+\n" +
+	"--XX--\n"
+
+func TestSection(t *testing.T) {
+	root := parsePart(normalizeCRLF([]byte(multipartMessage)))
+	require.Len(t, root.children, 2)
+
+	tcs := []struct {
+		spec string
+		want string
+	}{
+		{"1", "hello"},
+		{"1.MIME", "Content-Type: text/plain; charset=utf-8\r\n\r\n"},
+		{"2", "PGI+aGk8L2I+"},
+		{"HEADER.FIELDS (SUBJECT)", "Subject: multi\r\n\r\n"},
+		{"HEADER.FIELDS.NOT (SUBJECT CONTENT-TYPE)", "From: a@example.com\r\n\r\n"},
+	}
+	for _, tc := range tcs {
+		got, err := root.section(tc.spec)
+		if assert.NoError(t, err, tc.spec) {
+			assert.Equal(t, tc.want, string(got), tc.spec)
+		}
+	}
+
+	_, err := root.section("3")
+	assert.Error(t, err)
+}
+
+func TestBodyStructure(t *testing.T) {
+	root := parsePart(normalizeCRLF([]byte(multipartMessage)))
+	assert.Equal(t,
+		`(("TEXT" "PLAIN" ("CHARSET" "utf-8") NIL NIL "7BIT" 5 0)`+
+			`("TEXT" "HTML" NIL NIL NIL "BASE64" 12 0) "MIXED")`,
+		root.structure(false))
+}
+
+func TestSeqSet(t *testing.T) {
+	set, err := parseSeqSet("1:3,7,9:*")
+	require.NoError(t, err)
+	for n, want := range map[uint32]bool{1: true, 3: true, 4: false, 7: true, 8: false, 12: true} {
+		assert.Equal(t, want, set.contains(n, 12), "contains(%d)", n)
+	}
+
+	for _, bad := range []string{"", "0", "1:x", "a"} {
+		_, err := parseSeqSet(bad)
+		assert.Error(t, err, bad)
+	}
+}
@@ -7,27 +7,37 @@ import (
 	"github.com/inbucket/inbucket/v3/pkg/config"
 	"github.com/inbucket/inbucket/v3/pkg/extension"
 	"github.com/inbucket/inbucket/v3/pkg/extension/luahost"
+	"github.com/inbucket/inbucket/v3/pkg/extension/rpchost"
 	"github.com/inbucket/inbucket/v3/pkg/message"
+	"github.com/inbucket/inbucket/v3/pkg/msgauth"
 	"github.com/inbucket/inbucket/v3/pkg/msghub"
 	"github.com/inbucket/inbucket/v3/pkg/policy"
+	"github.com/inbucket/inbucket/v3/pkg/relay"
 	"github.com/inbucket/inbucket/v3/pkg/rest"
+	"github.com/inbucket/inbucket/v3/pkg/server/imap"
 	"github.com/inbucket/inbucket/v3/pkg/server/pop3"
 	"github.com/inbucket/inbucket/v3/pkg/server/smtp"
 	"github.com/inbucket/inbucket/v3/pkg/server/web"
 	"github.com/inbucket/inbucket/v3/pkg/storage"
 	"github.com/inbucket/inbucket/v3/pkg/stringutil"
+	"github.com/inbucket/inbucket/v3/pkg/webhook"
 	"github.com/inbucket/inbucket/v3/pkg/webui"
 )
 
 // Services holds the configured services.
 type Services struct {
+	IMAPServer       *imap.Server
+	LMTPServer       *smtp.Server // nil when LMTP is disabled.
 	MsgHub           *msghub.Hub
 	POP3Server       *pop3.Server
+	Relay            *relay.Relay // nil when no relay targets are configured.
 	RetentionScanner *storage.RetentionScanner
+	Webhooks         *webhook.Dispatcher // nil when no webhook URLs are configured.
 	SMTPServer       *smtp.Server
 	WebServer        *web.Server
 	ExtHost          *extension.Host
 	LuaHost          *luahost.Host
+	RPCHost          *rpchost.Host   // nil when no external extension is configured.
 	notify           chan error      // Combined notification for failed services.
 	ready            *sync.WaitGroup // Tracks services that have not reported ready.
 }
@@ -40,6 +50,10 @@ func FullAssembly(conf *config.Root) (*Services, error) {
 	if err != nil && err != luahost.ErrNoScript {
 		return nil, err
 	}
+	rpcHost, err := rpchost.New(conf.RPC, extHost)
+	if err != nil {
+		return nil, err
+	}
 
 	// Configure storage.
 	store, err := storage.FromConfig(conf.Storage, extHost)
@@ -50,31 +64,71 @@ func FullAssembly(conf *config.Root) (*Services, error) {
 	addrPolicy := &policy.Addressing{Config: conf}
 	// Configure shared components.
 	msgHub := msghub.New(conf.Web.MonitorHistory, extHost)
-	mmanager := &message.StoreManager{AddrPolicy: addrPolicy, Store: store, ExtHost: extHost}
+	authVerifier, err := msgauth.NewVerifier(conf.MsgAuth)
+	if err != nil {
+		return nil, err
+	}
+	mmanager := &message.StoreManager{
+		AddrPolicy:   addrPolicy,
+		Store:        store,
+		ExtHost:      extHost,
+		AuthVerifier: authVerifier,
+	}
+	msgRelay, err := relay.New(conf.Relay, conf.SMTP.Domain, mmanager)
+	if err != nil {
+		return nil, err
+	}
+	if msgRelay != nil && msgRelay.Forwarding() {
+		mmanager.Forwarder = msgRelay
+	}
+	webhooks, err := webhook.New(conf.Webhook, extHost, mmanager)
+	if err != nil {
+		return nil, err
+	}
+	if luaHost != nil {
+		luaHost.SetServices(luahost.Services{Manager: mmanager, Relay: msgRelay})
+	}
 
 	// Start Retention scanner.
-	retentionScanner := storage.NewRetentionScanner(conf.Storage, store)
+	retentionScanner := storage.NewRetentionScanner(conf.Storage, store,
+		func(m storage.Message) bool {
+			return message.DeleteDenied(extHost, message.MakeMetadata(m)) != nil
+		})
 
 	// Configure routes and build HTTP server.
 	prefix := stringutil.MakePathPrefixer(conf.Web.BasePath)
 	webui.SetupRoutes(web.Router.PathPrefix(prefix("/serve/")).Subrouter())
 	rest.SetupRoutes(web.Router.PathPrefix(prefix("/api/")).Subrouter())
-	webServer := web.NewServer(conf, mmanager, msgHub)
 
-	pop3Server, err := pop3.NewServer(conf.POP3, store)
+	pop3Server, err := pop3.NewServer(conf.POP3, store, extHost)
+	if err != nil {
+		return nil, err
+	}
+	imapServer, err := imap.NewServer(conf.IMAP, mmanager)
 	if err != nil {
 		return nil, err
 	}
 	smtpServer := smtp.NewServer(conf.SMTP, mmanager, addrPolicy, extHost)
+	var lmtpServer *smtp.Server
+	if conf.LMTP.Addr != "" {
+		lmtpServer = smtp.NewLMTPServer(conf.LMTP, smtpServer)
+	}
+	webServer := web.NewServer(conf, mmanager, msgHub, smtpServer.Faults(), msgRelay,
+		webhooks)
 
 	s := &Services{
 		MsgHub:           msgHub,
+		Relay:            msgRelay,
 		RetentionScanner: retentionScanner,
+		Webhooks:         webhooks,
 		POP3Server:       pop3Server,
+		IMAPServer:       imapServer,
 		SMTPServer:       smtpServer,
+		LMTPServer:       lmtpServer,
 		WebServer:        webServer,
 		ExtHost:          extHost,
 		LuaHost:          luaHost,
+		RPCHost:          rpcHost,
 		ready:            &sync.WaitGroup{},
 	}
 	s.setupNotify()
@@ -87,8 +141,24 @@ func (s *Services) Start(ctx context.Context, readyFunc func()) {
 	go s.MsgHub.Start(ctx)
 	go s.WebServer.Start(ctx, s.makeReadyFunc())
 	go s.SMTPServer.Start(ctx, s.makeReadyFunc())
+	if s.LMTPServer != nil {
+		go s.LMTPServer.Start(ctx, s.makeReadyFunc())
+	}
 	go s.POP3Server.Start(ctx, s.makeReadyFunc())
+	go s.IMAPServer.Start(ctx, s.makeReadyFunc())
 	go s.RetentionScanner.Start(ctx)
+	if s.Relay != nil {
+		go s.Relay.Start(ctx)
+	}
+	if s.Webhooks != nil {
+		go s.Webhooks.Start(ctx)
+	}
+	if s.LuaHost != nil {
+		go s.LuaHost.Start(ctx)
+	}
+	if s.RPCHost != nil {
+		go s.RPCHost.Start(ctx)
+	}
 
 	// Notify when all services report ready.
 	go func() {
@@ -107,13 +177,21 @@ func (s *Services) Notify() <-chan error {
 func (s *Services) setupNotify() {
 	c := make(chan error, 1)
 	s.notify = c
+	var lmtpNotify <-chan error // Blocks forever when LMTP is disabled.
+	if s.LMTPServer != nil {
+		lmtpNotify = s.LMTPServer.Notify()
+	}
 	go func() {
 		// TODO: What level to log failure.
 		select {
 		case err := <-s.POP3Server.Notify():
 			c <- err
+		case err := <-s.IMAPServer.Notify():
+			c <- err
 		case err := <-s.SMTPServer.Notify():
 			c <- err
+		case err := <-lmtpNotify:
+			c <- err
 		case err := <-s.WebServer.Notify():
 			c <- err
 		}
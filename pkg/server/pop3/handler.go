@@ -12,6 +12,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"github.com/inbucket/inbucket/v3/pkg/message"
 	"github.com/inbucket/inbucket/v3/pkg/storage"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -258,6 +260,7 @@ func (s *Session) authorizationHandler(ctx context.Context, cmd string, args []s
 			s.loadMailbox()
 			s.send(fmt.Sprintf("+OK Found %v messages for %v", s.msgCount, s.user))
 			s.enterState(TRANSACTION)
+			s.emitLogin()
 		}
 	case "APOP":
 		if len(args) != 2 {
@@ -269,6 +272,7 @@ func (s *Session) authorizationHandler(ctx context.Context, cmd string, args []s
 		s.loadMailbox()
 		s.send(fmt.Sprintf("+OK Found %v messages for %v", s.msgCount, s.user))
 		s.enterState(TRANSACTION)
+		s.emitLogin()
 	default:
 		s.ooSeq(cmd)
 	}
@@ -566,6 +570,15 @@ func (s *Session) loadMailbox() {
 	s.retainAll()
 }
 
+// emitLogin notifies extensions that the user has logged in.
+func (s *Session) emitLogin() {
+	s.extHost.Events.AfterPOP3Login.Emit(&event.POP3Login{
+		Mailbox:    s.user,
+		RemoteAddr: s.remoteHost,
+		Messages:   len(s.messages),
+	})
+}
+
 // Reset retain flag to true for all messages
 func (s *Session) retainAll() {
 	s.retain = make([]bool, len(s.messages))
@@ -583,6 +596,10 @@ func (s *Session) processDeletes() {
 	s.logger.Info().Msgf("Processing deletes")
 	for i, msg := range s.messages {
 		if !s.retain[i] {
+			if err := message.DeleteDenied(s.extHost, message.MakeMetadata(msg)); err != nil {
+				s.logger.Info().Str("id", msg.ID()).Err(err).Msg("Retaining message")
+				continue
+			}
 			s.logger.Debug().Str("id", msg.ID()).Msg("Deleting message")
 			if err := s.store.RemoveMessage(s.user, msg.ID()); err != nil {
 				s.logger.Warn().Str("id", msg.ID()).Err(err).Msg("Error deleting message")
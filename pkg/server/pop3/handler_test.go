@@ -19,6 +19,9 @@ import (
 	"time"
 
 	"github.com/inbucket/inbucket/v3/pkg/config"
+	"github.com/inbucket/inbucket/v3/pkg/extension"
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"github.com/inbucket/inbucket/v3/pkg/message"
 	"github.com/inbucket/inbucket/v3/pkg/storage"
 	"github.com/inbucket/inbucket/v3/pkg/test"
 )
@@ -288,6 +291,64 @@ func TestForceTLS(t *testing.T) {
 	}
 }
 
+func TestLoginEventAndDeleteDenied(t *testing.T) {
+	ds := test.NewStore()
+	keep := &message.Delivery{Meta: event.MessageMetadata{Mailbox: "u1", ID: "1", Subject: "pinned"}}
+	drop := &message.Delivery{Meta: event.MessageMetadata{Mailbox: "u1", ID: "2", Subject: "other"}}
+	for _, m := range []storage.Message{keep, drop} {
+		if _, err := ds.AddMessage(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := setupPOPServer(t, ds, false, false)
+	logins := server.extHost.Events.AfterPOP3Login.AsyncTestListener("test", 1)
+	server.extHost.Events.BeforeMessageDeleted.AddListener("test",
+		func(msg event.MessageMetadata) *event.DeleteResponse {
+			if msg.Subject == "pinned" {
+				return &event.DeleteResponse{Action: event.ActionDeny, Reason: "pinned"}
+			}
+			return nil
+		})
+	pipe := setupPOPSession(t, server)
+	c := textproto.NewConn(pipe)
+	defer func() {
+		_ = c.Close()
+		server.Drain()
+	}()
+
+	for _, cmd := range []string{"", "USER u1", "PASS x", "DELE 1", "DELE 2", "QUIT"} {
+		if cmd != "" {
+			if err := c.PrintfLine("%s", cmd); err != nil {
+				t.Fatalf("Failed to send %q; %v.", cmd, err)
+			}
+		}
+		reply, err := c.ReadLine()
+		if err != nil {
+			t.Fatalf("Reading %q reply failed %v", cmd, err)
+		}
+		if !strings.HasPrefix(reply, "+OK") {
+			t.Fatalf("%q failed: %s", cmd, reply)
+		}
+	}
+
+	got, err := logins()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Mailbox != "u1" || got.Messages != 2 {
+		t.Errorf("Got login event %+v, want mailbox u1 with 2 messages", got)
+	}
+
+	// Deletes are processed after the QUIT reply, wait for the session to end.
+	server.Drain()
+	if ds.MessageDeleted(keep) {
+		t.Error("Pinned message was deleted")
+	}
+	if !ds.MessageDeleted(drop) {
+		t.Error("Other message was not deleted")
+	}
+}
+
 // net.Pipe does not implement deadlines
 type mockConn struct {
 	net.Conn
@@ -328,7 +389,7 @@ func setupPOPServer(t *testing.T, ds storage.Store, tls bool, forceTLS bool) *Se
 		cfg.TLSPrivKey = keyPath
 	}
 
-	s, err := NewServer(cfg, ds)
+	s, err := NewServer(cfg, ds, extension.NewHost())
 	if err != nil {
 		t.Fatalf("Failed to create server: %v.", err)
 	}
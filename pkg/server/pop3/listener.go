@@ -9,6 +9,8 @@ import (
 	"time"
 
 	"github.com/inbucket/inbucket/v3/pkg/config"
+	"github.com/inbucket/inbucket/v3/pkg/extension"
+	"github.com/inbucket/inbucket/v3/pkg/server/proxyproto"
 	"github.com/inbucket/inbucket/v3/pkg/storage"
 	"github.com/rs/zerolog/log"
 )
@@ -17,6 +19,7 @@ import (
 type Server struct {
 	config    config.POP3     // POP3 configuration.
 	store     storage.Store   // Mail store.
+	extHost   *extension.Host // Extension event processor.
 	listener  net.Listener    // TCP listener.
 	wg        *sync.WaitGroup // Waitgroup tracking sessions.
 	notify    chan error      // Notify on fatal error.
@@ -25,7 +28,11 @@ type Server struct {
 }
 
 // NewServer creates a new, unstarted, POP3 server.
-func NewServer(pop3Config config.POP3, store storage.Store) (*Server, error) {
+func NewServer(
+	pop3Config config.POP3,
+	store storage.Store,
+	extHost *extension.Host,
+) (*Server, error) {
 	slog := log.With().Str("module", "pop3").Str("phase", "tls").Logger()
 	tlsConfig := &tls.Config{}
 	if pop3Config.TLSEnabled {
@@ -44,6 +51,7 @@ func NewServer(pop3Config config.POP3, store storage.Store) (*Server, error) {
 	return &Server{
 		config:    pop3Config,
 		store:     store,
+		extHost:   extHost,
 		wg:        new(sync.WaitGroup),
 		notify:    make(chan error, 1),
 		tlsConfig: tlsConfig,
@@ -60,14 +68,22 @@ func (s *Server) Start(ctx context.Context, readyFunc func()) {
 		close(s.notify)
 		return
 	}
+	trusted, err := proxyproto.ParseCIDRs(s.config.ProxyTrusted)
+	if err != nil {
+		slog.Error().Err(err).Msg("Failed to parse PROXY protocol trusted CIDRs")
+		s.notify <- err
+		close(s.notify)
+		return
+	}
 	slog.Info().Str("addr", addr.String()).Msg("POP3 listening on tcp4")
-	s.listener, err = net.ListenTCP("tcp4", addr)
+	listener, err := net.ListenTCP("tcp4", addr)
 	if err != nil {
 		slog.Error().Err(err).Msg("Failed to start tcp4 listener")
 		s.notify <- err
 		close(s.notify)
 		return
 	}
+	s.listener = proxyproto.NewListener(listener, trusted)
 
 	// Start listener go routine.
 	go s.serve(ctx)
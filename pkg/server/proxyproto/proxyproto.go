@@ -0,0 +1,267 @@
+// Package proxyproto implements the receiving side of the HAProxy PROXY protocol, versions 1 and 2,
+// allowing listeners behind a TCP load balancer to see the real client address.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// headerTimeout limits how long a trusted client may take to send the PROXY header.
+const headerTimeout = 10 * time.Second
+
+// v1MaxLen is the maximum length of a version 1 header, including CRLF.
+const v1MaxLen = 107
+
+// v1Prefix begins every version 1 header.
+var v1Prefix = []byte("PROXY")
+
+// v2Signature begins every version 2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrNoHeader is returned when a trusted client does not send a PROXY header.
+var ErrNoHeader = errors.New("PROXY protocol header missing")
+
+// ParseCIDRs parses a list of CIDR blocks, single IP addresses are also accepted.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// Listener wraps a net.Listener, reading PROXY headers from connections originating within the
+// trusted networks.  Connections from other sources are passed through unmodified.
+type Listener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+// NewListener wraps inner, trusting PROXY headers from the specified networks.  If trusted is
+// empty, inner is returned unwrapped.
+func NewListener(inner net.Listener, trusted []*net.IPNet) net.Listener {
+	if len(trusted) == 0 {
+		return inner
+	}
+	return &Listener{Listener: inner, trusted: trusted}
+}
+
+// Accept waits for and returns the next connection.  The PROXY header is read lazily, on the
+// first call to Read or RemoteAddr, so that a slow client does not block the accept loop.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &Conn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// isTrusted returns true if addr is within one of the trusted networks.
+func (l *Listener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipnet := range l.trusted {
+		if ipnet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection from a trusted source, which is expected to begin with a PROXY header.
+type Conn struct {
+	net.Conn
+	reader     *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr // Source address from the PROXY header, nil if not provided.
+	err        error    // Error reading the PROXY header.
+}
+
+// Read reads data from the connection, following the PROXY header.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY header, or the address of the proxy if the
+// header did not specify one.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader reads and parses the PROXY header, storing the result in c.
+func (c *Conn) readHeader() {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(headerTimeout)); err != nil {
+		c.err = err
+		return
+	}
+	c.remoteAddr, c.err = readHeader(c.reader)
+	if err := c.Conn.SetReadDeadline(time.Time{}); err != nil && c.err == nil {
+		c.err = err
+	}
+	if c.err != nil {
+		c.err = fmt.Errorf("proxy protocol from %v: %w", c.Conn.RemoteAddr(), c.err)
+	}
+}
+
+// readHeader reads a version 1 or 2 PROXY header from r, returning the source address it
+// describes, or nil for UNKNOWN and LOCAL connections.
+func readHeader(r *bufio.Reader) (net.Addr, error) {
+	// Peek no further than the shortest header, a client sending `PROXY UNKNOWN\r\n` may then
+	// wait for the server to speak first.
+	prefix, err := peek(r, len(v1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(prefix, v1Prefix) {
+		return readV1(r)
+	}
+	if !bytes.HasPrefix(v2Signature, prefix) {
+		return nil, ErrNoHeader
+	}
+	sig, err := peek(r, len(v2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(sig, v2Signature) {
+		return nil, ErrNoHeader
+	}
+	return readV2(r)
+}
+
+// peek returns the next n bytes from r without consuming them, or ErrNoHeader if the connection
+// was closed first.
+func peek(r *bufio.Reader, n int) ([]byte, error) {
+	b, err := r.Peek(n)
+	if err == io.EOF {
+		err = ErrNoHeader
+	}
+	return b, err
+}
+
+// readV1 parses a human readable version 1 header, ex:
+//
+//	PROXY TCP4 192.0.2.1 192.0.2.2 56324 25\r\n
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < v1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header not terminated by CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("invalid v1 source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 source port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readV2 parses a binary version 2 header.
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(v2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	verCmd, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", verCmd>>4)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch verCmd & 0x0f {
+	case 0x0:
+		// LOCAL command, ex: health checks from the proxy itself.
+		return nil, nil
+	case 0x1:
+		// PROXY command.
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", verCmd&0x0f)
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4.
+		if length < 12 {
+			return nil, errors.New("v2 IPv4 address block too short")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x21: // TCP over IPv6.
+		if length < 36 {
+			return nil, errors.New("v2 IPv6 address block too short")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	}
+
+	// Unsupported address family, use the connection address.
+	return nil, nil
+}
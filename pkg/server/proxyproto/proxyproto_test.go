@@ -0,0 +1,210 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := ParseCIDRs([]string{"10.0.0.0/8", " 192.0.2.1 ", "", "2001:db8::/32", "::1"})
+	require.NoError(t, err)
+	require.Len(t, nets, 4)
+	assert.Equal(t, "10.0.0.0/8", nets[0].String())
+	assert.Equal(t, "192.0.2.1/32", nets[1].String())
+	assert.Equal(t, "2001:db8::/32", nets[2].String())
+	assert.Equal(t, "::1/128", nets[3].String())
+
+	for _, bad := range []string{"10.0.0.0/33", "example.com", "300.1.1.1"} {
+		_, err := ParseCIDRs([]string{bad})
+		assert.Error(t, err, "input %q", bad)
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	tests := map[string]struct {
+		input string
+		want  string // Expected address, blank for nil.
+		err   bool
+	}{
+		"v1 tcp4":         {input: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 25\r\n", want: "192.0.2.1:56324"},
+		"v1 tcp6":         {input: "PROXY TCP6 2001:db8::1 2001:db8::2 4000 25\r\n", want: "[2001:db8::1]:4000"},
+		"v1 unknown":      {input: "PROXY UNKNOWN\r\n"},
+		"v1 unknown addr": {input: "PROXY UNKNOWN ::1 ::1 1 2\r\n"},
+		"v1 no crlf":      {input: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 25\n", err: true},
+		"v1 bad family":   {input: "PROXY UDP4 192.0.2.1 192.0.2.2 56324 25\r\n", err: true},
+		"v1 mismatch":     {input: "PROXY TCP4 2001:db8::1 192.0.2.2 56324 25\r\n", err: true},
+		"v1 bad port":     {input: "PROXY TCP4 192.0.2.1 192.0.2.2 99999 25\r\n", err: true},
+		"v1 too long":     {input: "PROXY " + strings.Repeat("x", 200) + "\r\n", err: true},
+		"v2 tcp4": {
+			input: v2Header(0x21, 0x11, []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0, 25}),
+			want:  "192.0.2.1:56324",
+		},
+		"v2 tcp6": {
+			input: v2Header(0x21, 0x21, append(append(
+				net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...),
+				0x0f, 0xa0, 0, 25)),
+			want: "[2001:db8::1]:4000",
+		},
+		"v2 tlvs": {
+			input: v2Header(0x21, 0x11, []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0, 25,
+				0x04, 0x00, 0x01, 0xff}),
+			want: "192.0.2.1:56324",
+		},
+		"v2 local":      {input: v2Header(0x20, 0x00, nil)},
+		"v2 unix":       {input: v2Header(0x21, 0x31, make([]byte, 216))},
+		"v2 bad ver":    {input: v2Header(0x11, 0x11, make([]byte, 12)), err: true},
+		"v2 short":      {input: v2Header(0x21, 0x11, make([]byte, 8)), err: true},
+		"v2 truncated":  {input: v2Header(0x21, 0x11, make([]byte, 12))[:20], err: true},
+		"no header":     {input: "EHLO localhost\r\n", err: true},
+		"short":         {input: "QUIT", err: true},
+		"v2 bad cmd":    {input: v2Header(0x22, 0x11, make([]byte, 12)), err: true},
+		"v1 lower case": {input: "proxy TCP4 192.0.2.1 192.0.2.2 56324 25\r\n", err: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tc.input + "DATA"))
+			addr, err := readHeader(r)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if tc.want == "" {
+				assert.Nil(t, addr)
+			} else {
+				require.NotNil(t, addr)
+				assert.Equal(t, tc.want, addr.String())
+			}
+			rest, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, "DATA", string(rest), "data following header")
+		})
+	}
+}
+
+func TestListener(t *testing.T) {
+	tests := map[string]struct {
+		trusted string
+		send    string
+		want    string // Expected remote IP, blank for the real client address.
+		data    string // Expected data read.
+	}{
+		"trusted v1": {
+			trusted: "127.0.0.0/8",
+			send:    "PROXY TCP4 192.0.2.1 127.0.0.1 56324 25\r\nHELO",
+			want:    "192.0.2.1",
+			data:    "HELO",
+		},
+		"trusted unknown": {
+			trusted: "127.0.0.1",
+			send:    "PROXY UNKNOWN\r\nHELO",
+			data:    "HELO",
+		},
+		"untrusted": {
+			trusted: "10.0.0.0/8",
+			send:    "PROXY TCP4 192.0.2.1 127.0.0.1 56324 25\r\n",
+			data:    "PROXY TCP4 192.0.2.1 127.0.0.1 56324 25\r\n",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			trusted, err := ParseCIDRs([]string{tc.trusted})
+			require.NoError(t, err)
+			inner, err := net.Listen("tcp4", "127.0.0.1:0")
+			require.NoError(t, err)
+			l := NewListener(inner, trusted)
+			defer l.Close()
+
+			client, err := net.Dial("tcp4", l.Addr().String())
+			require.NoError(t, err)
+			_, err = io.WriteString(client, tc.send)
+			require.NoError(t, err)
+			require.NoError(t, client.Close())
+
+			conn, err := l.Accept()
+			require.NoError(t, err)
+			defer conn.Close()
+			host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+			require.NoError(t, err)
+			if tc.want == "" {
+				assert.Equal(t, "127.0.0.1", host)
+			} else {
+				assert.Equal(t, tc.want, host)
+			}
+			data, err := io.ReadAll(conn)
+			require.NoError(t, err)
+			assert.Equal(t, tc.data, string(data))
+		})
+	}
+}
+
+func TestListenerShortHeaderNoDelay(t *testing.T) {
+	trusted, err := ParseCIDRs([]string{"127.0.0.1"})
+	require.NoError(t, err)
+	inner, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	l := NewListener(inner, trusted)
+	defer l.Close()
+
+	// Client sends the shortest valid header, then waits for the server to speak first.
+	client, err := net.Dial("tcp4", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = io.WriteString(client, "PROXY UNKNOWN\r\n")
+	require.NoError(t, err)
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	start := time.Now()
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", host)
+	assert.Less(t, time.Since(start), time.Second)
+	_, err = conn.Write([]byte("220 ready\r\n"))
+	assert.NoError(t, err)
+}
+
+func TestListenerMissingHeader(t *testing.T) {
+	trusted, err := ParseCIDRs([]string{"127.0.0.1"})
+	require.NoError(t, err)
+	inner, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	l := NewListener(inner, trusted)
+	defer l.Close()
+
+	client, err := net.Dial("tcp4", l.Addr().String())
+	require.NoError(t, err)
+	_, err = io.WriteString(client, "EHLO localhost\r\n")
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Read(make([]byte, 10))
+	assert.ErrorIs(t, err, ErrNoHeader)
+}
+
+func TestNewListenerUntrusted(t *testing.T) {
+	inner, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer inner.Close()
+	assert.Equal(t, inner, NewListener(inner, nil), "should not wrap without trusted networks")
+}
+
+// v2Header builds a version 2 PROXY header.
+func v2Header(verCmd, family byte, payload []byte) string {
+	b := append([]byte{}, v2Signature...)
+	b = append(b, verCmd, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	return string(append(b, payload...))
+}
@@ -0,0 +1,140 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/inbucket/inbucket/v3/pkg/config"
+)
+
+// errPlainFields is returned by decodePlain when the decoded response is not three NUL separated
+// fields.
+var errPlainFields = errors.New("expected authzid, authcid and password")
+
+// Authenticator validates the credentials presented via SMTP AUTH.
+type Authenticator interface {
+	// Authenticate returns true if the password is valid for username.
+	Authenticate(username, password string) bool
+	// Secret returns the shared secret for username, as required to verify CRAM-MD5 responses.
+	Secret(username string) (secret string, ok bool)
+}
+
+// Credentials is an Authenticator backed by a static map of usernames to passwords.
+type Credentials map[string]string
+
+var _ Authenticator = Credentials{}
+
+// Authenticate returns true if the password is valid for username.
+func (c Credentials) Authenticate(username, password string) bool {
+	want, ok := c[username]
+	return ok && hmac.Equal([]byte(want), []byte(password))
+}
+
+// Secret returns the password for username.
+func (c Credentials) Secret(username string) (string, bool) {
+	secret, ok := c[username]
+	return secret, ok
+}
+
+// Add parses a `user:password` pair into the credentials.
+func (c Credentials) Add(pair string) error {
+	user, pass, ok := strings.Cut(pair, ":")
+	if !ok || user == "" {
+		return errors.New("credentials not in user:password format")
+	}
+	c[user] = pass
+	return nil
+}
+
+// LoadCredentials reads `user:password` lines from r.  Blank lines and lines starting with `#` are
+// ignored.
+func LoadCredentials(r io.Reader) (Credentials, error) {
+	c := make(Credentials)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := c.Add(line); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+	}
+	return c, scanner.Err()
+}
+
+// newAuthenticator builds an Authenticator from the SMTP configuration, returns nil if no
+// credentials are configured, meaning any credentials will be accepted.
+func newAuthenticator(cfg config.SMTP) (Authenticator, error) {
+	if len(cfg.AuthUsers) == 0 && cfg.AuthFile == "" {
+		return nil, nil
+	}
+
+	creds := make(Credentials)
+	if cfg.AuthFile != "" {
+		f, err := os.Open(cfg.AuthFile)
+		if err != nil {
+			return creds, err
+		}
+		defer f.Close()
+		if creds, err = LoadCredentials(f); err != nil {
+			return make(Credentials), fmt.Errorf("%v: %v", cfg.AuthFile, err)
+		}
+	}
+	for _, pair := range cfg.AuthUsers {
+		if err := creds.Add(pair); err != nil {
+			return creds, err
+		}
+	}
+	return creds, nil
+}
+
+// decodePlain decodes an AUTH PLAIN response into its authentication identity and password.
+func decodePlain(response string) (username, password string, err error) {
+	b, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return "", "", err
+	}
+	fields := bytes.Split(b, []byte{0})
+	if len(fields) != 3 {
+		return "", "", errPlainFields
+	}
+	return string(fields[1]), string(fields[2]), nil
+}
+
+// decodeCRAMMD5 splits a decoded CRAM-MD5 response into the username and hex digest.
+func decodeCRAMMD5(response string) (username, digest string, err error) {
+	b, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return "", "", err
+	}
+	i := bytes.LastIndexByte(b, ' ')
+	if i < 0 {
+		return "", "", errors.New("expected username and digest")
+	}
+	return string(b[:i]), string(b[i+1:]), nil
+}
+
+// validCRAMMD5 verifies a CRAM-MD5 digest of the challenge, keyed by the users secret.
+func validCRAMMD5(auth Authenticator, username, challenge, digest string) bool {
+	secret, ok := auth.Secret(username)
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(digest)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write([]byte(challenge))
+	return hmac.Equal(got, mac.Sum(nil))
+}
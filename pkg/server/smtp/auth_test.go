@@ -0,0 +1,43 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/inbucket/inbucket/v3/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadCredentials(t *testing.T) {
+	input := `
+		# Comment line.
+		alice:secret
+		bob:pass:with:colons
+
+	`
+	creds, err := LoadCredentials(strings.NewReader(input))
+	require.NoError(t, err)
+	assert.Equal(t, Credentials{"alice": "secret", "bob": "pass:with:colons"}, creds)
+
+	assert.True(t, creds.Authenticate("alice", "secret"))
+	assert.False(t, creds.Authenticate("alice", "wrong"))
+	assert.False(t, creds.Authenticate("carol", ""))
+
+	_, err = LoadCredentials(strings.NewReader("alice:secret\nbroken\n"))
+	assert.ErrorContains(t, err, "line 2")
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	auth, err := newAuthenticator(config.SMTP{})
+	require.NoError(t, err)
+	assert.Nil(t, auth, "no credentials configured should accept any")
+
+	auth, err = newAuthenticator(config.SMTP{AuthUsers: []string{"alice:secret"}})
+	require.NoError(t, err)
+	assert.True(t, auth.Authenticate("alice", "secret"))
+
+	auth, err = newAuthenticator(config.SMTP{AuthFile: "/does/not/exist"})
+	assert.Error(t, err)
+	assert.False(t, auth.Authenticate("alice", "secret"), "failed load should reject all")
+}
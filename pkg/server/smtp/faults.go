@@ -0,0 +1,220 @@
+package smtp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stages of an SMTP transaction where faults may be injected.
+const (
+	FaultStageMail = "mail" // In response to MAIL FROM, pattern matches the sender.
+	FaultStageRcpt = "rcpt" // In response to RCPT TO, pattern matches the recipient.
+	FaultStageData = "data" // At the end of DATA, pattern matches any recipient.
+)
+
+// Fault actions.
+const (
+	FaultDelay    = "delay"    // Delay the normal response (tarpit).
+	FaultTempFail = "tempfail" // Respond with a 4xx temporary error.
+	FaultPermFail = "permfail" // Respond with a 5xx permanent error.
+	FaultDrop     = "drop"     // Drop the connection, mid-DATA for the data stage.
+)
+
+// FaultRule describes a fault to be injected into matching SMTP transactions.
+type FaultRule struct {
+	ID          string  `json:"id"`                    // Assigned when the rule is added.
+	Stage       string  `json:"stage"`                 // FaultStageMail, FaultStageRcpt, etc.
+	Action      string  `json:"action"`                // FaultDelay, FaultTempFail, etc.
+	Pattern     string  `json:"pattern,omitempty"`     // Address glob, empty matches all.
+	Probability float64 `json:"probability,omitempty"` // Chance of firing, 0 is always.
+	Code        int     `json:"code,omitempty"`        // SMTP response code for failures.
+	Message     string  `json:"message,omitempty"`     // SMTP response message for failures.
+	Delay       string  `json:"delay,omitempty"`       // Delay before responding, ex: 10s.
+	Count       int     `json:"count,omitempty"`       // Remaining times to fire, 0 is unlimited.
+
+	delay time.Duration
+}
+
+// Faults holds the fault injection rules for an SMTP server, it is safe for concurrent use.
+type Faults struct {
+	mu     sync.Mutex
+	rules  []*FaultRule
+	lastID int
+	random func() float64
+}
+
+// NewFaults creates an empty set of fault injection rules.
+func NewFaults() *Faults {
+	return &Faults{random: rand.Float64}
+}
+
+// LoadFaultRules reads a JSON array of rules from r.
+func LoadFaultRules(r io.Reader) ([]FaultRule, error) {
+	var rules []FaultRule
+	if err := json.NewDecoder(r).Decode(&rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// loadFaults builds Faults from the rules file named in the SMTP configuration.
+func loadFaults(filename string) (*Faults, error) {
+	faults := NewFaults()
+	if filename == "" {
+		return faults, nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return faults, err
+	}
+	defer f.Close()
+	rules, err := LoadFaultRules(f)
+	if err != nil {
+		return faults, fmt.Errorf("%v: %v", filename, err)
+	}
+	for i, rule := range rules {
+		if _, err := faults.Add(rule); err != nil {
+			return faults, fmt.Errorf("%v: rule %d: %v", filename, i+1, err)
+		}
+	}
+	return faults, nil
+}
+
+// Add validates and adds a rule, returning it with its assigned ID.
+func (f *Faults) Add(rule FaultRule) (FaultRule, error) {
+	switch rule.Stage {
+	case FaultStageMail, FaultStageRcpt, FaultStageData:
+	default:
+		return rule, fmt.Errorf("unknown stage %q", rule.Stage)
+	}
+	switch rule.Action {
+	case FaultTempFail:
+		if rule.Code == 0 {
+			rule.Code = 451
+		}
+		if rule.Code < 400 || rule.Code > 499 {
+			return rule, errors.New("tempfail code must be 4xx")
+		}
+	case FaultPermFail:
+		if rule.Code == 0 {
+			rule.Code = 554
+		}
+		if rule.Code < 500 || rule.Code > 599 {
+			return rule, errors.New("permfail code must be 5xx")
+		}
+	case FaultDelay, FaultDrop:
+	default:
+		return rule, fmt.Errorf("unknown action %q", rule.Action)
+	}
+	if rule.Message == "" && rule.Code != 0 {
+		rule.Message = "Fault injected by Inbucket"
+	}
+	if strings.ContainsAny(rule.Message, "\r\n") {
+		return rule, errors.New("message must be a single line")
+	}
+	if _, err := path.Match(rule.Pattern, ""); err != nil {
+		return rule, fmt.Errorf("pattern %q: %v", rule.Pattern, err)
+	}
+	if rule.Probability < 0 || rule.Probability > 1 {
+		return rule, errors.New("probability must be between 0 and 1")
+	}
+	if rule.Count < 0 {
+		return rule, errors.New("count must not be negative")
+	}
+	if rule.Delay != "" {
+		d, err := time.ParseDuration(rule.Delay)
+		if err != nil {
+			return rule, err
+		}
+		rule.delay = d
+	}
+	if rule.Action == FaultDelay && rule.delay <= 0 {
+		return rule, errors.New("delay action requires a delay")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastID++
+	rule.ID = strconv.Itoa(f.lastID)
+	stored := rule
+	f.rules = append(f.rules, &stored)
+	return rule, nil
+}
+
+// Rules returns a copy of the current rules.
+func (f *Faults) Rules() []FaultRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rules := make([]FaultRule, len(f.rules))
+	for i, rule := range f.rules {
+		rules[i] = *rule
+	}
+	return rules
+}
+
+// Remove deletes the rule with the specified ID, returns false if it did not exist.
+func (f *Faults) Remove(id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, rule := range f.rules {
+		if rule.ID == id {
+			f.rules = append(f.rules[:i], f.rules[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Clear deletes all rules.
+func (f *Faults) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = nil
+}
+
+// match returns the first rule for stage matching any of the addresses, and which passes its
+// probability check.  Returns nil if no fault should be injected.
+func (f *Faults) match(stage string, addrs ...string) *FaultRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, rule := range f.rules {
+		if rule.Stage != stage || !rule.matches(addrs) {
+			continue
+		}
+		if rule.Probability > 0 && f.random() >= rule.Probability {
+			continue
+		}
+		fired := *rule
+		if rule.Count > 0 {
+			rule.Count--
+			if rule.Count == 0 {
+				f.rules = append(f.rules[:i], f.rules[i+1:]...)
+			}
+		}
+		return &fired
+	}
+	return nil
+}
+
+// matches returns true if the rule pattern matches any of the addresses.
+func (r *FaultRule) matches(addrs []string) bool {
+	if r.Pattern == "" {
+		return true
+	}
+	pattern := strings.ToLower(r.Pattern)
+	for _, addr := range addrs {
+		if ok, _ := path.Match(pattern, strings.ToLower(addr)); ok {
+			return true
+		}
+	}
+	return false
+}
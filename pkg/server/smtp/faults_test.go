@@ -0,0 +1,102 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultsAdd(t *testing.T) {
+	f := NewFaults()
+
+	rule, err := f.Add(FaultRule{Stage: FaultStageRcpt, Action: FaultTempFail})
+	require.NoError(t, err)
+	assert.Equal(t, "1", rule.ID)
+	assert.Equal(t, 451, rule.Code)
+	assert.NotEmpty(t, rule.Message)
+
+	rule, err = f.Add(FaultRule{Stage: FaultStageData, Action: FaultDelay, Delay: "2s"})
+	require.NoError(t, err)
+	assert.Equal(t, "2", rule.ID)
+	assert.Equal(t, 2*time.Second, rule.delay)
+	assert.Zero(t, rule.Code)
+
+	invalid := map[string]FaultRule{
+		"stage":       {Stage: "helo", Action: FaultDrop},
+		"action":      {Stage: FaultStageMail, Action: "explode"},
+		"tempfail":    {Stage: FaultStageMail, Action: FaultTempFail, Code: 550},
+		"permfail":    {Stage: FaultStageMail, Action: FaultPermFail, Code: 421},
+		"pattern":     {Stage: FaultStageMail, Action: FaultDrop, Pattern: "[a"},
+		"probability": {Stage: FaultStageMail, Action: FaultDrop, Probability: 1.5},
+		"delay":       {Stage: FaultStageMail, Action: FaultDelay},
+		"duration":    {Stage: FaultStageMail, Action: FaultDrop, Delay: "soon"},
+		"message":     {Stage: FaultStageMail, Action: FaultPermFail, Message: "a\r\n250 ok"},
+	}
+	for name, rule := range invalid {
+		_, err := f.Add(rule)
+		assert.Error(t, err, name)
+	}
+	assert.Len(t, f.Rules(), 2)
+}
+
+func TestFaultsMatch(t *testing.T) {
+	f := NewFaults()
+	_, err := f.Add(FaultRule{
+		Stage: FaultStageRcpt, Action: FaultPermFail, Pattern: "*@Example.com", Count: 2})
+	require.NoError(t, err)
+	_, err = f.Add(FaultRule{Stage: FaultStageRcpt, Action: FaultTempFail, Probability: 0.5})
+	require.NoError(t, err)
+
+	// Pattern match is case insensitive, and rule removed after count.
+	for range 2 {
+		rule := f.match(FaultStageRcpt, "user@example.COM")
+		require.NotNil(t, rule)
+		assert.Equal(t, FaultPermFail, rule.Action)
+	}
+	assert.Len(t, f.Rules(), 1)
+	assert.Nil(t, f.match(FaultStageMail, "user@example.com"), "stage should not match")
+
+	// Probability.
+	f.random = func() float64 { return 0.7 }
+	assert.Nil(t, f.match(FaultStageRcpt, "user@example.com"))
+	f.random = func() float64 { return 0.2 }
+	rule := f.match(FaultStageRcpt, "user@example.com")
+	require.NotNil(t, rule)
+	assert.Equal(t, FaultTempFail, rule.Action)
+}
+
+func TestFaultsRemove(t *testing.T) {
+	f := NewFaults()
+	for range 3 {
+		_, err := f.Add(FaultRule{Stage: FaultStageMail, Action: FaultDrop})
+		require.NoError(t, err)
+	}
+
+	assert.True(t, f.Remove("2"))
+	assert.False(t, f.Remove("2"))
+	rules := f.Rules()
+	require.Len(t, rules, 2)
+	assert.Equal(t, "1", rules[0].ID)
+	assert.Equal(t, "3", rules[1].ID)
+
+	f.Clear()
+	assert.Empty(t, f.Rules())
+}
+
+func TestLoadFaultRules(t *testing.T) {
+	rules, err := LoadFaultRules(strings.NewReader(`[
+		{"stage": "rcpt", "action": "tempfail", "pattern": "retry-*@example.com"},
+		{"stage": "data", "action": "drop", "probability": 0.1}
+	]`))
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	assert.Equal(t, "retry-*@example.com", rules[0].Pattern)
+	assert.Equal(t, FaultDrop, rules[1].Action)
+	assert.Equal(t, 0.1, rules[1].Probability)
+
+	_, err = LoadFaultRules(strings.NewReader(`{"stage": "rcpt"}`))
+	assert.Error(t, err)
+}
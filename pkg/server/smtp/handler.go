@@ -3,7 +3,9 @@ package smtp
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -17,6 +19,7 @@ import (
 
 	"github.com/inbucket/inbucket/v3/pkg/extension/event"
 	"github.com/inbucket/inbucket/v3/pkg/policy"
+	"github.com/jhillyerd/enmime/v2"
 	"github.com/rs/zerolog"
 )
 
@@ -36,6 +39,14 @@ const (
 	passwordChallenge = "UGFzc3dvcmQA"
 )
 
+const (
+	// maxTranscriptBytes limits the size of a session transcript.
+	maxTranscriptBytes = 64 * 1024
+
+	// redacted replaces AUTH credentials in the session transcript.
+	redacted = "<redacted>"
+)
+
 const (
 	// GREET State: Waiting for HELO
 	GREET State = iota
@@ -45,6 +56,8 @@ const (
 	LOGIN
 	// PASSWORD State: Got Username, expecting password
 	PASSWORD
+	// CRAMMD5 State: Sent CRAM-MD5 challenge, expecting response
+	CRAMMD5
 	// MAIL State: Got MAIL, accepting RCPTs
 	MAIL
 	// DATA State: Got DATA, waiting for "."
@@ -59,6 +72,17 @@ const (
 var fromRegex = regexp.MustCompile(
 	`(?i)^FROM:\s*<((?:(?:\\>|[^>])+|"[^"]+"@[^>])+)?>( ([\w= ]|=<>)+)?$`)
 
+// enhancedCodeRegex matches an RFC 3463 enhanced status code at the start of a reply.
+var enhancedCodeRegex = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}( |$)`)
+
+// valuelessParams are the ESMTP parameters which may be specified without a value.
+var valuelessParams = map[string]bool{
+	"SMTPUTF8": true,
+}
+
+// errMessageTooLarge is returned by readDataBlock when the message exceeds MaxMessageBytes.
+var errMessageTooLarge = errors.New("message exceeds maximum size")
+
 func (s State) String() string {
 	switch s {
 	case GREET:
@@ -93,6 +117,7 @@ var commands = map[string]bool{
 	"TURN":     true,
 	"STARTTLS": true,
 	"AUTH":     true,
+	"BDAT":     true,
 }
 
 // Session holds the state of an SMTP session
@@ -107,10 +132,23 @@ type Session struct {
 	reader       *bufio.Reader       // Buffered reading for TCP conn.
 	from         *policy.Origin      // Sender from MAIL command.
 	recipients   []*policy.Recipient // Recipients from RCPT commands.
+	authUser     string              // Username from successful AUTH.
+	authLogin    string              // Username from AUTH LOGIN, awaiting password.
+	challenge    string              // Outstanding CRAM-MD5 challenge.
+	smtpUTF8     bool                // SMTPUTF8 requested by MAIL command.
+	bodyType     string              // BODY parameter from MAIL command.
+	chunks       *bytes.Buffer       // Message data received via BDAT, nil before first chunk.
+	chunkFault   *FaultRule          // Data stage fault matched on the first BDAT chunk.
+	rateSlot     *msgSlot            // Message rate reservation, released unless delivered.
+	transcript   *strings.Builder    // Session transcript, nil if disabled.
 	logger       zerolog.Logger      // Session specific logger.
 	debug        bool                // Print network traffic to stdout.
 	tlsState     *tls.ConnectionState
 	text         *textproto.Conn
+	started      time.Time // Time the session was started.
+	accepted     int       // Messages accepted for delivery.
+	acceptedRcpt int       // Recipients messages were accepted for.
+	acceptedSize int64     // Total size of accepted messages.
 }
 
 // NewSession creates a new Session for the given connection
@@ -133,6 +171,10 @@ func NewSession(server *Server, id int, conn net.Conn, logger zerolog.Logger) *S
 		logger:     logger,
 		debug:      server.config.Debug,
 		text:       textproto.NewConn(conn),
+		started:    time.Now(),
+	}
+	if server.config.Transcript {
+		session.transcript = new(strings.Builder)
 	}
 	if server.config.ForceTLS {
 		session.tlsState = new(tls.ConnectionState)
@@ -170,7 +212,26 @@ func (s *Server) startSession(id int, conn net.Conn, logger zerolog.Logger) {
 		expConnectsCurrent.Add(-1)
 	}()
 
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// Complete the ForceTLS handshake before the session captures the negotiated TLS state.
+		ctx, cancel := context.WithTimeout(context.Background(), s.config.Timeout)
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			logger.Warn().Err(err).Msg("TLS handshake failed")
+			return
+		}
+	}
+
 	ssn := NewSession(s, id, conn, logger)
+	if !s.limits.openConn(ssn.remoteHost) {
+		expConnectsLimited.Add(1)
+		logger.Warn().Msg("Connection limit exceeded")
+		ssn.send("421 4.7.0 Too many connections from your address, try again later")
+		return
+	}
+	defer s.limits.closeConn(ssn.remoteHost)
+	defer func() { s.limits.releaseMessage(ssn.rateSlot) }()
 	ssn.greet()
 
 	// This is our command reading loop
@@ -182,24 +243,28 @@ func (s *Server) startSession(id int, conn net.Conn, logger zerolog.Logger) {
 		}
 		line, err := ssn.readLine()
 		if err == nil {
-			// Handle LOGIN/PASSWORD states here, because they don't expect a command.
+			// Handle AUTH exchange states here, because they don't expect a command.
 			switch ssn.state {
 			case LOGIN:
-				ssn.loginHandler()
+				ssn.loginHandler(line)
 				continue
 			case PASSWORD:
-				ssn.passwordHandler()
+				ssn.passwordHandler(line)
+				continue
+			case CRAMMD5:
+				ssn.cramMD5Handler(line)
 				continue
 			}
 
 			if cmd, arg, ok := ssn.parseCmd(line); ok {
 				// Check against valid SMTP commands
 				if cmd == "" {
-					ssn.send("500 Speak up")
+					ssn.send("500 5.5.2 Speak up")
 					continue
 				}
-				if !commands[cmd] {
-					ssn.send(fmt.Sprintf("500 Syntax error, %v command unrecognized", cmd))
+				cmd, ok = ssn.protocolCommand(cmd)
+				if !ok {
+					ssn.send(fmt.Sprintf("500 5.5.1 Syntax error, %v command unrecognized", cmd))
 					ssn.logger.Warn().Msgf("Unrecognized command: %v", cmd)
 					continue
 				}
@@ -208,25 +273,29 @@ func (s *Server) startSession(id int, conn net.Conn, logger zerolog.Logger) {
 				switch cmd {
 				case "SEND", "SOML", "SAML", "EXPN", "HELP", "TURN":
 					// These commands are not implemented in any state
-					ssn.send(fmt.Sprintf("502 %v command not implemented", cmd))
+					ssn.send(fmt.Sprintf("502 5.5.1 %v command not implemented", cmd))
 					ssn.logger.Warn().Msgf("Command %v not implemented by Inbucket", cmd)
 					continue
 				case "VRFY":
-					ssn.send("252 Cannot VRFY user, but will accept message")
+					ssn.send("252 2.5.0 Cannot VRFY user, but will accept message")
 					continue
 				case "NOOP":
-					ssn.send("250 I have successfully done nothing")
+					ssn.send("250 2.0.0 I have successfully done nothing")
 					continue
 				case "RSET":
 					// Reset session
 					ssn.logger.Debug().Msgf("Resetting session state on RSET request")
 					ssn.reset()
-					ssn.send("250 Session reset")
+					ssn.send("250 2.0.0 Session reset")
 					continue
 				case "QUIT":
-					ssn.send("221 Goodnight and good luck")
+					ssn.send("221 2.0.0 Goodnight and good luck")
 					ssn.enterState(QUIT)
 					continue
+				case "BDAT":
+					// Chunk data must be consumed regardless of state.
+					ssn.bdatHandler(arg)
+					continue
 				}
 
 				// Send command to handler for current state
@@ -244,7 +313,7 @@ func (s *Server) startSession(id int, conn net.Conn, logger zerolog.Logger) {
 				ssn.logger.Error().Msgf("Session entered unexpected state %v", ssn.state)
 				break
 			} else {
-				ssn.send("500 Syntax error, command garbled")
+				ssn.send("500 5.5.2 Syntax error, command garbled")
 			}
 		} else {
 			// readLine() returned an error
@@ -262,18 +331,20 @@ func (s *Server) startSession(id int, conn net.Conn, logger zerolog.Logger) {
 			ssn.logger.Warn().Msgf("Connection error: %v", err)
 			if netErr, ok := err.(net.Error); ok {
 				if netErr.Timeout() {
-					ssn.send("221 Idle timeout, bye bye")
+					ssn.send("221 2.0.0 Idle timeout, bye bye")
 					break
 				}
 			}
-			ssn.send("221 Connection error, sorry")
+			ssn.send("221 2.0.0 Connection error, sorry")
 			break
 		}
 	}
+	ssn.flush()
 	if ssn.sendError != nil {
 		ssn.logger.Warn().Msgf("Network send error: %v", ssn.sendError)
 	}
 	ssn.logger.Info().Msgf("Closing connection")
+	s.extHost.Events.AfterSMTPSessionClosed.Emit(ssn.summary())
 }
 
 // GREET state -> waiting for HELO
@@ -283,7 +354,7 @@ func (s *Session) greetHandler(cmd string, arg string) {
 	case "HELO":
 		domain, err := parseHelloArgument(arg)
 		if err != nil {
-			s.send("501 Domain/address argument required for HELO")
+			s.send("501 5.5.4 Domain/address argument required for HELO")
 			return
 		}
 		s.remoteDomain = domain
@@ -292,14 +363,19 @@ func (s *Session) greetHandler(cmd string, arg string) {
 	case "EHLO":
 		domain, err := parseHelloArgument(arg)
 		if err != nil {
-			s.send("501 Domain/address argument required for EHLO")
+			s.send("501 5.5.4 Domain/address argument required for EHLO")
 			return
 		}
 		s.remoteDomain = domain
 		// Features before SIZE per RFC
 		s.send("250-" + readyBanner)
 		s.send("250-8BITMIME")
-		s.send("250-AUTH PLAIN LOGIN")
+		s.send("250-BINARYMIME")
+		s.send("250-CHUNKING")
+		s.send("250-PIPELINING")
+		s.send("250-ENHANCEDSTATUSCODES")
+		s.send("250-SMTPUTF8")
+		s.send("250-AUTH PLAIN LOGIN CRAM-MD5")
 		if s.config.TLSEnabled && !s.config.ForceTLS && s.tlsConfig != nil && s.tlsState == nil {
 			s.send("250-STARTTLS")
 		}
@@ -321,16 +397,107 @@ func parseHelloArgument(arg string) (string, error) {
 	return domain, nil
 }
 
-func (s *Session) loginHandler() {
-	// Content and length of username is ignored.
+// loginHandler receives the username for AUTH LOGIN.
+func (s *Session) loginHandler(line string) {
+	if s.authCancelled(line) {
+		return
+	}
+	username, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		s.send("501 5.5.2 Cannot decode username")
+		s.logger.Warn().Msgf("Bad AUTH LOGIN username: %q", line)
+		s.enterState(READY)
+		return
+	}
+	s.authLogin = string(username)
 	s.send(fmt.Sprintf("334 %v", passwordChallenge))
 	s.enterState(PASSWORD)
 }
 
-func (s *Session) passwordHandler() {
-	// Content and length of password is ignored.
-	s.send("235 Authentication successful")
+// passwordHandler receives the password for AUTH LOGIN.
+func (s *Session) passwordHandler(line string) {
+	if s.authCancelled(line) {
+		return
+	}
+	password, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		s.send("501 5.5.2 Cannot decode password")
+		s.logger.Warn().Msg("Bad AUTH LOGIN password")
+		s.enterState(READY)
+		return
+	}
+	username := s.authLogin
+	s.authLogin = ""
+	s.authenticate("LOGIN", username, string(password), func(auth Authenticator) bool {
+		return auth.Authenticate(username, string(password))
+	})
+}
+
+// cramMD5Handler receives the response to a CRAM-MD5 challenge.
+func (s *Session) cramMD5Handler(line string) {
+	if s.authCancelled(line) {
+		return
+	}
+	challenge := s.challenge
+	s.challenge = ""
+	username, digest, err := decodeCRAMMD5(line)
+	if err != nil {
+		s.send("501 5.5.2 Cannot decode CRAM-MD5 response")
+		s.logger.Warn().Msgf("Bad CRAM-MD5 response: %q", line)
+		s.enterState(READY)
+		return
+	}
+	s.authenticate("CRAM-MD5", username, "", func(auth Authenticator) bool {
+		return validCRAMMD5(auth, username, challenge, digest)
+	})
+}
+
+// authCancelled handles a client cancelling an AUTH exchange with `*`.
+func (s *Session) authCancelled(line string) bool {
+	if line != "*" {
+		return false
+	}
+	s.send("501 5.7.0 Authentication cancelled")
 	s.enterState(READY)
+	return true
+}
+
+// authenticate decides whether to accept the presented credentials.  Extensions are consulted
+// first, then the configured Authenticator, valid is used to check the credentials against it.
+func (s *Session) authenticate(
+	mechanism, username, password string,
+	valid func(Authenticator) bool,
+) {
+	s.enterState(READY)
+	logger := s.logger.With().Str("mechanism", mechanism).Str("user", username).Logger()
+
+	// Process through extensions.
+	extAction := event.ActionDefer
+	extResult := s.extHost.Events.BeforeAuthAccepted.Emit(&event.SMTPAuth{
+		Mechanism:  mechanism,
+		Username:   username,
+		Password:   password,
+		RemoteAddr: s.remoteHost,
+	})
+	if extResult != nil {
+		extAction = extResult.Action
+	}
+	if extAction == event.ActionDeny {
+		s.send(statusReply(extResult.ErrorCode, extResult.ErrorMsg))
+		logger.Warn().Msg("Extension denied authentication")
+		return
+	}
+
+	// Ignore configured credentials if extensions explicitly allowed this user.
+	if extAction == event.ActionDefer && s.auth != nil && !valid(s.auth) {
+		s.send("535 5.7.8 Authentication credentials invalid")
+		logger.Warn().Msg("Rejecting invalid credentials")
+		return
+	}
+
+	s.authUser = username
+	logger.Info().Msg("Accepting credentials")
+	s.send("235 2.7.0 Authentication successful")
 }
 
 // READY state -> waiting for MAIL
@@ -341,20 +508,30 @@ func (s *Session) readyHandler(cmd string, arg string) {
 		if !s.config.TLSEnabled {
 			// Invalid command since TLS unconfigured.
 			s.logger.Debug().Msgf("454 TLS unavailable on the server")
-			s.send("454 TLS unavailable on the server")
+			s.send("454 4.7.0 TLS unavailable on the server")
 			return
 		}
 		if s.tlsState != nil {
 			// TLS state previously valid.
 			s.logger.Debug().Msg("454 A TLS session already agreed upon.")
-			s.send("454 A TLS session already agreed upon.")
+			s.send("454 4.7.0 A TLS session already agreed upon.")
 			return
 		}
 		s.logger.Debug().Msg("Initiating TLS context.")
 
 		// Start TLS connection handshake.
-		s.send("220 STARTTLS")
+		s.send("220 2.0.0 Ready to start TLS")
+		s.flush()
 		tlsConn := tls.Server(s.conn, s.tlsConfig)
+		if err := tlsConn.SetDeadline(s.nextDeadline()); err != nil {
+			s.sendError = err
+			return
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			s.logger.Warn().Err(err).Msg("TLS handshake failed")
+			s.enterState(QUIT)
+			return
+		}
 		s.conn = tlsConn
 		s.text = textproto.NewConn(s.conn)
 		s.tlsState = new(tls.ConnectionState)
@@ -367,12 +544,20 @@ func (s *Session) readyHandler(cmd string, arg string) {
 		switch authMethod {
 		case "PLAIN":
 			if len(args) != 2 {
-				s.send("500 Bad auth arguments")
+				s.send("500 5.5.4 Bad auth arguments")
 				s.logger.Warn().Msgf("Bad auth attempt: %q", arg)
 				return
 			}
-			s.logger.Info().Msgf("Accepting credentials: %q", args[1])
-			s.send("235 2.7.0 Authentication successful")
+			// Without an authenticator any credentials are accepted, but they must be valid base64.
+			username, password, err := decodePlain(args[1])
+			if err != nil && (s.auth != nil || !errors.Is(err, errPlainFields)) {
+				s.send("501 5.5.2 Cannot decode PLAIN credentials")
+				s.logger.Warn().Err(err).Msg("Bad AUTH PLAIN credentials")
+				return
+			}
+			s.authenticate("PLAIN", username, password, func(auth Authenticator) bool {
+				return auth.Authenticate(username, password)
+			})
 			return
 
 		case "LOGIN":
@@ -380,8 +565,14 @@ func (s *Session) readyHandler(cmd string, arg string) {
 			s.enterState(LOGIN)
 			return
 
+		case "CRAM-MD5":
+			s.challenge = fmt.Sprintf("<%d.%d@%s>", s.id, time.Now().UnixNano(), s.config.Domain)
+			s.send("334 " + base64.StdEncoding.EncodeToString([]byte(s.challenge)))
+			s.enterState(CRAMMD5)
+			return
+
 		default:
-			s.send(fmt.Sprintf("500 Unsupported AUTH method: %v", authMethod))
+			s.send(fmt.Sprintf("500 5.5.4 Unsupported AUTH method: %v", authMethod))
 			return
 		}
 
@@ -392,7 +583,7 @@ func (s *Session) readyHandler(cmd string, arg string) {
 		// Reset session
 		s.logger.Debug().Msgf("Resetting session state on EHLO request")
 		s.reset()
-		s.send("250 Session reset")
+		s.send("250 2.0.0 Session reset")
 
 	default:
 		s.ooSeq(cmd)
@@ -404,7 +595,7 @@ func (s *Session) parseMailFromCmd(arg string) {
 	// Capture group 1: from address. 2: optional params.
 	m := fromRegex.FindStringSubmatch(arg)
 	if m == nil {
-		s.send("501 Was expecting MAIL arg syntax of FROM:<address>")
+		s.send("501 5.5.4 Was expecting MAIL arg syntax of FROM:<address>")
 		s.logger.Warn().Msgf("Bad MAIL argument: %q", arg)
 		return
 	}
@@ -417,31 +608,59 @@ func (s *Session) parseMailFromCmd(arg string) {
 		// reads the DATA as bytes, so it does not effect mail processing.
 		args, ok := s.parseArgs(m[2])
 		if !ok {
-			s.send("501 Unable to parse MAIL ESMTP parameters")
+			s.send("501 5.5.4 Unable to parse MAIL ESMTP parameters")
 			s.logger.Warn().Msgf("Bad MAIL argument: %q", arg)
 			return
 		}
 
+		// BINARYMIME content may only be transferred with BDAT, RFC 3030.
+		if body, ok := args["BODY"]; ok {
+			body = strings.ToUpper(body)
+			switch body {
+			case "7BIT", "8BITMIME", "BINARYMIME":
+				s.bodyType = body
+			default:
+				s.send("501 5.5.4 Unrecognized BODY type")
+				s.logger.Warn().Msgf("Unrecognized BODY type: %q", body)
+				return
+			}
+		}
+
 		// Reject oversized messages.
 		if args["SIZE"] != "" {
 			size, err := strconv.ParseInt(args["SIZE"], 10, 32)
 			if err != nil {
-				s.send("501 Unable to parse SIZE as an integer")
+				s.send("501 5.5.4 Unable to parse SIZE as an integer")
 				s.logger.Warn().Msgf("Unable to parse SIZE %q as an integer", args["SIZE"])
 				return
 			}
 			if int(size) > s.config.MaxMessageBytes {
-				s.send("552 Max message size exceeded")
+				s.send("552 5.3.4 Max message size exceeded")
 				s.logger.Warn().Msgf("Client wanted to send oversized message: %v", args["SIZE"])
 				return
 			}
 		}
+
+		// Internationalized addresses permitted for this transaction, RFC 6531.
+		var utf8Value string
+		utf8Value, s.smtpUTF8 = args["SMTPUTF8"]
+		if utf8Value != "" {
+			s.smtpUTF8 = false
+			s.send("501 5.5.4 SMTPUTF8 does not accept a value")
+			s.logger.Warn().Msgf("Bad SMTPUTF8 value: %q", utf8Value)
+			return
+		}
+	}
+	if !s.smtpUTF8 && !isASCII(from) {
+		s.send("553 5.6.7 SMTPUTF8 required for internationalized address")
+		s.logger.Warn().Msgf("Internationalized sender without SMTPUTF8: %q", from)
+		return
 	}
 
 	// Parse origin (from) address.
 	origin, err := s.addrPolicy.ParseOrigin(from)
 	if err != nil {
-		s.send("501 Bad origin address syntax")
+		s.send("501 5.1.7 Bad origin address syntax")
 		s.logger.Warn().Str("from", from).Err(err).Msg("Bad address as MAIL arg")
 		return
 	}
@@ -458,23 +677,36 @@ func (s *Session) parseMailFromCmd(arg string) {
 		extAction = extResult.Action
 	}
 	if extAction == event.ActionDeny {
-		s.send(fmt.Sprintf("%03d %s", extResult.ErrorCode, extResult.ErrorMsg))
+		s.send(statusReply(extResult.ErrorCode, extResult.ErrorMsg))
 		s.logger.Warn().Msgf("Extension denied mail from <%v>", from)
 		return
 	}
 
+	if s.injectFault(s.faults.match(FaultStageMail, origin.Address.Address)) {
+		return
+	}
+	slot := s.limits.allowMessage(s.remoteHost, origin.Address.Address)
+	if slot == nil {
+		expMessagesLimited.Add(1)
+		s.send("451 4.7.1 Message rate limit exceeded, try again later")
+		s.logger.Warn().Msgf("Message rate limit exceeded for <%v>", from)
+		return
+	}
+
 	// Sender was permitted by an extension, or no extension rejected it.
 	s.from = origin
 	// Ignore ShouldAccept if extensions explicitly allowed this From.
 	if extAction == event.ActionDefer && !s.from.ShouldAccept() {
-		s.send("501 Unauthorized domain")
+		s.limits.releaseMessage(slot)
+		s.send("501 5.1.8 Unauthorized domain")
 		s.logger.Warn().Msgf("Bad domain sender %s", origin.Domain)
 		return
 	}
+	s.rateSlot = slot
 
 	// Ok to transition to MAIL state.
 	s.logger.Info().Msgf("Mail from: %v", from)
-	s.send(fmt.Sprintf("250 Roger, accepting mail from <%v>", from))
+	s.send(fmt.Sprintf("250 2.1.0 Roger, accepting mail from <%v>", from))
 	s.enterState(MAIL)
 }
 
@@ -483,14 +715,19 @@ func (s *Session) mailHandler(cmd string, arg string) {
 	switch cmd {
 	case "RCPT":
 		if (len(arg) < 4) || (strings.ToUpper(arg[0:3]) != "TO:") {
-			s.send("501 Was expecting RCPT arg syntax of TO:<address>")
+			s.send("501 5.5.4 Was expecting RCPT arg syntax of TO:<address>")
 			s.logger.Warn().Msgf("Bad RCPT argument: %q", arg)
 			return
 		}
 		addr := strings.Trim(arg[3:], "<> ")
+		if !s.smtpUTF8 && !isASCII(addr) {
+			s.send("553 5.6.7 SMTPUTF8 required for internationalized address")
+			s.logger.Warn().Msgf("Internationalized recipient without SMTPUTF8: %q", addr)
+			return
+		}
 		recip, err := s.addrPolicy.NewRecipient(addr)
 		if err != nil {
-			s.send("501 Bad recipient address syntax")
+			s.send("501 5.1.3 Bad recipient address syntax")
 			s.logger.Warn().Str("to", addr).Err(err).Msg("Bad address as RCPT arg")
 			return
 		}
@@ -507,7 +744,7 @@ func (s *Session) mailHandler(cmd string, arg string) {
 			extAction = extResult.Action
 		}
 		if extAction == event.ActionDeny {
-			s.send(fmt.Sprintf("%03d %s", extResult.ErrorCode, extResult.ErrorMsg))
+			s.send(statusReply(extResult.ErrorCode, extResult.ErrorMsg))
 			s.logger.Warn().Msgf("Extension denied mail to <%v>", recip.Address)
 			return
 		}
@@ -515,36 +752,50 @@ func (s *Session) mailHandler(cmd string, arg string) {
 		// Ignore ShouldAccept if extensions explicitly allowed this Recipient.
 		if extAction == event.ActionDefer && !recip.ShouldAccept() {
 			s.logger.Warn().Str("to", addr).Msg("Rejecting recipient domain")
-			s.send("550 Relay not permitted")
+			s.send("550 5.7.1 Relay not permitted")
+			return
+		}
+		if s.injectFault(s.faults.match(FaultStageRcpt, recip.Address.Address)) {
 			return
 		}
 		if len(s.recipients) >= s.config.MaxRecipients {
 			s.logger.Warn().Msgf("Limit of %v recipients exceeded", s.config.MaxRecipients)
-			s.send(fmt.Sprintf("552 Limit of %v recipients exceeded", s.config.MaxRecipients))
+			s.send(fmt.Sprintf("552 5.5.3 Limit of %v recipients exceeded", s.config.MaxRecipients))
+			return
+		}
+		if !s.limits.allowRecipient(s.remoteHost) {
+			expRcptsLimited.Add(1)
+			s.send("451 4.7.1 Recipient rate limit exceeded, try again later")
+			s.logger.Warn().Str("to", addr).Msg("Recipient rate limit exceeded")
 			return
 		}
 		s.recipients = append(s.recipients, recip)
 		s.logger.Debug().Str("to", addr).Msg("Recipient added")
-		s.send(fmt.Sprintf("250 I'll make sure <%v> gets this", addr))
+		s.send(fmt.Sprintf("250 2.1.5 I'll make sure <%v> gets this", addr))
 		return
 	case "DATA":
 		if arg != "" {
-			s.send("501 DATA command should not have any arguments")
+			s.send("501 5.5.4 DATA command should not have any arguments")
 			s.logger.Warn().Msgf("Got unexpected args on DATA: %q", arg)
 			return
 		}
-		if len(s.recipients) == 0 {
-			// DATA out of sequence
+		if len(s.recipients) == 0 || s.chunks != nil {
+			// DATA out of sequence, or mixed with BDAT.
 			s.ooSeq(cmd)
 			return
 		}
+		if s.bodyType == "BINARYMIME" {
+			s.send("503 5.5.1 BINARYMIME requires BDAT")
+			s.logger.Warn().Msg("Client attempted DATA with BODY=BINARYMIME")
+			return
+		}
 		s.enterState(DATA)
 		return
 	case "EHLO":
 		// Reset session
 		s.logger.Debug().Msgf("Resetting session state on EHLO request")
 		s.reset()
-		s.send("250 Session reset")
+		s.send("250 2.0.0 Session reset")
 		return
 	}
 	s.ooSeq(cmd)
@@ -553,36 +804,245 @@ func (s *Session) mailHandler(cmd string, arg string) {
 // DATA
 func (s *Session) dataHandler() {
 	s.send("354 Start mail input; end with <CRLF>.<CRLF>")
+	fault := s.dataFault()
+	if fault != nil && fault.Action == FaultDrop {
+		// Drop connection while the client is sending DATA.
+		s.injectFault(fault)
+		return
+	}
 	msgBuf, err := s.readDataBlock()
+	if err == errMessageTooLarge {
+		s.send("552 5.3.4 Message exceeds maximum size")
+		s.logger.Warn().Msgf("Rejected message larger than %v bytes", s.config.MaxMessageBytes)
+		s.reset()
+		return
+	}
 	if err != nil {
-		if netErr, ok := err.(net.Error); ok {
-			if netErr.Timeout() {
-				s.send("221 Idle timeout, bye bye")
+		s.readError(err)
+		return
+	}
+	s.transcribe("C: ", fmt.Sprintf("[%d bytes of message data]", len(msgBuf)))
+	s.deliver(msgBuf, fault)
+}
+
+// BDAT command, receives a chunk of message data per RFC 3030.  Chunk data is always consumed,
+// even when the command is rejected, so it is not interpreted as further commands.
+func (s *Session) bdatHandler(arg string) {
+	fields := strings.Fields(arg)
+	if len(fields) < 1 || len(fields) > 2 ||
+		(len(fields) == 2 && !strings.EqualFold(fields[1], "LAST")) {
+		s.send("501 5.5.4 Was expecting BDAT arg syntax of <size> [LAST]")
+		s.logger.Warn().Msgf("Bad BDAT argument: %q", arg)
+		return
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || size < 0 {
+		s.send("501 5.5.4 Unable to parse BDAT size as an integer")
+		s.logger.Warn().Msgf("Unable to parse BDAT size %q as an integer", fields[0])
+		return
+	}
+	last := len(fields) == 2
+
+	if s.state != MAIL || len(s.recipients) == 0 {
+		if err := s.discardChunk(size); err != nil {
+			s.readError(err)
+			return
+		}
+		s.ooSeq("BDAT")
+		return
+	}
+	if s.chunks == nil {
+		s.chunks = new(bytes.Buffer)
+		s.chunkFault = s.dataFault()
+		if s.chunkFault != nil && s.chunkFault.Action == FaultDrop {
+			// Drop connection while the client is sending chunks.
+			s.injectFault(s.chunkFault)
+			return
+		}
+	}
+	if int64(s.chunks.Len())+size > int64(s.config.MaxMessageBytes) {
+		if err := s.discardChunk(size); err != nil {
+			s.readError(err)
+			return
+		}
+		s.send("552 5.3.4 Message exceeds maximum size")
+		s.logger.Warn().Msgf("Rejected message larger than %v bytes", s.config.MaxMessageBytes)
+		s.reset()
+		return
+	}
+	if err := s.conn.SetReadDeadline(s.nextDeadline()); err != nil {
+		s.readError(err)
+		return
+	}
+	if _, err := io.CopyN(s.chunks, s.text.R, size); err != nil {
+		s.readError(err)
+		return
+	}
+	if s.debug {
+		fmt.Printf("%04d   Received %d byte chunk\n", s.id, size)
+	}
+	s.transcribe("C: ", fmt.Sprintf("[%d bytes of message data]", size))
+	if !last {
+		s.send(fmt.Sprintf("250 2.0.0 %d octets received", size))
+		return
+	}
+
+	s.deliver(s.chunks.Bytes(), s.chunkFault)
+}
+
+// discardChunk reads and discards size bytes of BDAT chunk data.
+func (s *Session) discardChunk(size int64) error {
+	if err := s.conn.SetReadDeadline(s.nextDeadline()); err != nil {
+		return err
+	}
+	_, err := io.CopyN(io.Discard, s.text.R, size)
+	return err
+}
+
+// readError handles a failure to read message data from the client, ending the session.
+func (s *Session) readError(err error) {
+	if netErr, ok := err.(net.Error); ok {
+		if netErr.Timeout() {
+			s.send("221 2.0.0 Idle timeout, bye bye")
+		}
+	}
+	s.logger.Warn().Msgf("Error: %v while reading", err)
+	s.enterState(QUIT)
+}
+
+// dataFault returns the data stage fault to inject for the current transaction, if any.  LMTP
+// sessions match data stage faults per recipient during delivery instead.
+func (s *Session) dataFault() *FaultRule {
+	if s.lmtp {
+		return nil
+	}
+	return s.faults.match(FaultStageData, s.recipientAddrs()...)
+}
+
+// deliver hands a completed message to the manager, after applying any data stage fault, and
+// then resets the session for the next transaction.
+func (s *Session) deliver(msgBuf []byte, fault *FaultRule) {
+	if s.injectFault(fault) {
+		s.reset()
+		return
+	}
+	if resp := s.dataDenied(msgBuf); resp != nil {
+		reply := statusReply(resp.ErrorCode, resp.ErrorMsg)
+		if s.lmtp {
+			// LMTP requires a reply per recipient.
+			for range s.recipients {
+				s.send(reply)
 			}
+		} else {
+			s.send(reply)
 		}
-		s.logger.Warn().Msgf("Error: %v while reading", err)
-		s.enterState(QUIT)
+		s.logger.Warn().Msgf("Extension denied message data from <%v>", s.from.Address.Address)
+		s.reset()
 		return
 	}
-	mailData := bytes.NewBuffer(msgBuf)
 
 	// Generate Received header; Deliver() will append recipient and timestamp to this.
 	recvdHeader := fmt.Sprintf("Received: from %s ([%s]) by %s\r\n",
 		s.remoteDomain, s.remoteHost, s.config.Domain)
+	if s.lmtp {
+		s.deliverEach(recvdHeader, msgBuf)
+		return
+	}
 
 	// Deliver message.
-	if err := s.manager.Deliver(s.from, s.recipients, recvdHeader, mailData.Bytes()); err != nil {
+	err := s.manager.Deliver(s.from, s.recipients, recvdHeader, msgBuf, s.sessionInfo())
+	if err != nil {
 		// Deliver() logs failure details, and the effected mailbox.
-		s.send("451 Failed to store message")
+		s.send("451 4.3.0 Failed to store message")
 		s.reset()
 		return
 	}
 
 	// TODO Consider changing this to just 1 regardless of # of recipents.
 	expReceivedTotal.Add(int64(len(s.recipients)))
+	s.rateSlot = nil // Delivered, keep the rate limit reservation.
 
-	s.send("250 Mail accepted for delivery")
-	s.logger.Info().Msgf("Message size %v bytes", mailData.Len())
+	s.send("250 2.6.0 Mail accepted for delivery")
+	s.logger.Info().Msgf("Message size %v bytes", len(msgBuf))
+	s.accepted++
+	s.acceptedRcpt += len(s.recipients)
+	s.acceptedSize += int64(len(msgBuf))
+	s.reset()
+}
+
+// dataDenied emits the BeforeDataAccepted event with the parsed message, returning the extension
+// response if the message was denied, otherwise nil.
+func (s *Session) dataDenied(msgBuf []byte) *event.SMTPResponse {
+	broker := &s.extHost.Events.BeforeDataAccepted
+	if !broker.HasListeners() {
+		// Skip parsing the message.
+		return nil
+	}
+	env, err := enmime.ReadEnvelope(bytes.NewReader(msgBuf))
+	if err != nil {
+		s.logger.Warn().Err(err).Msg("Failed to parse message for BeforeDataAccepted event")
+		return nil
+	}
+
+	msg := &event.DataMessage{
+		MailFrom:   s.from.Address.Address,
+		RcptTo:     s.recipientAddrs(),
+		RemoteAddr: s.remoteHost,
+		Header:     env.Root.Header,
+		Subject:    env.GetHeader("Subject"),
+		Text:       env.Text,
+		HTML:       env.HTML,
+		Size:       int64(len(msgBuf)),
+	}
+	for _, parts := range [][]*enmime.Part{env.Inlines, env.Attachments} {
+		for _, part := range parts {
+			msg.Attachments = append(msg.Attachments, event.AttachmentInfo{
+				FileName:    part.FileName,
+				ContentType: part.ContentType,
+				Size:        int64(len(part.Content)),
+			})
+		}
+	}
+
+	result := broker.Emit(msg)
+	if result == nil || result.Action != event.ActionDeny {
+		return nil
+	}
+	return result
+}
+
+// deliverEach delivers the message to each recipient individually, sending a reply per recipient
+// as required by LMTP, RFC 2033.
+func (s *Session) deliverEach(recvdHeader string, msgBuf []byte) {
+	session := s.sessionInfo()
+	delivered := 0
+	for _, recip := range s.recipients {
+		addr := recip.Address.Address
+		if s.injectFault(s.faults.match(FaultStageData, addr)) {
+			if s.state == QUIT {
+				return
+			}
+			continue
+		}
+		err := s.manager.Deliver(s.from, []*policy.Recipient{recip}, recvdHeader, msgBuf, session)
+		if err != nil {
+			// Deliver() logs failure details, and the effected mailbox.
+			s.send(fmt.Sprintf("451 4.3.0 Failed to store message for <%v>", addr))
+			continue
+		}
+		delivered++
+		s.send(fmt.Sprintf("250 2.1.5 <%v> Mail accepted for delivery", addr))
+	}
+
+	expReceivedTotal.Add(int64(delivered))
+	if delivered > 0 {
+		s.rateSlot = nil // Delivered, keep the rate limit reservation.
+		s.accepted++
+		s.acceptedRcpt += delivered
+		s.acceptedSize += int64(len(msgBuf))
+	}
+	s.logger.Info().Msgf("Message size %v bytes, delivered to %v of %v recipients",
+		len(msgBuf), delivered, len(s.recipients))
 	s.reset()
 }
 
@@ -592,7 +1052,7 @@ func (s *Session) enterState(state State) {
 }
 
 func (s *Session) greet() {
-	s.send(fmt.Sprintf("220 %v Inbucket SMTP ready", s.config.Domain))
+	s.send(fmt.Sprintf("220 %v Inbucket %v ready", s.config.Domain, s.protocol()))
 }
 
 // nextDeadline calculates the next read or write deadline based on configured timeout.
@@ -600,13 +1060,10 @@ func (s *Session) nextDeadline() time.Time {
 	return time.Now().Add(s.config.Timeout)
 }
 
-// Send requested message, store errors in Session.sendError
+// Send requested message, store errors in Session.sendError.  Responses are held back while
+// pipelined commands remain buffered, per RFC 2920.
 func (s *Session) send(msg string) {
-	if err := s.conn.SetWriteDeadline(s.nextDeadline()); err != nil {
-		s.sendError = err
-		return
-	}
-	if err := s.text.PrintfLine("%s", msg); err != nil {
+	if _, err := s.text.W.WriteString(msg + "\r\n"); err != nil {
 		s.sendError = err
 		s.logger.Warn().Msgf("Failed to send: %q", msg)
 		return
@@ -614,6 +1071,25 @@ func (s *Session) send(msg string) {
 	if s.debug {
 		fmt.Printf("%04d > %v\n", s.id, msg)
 	}
+	s.transcribe("S: ", msg)
+	if s.text.R.Buffered() == 0 {
+		s.flush()
+	}
+}
+
+// flush writes any held back responses, store errors in Session.sendError.
+func (s *Session) flush() {
+	if s.text.W.Buffered() == 0 {
+		return
+	}
+	if err := s.conn.SetWriteDeadline(s.nextDeadline()); err != nil {
+		s.sendError = err
+		return
+	}
+	if err := s.text.W.Flush(); err != nil {
+		s.sendError = err
+		s.logger.Warn().Err(err).Msg("Failed to flush responses")
+	}
 }
 
 // readDataBlock reads message DATA until `.` using the textproto pkg.
@@ -621,10 +1097,18 @@ func (s *Session) readDataBlock() ([]byte, error) {
 	if err := s.conn.SetReadDeadline(s.nextDeadline()); err != nil {
 		return nil, err
 	}
-	b, err := s.text.ReadDotBytes()
+	dr := s.text.DotReader()
+	b, err := io.ReadAll(io.LimitReader(dr, int64(s.config.MaxMessageBytes)+1))
 	if err != nil {
 		return nil, err
 	}
+	if len(b) > s.config.MaxMessageBytes {
+		// Consume the remainder of the message so the session may continue.
+		if _, err := io.Copy(io.Discard, dr); err != nil {
+			return nil, err
+		}
+		return nil, errMessageTooLarge
+	}
 	if s.debug {
 		fmt.Printf("%04d   Received %d bytes\n", s.id, len(b))
 	}
@@ -643,9 +1127,33 @@ func (s *Session) readLine() (line string, err error) {
 	if s.debug {
 		fmt.Printf("%04d   %v\n", s.id, strings.TrimRight(line, "\r\n"))
 	}
+	switch {
+	case s.state == LOGIN || s.state == PASSWORD || s.state == CRAMMD5:
+		s.transcribe("C: ", redacted)
+	case len(line) > 11 && strings.EqualFold(line[:11], "AUTH PLAIN "):
+		s.transcribe("C: ", line[:11]+redacted)
+	default:
+		s.transcribe("C: ", line)
+	}
 	return line, nil
 }
 
+// transcribe records a line of network traffic to the session transcript, if enabled.
+func (s *Session) transcribe(prefix, line string) {
+	if s.transcript == nil {
+		return
+	}
+	if s.transcript.Len() >= maxTranscriptBytes {
+		return
+	}
+	s.transcript.WriteString(prefix)
+	s.transcript.WriteString(strings.TrimRight(line, "\r\n"))
+	s.transcript.WriteString("\r\n")
+	if s.transcript.Len() >= maxTranscriptBytes {
+		s.transcript.WriteString("[transcript truncated]\r\n")
+	}
+}
+
 func (s *Session) parseCmd(line string) (cmd string, arg string, ok bool) {
 	line = strings.TrimRight(line, "\r\n")
 	s.logger.Debug().Msgf("Line received: %v", line)
@@ -682,27 +1190,103 @@ func (s *Session) parseCmd(line string) (cmd string, arg string, ok bool) {
 // The leading space is mandatory.
 func (s *Session) parseArgs(arg string) (args map[string]string, ok bool) {
 	args = make(map[string]string)
-	re := regexp.MustCompile(` (\w+)=(\w+|<>)`)
+	re := regexp.MustCompile(` (\w+)(?:=(\w+|<>))?`)
 	pm := re.FindAllStringSubmatch(arg, -1)
 	if pm == nil {
 		s.logger.Warn().Msgf("Failed to parse arg string: %q", arg)
 		return nil, false
 	}
 	for _, m := range pm {
-		args[strings.ToUpper(m[1])] = m[2]
+		key := strings.ToUpper(m[1])
+		if !strings.Contains(m[0], "=") && !valuelessParams[key] {
+			s.logger.Warn().Msgf("ESMTP param %q requires a value", m[1])
+			return nil, false
+		}
+		args[key] = m[2]
 	}
 	s.logger.Debug().Msgf("ESMTP params: %v", args)
 	return args, true
 }
 
+// injectFault delays and/or responds according to the fault rule, which may be nil.  Returns true
+// if the fault handled the command, in which case no further response should be sent.
+func (s *Session) injectFault(rule *FaultRule) bool {
+	if rule == nil {
+		return false
+	}
+	s.logger.Info().Str("fault", rule.ID).Str("stage", rule.Stage).Str("action", rule.Action).
+		Msg("Injecting fault")
+	expFaultsTotal.Add(1)
+	if rule.delay > 0 {
+		time.Sleep(rule.delay)
+	}
+	switch rule.Action {
+	case FaultTempFail, FaultPermFail:
+		s.send(statusReply(rule.Code, rule.Message))
+		return true
+	case FaultDrop:
+		s.enterState(QUIT)
+		return true
+	}
+	return false
+}
+
+// recipientAddrs returns the addresses of the accepted recipients.
+func (s *Session) recipientAddrs() []string {
+	addrs := make([]string, len(s.recipients))
+	for i, recip := range s.recipients {
+		addrs[i] = recip.Address.Address
+	}
+	return addrs
+}
+
 func (s *Session) reset() {
 	s.enterState(READY)
 	s.from = nil
 	s.recipients = nil
+	s.smtpUTF8 = false
+	s.bodyType = ""
+	s.chunks = nil
+	s.chunkFault = nil
+	s.limits.releaseMessage(s.rateSlot)
+	s.rateSlot = nil
+}
+
+// statusReply formats an SMTP reply, prefixing msg with a generic RFC 3463 enhanced status code
+// unless it already has one.
+func statusReply(code int, msg string) string {
+	if !enhancedCodeRegex.MatchString(msg) {
+		msg = fmt.Sprintf("%d.0.0 %s", code/100, msg)
+	}
+	return fmt.Sprintf("%03d %s", code, msg)
+}
+
+// isASCII returns true if s contains only US-ASCII characters.
+func isASCII(s string) bool {
+	for i := range len(s) {
+		if s[i] > 127 {
+			return false
+		}
+	}
+	return true
+}
+
+// protocolCommand maps cmd to the equivalent SMTP command.  LMTP replaces HELO and EHLO with
+// LHLO, RFC 2033.  Returns false if cmd is not recognized by the protocol.
+func (s *Session) protocolCommand(cmd string) (string, bool) {
+	if s.lmtp {
+		switch cmd {
+		case "LHLO":
+			return "EHLO", true
+		case "HELO", "EHLO":
+			return cmd, false
+		}
+	}
+	return cmd, commands[cmd]
 }
 
 func (s *Session) ooSeq(cmd string) {
-	s.send(fmt.Sprintf("503 Command %v is out of sequence", cmd))
+	s.send(fmt.Sprintf("503 5.5.1 Command %v is out of sequence", cmd))
 	s.logger.Warn().Msgf("Wasn't expecting %v here", cmd)
 }
 
@@ -725,3 +1309,41 @@ func (s *Session) extSession() *event.SMTPSession {
 		RemoteAddr: s.remoteHost,
 	}
 }
+
+// summary describes the session for the AfterSMTPSessionClosed event.
+func (s *Session) summary() *event.SMTPSessionSummary {
+	return &event.SMTPSessionSummary{
+		RemoteAddr: s.remoteHost,
+		Helo:       s.remoteDomain,
+		AuthUser:   s.authUser,
+		Messages:   s.accepted,
+		Recipients: s.acceptedRcpt,
+		Bytes:      s.acceptedSize,
+		Started:    s.started,
+		Duration:   time.Since(s.started),
+	}
+}
+
+// sessionInfo captures the details of this session to be stored with the message.
+func (s *Session) sessionInfo() *event.SessionInfo {
+	info := &event.SessionInfo{
+		AuthUser:   s.authUser,
+		Helo:       s.remoteDomain,
+		RemoteAddr: s.remoteHost,
+		RcptTo:     make([]string, 0, len(s.recipients)),
+	}
+	if s.tlsState != nil {
+		info.TLSVersion = tls.VersionName(s.tlsState.Version)
+		info.TLSCipher = tls.CipherSuiteName(s.tlsState.CipherSuite)
+	}
+	if s.from != nil {
+		info.MailFrom = s.from.Address.Address
+	}
+	if s.transcript != nil {
+		info.Transcript = s.transcript.String()
+	}
+	for _, recip := range s.recipients {
+		info.RcptTo = append(info.RcptTo, recip.Address.Address)
+	}
+	return info
+}
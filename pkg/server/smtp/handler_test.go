@@ -1,11 +1,22 @@
 package smtp
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"math/big"
 
 	"net"
 	"net/textproto"
+	"strings"
 	"testing"
 	"time"
 
@@ -117,6 +128,8 @@ func TestAuth(t *testing.T) {
 		{"AUTH PLAIN", 500},
 		{"RSET", 250},
 		{"AUTH PLAIN aW5idWNrZXQ6cG Fzc3dvcmQK", 500},
+		{"RSET", 250},
+		{"AUTH PLAIN not-base64!", 501},
 	}
 	playSession(t, server, script)
 
@@ -130,8 +143,106 @@ func TestAuth(t *testing.T) {
 		{"AUTH LOGIN", 334}, // Test with empty user/pass.
 		{"", 334},
 		{"", 235},
+		{"RSET", 250},
+		{"AUTH LOGIN", 334}, // Test with undecodable user.
+		{"user!", 501},
+		{"AUTH LOGIN", 334}, // Test with undecodable pass.
+		{"username", 334},
+		{"pass!", 501},
+	}
+	playSession(t, server, script)
+}
+
+// Test AUTH commands against configured credentials.
+func TestAuthCredentials(t *testing.T) {
+	ds := test.NewStore()
+	server := setupSMTPServer(ds, extension.NewHost())
+	server.auth = Credentials{"user": "secret"}
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	// PLAIN AUTH
+	script := []scriptStep{
+		{"EHLO localhost", 250},
+		{"AUTH PLAIN " + b64("\x00user\x00secret"), 235},
+		{"AUTH PLAIN " + b64("user\x00user\x00secret"), 235},
+		{"AUTH PLAIN " + b64("\x00user\x00wrong"), 535},
+		{"AUTH PLAIN " + b64("\x00nobody\x00secret"), 535},
+		{"AUTH PLAIN aW5idWNrZXQ6cGFzc3dvcmQK", 501},
+	}
+	playSession(t, server, script)
+
+	// LOGIN AUTH
+	script = []scriptStep{
+		{"EHLO localhost", 250},
+		{"AUTH LOGIN", 334},
+		{b64("user"), 334},
+		{b64("secret"), 235},
+		{"AUTH LOGIN", 334},
+		{b64("user"), 334},
+		{b64("wrong"), 535},
+		{"AUTH LOGIN", 334},
+		{"*", 501},
+		{"NOOP", 250},
+	}
+	playSession(t, server, script)
+
+	// CRAM-MD5 AUTH
+	for secret, want := range map[string]int{"secret": 235, "wrong": 535} {
+		pipe := setupSMTPSession(t, server)
+		c := textproto.NewConn(pipe)
+		_, _, err := c.ReadCodeLine(220)
+		require.NoError(t, err)
+		playScriptAgainst(t, c, []scriptStep{{"EHLO localhost", 250}})
+
+		require.NoError(t, c.PrintfLine("AUTH CRAM-MD5"))
+		_, msg, err := c.ReadCodeLine(334)
+		require.NoError(t, err)
+		challenge, err := base64.StdEncoding.DecodeString(msg)
+		require.NoError(t, err)
+		mac := hmac.New(md5.New, []byte(secret))
+		mac.Write(challenge)
+		response := b64(fmt.Sprintf("user %x", mac.Sum(nil)))
+
+		playScriptAgainst(t, c, []scriptStep{{response, want}, {"QUIT", 221}})
+	}
+}
+
+// Test AUTH acts on BeforeAuthAccepted event result.
+func TestBeforeAuthAcceptedEvent(t *testing.T) {
+	ds := test.NewStore()
+	extHost := extension.NewHost()
+	server := setupSMTPServer(ds, extHost)
+	server.auth = Credentials{"user": "secret"}
+
+	var got *event.SMTPAuth
+	extHost.Events.BeforeAuthAccepted.AddListener(
+		"test",
+		func(auth event.SMTPAuth) *event.SMTPResponse {
+			got = &auth
+			switch auth.Username {
+			case "allowed":
+				return &event.SMTPResponse{Action: event.ActionAllow}
+			case "denied":
+				return &event.SMTPResponse{Action: event.ActionDeny, ErrorCode: 535, ErrorMsg: "nope"}
+			}
+			return nil
+		})
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	script := []scriptStep{
+		{"EHLO localhost", 250},
+		{"AUTH PLAIN " + b64("\x00allowed\x00any"), 235},
+		{"AUTH PLAIN " + b64("\x00denied\x00any"), 535},
+		{"AUTH PLAIN " + b64("\x00user\x00secret"), 235},
+		{"AUTH PLAIN " + b64("\x00user\x00bad"), 535},
 	}
 	playSession(t, server, script)
+
+	require.NotNil(t, got, "BeforeAuthAccepted did not receive event")
+	assert.Equal(t, "PLAIN", got.Mechanism)
+	assert.Equal(t, "user", got.Username)
+	assert.Equal(t, "bad", got.Password)
+	assert.Equal(t, "pipe", got.RemoteAddr)
 }
 
 // Test TLS commands.
@@ -390,6 +501,573 @@ Hi!
 	_, _, _ = c.ReadCodeLine(221)
 }
 
+// Test the SMTP session details are delivered with the message.
+func TestDataSessionInfo(t *testing.T) {
+	ds := test.NewStore()
+	server := setupSMTPServer(ds, extension.NewHost())
+	server.auth = Credentials{"user": "secret"}
+	server.addrPolicy.Config.SMTP.DefaultStore = true
+
+	pipe := setupSMTPSession(t, server)
+	c := textproto.NewConn(pipe)
+	_, _, err := c.ReadCodeLine(220)
+	require.NoError(t, err)
+	playScriptAgainst(t, c, []scriptStep{
+		{"EHLO client.example.com", 250},
+		{"AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret")), 235},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"RCPT TO:<u2@gmail.com>", 250},
+		{"DATA", 354},
+	})
+	dw := c.DotWriter()
+	_, _ = io.WriteString(dw, "Subject: test\n\nHi!\n")
+	_ = dw.Close()
+	_, _, err = c.ReadCodeLine(250)
+	require.NoError(t, err)
+	playScriptAgainst(t, c, []scriptStep{{"QUIT", 221}})
+
+	msgs, err := ds.GetMessages("u1@gmail.com")
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, &event.SessionInfo{
+		AuthUser:   "user",
+		Helo:       "client.example.com",
+		RemoteAddr: "pipe",
+		MailFrom:   "john@gmail.com",
+		RcptTo:     []string{"u1@gmail.com", "u2@gmail.com"},
+	}, msgs[0].Session())
+}
+
+// Test the negotiated TLS details are delivered with the message, for both STARTTLS and ForceTLS.
+func TestDataSessionInfoTLS(t *testing.T) {
+	for _, forceTLS := range []bool{false, true} {
+		t.Run(fmt.Sprintf("forceTLS=%v", forceTLS), func(t *testing.T) {
+			ds := test.NewStore()
+			server := setupSMTPServer(ds, extension.NewHost())
+			server.addrPolicy.Config.SMTP.DefaultStore = true
+			server.config.Timeout = 5 * time.Second
+			server.config.TLSEnabled = true
+			server.config.ForceTLS = forceTLS
+			server.tlsConfig = testTLSConfig(t)
+
+			var c *textproto.Conn
+			if forceTLS {
+				c = textproto.NewConn(setupSMTPTLSSession(t, server))
+				_, _, err := c.ReadCodeLine(220)
+				require.NoError(t, err)
+			} else {
+				pipe := setupSMTPSession(t, server)
+				c = textproto.NewConn(pipe)
+				_, _, err := c.ReadCodeLine(220)
+				require.NoError(t, err)
+				playScriptAgainst(t, c, []scriptStep{
+					{"EHLO client.example.com", 250},
+					{"STARTTLS", 220},
+				})
+				c = textproto.NewConn(tls.Client(pipe, &tls.Config{InsecureSkipVerify: true}))
+			}
+			playScriptAgainst(t, c, []scriptStep{
+				{"EHLO client.example.com", 250},
+				{"MAIL FROM:<john@gmail.com>", 250},
+				{"RCPT TO:<u1@gmail.com>", 250},
+				{"DATA", 354},
+			})
+			dw := c.DotWriter()
+			_, _ = io.WriteString(dw, "Subject: test\n\nHi!\n")
+			_ = dw.Close()
+			_, _, err := c.ReadCodeLine(250)
+			require.NoError(t, err)
+			playScriptAgainst(t, c, []scriptStep{{"QUIT", 221}})
+
+			msgs, err := ds.GetMessages("u1@gmail.com")
+			require.NoError(t, err)
+			require.Len(t, msgs, 1)
+			info := msgs[0].Session()
+			assert.Equal(t, "TLS 1.3", info.TLSVersion)
+			assert.NotEmpty(t, info.TLSCipher)
+		})
+	}
+}
+
+// Test the SMTP session transcript is delivered with the message, minus credentials.
+func TestDataTranscript(t *testing.T) {
+	ds := test.NewStore()
+	server := setupSMTPServer(ds, extension.NewHost())
+	server.addrPolicy.Config.SMTP.DefaultStore = true
+	server.config.Transcript = true
+
+	pipe := setupSMTPSession(t, server)
+	c := textproto.NewConn(pipe)
+	_, _, err := c.ReadCodeLine(220)
+	require.NoError(t, err)
+	playScriptAgainst(t, c, []scriptStep{
+		{"EHLO localhost", 250},
+		{"AUTH PLAIN AHVzZXIAc2VjcmV0", 235},
+		{"AUTH LOGIN", 334},
+		{"dXNlcm5hbWU=", 334},
+		{"cGFzc3dvcmQ=", 235},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+	})
+	dw := c.DotWriter()
+	_, _ = io.WriteString(dw, "Subject: test\n\nHi!\n")
+	_ = dw.Close()
+	_, _, err = c.ReadCodeLine(250)
+	require.NoError(t, err)
+	playScriptAgainst(t, c, []scriptStep{{"QUIT", 221}})
+
+	msgs, err := ds.GetMessages("u1@gmail.com")
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	transcript := msgs[0].Session().Transcript
+	assert.True(t, strings.HasPrefix(transcript, "S: 220 "), "transcript should begin with greeting")
+	assert.Contains(t, transcript, "C: EHLO localhost\r\nS: 250-")
+	assert.Contains(t, transcript, "C: AUTH PLAIN <redacted>\r\n")
+	assert.Contains(t, transcript, "C: AUTH LOGIN\r\nS: 334 VXNlciBOYW1lAA==\r\nC: <redacted>\r\n")
+	assert.Contains(t, transcript, "C: RCPT TO:<u1@gmail.com>\r\n")
+	assert.True(t, strings.HasSuffix(transcript, "S: 354 Start mail input; end with <CRLF>.<CRLF>\r\n"+
+		"C: [19 bytes of message data]\r\n"))
+	assert.NotContains(t, transcript, "c2VjcmV0")
+	assert.NotContains(t, transcript, "cGFzc3dvcmQ=")
+	assert.NotContains(t, transcript, "Hi!")
+}
+
+// Test EHLO advertises supported ESMTP extensions.
+func TestEHLOExtensions(t *testing.T) {
+	ds := test.NewStore()
+	server := setupSMTPServer(ds, extension.NewHost())
+
+	pipe := setupSMTPSession(t, server)
+	c := textproto.NewConn(pipe)
+	_, _, err := c.ReadCodeLine(220)
+	require.NoError(t, err)
+	id, err := c.Cmd("EHLO localhost")
+	require.NoError(t, err)
+	c.StartResponse(id)
+	_, msg, err := c.ReadResponse(250)
+	c.EndResponse(id)
+	require.NoError(t, err)
+	lines := strings.Split(msg, "\n")
+	for _, ext := range []string{"8BITMIME", "BINARYMIME", "CHUNKING", "PIPELINING",
+		"ENHANCEDSTATUSCODES", "SMTPUTF8",
+		"SIZE 5000"} {
+		assert.Contains(t, lines, ext)
+	}
+
+	// Replies carry RFC 3463 enhanced status codes.
+	id, err = c.Cmd("MAIL FROM:<john@gmail.com>")
+	require.NoError(t, err)
+	c.StartResponse(id)
+	_, msg, err = c.ReadResponse(250)
+	c.EndResponse(id)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(msg, "2.1.0 "), "got %q", msg)
+}
+
+// Test pipelined commands each receive a response, in order.
+func TestPipelining(t *testing.T) {
+	ds := test.NewStore()
+	server := setupSMTPServer(ds, extension.NewHost())
+	server.addrPolicy.Config.SMTP.DefaultStore = true
+
+	pipe := setupSMTPSession(t, server)
+	c := textproto.NewConn(pipe)
+	_, _, err := c.ReadCodeLine(220)
+	require.NoError(t, err)
+	playScriptAgainst(t, c, []scriptStep{{"EHLO localhost", 250}})
+
+	_, err = io.WriteString(pipe, "MAIL FROM:<john@gmail.com>\r\n"+
+		"RCPT TO:<u1@gmail.com>\r\n"+
+		"RCPT TO:<u1@deny.com>\r\n"+
+		"RCPT TO:<u2@gmail.com>\r\n"+
+		"DATA\r\n")
+	require.NoError(t, err)
+	for _, want := range []int{250, 250, 550, 250, 354} {
+		_, _, err = c.ReadCodeLine(want)
+		require.NoError(t, err)
+	}
+	dw := c.DotWriter()
+	_, _ = io.WriteString(dw, "Subject: test\n\nHi!\n")
+	_ = dw.Close()
+	_, _, err = c.ReadCodeLine(250)
+	require.NoError(t, err)
+	playScriptAgainst(t, c, []scriptStep{{"QUIT", 221}})
+
+	for _, mailbox := range []string{"u1@gmail.com", "u2@gmail.com"} {
+		msgs, err := ds.GetMessages(mailbox)
+		require.NoError(t, err)
+		assert.Len(t, msgs, 1, "mailbox %v", mailbox)
+	}
+}
+
+// Test internationalized addresses require the SMTPUTF8 parameter.
+func TestSMTPUTF8(t *testing.T) {
+	ds := test.NewStore()
+	server := setupSMTPServer(ds, extension.NewHost())
+	server.addrPolicy.Config.SMTP.DefaultStore = true
+
+	playSession(t, server, []scriptStep{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<jöran@bücher.example>", 553},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<用户@例子.广告>", 553},
+		{"RSET", 250},
+		{"MAIL FROM:<jöran@bücher.example> SMTPUTF8", 250},
+		{"RCPT TO:<用户@例子.广告>", 250},
+		{"RCPT TO:<Jöran+label@bücher.example>", 250},
+		{"DATA", 354},
+		{".", 250},
+		{"MAIL FROM:<john@gmail.com> SMTPUTF8=yes", 501},
+		{"MAIL FROM:<john@gmail.com> SIZE", 501},
+		{"QUIT", 221},
+	})
+
+	for _, mailbox := range []string{"用户@例子.广告", "jöran@bücher.example"} {
+		msgs, err := ds.GetMessages(mailbox)
+		require.NoError(t, err)
+		assert.Len(t, msgs, 1, "mailbox %v", mailbox)
+	}
+}
+
+// Test messages larger than MaxMessageBytes are rejected after DATA.
+func TestDataSizeLimit(t *testing.T) {
+	ds := test.NewStore()
+	server := setupSMTPServer(ds, extension.NewHost())
+	server.addrPolicy.Config.SMTP.DefaultStore = true
+
+	pipe := setupSMTPSession(t, server)
+	c := textproto.NewConn(pipe)
+	_, _, err := c.ReadCodeLine(220)
+	require.NoError(t, err)
+	playScriptAgainst(t, c, []scriptStep{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+	})
+	dw := c.DotWriter()
+	_, _ = io.WriteString(dw, "Subject: big\n\n"+strings.Repeat("0123456789\n", 500))
+	_ = dw.Close()
+	_, _, err = c.ReadCodeLine(552)
+	require.NoError(t, err)
+
+	// Session remains usable after rejection.
+	playScriptAgainst(t, c, []scriptStep{
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+		{".", 250},
+		{"QUIT", 221},
+	})
+
+	msgs, err := ds.GetMessages("u1@gmail.com")
+	require.NoError(t, err)
+	assert.Len(t, msgs, 1, "only the small message should be stored")
+}
+
+// Test BDAT chunks are assembled and delivered.
+func TestBDAT(t *testing.T) {
+	ds := test.NewStore()
+	server := setupSMTPServer(ds, extension.NewHost())
+	server.addrPolicy.Config.SMTP.DefaultStore = true
+
+	pipe := setupSMTPSession(t, server)
+	c := textproto.NewConn(pipe)
+	_, _, err := c.ReadCodeLine(220)
+	require.NoError(t, err)
+	playScriptAgainst(t, c, []scriptStep{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<john@gmail.com> BODY=BINARYMIME", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 503},
+	})
+
+	// Chunks may be pipelined, and contain binary data without dot stuffing.
+	chunk1 := "Subject: chunky\r\n\r\n"
+	chunk2 := ".\r\nbinary\x00data\r\n"
+	_, err = fmt.Fprintf(pipe, "BDAT %d\r\n%sBDAT %d LAST\r\n%s",
+		len(chunk1), chunk1, len(chunk2), chunk2)
+	require.NoError(t, err)
+	_, _, err = c.ReadCodeLine(250)
+	require.NoError(t, err)
+	_, _, err = c.ReadCodeLine(250)
+	require.NoError(t, err)
+
+	// BDAT requires a transaction, but the chunk data must still be consumed.
+	_, err = io.WriteString(pipe, "BDAT 4 LAST\r\nQUIT")
+	require.NoError(t, err)
+	_, _, err = c.ReadCodeLine(503)
+	require.NoError(t, err)
+	playScriptAgainst(t, c, []scriptStep{
+		{"BDAT", 501},
+		{"BDAT x LAST", 501},
+		{"QUIT", 221},
+	})
+
+	msgs, err := ds.GetMessages("u1@gmail.com")
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "chunky", msgs[0].Subject())
+	source, err := msgs[0].Source()
+	require.NoError(t, err)
+	body, err := io.ReadAll(source)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(body), chunk1+chunk2))
+}
+
+// Test BDAT enforces MaxMessageBytes across chunks.
+func TestBDATSizeLimit(t *testing.T) {
+	ds := test.NewStore()
+	server := setupSMTPServer(ds, extension.NewHost())
+	server.addrPolicy.Config.SMTP.DefaultStore = true
+
+	pipe := setupSMTPSession(t, server)
+	c := textproto.NewConn(pipe)
+	_, _, err := c.ReadCodeLine(220)
+	require.NoError(t, err)
+	playScriptAgainst(t, c, []scriptStep{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+	})
+	chunk := strings.Repeat("x", 3000)
+	_, err = fmt.Fprintf(pipe, "BDAT %d\r\n%s", len(chunk), chunk)
+	require.NoError(t, err)
+	_, _, err = c.ReadCodeLine(250)
+	require.NoError(t, err)
+	_, err = fmt.Fprintf(pipe, "BDAT %d LAST\r\n%s", len(chunk), chunk)
+	require.NoError(t, err)
+	_, _, err = c.ReadCodeLine(552)
+	require.NoError(t, err)
+
+	// Transaction was reset, but the session remains usable.
+	playScriptAgainst(t, c, []scriptStep{
+		{"RCPT TO:<u1@gmail.com>", 503},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"BDAT 0 LAST", 250},
+		{"QUIT", 221},
+	})
+
+	msgs, err := ds.GetMessages("u1@gmail.com")
+	require.NoError(t, err)
+	assert.Len(t, msgs, 1, "only the empty message should be stored")
+}
+
+// Test LMTP sessions require LHLO, and reply per recipient after DATA.
+func TestLMTP(t *testing.T) {
+	ds := test.NewStore()
+	extHost := extension.NewHost()
+	server := NewLMTPServer(config.LMTP{Addr: "127.0.0.1:2400"}, setupSMTPServer(ds, extHost))
+	server.addrPolicy.Config.MailboxNaming = config.LocalNaming
+	server.addrPolicy.Config.SMTP.DefaultStore = true
+	_, err := server.Faults().Add(FaultRule{
+		Stage: FaultStageData, Action: FaultPermFail, Pattern: "fault@*", Code: 550})
+	require.NoError(t, err)
+	extHost.Events.BeforeRcptToAccepted.AddListener(
+		"test",
+		func(session event.SMTPSession) *event.SMTPResponse {
+			for _, to := range session.To {
+				if to.Address == "bad@gmail.com" {
+					return &event.SMTPResponse{Action: event.ActionDeny, ErrorCode: 550,
+						ErrorMsg: "rotten"}
+				}
+			}
+			return nil
+		})
+
+	pipe := setupSMTPSession(t, server)
+	c := textproto.NewConn(pipe)
+	_, msg, err := c.ReadCodeLine(220)
+	require.NoError(t, err)
+	assert.Contains(t, msg, "LMTP")
+	playScriptAgainst(t, c, []scriptStep{
+		{"HELO localhost", 500},
+		{"EHLO localhost", 500},
+		{"LHLO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"RCPT TO:<bad@gmail.com>", 550},
+		{"RCPT TO:<deliveryerr@gmail.com>", 250},
+		{"RCPT TO:<fault@gmail.com>", 250},
+		{"RCPT TO:<u2@gmail.com>", 250},
+		{"DATA", 354},
+	})
+	dw := c.DotWriter()
+	_, _ = io.WriteString(dw, "Subject: test\n\nHi!\n")
+	_ = dw.Close()
+	for _, want := range []int{250, 451, 550, 250} {
+		_, _, err = c.ReadCodeLine(want)
+		require.NoError(t, err)
+	}
+
+	// Per recipient replies also follow the last BDAT chunk.
+	playScriptAgainst(t, c, []scriptStep{
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<fault@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+	})
+	_, err = io.WriteString(pipe, "BDAT 0 LAST\r\n")
+	require.NoError(t, err)
+	for _, want := range []int{550, 250} {
+		_, _, err = c.ReadCodeLine(want)
+		require.NoError(t, err)
+	}
+	playScriptAgainst(t, c, []scriptStep{{"QUIT", 221}})
+
+	for mailbox, want := range map[string]int{"u1": 2, "u2": 1, "fault": 0, "bad": 0} {
+		msgs, err := ds.GetMessages(mailbox)
+		require.NoError(t, err)
+		assert.Len(t, msgs, want, "mailbox %v", mailbox)
+	}
+}
+
+// Test SMTP sessions do not accept LHLO.
+func TestSMTPRejectsLHLO(t *testing.T) {
+	ds := test.NewStore()
+	server := setupSMTPServer(ds, extension.NewHost())
+	playSession(t, server, []scriptStep{
+		{"LHLO localhost", 500},
+		{"EHLO localhost", 250},
+	})
+}
+
+// Test connections beyond the per IP limit are refused with 421.
+func TestConnectionLimit(t *testing.T) {
+	ds := test.NewStore()
+	server := setupSMTPServer(ds, extension.NewHost())
+	server.limits = newLimits(config.SMTP{MaxConnsPerIP: 1})
+
+	first := textproto.NewConn(setupSMTPSession(t, server))
+	_, _, err := first.ReadCodeLine(220)
+	require.NoError(t, err)
+
+	second := textproto.NewConn(setupSMTPSession(t, server))
+	_, _, err = second.ReadCodeLine(421)
+	require.NoError(t, err)
+
+	playScriptAgainst(t, first, []scriptStep{{"QUIT", 221}})
+}
+
+// Test message and recipient rate limits respond with 451.
+func TestRateLimits(t *testing.T) {
+	ds := test.NewStore()
+	server := setupSMTPServer(ds, extension.NewHost())
+	server.limits = newLimits(config.SMTP{MaxMessagesPerIP: 1, MaxRecipientsPerIP: 2})
+
+	playSession(t, server, []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RSET", 250}, // Abandoned transactions release their message slot.
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"RCPT TO:<u2@gmail.com>", 250},
+		{"RCPT TO:<u3@gmail.com>", 451},
+		{"DATA", 354},
+		{".", 250},
+		{"MAIL FROM:<john@gmail.com>", 451},
+		{"QUIT", 221},
+	})
+}
+
+func TestStatusReply(t *testing.T) {
+	tests := []struct {
+		code int
+		msg  string
+		want string
+	}{
+		{451, "Try later", "451 4.0.0 Try later"},
+		{550, "5.7.1 Denied", "550 5.7.1 Denied"},
+		{250, "2.1.5", "250 2.1.5"},
+		{554, "5.7 partial", "554 5.0.0 5.7 partial"},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, statusReply(tc.code, tc.msg))
+	}
+}
+
+// Test fault injection rules alter SMTP responses.
+func TestFaultInjection(t *testing.T) {
+	ds := test.NewStore()
+	server := setupSMTPServer(ds, extension.NewHost())
+	faults := server.Faults()
+	for _, rule := range []FaultRule{
+		{Stage: FaultStageMail, Action: FaultPermFail, Pattern: "bounce@*"},
+		{Stage: FaultStageRcpt, Action: FaultTempFail, Pattern: "retry@*", Code: 450},
+		{Stage: FaultStageRcpt, Action: FaultDelay, Pattern: "slow@*", Delay: "10ms"},
+		{Stage: FaultStageData, Action: FaultTempFail, Pattern: "data@*", Count: 1},
+	} {
+		_, err := faults.Add(rule)
+		require.NoError(t, err)
+	}
+
+	script := []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<bounce@gmail.com>", 554},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<retry@gmail.com>", 450},
+		{"RCPT TO:<slow@gmail.com>", 250},
+		{"RCPT TO:<data@gmail.com>", 250},
+		{"DATA", 354},
+		{".", 451},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<data@gmail.com>", 250},
+		{"DATA", 354},
+		{".", 250},
+		{"QUIT", 221},
+	}
+	playSession(t, server, script)
+}
+
+// Test fault injection can drop the connection during DATA.
+func TestFaultInjectionDrop(t *testing.T) {
+	ds := test.NewStore()
+	server := setupSMTPServer(ds, extension.NewHost())
+	_, err := server.Faults().Add(FaultRule{Stage: FaultStageData, Action: FaultDrop})
+	require.NoError(t, err)
+
+	pipe := setupSMTPSession(t, server)
+	c := textproto.NewConn(pipe)
+	_, _, err = c.ReadCodeLine(220)
+	require.NoError(t, err)
+	playScriptAgainst(t, c, []scriptStep{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+	})
+	_, _, err = c.ReadCodeLine(250)
+	assert.ErrorIs(t, err, io.EOF, "connection should have been dropped")
+}
+
+// Test fault injection drops the connection on the first BDAT chunk, before LAST.
+func TestFaultInjectionDropBDAT(t *testing.T) {
+	ds := test.NewStore()
+	server := setupSMTPServer(ds, extension.NewHost())
+	_, err := server.Faults().Add(FaultRule{Stage: FaultStageData, Action: FaultDrop})
+	require.NoError(t, err)
+
+	pipe := setupSMTPSession(t, server)
+	c := textproto.NewConn(pipe)
+	_, _, err = c.ReadCodeLine(220)
+	require.NoError(t, err)
+	playScriptAgainst(t, c, []scriptStep{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+	})
+	go func() {
+		_, _ = io.WriteString(pipe, "BDAT 5\r\nchunk")
+	}()
+	_, _, err = c.ReadCodeLine(250)
+	assert.ErrorIs(t, err, io.EOF, "connection should have been dropped")
+	msgs, err := ds.GetMessages("u1@gmail.com")
+	require.NoError(t, err)
+	assert.Empty(t, msgs)
+}
+
 // Tests "MAIL FROM" emits BeforeMailFromAccepted event.
 func TestBeforeMailFromAcceptedEventEmitted(t *testing.T) {
 	ds := test.NewStore()
@@ -735,3 +1413,158 @@ func setupSMTPSession(t *testing.T, server *Server) net.Conn {
 
 	return clientConn
 }
+
+// setupSMTPTLSSession starts a ForceTLS session, returning the client side of the TLS connection.
+func setupSMTPTLSSession(t *testing.T, server *Server) net.Conn {
+	t.Helper()
+	logger := zerolog.New(zerolog.NewTestWriter(t))
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = clientConn.Close()
+		server.Drain()
+	})
+
+	sessionNum++
+	go server.startSession(sessionNum, tls.Server(&mockConn{serverConn}, server.tlsConfig), logger)
+
+	return tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true})
+}
+
+// testTLSConfig returns a server TLS config with a self-signed certificate.
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "inbucket.local"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	require.NoError(t, err)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}},
+	}
+}
+
+// Test DATA acts on BeforeDataAccepted event result.
+func TestBeforeDataAcceptedEvent(t *testing.T) {
+	ds := test.NewStore()
+	extHost := extension.NewHost()
+	server := setupSMTPServer(ds, extHost)
+	server.addrPolicy.Config.SMTP.DefaultStore = true
+
+	var got *event.DataMessage
+	extHost.Events.BeforeDataAccepted.AddListener(
+		"test",
+		func(msg event.DataMessage) *event.SMTPResponse {
+			got = &msg
+			for _, a := range msg.Attachments {
+				if strings.HasSuffix(a.FileName, ".exe") {
+					return &event.SMTPResponse{Action: event.ActionDeny, ErrorCode: 554,
+						ErrorMsg: "5.7.1 Attachment blocked"}
+				}
+			}
+			return nil
+		})
+
+	const badMsg = "From: john@gmail.com\r\n" +
+		"Subject: invoice\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=XYZ\r\n" +
+		"\r\n" +
+		"--XYZ\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Please see attached.\r\n" +
+		"--XYZ\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=invoice.exe\r\n" +
+		"\r\n" +
+		"MZ\r\n" +
+		"--XYZ--\r\n"
+
+	pipe := setupSMTPSession(t, server)
+	c := textproto.NewConn(pipe)
+	_, _, err := c.ReadCodeLine(220)
+	require.NoError(t, err)
+	playScriptAgainst(t, c, []scriptStep{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+	})
+	dw := c.DotWriter()
+	_, _ = io.WriteString(dw, badMsg)
+	_ = dw.Close()
+	_, msg, err := c.ReadCodeLine(554)
+	require.NoError(t, err)
+	assert.Equal(t, "5.7.1 Attachment blocked", msg)
+
+	require.NotNil(t, got, "BeforeDataAccepted listener did not receive DataMessage")
+	assert.Equal(t, "john@gmail.com", got.MailFrom)
+	assert.Equal(t, []string{"u1@gmail.com"}, got.RcptTo)
+	assert.Equal(t, "pipe", got.RemoteAddr)
+	assert.Equal(t, "invoice", got.Subject)
+	assert.Equal(t, []string{"john@gmail.com"}, got.Header["From"])
+	assert.Equal(t, "Please see attached.", strings.TrimSpace(got.Text))
+	assert.Equal(t, []event.AttachmentInfo{
+		{FileName: "invoice.exe", ContentType: "application/octet-stream", Size: 2},
+	}, got.Attachments)
+	assert.Equal(t, int64(len(strings.ReplaceAll(badMsg, "\r\n", "\n"))), got.Size)
+
+	// Session was reset, and accepts a clean message.
+	playScriptAgainst(t, c, []scriptStep{
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"DATA", 354},
+	})
+	dw = c.DotWriter()
+	_, _ = io.WriteString(dw, "Subject: clean\r\n\r\nHi!\r\n")
+	_ = dw.Close()
+	_, _, err = c.ReadCodeLine(250)
+	require.NoError(t, err)
+	playScriptAgainst(t, c, []scriptStep{{"QUIT", 221}})
+
+	msgs, err := ds.GetMessages("u1@gmail.com")
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "clean", msgs[0].Subject())
+}
+
+func TestAfterSMTPSessionClosedEvent(t *testing.T) {
+	ds := test.NewStore()
+	extHost := extension.NewHost()
+	server := setupSMTPServer(ds, extHost)
+	listener := extHost.Events.AfterSMTPSessionClosed.AsyncTestListener("test", 1)
+
+	const msg = "Subject: hi\r\n\r\nHi!\r\n"
+	pipe := setupSMTPSession(t, server)
+	c := textproto.NewConn(pipe)
+	_, _, err := c.ReadCodeLine(220)
+	require.NoError(t, err)
+	playScriptAgainst(t, c, []scriptStep{
+		{"EHLO client.example.com", 250},
+		{"MAIL FROM:<john@gmail.com>", 250},
+		{"RCPT TO:<u1@gmail.com>", 250},
+		{"RCPT TO:<u2@gmail.com>", 250},
+		{"DATA", 354},
+	})
+	dw := c.DotWriter()
+	_, _ = io.WriteString(dw, msg)
+	_ = dw.Close()
+	_, _, err = c.ReadCodeLine(250)
+	require.NoError(t, err)
+	playScriptAgainst(t, c, []scriptStep{{"QUIT", 221}})
+
+	got, err := listener()
+	require.NoError(t, err)
+	assert.Equal(t, "pipe", got.RemoteAddr)
+	assert.Equal(t, "client.example.com", got.Helo)
+	assert.Equal(t, 1, got.Messages)
+	assert.Equal(t, 2, got.Recipients)
+	assert.Equal(t, int64(len(strings.ReplaceAll(msg, "\r\n", "\n"))), got.Bytes)
+	assert.False(t, got.Started.IsZero())
+	assert.Positive(t, got.Duration)
+}
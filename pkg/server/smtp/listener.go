@@ -14,6 +14,7 @@ import (
 	"github.com/inbucket/inbucket/v3/pkg/message"
 	"github.com/inbucket/inbucket/v3/pkg/metric"
 	"github.com/inbucket/inbucket/v3/pkg/policy"
+	"github.com/inbucket/inbucket/v3/pkg/server/proxyproto"
 	"github.com/rs/zerolog/log"
 )
 
@@ -21,9 +22,13 @@ var (
 	// Raw stat collectors
 	expConnectsTotal   = new(expvar.Int)
 	expConnectsCurrent = new(expvar.Int)
+	expConnectsLimited = new(expvar.Int)
+	expMessagesLimited = new(expvar.Int)
+	expRcptsLimited    = new(expvar.Int)
 	expReceivedTotal   = new(expvar.Int)
 	expErrorsTotal     = new(expvar.Int)
 	expWarnsTotal      = new(expvar.Int)
+	expFaultsTotal     = new(expvar.Int)
 
 	// History of certain stats
 	deliveredHist = list.New()
@@ -43,12 +48,16 @@ func init() {
 	m.Set("ConnectsTotal", expConnectsTotal)
 	m.Set("ConnectsHist", expConnectsHist)
 	m.Set("ConnectsCurrent", expConnectsCurrent)
+	m.Set("ConnectsLimitedTotal", expConnectsLimited)
+	m.Set("MessagesLimitedTotal", expMessagesLimited)
+	m.Set("RecipientsLimitedTotal", expRcptsLimited)
 	m.Set("ReceivedTotal", expReceivedTotal)
 	m.Set("ReceivedHist", expReceivedHist)
 	m.Set("ErrorsTotal", expErrorsTotal)
 	m.Set("ErrorsHist", expErrorsHist)
 	m.Set("WarnsTotal", expWarnsTotal)
 	m.Set("WarnsHist", expWarnsHist)
+	m.Set("FaultsTotal", expFaultsTotal)
 	metric.AddTickerFunc(func() {
 		expReceivedHist.Set(metric.Push(deliveredHist, expReceivedTotal))
 		expConnectsHist.Set(metric.Push(connectsHist, expConnectsTotal))
@@ -62,8 +71,12 @@ type Server struct {
 	config     config.SMTP        // SMTP configuration.
 	tlsConfig  *tls.Config        // TLS encryption configuration.
 	addrPolicy *policy.Addressing // Address policy.
+	auth       Authenticator      // Validates AUTH credentials, nil accepts any.
+	faults     *Faults            // Fault injection rules.
+	limits     *limits            // Per-client connection and rate limits.
 	manager    message.Manager    // Used to deliver messages.
 	extHost    *extension.Host    // Extension event processor.
+	lmtp       bool               // Speak LMTP instead of SMTP.
 	listener   net.Listener       // Incoming network connections.
 	wg         *sync.WaitGroup    // Waitgroup tracks individual sessions.
 	notify     chan error         // Notify on fatal error.
@@ -91,9 +104,24 @@ func NewServer(
 		}
 	}
 
+	auth, err := newAuthenticator(smtpConfig)
+	if err != nil {
+		log.Error().Str("module", "smtp").Str("phase", "startup").Err(err).
+			Msg("Failed to load AUTH credentials, all AUTH attempts will be rejected")
+	}
+
+	faults, err := loadFaults(smtpConfig.FaultFile)
+	if err != nil {
+		log.Error().Str("module", "smtp").Str("phase", "startup").Err(err).
+			Msg("Failed to load fault injection rules")
+	}
+
 	return &Server{
 		config:     smtpConfig,
 		tlsConfig:  tlsConfig,
+		auth:       auth,
+		faults:     faults,
+		limits:     newLimits(smtpConfig),
 		manager:    manager,
 		addrPolicy: apolicy,
 		extHost:    extHost,
@@ -102,6 +130,33 @@ func NewServer(
 	}
 }
 
+// NewLMTPServer creates a new, unstarted, LMTP server instance listening on the LMTP address.
+// It shares configuration, credentials and fault injection rules with smtpServer.
+func NewLMTPServer(lmtpConfig config.LMTP, smtpServer *Server) *Server {
+	smtpConfig := smtpServer.config
+	smtpConfig.Addr = lmtpConfig.Addr
+	smtpConfig.ForceTLS = false
+
+	return &Server{
+		config:     smtpConfig,
+		tlsConfig:  smtpServer.tlsConfig,
+		auth:       smtpServer.auth,
+		faults:     smtpServer.faults,
+		limits:     smtpServer.limits,
+		manager:    smtpServer.manager,
+		addrPolicy: smtpServer.addrPolicy,
+		extHost:    smtpServer.extHost,
+		lmtp:       true,
+		wg:         new(sync.WaitGroup),
+		notify:     make(chan error, 1),
+	}
+}
+
+// Faults returns the fault injection rules for this server, which may be modified at runtime.
+func (s *Server) Faults() *Faults {
+	return s.faults
+}
+
 // Start the listener and handle incoming connections.
 func (s *Server) Start(ctx context.Context, readyFunc func()) {
 	slog := log.With().Str("module", "smtp").Str("phase", "startup").Logger()
@@ -112,18 +167,25 @@ func (s *Server) Start(ctx context.Context, readyFunc func()) {
 		close(s.notify)
 		return
 	}
-	slog.Info().Str("addr", addr.String()).Msg("SMTP listening on tcp4")
-	if s.config.ForceTLS {
-		s.listener, err = tls.Listen("tcp4", addr.String(), s.tlsConfig)
-	} else {
-		s.listener, err = net.ListenTCP("tcp4", addr)
+	trusted, err := proxyproto.ParseCIDRs(s.config.ProxyTrusted)
+	if err != nil {
+		slog.Error().Err(err).Msg("Failed to parse PROXY protocol trusted CIDRs")
+		s.notify <- err
+		close(s.notify)
+		return
 	}
+	slog.Info().Str("addr", addr.String()).Msgf("%v listening on tcp4", s.protocol())
+	listener, err := net.ListenTCP("tcp4", addr)
 	if err != nil {
 		slog.Error().Err(err).Msg("Failed to start tcp4 listener")
 		s.notify <- err
 		close(s.notify)
 		return
 	}
+	s.listener = proxyproto.NewListener(listener, trusted)
+	if s.config.ForceTLS {
+		s.listener = tls.NewListener(s.listener, s.tlsConfig)
+	}
 
 	// Start listener go routine.
 	go s.serve(ctx)
@@ -132,11 +194,11 @@ func (s *Server) Start(ctx context.Context, readyFunc func()) {
 	// Wait for shutdown.
 	<-ctx.Done()
 	slog = log.With().Str("module", "smtp").Str("phase", "shutdown").Logger()
-	slog.Debug().Msg("SMTP shutdown requested, connections will be drained")
+	slog.Debug().Msgf("%v shutdown requested, connections will be drained", s.protocol())
 
 	// Closing the listener will cause the serve() go routine to exit.
 	if err := s.listener.Close(); err != nil {
-		slog.Error().Err(err).Msg("Failed to close SMTP listener")
+		slog.Error().Err(err).Msgf("Failed to close %v listener", s.protocol())
 	}
 }
 
@@ -158,7 +220,7 @@ func (s *Server) serve(ctx context.Context) {
 					tempDelay = maxDelay
 				}
 				log.Error().Str("module", "smtp").Err(err).
-					Msgf("SMTP accept timeout; retrying in %v", tempDelay)
+					Msgf("%v accept timeout; retrying in %v", s.protocol(), tempDelay)
 				time.Sleep(tempDelay)
 				continue
 			} else {
@@ -181,6 +243,14 @@ func (s *Server) serve(ctx context.Context) {
 	}
 }
 
+// protocol returns the name of the protocol this server speaks.
+func (s *Server) protocol() string {
+	if s.lmtp {
+		return "LMTP"
+	}
+	return "SMTP"
+}
+
 // Drain causes the caller to block until all active SMTP sessions have finished
 func (s *Server) Drain() {
 	// Wait for sessions to close.
@@ -0,0 +1,164 @@
+package smtp
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/config"
+)
+
+// rateWindow is the period over which message and recipient rates are limited.
+const rateWindow = time.Minute
+
+// limits enforces the per-client connection and rate limits from the SMTP configuration, it is
+// safe for concurrent use.
+type limits struct {
+	connsPerIP int              // Maximum concurrent connections per IP, 0 is unlimited.
+	conns      map[string]int   // Current connections, by IP.
+	mu         sync.Mutex       // Guards conns, and serializes message reservations.
+	msgsIP     *rateCounter     // Messages per minute, by IP.
+	msgsSender *rateCounter     // Messages per minute, by sender address.
+	rcptsIP    *rateCounter     // Recipients per minute, by IP.
+	now        func() time.Time // Clock, replaced by tests.
+}
+
+// newLimits creates limits from the SMTP configuration.
+func newLimits(smtpConfig config.SMTP) *limits {
+	return &limits{
+		connsPerIP: smtpConfig.MaxConnsPerIP,
+		conns:      make(map[string]int),
+		msgsIP:     newRateCounter(smtpConfig.MaxMessagesPerIP),
+		msgsSender: newRateCounter(smtpConfig.MaxMessagesPerSender),
+		rcptsIP:    newRateCounter(smtpConfig.MaxRecipientsPerIP),
+		now:        time.Now,
+	}
+}
+
+// openConn records a new connection from ip, returning false if the IP has reached its limit.  If
+// true is returned, closeConn must be called when the connection ends.
+func (l *limits) openConn(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.connsPerIP > 0 && l.conns[ip] >= l.connsPerIP {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+// closeConn records the end of a connection from ip.
+func (l *limits) closeConn(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip] <= 1 {
+		delete(l.conns, ip)
+		return
+	}
+	l.conns[ip]--
+}
+
+// msgSlot is a message reserved against the rate limits of an IP and sender.
+type msgSlot struct {
+	ip, sender string
+	at         time.Time
+}
+
+// allowMessage reserves a message against ip and sender, returning nil if either has reached its
+// limit.  The reservation is kept once the message is delivered, otherwise it must be returned via
+// releaseMessage.
+func (l *limits) allowMessage(ip, sender string) *msgSlot {
+	slot := &msgSlot{ip: ip, sender: strings.ToLower(sender), at: l.now()}
+	// Hold mu so concurrent transactions cannot both pass one counter and then fail the other.
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.msgsIP.take(slot.ip, slot.at) {
+		return nil
+	}
+	if !l.msgsSender.take(slot.sender, slot.at) {
+		l.msgsIP.release(slot.ip, slot.at)
+		return nil
+	}
+	return slot
+}
+
+// releaseMessage returns a reservation from allowMessage for a message that was not delivered.
+// It does nothing if slot is nil.
+func (l *limits) releaseMessage(slot *msgSlot) {
+	if slot == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgsIP.release(slot.ip, slot.at)
+	l.msgsSender.release(slot.sender, slot.at)
+}
+
+// allowRecipient returns true if ip may add another recipient, and counts it if so.
+func (l *limits) allowRecipient(ip string) bool {
+	return l.rcptsIP.take(ip, l.now())
+}
+
+// rateCounter counts events per key within fixed windows of rateWindow.
+type rateCounter struct {
+	limit   int // Maximum events per window, 0 is unlimited.
+	mu      sync.Mutex
+	windows map[string]*window
+	swept   time.Time // Last time expired windows were removed.
+}
+
+// window holds the event count for a key since start.
+type window struct {
+	start time.Time
+	count int
+}
+
+func newRateCounter(limit int) *rateCounter {
+	return &rateCounter{limit: limit, windows: make(map[string]*window)}
+}
+
+// take counts an event against key and returns true, unless key has reached the limit in the
+// current window.
+func (r *rateCounter) take(key string, now time.Time) bool {
+	if r.limit <= 0 {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w := r.current(key, now)
+	if w.count >= r.limit {
+		return false
+	}
+	w.count++
+	return true
+}
+
+// release uncounts an event taken for key at the given time, if its window is still active.
+func (r *rateCounter) release(key string, at time.Time) {
+	if r.limit <= 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if w := r.windows[key]; w != nil && !at.Before(w.start) && w.count > 0 {
+		w.count--
+	}
+}
+
+// current returns the active window for key, starting a new one if needed.  Caller must hold mu.
+func (r *rateCounter) current(key string, now time.Time) *window {
+	if now.Sub(r.swept) >= rateWindow {
+		for k, w := range r.windows {
+			if now.Sub(w.start) >= rateWindow {
+				delete(r.windows, k)
+			}
+		}
+		r.swept = now
+	}
+	w := r.windows[key]
+	if w == nil || now.Sub(w.start) >= rateWindow {
+		w = &window{start: now}
+		r.windows[key] = w
+	}
+	return w
+}
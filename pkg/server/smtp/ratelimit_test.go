@@ -0,0 +1,111 @@
+package smtp
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimitsConnections(t *testing.T) {
+	l := newLimits(config.SMTP{MaxConnsPerIP: 2})
+	assert.True(t, l.openConn("192.0.2.1"))
+	assert.True(t, l.openConn("192.0.2.1"))
+	assert.False(t, l.openConn("192.0.2.1"), "third connection should be refused")
+	assert.True(t, l.openConn("192.0.2.2"), "other IPs have their own limit")
+
+	l.closeConn("192.0.2.1")
+	assert.True(t, l.openConn("192.0.2.1"), "closed connection should free a slot")
+	l.closeConn("192.0.2.1")
+	l.closeConn("192.0.2.1")
+	l.closeConn("192.0.2.2")
+	assert.Empty(t, l.conns, "closed IPs should be forgotten")
+
+	unlimited := newLimits(config.SMTP{})
+	for range 100 {
+		assert.True(t, unlimited.openConn("192.0.2.1"))
+	}
+}
+
+func TestLimitsMessages(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newLimits(config.SMTP{MaxMessagesPerIP: 3, MaxMessagesPerSender: 2})
+	l.now = func() time.Time { return now }
+
+	assert.NotNil(t, l.allowMessage("192.0.2.1", "a@example.com"))
+	assert.NotNil(t, l.allowMessage("192.0.2.1", "A@Example.com"))
+	assert.Nil(t, l.allowMessage("192.0.2.1", "a@example.com"), "sender limit is case insensitive")
+	assert.NotNil(t, l.allowMessage("192.0.2.1", "b@example.com"))
+	assert.Nil(t, l.allowMessage("192.0.2.1", "c@example.com"), "IP limit reached")
+	assert.Nil(t, l.allowMessage("192.0.2.2", "a@example.com"), "sender limit spans IPs")
+	assert.NotNil(t, l.allowMessage("192.0.2.2", "c@example.com"))
+
+	// Limits reset after the window.
+	now = now.Add(rateWindow)
+	assert.NotNil(t, l.allowMessage("192.0.2.1", "a@example.com"))
+}
+
+func TestLimitsMessageRelease(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newLimits(config.SMTP{MaxMessagesPerIP: 2, MaxMessagesPerSender: 1})
+	l.now = func() time.Time { return now }
+
+	slot := l.allowMessage("192.0.2.1", "a@example.com")
+	assert.NotNil(t, slot)
+	assert.Nil(t, l.allowMessage("192.0.2.1", "a@example.com"))
+	assert.NotNil(t, l.allowMessage("192.0.2.1", "b@example.com"))
+	assert.Nil(t, l.allowMessage("192.0.2.1", "c@example.com"))
+
+	l.releaseMessage(slot)
+	assert.NotNil(t, l.allowMessage("192.0.2.1", "a@example.com"), "released slot should be reusable")
+
+	// A sender refusal must not consume the IP slot.
+	l = newLimits(config.SMTP{MaxMessagesPerIP: 1, MaxMessagesPerSender: 1})
+	l.now = func() time.Time { return now }
+	assert.NotNil(t, l.allowMessage("192.0.2.1", "a@example.com"))
+	assert.Nil(t, l.allowMessage("192.0.2.2", "a@example.com"))
+	assert.NotNil(t, l.allowMessage("192.0.2.2", "b@example.com"))
+
+	// Releasing a slot from an expired window leaves the new window alone.
+	slot = l.allowMessage("192.0.2.3", "c@example.com")
+	now = now.Add(rateWindow)
+	assert.NotNil(t, l.allowMessage("192.0.2.3", "d@example.com"))
+	l.releaseMessage(slot)
+	assert.Nil(t, l.allowMessage("192.0.2.3", "e@example.com"))
+	l.releaseMessage(nil)
+}
+
+func TestLimitsMessagesConcurrent(t *testing.T) {
+	l := newLimits(config.SMTP{MaxMessagesPerIP: 5})
+	var wg sync.WaitGroup
+	var allowed atomic.Int32
+	for range 50 {
+		wg.Go(func() {
+			if l.allowMessage("192.0.2.1", "a@example.com") != nil {
+				allowed.Add(1)
+			}
+		})
+	}
+	wg.Wait()
+	assert.Equal(t, int32(5), allowed.Load())
+}
+
+func TestLimitsRecipients(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newLimits(config.SMTP{MaxRecipientsPerIP: 2})
+	l.now = func() time.Time { return now }
+
+	assert.True(t, l.allowRecipient("192.0.2.1"))
+	assert.True(t, l.allowRecipient("192.0.2.1"))
+	assert.False(t, l.allowRecipient("192.0.2.1"))
+	assert.True(t, l.allowRecipient("192.0.2.2"))
+
+	now = now.Add(rateWindow - time.Second)
+	assert.False(t, l.allowRecipient("192.0.2.1"), "window has not expired")
+	now = now.Add(time.Second)
+	assert.True(t, l.allowRecipient("192.0.2.1"), "window has expired")
+	assert.Len(t, l.rcptsIP.windows, 1, "expired windows should be swept")
+}
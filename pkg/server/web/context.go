@@ -8,6 +8,9 @@ import (
 	"github.com/inbucket/inbucket/v3/pkg/config"
 	"github.com/inbucket/inbucket/v3/pkg/message"
 	"github.com/inbucket/inbucket/v3/pkg/msghub"
+	"github.com/inbucket/inbucket/v3/pkg/relay"
+	"github.com/inbucket/inbucket/v3/pkg/server/smtp"
+	"github.com/inbucket/inbucket/v3/pkg/webhook"
 )
 
 // Context is passed into every request handler function
@@ -16,6 +19,9 @@ type Context struct {
 	Vars       map[string]string
 	MsgHub     *msghub.Hub
 	Manager    message.Manager
+	SMTPFaults *smtp.Faults
+	Relay      *relay.Relay        // nil when no relay targets are configured.
+	Webhooks   *webhook.Dispatcher // nil when no webhook URLs are configured.
 	RootConfig *config.Root
 	WebConfig  config.Web
 	IsJSON     bool
@@ -50,6 +56,9 @@ func NewContext(req *http.Request) (*Context, error) {
 		Vars:       vars,
 		MsgHub:     msgHub,
 		Manager:    manager,
+		SMTPFaults: smtpFaults,
+		Relay:      msgRelay,
+		Webhooks:   webhooks,
 		RootConfig: rootConfig,
 		WebConfig:  rootConfig.Web,
 		IsJSON:     headerMatch(req, "Accept", "application/json"),
@@ -18,14 +18,21 @@ import (
 	"github.com/inbucket/inbucket/v3/pkg/config"
 	"github.com/inbucket/inbucket/v3/pkg/message"
 	"github.com/inbucket/inbucket/v3/pkg/msghub"
+	"github.com/inbucket/inbucket/v3/pkg/relay"
+	"github.com/inbucket/inbucket/v3/pkg/server/proxyproto"
+	"github.com/inbucket/inbucket/v3/pkg/server/smtp"
 	"github.com/inbucket/inbucket/v3/pkg/stringutil"
+	"github.com/inbucket/inbucket/v3/pkg/webhook"
 	"github.com/rs/zerolog/log"
 )
 
 var (
 	// msgHub holds a reference to the message pub/sub system
-	msgHub  *msghub.Hub
-	manager message.Manager
+	msgHub     *msghub.Hub
+	manager    message.Manager
+	smtpFaults *smtp.Faults
+	msgRelay   *relay.Relay
+	webhooks   *webhook.Dispatcher
 
 	// Router is shared between httpd, webui and rest packages. It sends
 	// incoming requests to the correct handler function
@@ -51,12 +58,22 @@ type Server struct {
 }
 
 // NewServer sets up things for unit tests or the Start() method.
-func NewServer(conf *config.Root, mm message.Manager, mh *msghub.Hub) *Server {
+func NewServer(
+	conf *config.Root,
+	mm message.Manager,
+	mh *msghub.Hub,
+	faults *smtp.Faults,
+	rl *relay.Relay,
+	wh *webhook.Dispatcher,
+) *Server {
 	rootConfig = conf
 
 	// NewContext() will use this DataStore for the web handlers.
 	msgHub = mh
 	manager = mm
+	smtpFaults = faults
+	msgRelay = rl
+	webhooks = wh
 
 	// Redirect requests to / if there is a base path configured.
 	prefix := stringutil.MakePathPrefixer(conf.Web.BasePath)
@@ -142,6 +159,15 @@ func (s *Server) Start(ctx context.Context, readyFunc func()) {
 		WriteTimeout: 60 * time.Second,
 	}
 
+	trusted, err := proxyproto.ParseCIDRs(rootConfig.Web.ProxyTrusted)
+	if err != nil {
+		log.Error().Str("module", "web").Str("phase", "startup").Err(err).
+			Msg("HTTP failed to parse PROXY protocol trusted CIDRs")
+		s.notify <- err
+		close(s.notify)
+		return
+	}
+
 	// We don't use ListenAndServe because it lacks a way to close the listener
 	log.Info().Str("module", "web").Str("phase", "startup").Str("addr", server.Addr).
 		Msg("HTTP listening on tcp4")
@@ -157,6 +183,7 @@ func (s *Server) Start(ctx context.Context, readyFunc func()) {
 		close(s.notify)
 		return
 	}
+	listener = proxyproto.NewListener(listener, trusted)
 
 	// Start listener go routine
 	go s.serve(ctx)
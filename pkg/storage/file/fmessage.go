@@ -7,6 +7,8 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"github.com/inbucket/inbucket/v3/pkg/message"
 	"github.com/rs/zerolog/log"
 )
 
@@ -22,6 +24,8 @@ type Message struct {
 	Fsubject string
 	Fsize    int64
 	Fseen    bool
+	Fsession *event.SessionInfo
+	Fauth    []event.AuthResult
 }
 
 // newMessage creates a new FileMessage object and sets the Date and ID fields.
@@ -33,15 +37,20 @@ func (mb *mbox) newMessage() (*Message, error) {
 			return nil, err
 		}
 	}
-	// Delete old messages over messageCap
+	// Delete old messages over messageCap, skipping those extensions refuse to delete.
 	if mb.store.messageCap > 0 {
-		for len(mb.messages) >= mb.store.messageCap {
+		for i := 0; i < len(mb.messages) && len(mb.messages) >= mb.store.messageCap; {
+			m := mb.messages[i]
+			if message.DeleteDenied(mb.store.extHost, message.MakeMetadata(m)) != nil {
+				i++
+				continue
+			}
 			log.Info().Str("module", "storage").Str("mailbox", mb.name).
 				Msg("Mailbox over message cap")
-			id := mb.messages[0].ID()
-			if err := mb.removeMessage(id); err != nil {
-				log.Error().Str("module", "storage").Str("mailbox", mb.name).Str("id", id).
+			if err := mb.removeMessage(m.ID()); err != nil {
+				log.Error().Str("module", "storage").Str("mailbox", mb.name).Str("id", m.ID()).
 					Err(err).Msg("Unable to delete message")
+				break
 			}
 		}
 	}
@@ -102,3 +111,13 @@ func (m *Message) Source() (reader io.ReadCloser, err error) {
 func (m *Message) Seen() bool {
 	return m.Fseen
 }
+
+// Session returns the SMTP session details the Message was received with
+func (m *Message) Session() *event.SessionInfo {
+	return m.Fsession
+}
+
+// AuthResults returns the authentication results recorded when the Message was delivered
+func (m *Message) AuthResults() []event.AuthResult {
+	return m.Fauth
+}
@@ -23,14 +23,17 @@ func (s *Store) maxSizeEnforcer(maxSize int64) {
 			el := all.PushBack(m)
 			m.el = el
 			curSize += int64(m.Size())
-			for curSize > maxSize {
-				// Remove oldest message.
-				el := all.Front()
-				all.Remove(el)
+			// Remove oldest messages, keeping those extensions refuse to delete.
+			for el := all.Front(); el != nil && curSize > maxSize; {
+				next := el.Next()
 				m := el.Value.(*Message)
-				if s.removeMessage(m.mailbox, m.id) != nil {
-					curSize -= int64(m.Size())
+				if !s.deleteDenied(m) {
+					all.Remove(el)
+					if s.removeMessage(m.mailbox, m.id) != nil {
+						curSize -= int64(m.Size())
+					}
 				}
+				el = next
 			}
 			close(md.done)
 		case md, ok := <-s.remove:
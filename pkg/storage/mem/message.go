@@ -7,6 +7,7 @@ import (
 	"net/mail"
 	"time"
 
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
 	"github.com/inbucket/inbucket/v3/pkg/storage"
 )
 
@@ -21,6 +22,8 @@ type Message struct {
 	subject string
 	source  []byte
 	seen    bool
+	session *event.SessionInfo
+	auth    []event.AuthResult
 	el      *list.Element // This message in Store.messages
 }
 
@@ -54,3 +57,9 @@ func (m *Message) Size() int64 { return int64(len(m.source)) }
 
 // Seen returns the message seen flag.
 func (m *Message) Seen() bool { return m.seen }
+
+// Session returns the SMTP session details the message was received with.
+func (m *Message) Session() *event.SessionInfo { return m.session }
+
+// AuthResults returns the authentication results recorded on delivery.
+func (m *Message) AuthResults() []event.AuthResult { return m.auth }
@@ -18,6 +18,7 @@ type Store struct {
 	sync.Mutex
 	boxes    map[string]*mbox
 	cap      int           // Per-mailbox message cap.
+	capMu    sync.Mutex    // Serializes deliveries while the cap is enforced.
 	incoming chan *msgDone // New messages for size enforcer.
 	remove   chan *msgDone // Remove deleted messages from size enforcer.
 	extHost  *extension.Host
@@ -27,7 +28,6 @@ type mbox struct {
 	sync.RWMutex
 	name     string
 	last     int
-	first    int
 	messages map[string]*Message
 }
 
@@ -73,6 +73,12 @@ func (s *Store) AddMessage(message storage.Message) (id string, err error) {
 		to:      message.To(),
 		date:    message.Date(),
 		subject: message.Subject(),
+		session: message.Session(),
+		auth:    message.AuthResults(),
+	}
+	if s.cap > 0 {
+		s.capMu.Lock()
+		defer s.capMu.Unlock()
 	}
 	s.withMailbox(message.Mailbox(), true, func(mb *mbox) {
 		// Generate message ID.
@@ -82,19 +88,39 @@ func (s *Store) AddMessage(message storage.Message) (id string, err error) {
 		m.id = id
 		m.source = source
 		mb.messages[id] = m
-
-		if s.cap > 0 {
-			// Enforce cap.
-			for len(mb.messages) > s.cap {
-				delete(mb.messages, strconv.Itoa(mb.first))
-				mb.first++
-			}
-		}
 	})
 	s.enforcerDeliver(m)
+	if s.cap > 0 {
+		s.enforceCap(m)
+	}
 	return id, err
 }
 
+// enforceCap removes the oldest messages from the mailbox of newest until it is within the cap,
+// skipping messages extensions refuse to delete.  Caller must hold capMu.
+func (s *Store) enforceCap(newest *Message) {
+	msgs, _ := s.GetMessages(newest.mailbox)
+	over := len(msgs) - s.cap
+	for _, sm := range msgs {
+		m := sm.(*Message)
+		if over <= 0 || m == newest {
+			break
+		}
+		if s.deleteDenied(m) {
+			continue
+		}
+		if s.removeMessage(m.mailbox, m.id) != nil {
+			s.enforcerRemove(m)
+			over--
+		}
+	}
+}
+
+// deleteDenied returns true if an extension refused the deletion of m.
+func (s *Store) deleteDenied(m *Message) bool {
+	return message.DeleteDenied(s.extHost, message.MakeMetadata(m)) != nil
+}
+
 // GetMessage gets a mesage.
 func (s *Store) GetMessage(mailbox, id string) (m storage.Message, err error) {
 	if id == "latest" {
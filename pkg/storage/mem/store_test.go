@@ -7,6 +7,7 @@ import (
 
 	"github.com/inbucket/inbucket/v3/pkg/config"
 	"github.com/inbucket/inbucket/v3/pkg/extension"
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
 	"github.com/inbucket/inbucket/v3/pkg/storage"
 	"github.com/inbucket/inbucket/v3/pkg/test"
 	"github.com/stretchr/testify/require"
@@ -94,3 +95,26 @@ func TestMaxSize(t *testing.T) {
 		t.Errorf("Got %v total messages, want: %v", count, 0)
 	}
 }
+
+// TestMaxSizeDenied verifies the size limit keeps messages extensions refuse to delete.
+func TestMaxSizeDenied(t *testing.T) {
+	extHost := extension.NewHost()
+	extHost.Events.BeforeMessageDeleted.AddListener("test",
+		func(msg event.MessageMetadata) *event.DeleteResponse {
+			if msg.Subject == "pinned" {
+				return &event.DeleteResponse{Action: event.ActionDeny}
+			}
+			return nil
+		})
+	s, _ := New(config.Storage{Params: map[string]string{"maxkb": "1"}}, extHost)
+
+	test.DeliverToStore(t, s, "alpha", "pinned", time.Now())
+	for range 30 {
+		test.DeliverToStore(t, s, "alpha", "subject", time.Now())
+	}
+
+	msgs, err := s.GetMessages("alpha")
+	require.NoError(t, err)
+	require.Less(t, len(msgs), 31, "size limit should remove messages")
+	require.Equal(t, "pinned", msgs[0].Subject())
+}
@@ -55,18 +55,22 @@ type RetentionScanner struct {
 	ds                Store
 	retentionPeriod   time.Duration
 	retentionSleep    time.Duration
+	denied            func(Message) bool // Returns true if deleting the message was vetoed.
 }
 
-// NewRetentionScanner configures a new RententionScanner.
+// NewRetentionScanner configures a new RententionScanner.  Expired messages are only deleted if
+// denied, which may be nil, returns false for them.
 func NewRetentionScanner(
 	cfg config.Storage,
 	ds Store,
+	denied func(Message) bool,
 ) *RetentionScanner {
 	rs := &RetentionScanner{
 		retentionShutdown: make(chan bool),
 		ds:                ds,
 		retentionPeriod:   cfg.RetentionPeriod,
 		retentionSleep:    cfg.RetentionSleep,
+		denied:            denied,
 	}
 	// expRetentionPeriod is displayed on the status page
 	expRetentionPeriod.Set(int64(cfg.RetentionPeriod / time.Second))
@@ -119,13 +123,16 @@ func (rs *RetentionScanner) DoScan(ctx context.Context) error {
 	slog := log.With().Str("module", "storage").Logger()
 	slog.Debug().Msg("Starting retention scan")
 	cutoff := time.Now().Add(-1 * rs.retentionPeriod)
+	if ex, ok := rs.ds.(Expirer); ok {
+		return rs.expire(ex, cutoff)
+	}
 
 	// Loop over all mailboxes.
 	retained := 0
 	storeSize := int64(0)
 	err := rs.ds.VisitMailboxes(func(messages []Message) bool {
 		for _, msg := range messages {
-			if msg.Date().Before(cutoff) {
+			if msg.Date().Before(cutoff) && (rs.denied == nil || !rs.denied(msg)) {
 				slog.Debug().Str("mailbox", msg.Mailbox()).
 					Msgf("Purging expired message %v", msg.ID())
 				if err := rs.ds.RemoveMessage(msg.Mailbox(), msg.ID()); err != nil {
@@ -160,6 +167,26 @@ func (rs *RetentionScanner) DoScan(ctx context.Context) error {
 	return nil
 }
 
+// expire removes messages older than cutoff from a store implementing Expirer.
+func (rs *RetentionScanner) expire(ex Expirer, cutoff time.Time) error {
+	removed, err := ex.RemoveMessagesBefore(cutoff, rs.denied)
+	if err != nil {
+		return err
+	}
+	expRetentionDeletesTotal.Add(removed)
+	count, size, err := ex.Usage()
+	if err != nil {
+		return err
+	}
+
+	// Update metrics
+	scanCompletedMillis.Set(time.Now().UnixNano() / 1000000)
+	expRetainedCurrent.Set(count)
+	expRetainedSize.Set(size)
+
+	return nil
+}
+
 // Join does not return until the retention scanner has shut down.
 func (rs *RetentionScanner) Join() {
 	if rs.retentionShutdown != nil {
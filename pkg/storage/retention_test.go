@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/inbucket/inbucket/v3/pkg/config"
+	"github.com/inbucket/inbucket/v3/pkg/extension"
 	"github.com/inbucket/inbucket/v3/pkg/extension/event"
 	"github.com/inbucket/inbucket/v3/pkg/message"
 	"github.com/inbucket/inbucket/v3/pkg/storage"
@@ -37,7 +38,7 @@ func TestDoRetentionScan(t *testing.T) {
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	rs := storage.NewRetentionScanner(cfg, ds)
+	rs := storage.NewRetentionScanner(cfg, ds, nil)
 	if err := rs.DoScan(ctx); err != nil {
 		t.Error(err)
 	}
@@ -57,6 +58,88 @@ func TestDoRetentionScan(t *testing.T) {
 	}
 }
 
+func TestDoRetentionScanDenied(t *testing.T) {
+	ds := test.NewStore()
+	extHost := extension.NewHost()
+	extHost.Events.BeforeMessageDeleted.AddListener("test",
+		func(msg event.MessageMetadata) *event.DeleteResponse {
+			if msg.Mailbox == "pinned" {
+				return &event.DeleteResponse{Action: event.ActionDeny, Reason: "pinned"}
+			}
+			return nil
+		})
+	pinned := stubMessage("pinned", 12)
+	old := stubMessage("mb1", 12)
+	_, _ = ds.AddMessage(pinned)
+	_, _ = ds.AddMessage(old)
+
+	cfg := config.Storage{
+		RetentionPeriod: time.Hour,
+		RetentionSleep:  0,
+	}
+	rs := storage.NewRetentionScanner(cfg, ds, func(m storage.Message) bool {
+		return message.DeleteDenied(extHost, message.MakeMetadata(m)) != nil
+	})
+	if err := rs.DoScan(context.Background()); err != nil {
+		t.Error(err)
+	}
+
+	if ds.MessageDeleted(pinned) {
+		t.Errorf("Expected %v to be present, deletion was denied", pinned.ID())
+	}
+	if !ds.MessageDeleted(old) {
+		t.Errorf("Expected %v to be deleted, was present", old.ID())
+	}
+}
+
+// expirerStub records calls to the storage.Expirer methods.
+type expirerStub struct {
+	*test.StoreStub
+	cutoff time.Time
+	denied func(storage.Message) bool
+}
+
+func (s *expirerStub) RemoveMessagesBefore(
+	cutoff time.Time,
+	denied func(storage.Message) bool,
+) (int64, error) {
+	s.cutoff = cutoff
+	s.denied = denied
+	return 2, nil
+}
+
+func (s *expirerStub) Usage() (count, size int64, err error) {
+	return 1, 100, nil
+}
+
+func TestDoRetentionScanExpirer(t *testing.T) {
+	ds := &expirerStub{StoreStub: test.NewStore()}
+	old := stubMessage("mb1", 12)
+	_, _ = ds.AddMessage(old)
+
+	cfg := config.Storage{
+		RetentionPeriod: time.Hour,
+		RetentionSleep:  0,
+	}
+	rs := storage.NewRetentionScanner(cfg, ds, func(storage.Message) bool { return true })
+	start := time.Now()
+	if err := rs.DoScan(context.Background()); err != nil {
+		t.Error(err)
+	}
+
+	// Expirer should be used in place of visiting mailboxes.
+	if ds.MessageDeleted(old) {
+		t.Error("Expected RemoveMessage not to be called")
+	}
+	want := start.Add(-time.Hour)
+	if ds.cutoff.Before(want) || ds.cutoff.After(time.Now().Add(-time.Hour)) {
+		t.Errorf("Got cutoff %v, want about %v", ds.cutoff, want)
+	}
+	if ds.denied == nil || !ds.denied(old) {
+		t.Error("Expected the veto check to be passed to the Expirer")
+	}
+}
+
 // stubMessage creates a message stub of a specific age
 func stubMessage(mailbox string, ageHours int) storage.Message {
 	return &message.Delivery{
@@ -0,0 +1,74 @@
+package sqlite
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"io"
+	"net/mail"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"github.com/inbucket/inbucket/v3/pkg/storage"
+)
+
+// Message is a SQLite store message.  The source is read from the database on request.
+type Message struct {
+	store   *Store
+	seq     int64
+	mailbox string
+	id      string
+	from    *mail.Address
+	to      []*mail.Address
+	date    time.Time
+	subject string
+	size    int64
+	seen    bool
+	session *event.SessionInfo
+	auth    []event.AuthResult
+}
+
+var _ storage.Message = &Message{}
+
+// Mailbox returns the mailbox name.
+func (m *Message) Mailbox() string { return m.mailbox }
+
+// ID the message ID.
+func (m *Message) ID() string { return m.id }
+
+// From returns the from address.
+func (m *Message) From() *mail.Address { return m.from }
+
+// To returns the to address list.
+func (m *Message) To() []*mail.Address { return m.to }
+
+// Date returns the date received.
+func (m *Message) Date() time.Time { return m.date }
+
+// Subject returns the subject line.
+func (m *Message) Subject() string { return m.subject }
+
+// Source returns a reader for the message source.
+func (m *Message) Source() (io.ReadCloser, error) {
+	var data []byte
+	err := m.store.db.QueryRow(`SELECT data FROM sources WHERE id = ?`, m.seq).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Size returns the message size in bytes.
+func (m *Message) Size() int64 { return m.size }
+
+// Seen returns the message seen flag.
+func (m *Message) Seen() bool { return m.seen }
+
+// Session returns the SMTP session details the message was received with.
+func (m *Message) Session() *event.SessionInfo { return m.session }
+
+// AuthResults returns the authentication results recorded on delivery.
+func (m *Message) AuthResults() []event.AuthResult { return m.auth }
@@ -0,0 +1,64 @@
+package sqlite
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/inbucket/inbucket/v3/pkg/storage"
+)
+
+// where returns the SQL condition and arguments selecting the messages matched by q.
+func where(q storage.Query) (string, []any) {
+	conds := []string{"1"}
+	var args []any
+	like := func(s string) string {
+		r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+		return "%" + r.Replace(s) + "%"
+	}
+	if q.Mailbox != "" {
+		conds = append(conds, "mailbox = ?")
+		args = append(args, q.Mailbox)
+	}
+	if q.From != "" {
+		conds = append(conds, `(from_name LIKE ? ESCAPE '\' OR from_address LIKE ? ESCAPE '\')`)
+		args = append(args, like(q.From), like(q.From))
+	}
+	if q.To != "" {
+		conds = append(conds, `to_text LIKE ? ESCAPE '\'`)
+		args = append(args, like(q.To))
+	}
+	if q.Subject != "" {
+		conds = append(conds, `subject LIKE ? ESCAPE '\'`)
+		args = append(args, like(q.Subject))
+	}
+	if q.Seen != nil {
+		conds = append(conds, "seen = ?")
+		args = append(args, *q.Seen)
+	}
+	if !q.After.IsZero() {
+		conds = append(conds, "date > ?")
+		args = append(args, q.After.UnixNano())
+	}
+	if !q.Before.IsZero() {
+		conds = append(conds, "date < ?")
+		args = append(args, q.Before.UnixNano())
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// Find returns the messages matching q from all mailboxes, in delivery order.
+func (s *Store) Find(q storage.Query) ([]storage.Message, error) {
+	where, args := where(q)
+	query := `SELECT ` + columns + ` FROM messages WHERE ` + where + ` ORDER BY id`
+	if q.Limit > 0 {
+		query += ` LIMIT ` + strconv.Itoa(q.Limit)
+	}
+	return s.query(query, args...)
+}
+
+// Count returns the number of messages matching q from all mailboxes, ignoring q.Limit.
+func (s *Store) Count(q storage.Query) (count int64, err error) {
+	where, args := where(q)
+	err = s.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE `+where, args...).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,461 @@
+// Package sqlite implements a message store in a SQLite database, holding message metadata in
+// indexed tables and raw message sources as blobs.  It uses a pure Go driver, so does not require
+// cgo.
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/config"
+	"github.com/inbucket/inbucket/v3/pkg/extension"
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"github.com/inbucket/inbucket/v3/pkg/message"
+	"github.com/inbucket/inbucket/v3/pkg/storage"
+	"github.com/inbucket/inbucket/v3/pkg/stringutil"
+	"github.com/rs/zerolog/log"
+
+	// Registers the "sqlite" database/sql driver.
+	_ "modernc.org/sqlite"
+)
+
+// schema creates the database tables.  Message IDs are never reused, and sources are stored
+// separately so that metadata queries do not page in message content.  Recipients are stored as
+// JSON to reconstruct messages, and as UTF-8 text, one address per line, for searching.
+const schema = `
+CREATE TABLE IF NOT EXISTS messages (
+	id           INTEGER PRIMARY KEY AUTOINCREMENT,
+	mailbox      TEXT    NOT NULL,
+	from_name    TEXT,
+	from_address TEXT,
+	recipients   TEXT    NOT NULL,
+	to_text      TEXT    NOT NULL,
+	date         INTEGER NOT NULL,
+	subject      TEXT    NOT NULL,
+	size         INTEGER NOT NULL,
+	seen         INTEGER NOT NULL DEFAULT 0,
+	session      TEXT,
+	auth_results TEXT
+);
+CREATE INDEX IF NOT EXISTS messages_mailbox ON messages (mailbox, id);
+CREATE INDEX IF NOT EXISTS messages_date ON messages (date);
+CREATE TABLE IF NOT EXISTS sources (
+	id   INTEGER PRIMARY KEY REFERENCES messages (id) ON DELETE CASCADE,
+	data BLOB    NOT NULL
+);
+`
+
+// columns lists the messages table columns read by scanMessage.
+const columns = `id, mailbox, from_name, from_address, recipients, date, subject, size, seen,
+	session, auth_results`
+
+// Store implements storage.Store in a SQLite database.
+type Store struct {
+	db         *sql.DB
+	messageCap int
+	capMu      sync.Mutex // Serializes message cap enforcement.
+	extHost    *extension.Host
+}
+
+var _ storage.Store = &Store{}
+var _ storage.Expirer = &Store{}
+var _ storage.Searcher = &Store{}
+
+// New opens or creates the SQLite database specified by the `path` parameter.
+func New(cfg config.Storage, extHost *extension.Host) (storage.Store, error) {
+	path := cfg.Params["path"]
+	if path == "" {
+		return nil, errors.New("'path' parameter not specified")
+	}
+	// Support Windows drive letters, as for the file store.
+	path = strings.ReplaceAll(path, "$", ":")
+	if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+		log.Error().Str("module", "storage").Str("path", path).Err(err).
+			Msg("Error creating dir")
+		return nil, err
+	}
+
+	// Immediate transactions avoid deadlocks between concurrent writers upgrading read locks.
+	dsn := path + "?_txlock=immediate&_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)" +
+		"&_pragma=foreign_keys(1)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to create sqlite schema in %q: %w", path, err)
+	}
+
+	return &Store{
+		db:         db,
+		messageCap: cfg.MailboxMsgCap,
+		extHost:    extHost,
+	}, nil
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// AddMessage stores the message, message ID and Size will be ignored.
+func (s *Store) AddMessage(m storage.Message) (id string, err error) {
+	r, err := m.Source()
+	if err != nil {
+		return "", err
+	}
+	source, err := io.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return "", err
+	}
+	var fromName, fromAddress sql.NullString
+	if from := m.From(); from != nil {
+		fromName = sql.NullString{String: from.Name, Valid: true}
+		fromAddress = sql.NullString{String: from.Address, Valid: true}
+	}
+	to := m.To()
+	if to == nil {
+		to = []*mail.Address{}
+	}
+	recipients, err := json.Marshal(to)
+	if err != nil {
+		return "", err
+	}
+	session, err := encodeNullable(m.Session(), m.Session() == nil)
+	if err != nil {
+		return "", err
+	}
+	auth, err := encodeNullable(m.AuthResults(), len(m.AuthResults()) == 0)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec(`INSERT INTO messages (mailbox, from_name, from_address, recipients,
+		to_text, date, subject, size, seen, session, auth_results)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		m.Mailbox(), fromName, fromAddress, string(recipients),
+		strings.Join(stringutil.StringAddressList(to), "\n"), m.Date().UnixNano(), m.Subject(),
+		len(source), false, session, auth)
+	if err != nil {
+		return "", err
+	}
+	seq, err := res.LastInsertId()
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`INSERT INTO sources (id, data) VALUES (?, ?)`, seq, source); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	if s.messageCap > 0 {
+		if err := s.enforceCap(m.Mailbox(), seq); err != nil {
+			log.Error().Str("module", "storage").Str("mailbox", m.Mailbox()).Err(err).
+				Msg("Failed to enforce message cap")
+		}
+	}
+
+	return strconv.FormatInt(seq, 10), nil
+}
+
+// GetMessage returns the specified message, or the most recent message in the mailbox if id is
+// `latest`.
+func (s *Store) GetMessage(mailbox, id string) (storage.Message, error) {
+	var row *sql.Row
+	if id == "latest" {
+		row = s.db.QueryRow(`SELECT `+columns+` FROM messages WHERE mailbox = ?
+			ORDER BY id DESC LIMIT 1`, mailbox)
+	} else {
+		seq, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return nil, storage.ErrNotExist
+		}
+		row = s.db.QueryRow(`SELECT `+columns+` FROM messages WHERE mailbox = ? AND id = ?`,
+			mailbox, seq)
+	}
+	m, err := s.scanMessage(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// GetMessages returns the messages in the mailbox, in delivery order.
+func (s *Store) GetMessages(mailbox string) ([]storage.Message, error) {
+	return s.query(`SELECT `+columns+` FROM messages WHERE mailbox = ? ORDER BY id`, mailbox)
+}
+
+// MarkSeen flags the message as having been read.
+func (s *Store) MarkSeen(mailbox, id string) error {
+	seq, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return storage.ErrNotExist
+	}
+	res, err := s.db.Exec(`UPDATE messages SET seen = 1 WHERE mailbox = ? AND id = ?`,
+		mailbox, seq)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return storage.ErrNotExist
+	}
+	return nil
+}
+
+// PurgeMessages deletes all messages in the named mailbox.
+func (s *Store) PurgeMessages(mailbox string) error {
+	removed, err := s.deleteWhere(s.db, `mailbox = ?`, mailbox)
+	if err != nil {
+		return err
+	}
+	s.emitDeleted(removed)
+	return nil
+}
+
+// RemoveMessage deletes a message by ID from the specified mailbox.
+func (s *Store) RemoveMessage(mailbox, id string) error {
+	seq, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return storage.ErrNotExist
+	}
+	removed, err := s.deleteWhere(s.db, `mailbox = ? AND id = ?`, mailbox, seq)
+	if err != nil {
+		return err
+	}
+	if len(removed) == 0 {
+		return storage.ErrNotExist
+	}
+	s.emitDeleted(removed)
+	return nil
+}
+
+// VisitMailboxes accepts a function that will be called with the messages in each mailbox while it
+// continues to return true.
+func (s *Store) VisitMailboxes(f func([]storage.Message) (cont bool)) error {
+	rows, err := s.db.Query(`SELECT DISTINCT mailbox FROM messages ORDER BY mailbox`)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		msgs, err := s.GetMessages(name)
+		if err != nil {
+			return err
+		}
+		if !f(msgs) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// RemoveMessagesBefore deletes messages from all mailboxes dated before cutoff, returning the
+// number removed.  Messages for which denied returns true are kept.
+func (s *Store) RemoveMessagesBefore(
+	cutoff time.Time,
+	denied func(storage.Message) bool,
+) (int64, error) {
+	kept := []int64{}
+	if denied != nil {
+		expired, err := s.query(`SELECT `+columns+` FROM messages WHERE date < ?`,
+			cutoff.UnixNano())
+		if err != nil {
+			return 0, err
+		}
+		for _, m := range expired {
+			if denied(m) {
+				kept = append(kept, m.(*Message).seq)
+			}
+		}
+	}
+	keep, err := json.Marshal(kept)
+	if err != nil {
+		return 0, err
+	}
+	removed, err := s.deleteWhere(s.db,
+		`date < ? AND id NOT IN (SELECT value FROM json_each(?))`, cutoff.UnixNano(), string(keep))
+	if err != nil {
+		return 0, err
+	}
+	s.emitDeleted(removed)
+	return int64(len(removed)), nil
+}
+
+// enforceCap deletes the oldest messages in mailbox, excluding the newest message with ID seq,
+// until it is within messageCap.  Messages extensions refuse to delete are skipped.
+func (s *Store) enforceCap(mailbox string, seq int64) error {
+	s.capMu.Lock()
+	defer s.capMu.Unlock()
+
+	var count int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE mailbox = ?`, mailbox).Scan(&count)
+	if err != nil || count <= s.messageCap {
+		return err
+	}
+	log.Info().Str("module", "storage").Str("mailbox", mailbox).Msg("Mailbox over message cap")
+	msgs, err := s.query(`SELECT `+columns+` FROM messages WHERE mailbox = ? AND id < ?
+		ORDER BY id`, mailbox, seq)
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		if count <= s.messageCap {
+			break
+		}
+		if message.DeleteDenied(s.extHost, message.MakeMetadata(m)) != nil {
+			continue
+		}
+		removed, err := s.deleteWhere(s.db, `id = ?`, m.(*Message).seq)
+		if err != nil {
+			return err
+		}
+		s.emitDeleted(removed)
+		count -= len(removed)
+	}
+	return nil
+}
+
+// Usage returns the number of messages in the store, and their total size.
+func (s *Store) Usage() (count, size int64, err error) {
+	err = s.db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(size), 0) FROM messages`).
+		Scan(&count, &size)
+	return count, size, err
+}
+
+// execQueryer is implemented by sql.DB and sql.Tx.
+type execQueryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// deleteWhere deletes the messages matching the where clause, returning them.
+func (s *Store) deleteWhere(q execQueryer, where string, args ...any) ([]*Message, error) {
+	rows, err := q.Query(`DELETE FROM messages WHERE `+where+` RETURNING `+columns, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var removed []*Message
+	for rows.Next() {
+		m, err := s.scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		removed = append(removed, m)
+	}
+	return removed, rows.Err()
+}
+
+// query returns the messages selected by a query of the messages table columns.
+func (s *Store) query(query string, args ...any) ([]storage.Message, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	msgs := make([]storage.Message, 0)
+	for rows.Next() {
+		m, err := s.scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, rows.Err()
+}
+
+// emitDeleted emits a delete event for each message.
+func (s *Store) emitDeleted(msgs []*Message) {
+	for _, m := range msgs {
+		s.extHost.Events.AfterMessageDeleted.Emit(message.MakeMetadata(m))
+	}
+}
+
+// scanner is implemented by sql.Row and sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanMessage reads the messages table columns into a Message.
+func (s *Store) scanMessage(row scanner) (*Message, error) {
+	m := &Message{store: s}
+	var fromName, fromAddress, session, auth sql.NullString
+	var recipients string
+	var date int64
+	err := row.Scan(&m.seq, &m.mailbox, &fromName, &fromAddress, &recipients, &date, &m.subject,
+		&m.size, &m.seen, &session, &auth)
+	if err != nil {
+		return nil, err
+	}
+	m.id = strconv.FormatInt(m.seq, 10)
+	m.date = time.Unix(0, date)
+	if fromAddress.Valid {
+		m.from = &mail.Address{Name: fromName.String, Address: fromAddress.String}
+	}
+	if err := json.Unmarshal([]byte(recipients), &m.to); err != nil {
+		return nil, fmt.Errorf("message %v recipients: %w", m.id, err)
+	}
+	if session.Valid {
+		m.session = &event.SessionInfo{}
+		if err := json.Unmarshal([]byte(session.String), m.session); err != nil {
+			return nil, fmt.Errorf("message %v session: %w", m.id, err)
+		}
+	}
+	if auth.Valid {
+		if err := json.Unmarshal([]byte(auth.String), &m.auth); err != nil {
+			return nil, fmt.Errorf("message %v auth results: %w", m.id, err)
+		}
+	}
+	return m, nil
+}
+
+// encodeNullable returns v encoded as JSON, or NULL if null is true.
+func encodeNullable(v any, null bool) (sql.NullString, error) {
+	if null {
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
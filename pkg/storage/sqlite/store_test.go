@@ -0,0 +1,173 @@
+package sqlite_test
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/config"
+	"github.com/inbucket/inbucket/v3/pkg/extension"
+	"github.com/inbucket/inbucket/v3/pkg/storage"
+	"github.com/inbucket/inbucket/v3/pkg/storage/sqlite"
+	"github.com/inbucket/inbucket/v3/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSuite runs storage package test suite on the SQLite store.
+func TestSuite(t *testing.T) {
+	test.StoreSuite(t,
+		func(conf config.Storage, extHost *extension.Host) (storage.Store, func(), error) {
+			conf.Params = map[string]string{"path": filepath.Join(t.TempDir(), "inbucket.db")}
+			s, err := sqlite.New(conf, extHost)
+			if err != nil {
+				return nil, nil, err
+			}
+			destroy := func() { _ = s.(*sqlite.Store).Close() }
+			return s, destroy, nil
+		})
+}
+
+func TestNewRequiresPath(t *testing.T) {
+	_, err := sqlite.New(config.Storage{}, extension.NewHost())
+	assert.Error(t, err)
+}
+
+func TestPersistence(t *testing.T) {
+	conf := config.Storage{
+		Params: map[string]string{"path": filepath.Join(t.TempDir(), "sub", "inbucket.db")},
+	}
+	s := openStore(t, conf, extension.NewHost())
+	id1, _ := test.DeliverToStore(t, s, "fred", "before restart", time.Now())
+	require.NoError(t, s.MarkSeen("fred", id1))
+	require.NoError(t, s.Close())
+
+	// Messages survive reopening, and IDs are not reused.
+	s = openStore(t, conf, extension.NewHost())
+	msgs := test.GetAndCountMessages(t, s, "fred", 1)
+	assert.Equal(t, "before restart", msgs[0].Subject())
+	assert.True(t, msgs[0].Seen())
+	require.NoError(t, s.RemoveMessage("fred", id1))
+	id2, _ := test.DeliverToStore(t, s, "fred", "after restart", time.Now())
+	assert.NotEqual(t, id1, id2)
+
+	// Missing messages.
+	_, err := s.GetMessage("fred", id1)
+	require.ErrorIs(t, err, storage.ErrNotExist)
+	require.ErrorIs(t, s.RemoveMessage("fred", id1), storage.ErrNotExist)
+	require.ErrorIs(t, s.MarkSeen("fred", "bogus"), storage.ErrNotExist)
+	_, err = s.GetMessage("empty", "latest")
+	require.ErrorIs(t, err, storage.ErrNotExist)
+}
+
+func TestFindAndCount(t *testing.T) {
+	s := openStore(t, config.Storage{}, extension.NewHost())
+	now := time.Now()
+	test.DeliverToStore(t, s, "alice", "Password Reset", now.Add(-2*time.Hour))
+	test.DeliverToStore(t, s, "bob", "password reset", now.Add(-time.Hour))
+	id3, _ := test.DeliverToStore(t, s, "bob", "welcome_100%", now)
+	require.NoError(t, s.MarkSeen("bob", id3))
+
+	subjects := func(msgs []storage.Message) []string {
+		var got []string
+		for _, m := range msgs {
+			got = append(got, m.Mailbox()+":"+m.Subject())
+		}
+		return got
+	}
+	seen := true
+	for name, tc := range map[string]struct {
+		query storage.Query
+		want  []string
+	}{
+		"all":        {storage.Query{}, []string{"alice:Password Reset", "bob:password reset", "bob:welcome_100%"}},
+		"mailbox":    {storage.Query{Mailbox: "bob"}, []string{"bob:password reset", "bob:welcome_100%"}},
+		"subject":    {storage.Query{Subject: "RESET"}, []string{"alice:Password Reset", "bob:password reset"}},
+		"escaped":    {storage.Query{Subject: "_100%"}, []string{"bob:welcome_100%"}},
+		"seen":       {storage.Query{Seen: &seen}, []string{"bob:welcome_100%"}},
+		"to":         {storage.Query{Mailbox: "alice", To: "SOMEBODY@"}, []string{"alice:Password Reset"}},
+		"to address": {storage.Query{To: "body <somebody@host>"}, []string{"alice:Password Reset", "bob:password reset", "bob:welcome_100%"}},
+		"to none":    {storage.Query{To: "alice@"}, nil},
+		"from":       {storage.Query{Mailbox: "alice", From: "b. else"}, []string{"alice:Password Reset"}},
+		"after":      {storage.Query{After: now.Add(-90 * time.Minute)}, []string{"bob:password reset", "bob:welcome_100%"}},
+		"before":     {storage.Query{Before: now.Add(-90 * time.Minute)}, []string{"alice:Password Reset"}},
+		"limit":      {storage.Query{Subject: "reset", Limit: 1}, []string{"alice:Password Reset"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			msgs, err := s.Find(tc.query)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, subjects(msgs))
+			if tc.query.Limit == 0 {
+				count, err := s.Count(tc.query)
+				require.NoError(t, err)
+				assert.Equal(t, int64(len(tc.want)), count)
+			}
+		})
+	}
+}
+
+func TestRemoveMessagesBefore(t *testing.T) {
+	extHost := extension.NewHost()
+	s := openStore(t, config.Storage{}, extHost)
+	deleted := extHost.Events.AfterMessageDeleted.AsyncTestListener("test", 2)
+	now := time.Now()
+	test.DeliverToStore(t, s, "alice", "old", now.Add(-48*time.Hour))
+	test.DeliverToStore(t, s, "bob", "old", now.Add(-25*time.Hour))
+	_, size := test.DeliverToStore(t, s, "bob", "new", now)
+
+	removed, err := s.RemoveMessagesBefore(now.Add(-24*time.Hour), nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), removed)
+	for range 2 {
+		ev, err := deleted()
+		require.NoError(t, err)
+		assert.Equal(t, "old", ev.Subject)
+	}
+
+	count, total, err := s.Usage()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+	assert.Equal(t, size, total)
+	test.GetAndCountMessages(t, s, "alice", 0)
+	msgs := test.GetAndCountMessages(t, s, "bob", 1)
+	src, err := msgs[0].Source()
+	require.NoError(t, err)
+	b, err := io.ReadAll(src)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), "Subject: new")
+
+	// Source of a removed message is no longer available.
+	require.NoError(t, s.PurgeMessages("bob"))
+	_, err = msgs[0].Source()
+	assert.ErrorIs(t, err, storage.ErrNotExist)
+}
+
+func TestRemoveMessagesBeforeDenied(t *testing.T) {
+	s := openStore(t, config.Storage{}, extension.NewHost())
+	now := time.Now()
+	test.DeliverToStore(t, s, "alice", "pinned", now.Add(-48*time.Hour))
+	test.DeliverToStore(t, s, "alice", "old", now.Add(-48*time.Hour))
+	test.DeliverToStore(t, s, "bob", "old", now.Add(-25*time.Hour))
+
+	removed, err := s.RemoveMessagesBefore(now.Add(-24*time.Hour), func(m storage.Message) bool {
+		return m.Subject() == "pinned"
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), removed)
+	msgs := test.GetAndCountMessages(t, s, "alice", 1)
+	assert.Equal(t, "pinned", msgs[0].Subject())
+	test.GetAndCountMessages(t, s, "bob", 0)
+}
+
+func openStore(t *testing.T, conf config.Storage, extHost *extension.Host) *sqlite.Store {
+	t.Helper()
+	if conf.Params == nil {
+		conf.Params = map[string]string{"path": filepath.Join(t.TempDir(), "inbucket.db")}
+	}
+	s, err := sqlite.New(conf, extHost)
+	require.NoError(t, err)
+	store := s.(*sqlite.Store)
+	t.Cleanup(func() { _ = store.Close() })
+	return store
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/inbucket/inbucket/v3/pkg/config"
 	"github.com/inbucket/inbucket/v3/pkg/extension"
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
 )
 
 var (
@@ -35,6 +36,36 @@ type Store interface {
 	VisitMailboxes(f func([]Message) (cont bool)) error
 }
 
+// Expirer is implemented by stores able to remove expired messages from every mailbox at once.
+// RetentionScanner uses it in place of visiting each mailbox.
+type Expirer interface {
+	// RemoveMessagesBefore deletes messages dated before cutoff, returning the number removed.
+	// Messages for which denied returns true are kept, denied may be nil.
+	RemoveMessagesBefore(cutoff time.Time, denied func(Message) bool) (removed int64, err error)
+	// Usage returns the number of messages in the store, and their total size.
+	Usage() (count, size int64, err error)
+}
+
+// Searcher is implemented by stores able to find messages across every mailbox.
+type Searcher interface {
+	// Find returns the messages matching q, in delivery order.
+	Find(q Query) ([]Message, error)
+	// Count returns the number of messages matching q, ignoring q.Limit.
+	Count(q Query) (int64, error)
+}
+
+// Query selects messages across all mailboxes.  Zero valued fields match any message.
+type Query struct {
+	Mailbox string    // Mailbox name, matched exactly.
+	From    string    // Sender name or address substring, ignoring ASCII case.
+	To      string    // Recipient name or address substring, ignoring ASCII case.
+	Subject string    // Subject substring, ignoring ASCII case.
+	Seen    *bool     // Seen flag.
+	After   time.Time // Messages dated after this time.
+	Before  time.Time // Messages dated before this time.
+	Limit   int       // Maximum number of messages to return.
+}
+
 // Message represents a message to be stored, or returned from a storage implementation.
 type Message interface {
 	Mailbox() string
@@ -46,6 +77,8 @@ type Message interface {
 	Source() (io.ReadCloser, error)
 	Size() int64
 	Seen() bool
+	Session() *event.SessionInfo
+	AuthResults() []event.AuthResult
 }
 
 // FromConfig creates an instance of the Store based on the provided configuration.
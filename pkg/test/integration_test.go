@@ -200,11 +200,11 @@ func startServer() (func(), error) {
 	// Start HTTP server.
 	webui.SetupRoutes(web.Router.PathPrefix("/serve/").Subrouter())
 	rest.SetupRoutes(web.Router.PathPrefix("/api/").Subrouter())
-	webServer := web.NewServer(conf, mmanager, msgHub)
+	smtpServer := smtp.NewServer(conf.SMTP, mmanager, addrPolicy, extHost)
+	webServer := web.NewServer(conf, mmanager, msgHub, smtpServer.Faults(), nil, nil)
 	go webServer.Start(svcCtx, func() {})
 
 	// Start SMTP server.
-	smtpServer := smtp.NewServer(conf.SMTP, mmanager, addrPolicy, extHost)
 	go smtpServer.Start(svcCtx, func() {})
 
 	// TODO Use a readyFunc to determine server readiness.
@@ -76,3 +76,8 @@ func (m *ManagerStub) MarkSeen(mailbox, id string) error {
 	}
 	return storage.ErrNotExist
 }
+
+// Search is not supported by the stub.
+func (m *ManagerStub) Search(q storage.Query) ([]*event.MessageMetadata, int64, error) {
+	return nil, 0, message.ErrSearchUnsupported
+}
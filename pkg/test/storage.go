@@ -24,6 +24,9 @@ func NewStore() *StoreStub {
 // AddMessage adds a message to the specified mailbox.
 func (s *StoreStub) AddMessage(m storage.Message) (id string, err error) {
 	mb := m.Mailbox()
+	if mb == "deliveryerr" {
+		return "", errors.New("internal error")
+	}
 	msgs := s.mailboxes[mb]
 	s.mailboxes[mb] = append(msgs, &MessageStub{Message: m})
 	return m.ID(), nil
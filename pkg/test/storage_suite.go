@@ -39,6 +39,8 @@ func StoreSuite(t *testing.T, factory StoreFactory) {
 	}{
 		{"metadata", testMetadata, config.Storage{}},
 		{"content", testContent, config.Storage{}},
+		{"session", testSession, config.Storage{}},
+		{"auth results", testAuthResults, config.Storage{}},
 		{"delivery order", testDeliveryOrder, config.Storage{}},
 		{"latest", testLatest, config.Storage{}},
 		{"naming", testNaming, config.Storage{}},
@@ -48,6 +50,7 @@ func StoreSuite(t *testing.T, factory StoreFactory) {
 		{"purge", testPurge, config.Storage{}},
 		{"cap=10", testMsgCap, config.Storage{MailboxMsgCap: 10}},
 		{"cap=0", testNoMsgCap, config.Storage{MailboxMsgCap: 0}},
+		{"cap denied", testMsgCapDenied, config.Storage{MailboxMsgCap: 3}},
 		{"visit mailboxes", testVisitMailboxes, config.Storage{}},
 	}
 	for _, tc := range testCases {
@@ -136,6 +139,72 @@ func testMetadata(s storeSuite) {
 	}
 }
 
+// testSession verifies SMTP session details are stored and retrieved correctly.
+func testSession(s storeSuite) {
+	mailbox := "testmailbox"
+	session := &event.SessionInfo{
+		AuthUser:   "user1",
+		Helo:       "client.example.com",
+		RemoteAddr: "192.0.2.1",
+		TLSVersion: "TLS 1.3",
+		TLSCipher:  "TLS_AES_128_GCM_SHA256",
+		MailFrom:   "from@person.com",
+		RcptTo:     []string{"one@a.person.com", "two@b.person.com"},
+	}
+	delivery := &message.Delivery{
+		Meta: event.MessageMetadata{
+			Mailbox: mailbox,
+			From:    &mail.Address{Address: "from@person.com"},
+			Date:    time.Now(),
+			Subject: "with session",
+			Session: session,
+		},
+		Reader: strings.NewReader("doesn't matter"),
+	}
+	id, err := s.store.AddMessage(delivery)
+	require.NoError(s, err, "AddMessage() failed")
+	DeliverToStore(s.T, s.store, mailbox, "without session", time.Now())
+
+	sm, err := s.store.GetMessage(mailbox, id)
+	require.NoError(s, err, "GetMessage() failed")
+	assert.Equal(s, session, sm.Session())
+
+	msgs := GetAndCountMessages(s.T, s.store, mailbox, 2)
+	assert.Equal(s, session, msgs[0].Session())
+	assert.Nil(s, msgs[1].Session(), "message delivered without session")
+}
+
+// testAuthResults verifies message authentication results are stored and retrieved correctly.
+func testAuthResults(s storeSuite) {
+	mailbox := "testmailbox"
+	results := []event.AuthResult{
+		{Method: "dkim", Result: "pass", Domain: "example.com", Selector: "s1"},
+		{Method: "dkim", Result: "fail", Domain: "example.org", Selector: "s2",
+			Reason: "body hash did not verify"},
+	}
+	delivery := &message.Delivery{
+		Meta: event.MessageMetadata{
+			Mailbox:     mailbox,
+			From:        &mail.Address{Address: "from@person.com"},
+			Date:        time.Now(),
+			Subject:     "with auth results",
+			AuthResults: results,
+		},
+		Reader: strings.NewReader("doesn't matter"),
+	}
+	id, err := s.store.AddMessage(delivery)
+	require.NoError(s, err, "AddMessage() failed")
+	DeliverToStore(s.T, s.store, mailbox, "without auth results", time.Now())
+
+	sm, err := s.store.GetMessage(mailbox, id)
+	require.NoError(s, err, "GetMessage() failed")
+	assert.Equal(s, results, sm.AuthResults())
+
+	msgs := GetAndCountMessages(s.T, s.store, mailbox, 2)
+	assert.Equal(s, results, msgs[0].AuthResults())
+	assert.Empty(s, msgs[1].AuthResults(), "message delivered without auth results")
+}
+
 // testContent generates some binary content and makes sure it is correctly retrieved.
 func testContent(s storeSuite) {
 	content := make([]byte, 5000)
@@ -409,6 +478,29 @@ func testMsgCap(s storeSuite) {
 	}
 }
 
+// testMsgCapDenied verifies the message cap skips messages extensions refuse to delete.
+func testMsgCapDenied(s storeSuite) {
+	s.extHost.Events.BeforeMessageDeleted.AddListener("test",
+		func(msg event.MessageMetadata) *event.DeleteResponse {
+			if msg.Subject == "pinned" {
+				return &event.DeleteResponse{Action: event.ActionDeny}
+			}
+			return nil
+		})
+
+	mailbox := "captain"
+	DeliverToStore(s.T, s.store, mailbox, "pinned", time.Now())
+	for i := range 5 {
+		DeliverToStore(s.T, s.store, mailbox, fmt.Sprintf("subject %v", i), time.Now())
+	}
+	msgs := GetAndCountMessages(s.T, s.store, mailbox, 3)
+	got := make([]string, len(msgs))
+	for i, m := range msgs {
+		got[i] = m.Subject()
+	}
+	assert.Equal(s, []string{"pinned", "subject 3", "subject 4"}, got)
+}
+
 // testNoMsgCap verfies a cap of 0 is not enforced.
 func testNoMsgCap(s storeSuite) {
 	mailbox := "captain"
@@ -0,0 +1,153 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"github.com/inbucket/inbucket/v3/pkg/retryqueue"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Delivery is an event being posted to a webhook URL.
+type Delivery struct {
+	ID          string
+	URL         string
+	Event       string
+	Mailbox     string
+	MessageID   string
+	Created     time.Time
+	Attempts    int       // Post attempts made so far.
+	NextAttempt time.Time // Time of the next post attempt, zero once dead-lettered.
+	LastError   string    // Error from the most recent attempt, if any.
+	Payload     []byte    // JSON request body.
+}
+
+// Status describes the delivery queue and dead-letter list.
+type Status struct {
+	Pending     []Delivery // Deliveries awaiting a post attempt, ordered by next attempt.
+	DeadLetters []Delivery // Failed deliveries, oldest first.
+	Delivered   int64      // Posts accepted by the endpoint.
+	Failed      int64      // Posts rejected by the endpoint, or out of attempts.
+	Dropped     int64      // Posts discarded because the queue was full.
+}
+
+// request is an event queued for posting to a webhook URL.
+type request struct {
+	url       string
+	event     string
+	mailbox   string
+	messageID string
+	payload   []byte
+}
+
+// statusError is returned when the webhook endpoint replies with a non-2xx status.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return "webhook endpoint replied " + e.status
+}
+
+// enqueue adds a delivery of payload to each webhook URL.
+func (d *Dispatcher) enqueue(name string, msg event.MessageMetadata, payload []byte) {
+	for _, u := range d.urls {
+		p := request{url: u, event: name, mailbox: msg.Mailbox, messageID: msg.ID, payload: payload}
+		if !d.queue.Add(p) {
+			log.Warn().Str("module", "webhook").Str("url", u).Str("event", name).
+				Msg("Webhook queue full, dropping event")
+		}
+	}
+}
+
+// Status returns a snapshot of the delivery queue and dead-letter list.
+func (d *Dispatcher) Status() Status {
+	qs := d.queue.Status()
+	return Status{
+		Pending:     deliveries(qs.Pending),
+		DeadLetters: deliveries(qs.DeadLetters),
+		Delivered:   qs.Delivered,
+		Failed:      qs.Failed,
+		Dropped:     qs.Dropped,
+	}
+}
+
+// ClearDeadLetters empties the dead-letter list.
+func (d *Dispatcher) ClearDeadLetters() {
+	d.queue.ClearDeadLetters()
+}
+
+// Start posts queued deliveries until the context is cancelled.
+func (d *Dispatcher) Start(ctx context.Context) {
+	d.queue.Start(ctx)
+}
+
+// post sends entry's payload to its URL.
+func (d *Dispatcher) post(ctx context.Context, entry retryqueue.Entry[request]) error {
+	p := entry.Item
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(p.payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderDelivery, entry.ID)
+	req.Header.Set(HeaderEvent, p.event)
+	if len(d.secret) > 0 {
+		req.Header.Set(HeaderSignature, Sign(d.secret, p.payload))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	return &statusError{code: resp.StatusCode, status: resp.Status}
+}
+
+// permanent returns true if the endpoint rejected the payload, and it should not be retried.
+func permanent(err error) bool {
+	var se *statusError
+	if !errors.As(err, &se) {
+		return false
+	}
+	return se.code >= 400 && se.code < 500 &&
+		se.code != http.StatusRequestTimeout && se.code != http.StatusTooManyRequests
+}
+
+// postLogger returns a logger describing a queued post.
+func postLogger(entry retryqueue.Entry[request]) zerolog.Logger {
+	return log.With().Str("module", "webhook").Str("url", entry.Item.url).
+		Str("delivery", entry.ID).Str("event", entry.Item.event).Logger()
+}
+
+// deliveries converts queue entries to Deliveries.
+func deliveries(entries []retryqueue.Entry[request]) []Delivery {
+	result := make([]Delivery, len(entries))
+	for i, e := range entries {
+		result[i] = Delivery{
+			ID:          e.ID,
+			URL:         e.Item.url,
+			Event:       e.Item.event,
+			Mailbox:     e.Item.mailbox,
+			MessageID:   e.Item.messageID,
+			Created:     e.Created,
+			Attempts:    e.Attempts,
+			NextAttempt: e.NextAttempt,
+			LastError:   e.LastError,
+			Payload:     e.Item.payload,
+		}
+	}
+	return result
+}
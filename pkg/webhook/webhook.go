@@ -0,0 +1,192 @@
+// Package webhook posts message events to HTTP endpoints, allowing external services to react to
+// messages as they are stored or deleted.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/config"
+	"github.com/inbucket/inbucket/v3/pkg/extension"
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"github.com/inbucket/inbucket/v3/pkg/message"
+	"github.com/inbucket/inbucket/v3/pkg/retryqueue"
+	"github.com/inbucket/inbucket/v3/pkg/storage"
+	"github.com/inbucket/inbucket/v3/pkg/stringutil"
+	"github.com/rs/zerolog/log"
+)
+
+// Event names sent in payloads and the X-Inbucket-Event header.
+const (
+	EventMessageStored  = "message-stored"
+	EventMessageDeleted = "message-deleted"
+)
+
+// HTTP headers added to each post.
+const (
+	HeaderDelivery  = "X-Inbucket-Delivery"
+	HeaderEvent     = "X-Inbucket-Event"
+	HeaderSignature = "X-Inbucket-Signature"
+)
+
+const listenerName = "webhook"
+
+// Payload is the JSON body posted for a message event.
+type Payload struct {
+	Event   string    `json:"event"`
+	Mailbox string    `json:"mailbox"`
+	ID      string    `json:"id"`
+	From    string    `json:"from"`
+	To      []string  `json:"to"`
+	Subject string    `json:"subject"`
+	Date    time.Time `json:"date"`
+	Size    int64     `json:"size"`
+	Seen    bool      `json:"seen"`
+	Body    *Body     `json:"body,omitempty"` // Only present for stored events, when enabled.
+}
+
+// Body contains the text and HTML versions of the message body.
+type Body struct {
+	Text string `json:"text"`
+	HTML string `json:"html"`
+}
+
+// Dispatcher posts message events to the configured webhook URLs.
+type Dispatcher struct {
+	urls        []string
+	mailboxes   map[string]bool // Mailboxes to post events for, empty for all.
+	subject     *regexp.Regexp  // Nil to match all subjects.
+	secret      []byte
+	includeBody bool
+	client      *http.Client
+	queue       *retryqueue.Queue[request]
+	manager     message.Manager
+}
+
+// New creates a Dispatcher from the configuration, and registers it to receive message events
+// from extHost.  Returns nil if no webhook URLs are configured.
+func New(conf config.Webhook, extHost *extension.Host, manager message.Manager) (*Dispatcher, error) {
+	if len(conf.URLs) == 0 {
+		return nil, nil
+	}
+	d := &Dispatcher{
+		urls:        make([]string, 0, len(conf.URLs)),
+		mailboxes:   make(map[string]bool, len(conf.Mailboxes)),
+		secret:      []byte(conf.Secret),
+		includeBody: conf.IncludeBody,
+		client:      &http.Client{Timeout: conf.Timeout},
+		manager:     manager,
+	}
+	for _, rawURL := range conf.URLs {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("webhook URL %q: %w", rawURL, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("webhook URL %q: must be an absolute http or https URL", rawURL)
+		}
+		d.urls = append(d.urls, rawURL)
+	}
+	for _, address := range conf.Mailboxes {
+		name, err := manager.MailboxForAddress(address)
+		if err != nil {
+			return nil, fmt.Errorf("webhook mailbox %q: %w", address, err)
+		}
+		d.mailboxes[name] = true
+	}
+	if conf.Subject != "" {
+		re, err := regexp.Compile(conf.Subject)
+		if err != nil {
+			return nil, fmt.Errorf("webhook subject: %w", err)
+		}
+		d.subject = re
+	}
+	if conf.RetryInterval <= 0 {
+		conf.RetryInterval = 10 * time.Second
+	}
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = 1000
+	}
+	d.queue = retryqueue.New(retryqueue.Options[request]{
+		Size:           conf.QueueSize,
+		RetryInterval:  conf.RetryInterval,
+		MaxAttempts:    conf.MaxAttempts,
+		DeadLetterSize: conf.DeadLetterSize,
+		Send:           d.post,
+		Permanent:      permanent,
+		Logger:         postLogger,
+	})
+
+	extHost.Events.AfterMessageStored.AddListener(listenerName,
+		func(msg event.MessageMetadata) { d.Notify(EventMessageStored, msg) })
+	extHost.Events.AfterMessageDeleted.AddListener(listenerName,
+		func(msg event.MessageMetadata) { d.Notify(EventMessageDeleted, msg) })
+
+	return d, nil
+}
+
+// Notify queues a post of the named event to each webhook URL, if the message matches the
+// configured mailbox and subject filters.  Notify does not block on delivery.
+func (d *Dispatcher) Notify(name string, msg event.MessageMetadata) {
+	if !d.matches(msg) {
+		return
+	}
+	logger := log.With().Str("module", "webhook").Str("event", name).
+		Str("mailbox", msg.Mailbox).Str("id", msg.ID).Logger()
+
+	payload := &Payload{
+		Event:   name,
+		Mailbox: msg.Mailbox,
+		ID:      msg.ID,
+		From:    stringutil.StringAddress(msg.From),
+		To:      stringutil.StringAddressList(msg.To),
+		Subject: msg.Subject,
+		Date:    msg.Date,
+		Size:    msg.Size,
+		Seen:    msg.Seen,
+	}
+	if d.includeBody && name == EventMessageStored {
+		full, err := d.manager.GetMessage(msg.Mailbox, msg.ID)
+		switch {
+		case errors.Is(err, storage.ErrNotExist) || (err == nil && full == nil):
+			logger.Debug().Msg("Message removed before webhook body was read")
+		case err != nil:
+			logger.Warn().Err(err).Msg("Failed to read message body for webhook")
+		default:
+			payload.Body = &Body{Text: full.Text(), HTML: full.HTML()}
+		}
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to encode webhook payload")
+		return
+	}
+
+	d.enqueue(name, msg, data)
+}
+
+// matches returns true if msg passes the mailbox and subject filters.
+func (d *Dispatcher) matches(msg event.MessageMetadata) bool {
+	if len(d.mailboxes) > 0 && !d.mailboxes[msg.Mailbox] {
+		return false
+	}
+	if d.subject != nil && !d.subject.MatchString(msg.Subject) {
+		return false
+	}
+	return true
+}
+
+// Sign returns the X-Inbucket-Signature header value for body, signed with secret.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
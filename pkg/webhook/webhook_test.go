@@ -0,0 +1,308 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/inbucket/inbucket/v3/pkg/config"
+	"github.com/inbucket/inbucket/v3/pkg/extension"
+	"github.com/inbucket/inbucket/v3/pkg/extension/event"
+	"github.com/inbucket/inbucket/v3/pkg/message"
+	"github.com/inbucket/inbucket/v3/pkg/policy"
+	"github.com/inbucket/inbucket/v3/pkg/storage/mem"
+	"github.com/inbucket/inbucket/v3/pkg/test"
+	"github.com/inbucket/inbucket/v3/pkg/webhook"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// post is a request received by an endpoint.
+type post struct {
+	header http.Header
+	body   []byte
+}
+
+// endpoint records posts, replying with each status in turn, then 200.
+type endpoint struct {
+	*httptest.Server
+	posts chan post
+}
+
+func startEndpoint(t *testing.T, statuses ...int) *endpoint {
+	t.Helper()
+	e := &endpoint{posts: make(chan post, 10)}
+	replies := make(chan int, len(statuses))
+	for _, s := range statuses {
+		replies <- s
+	}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		e.posts <- post{header: r.Header.Clone(), body: body}
+		select {
+		case status := <-replies:
+			w.WriteHeader(status)
+		default:
+		}
+	}))
+	t.Cleanup(e.Close)
+	return e
+}
+
+func (e *endpoint) wait(t *testing.T) post {
+	t.Helper()
+	select {
+	case p := <-e.posts:
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for webhook post")
+	}
+	return post{}
+}
+
+func startDispatcher(t *testing.T, conf config.Webhook) (*webhook.Dispatcher, *extension.Host) {
+	t.Helper()
+	extHost := extension.NewHost()
+	d, err := webhook.New(conf, extHost, test.NewManager())
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(t.Context())
+	t.Cleanup(cancel)
+	go d.Start(ctx)
+	return d, extHost
+}
+
+func TestNewNotConfigured(t *testing.T) {
+	d, err := webhook.New(config.Webhook{}, extension.NewHost(), test.NewManager())
+	require.NoError(t, err)
+	assert.Nil(t, d)
+}
+
+func TestNewInvalid(t *testing.T) {
+	for name, conf := range map[string]config.Webhook{
+		"relative url": {URLs: []string{"/hook"}},
+		"bad scheme":   {URLs: []string{"ftp://example.com/hook"}},
+		"bad subject":  {URLs: []string{"http://example.com/hook"}, Subject: "("},
+		"bad mailbox":  {URLs: []string{"http://example.com/hook"}, Mailboxes: []string{"a@b@c"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := webhook.New(conf, extension.NewHost(), test.NewManager())
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestPostsStoredMessage(t *testing.T) {
+	ep := startEndpoint(t)
+	extHost := extension.NewHost()
+	store, err := mem.New(config.Storage{}, extHost)
+	require.NoError(t, err)
+	mm := &message.StoreManager{
+		AddrPolicy: &policy.Addressing{Config: &config.Root{
+			MailboxNaming: config.FullNaming,
+			SMTP:          config.SMTP{DefaultAccept: true, DefaultStore: true},
+		}},
+		Store:   store,
+		ExtHost: extHost,
+	}
+	d, err := webhook.New(config.Webhook{
+		URLs:        []string{ep.URL},
+		Secret:      "s3cret",
+		IncludeBody: true,
+	}, extHost, mm)
+	require.NoError(t, err)
+	go d.Start(t.Context())
+
+	origin, _ := mm.AddrPolicy.ParseOrigin("from@example.com")
+	recip, _ := mm.AddrPolicy.NewRecipient("to@example.com")
+	err = mm.Deliver(origin, []*policy.Recipient{recip}, "",
+		[]byte("From: from@example.com\r\nTo: to@example.com\r\nSubject: hello\r\n\r\nbody text\r\n"),
+		nil)
+	require.NoError(t, err)
+
+	p := ep.wait(t)
+	assert.Equal(t, webhook.EventMessageStored, p.header.Get(webhook.HeaderEvent))
+	assert.Equal(t, "1", p.header.Get(webhook.HeaderDelivery))
+	assert.Equal(t, "application/json", p.header.Get("Content-Type"))
+	assert.Equal(t, webhook.Sign([]byte("s3cret"), p.body), p.header.Get(webhook.HeaderSignature))
+
+	got := &webhook.Payload{}
+	require.NoError(t, json.Unmarshal(p.body, got))
+	assert.Equal(t, webhook.EventMessageStored, got.Event)
+	assert.Equal(t, "to@example.com", got.Mailbox)
+	assert.Equal(t, "<from@example.com>", got.From)
+	assert.Equal(t, []string{"<to@example.com>"}, got.To)
+	assert.Equal(t, "hello", got.Subject)
+	require.NotNil(t, got.Body)
+	assert.Equal(t, "body text\r\n", got.Body.Text)
+
+	// Deleted events do not include the body.
+	require.NoError(t, mm.RemoveMessage(got.Mailbox, got.ID))
+	p = ep.wait(t)
+	assert.Equal(t, webhook.EventMessageDeleted, p.header.Get(webhook.HeaderEvent))
+	got = &webhook.Payload{}
+	require.NoError(t, json.Unmarshal(p.body, got))
+	assert.Equal(t, webhook.EventMessageDeleted, got.Event)
+	assert.Equal(t, "hello", got.Subject)
+	assert.Nil(t, got.Body)
+}
+
+func TestStoredMessageRemovedBeforeNotify(t *testing.T) {
+	extHost := extension.NewHost()
+	store, err := mem.New(config.Storage{}, extHost)
+	require.NoError(t, err)
+	mm := &message.StoreManager{
+		AddrPolicy: &policy.Addressing{Config: &config.Root{MailboxNaming: config.FullNaming}},
+		Store:      store,
+		ExtHost:    extHost,
+	}
+	d, err := webhook.New(config.Webhook{
+		URLs:        []string{"http://127.0.0.1:1/hook"},
+		IncludeBody: true,
+	}, extension.NewHost(), mm)
+	require.NoError(t, err)
+
+	id, _ := test.DeliverToStore(t, store, "m", "gone", time.Now())
+	require.NoError(t, mm.RemoveMessage("m", id))
+	d.Notify(webhook.EventMessageStored, event.MessageMetadata{Mailbox: "m", ID: id, Subject: "gone"})
+
+	pending := d.Status().Pending
+	require.Len(t, pending, 1)
+	got := &webhook.Payload{}
+	require.NoError(t, json.Unmarshal(pending[0].Payload, got))
+	assert.Equal(t, "gone", got.Subject)
+	assert.Nil(t, got.Body)
+}
+
+func TestPostsToEachURL(t *testing.T) {
+	a, b := startEndpoint(t), startEndpoint(t)
+	_, extHost := startDispatcher(t, config.Webhook{URLs: []string{a.URL, b.URL}})
+
+	extHost.Events.AfterMessageStored.Emit(&event.MessageMetadata{Mailbox: "m", ID: "1"})
+	a.wait(t)
+	p := b.wait(t)
+	assert.Empty(t, p.header.Get(webhook.HeaderSignature))
+}
+
+func TestFilters(t *testing.T) {
+	d, err := webhook.New(config.Webhook{
+		URLs:      []string{"http://127.0.0.1:1/hook"},
+		Mailboxes: []string{"Alerts", "signup@example.com"},
+		Subject:   "^(?i)reset",
+	}, extension.NewHost(), test.NewManager())
+	require.NoError(t, err)
+
+	d.Notify(webhook.EventMessageStored, event.MessageMetadata{Mailbox: "alerts", Subject: "Reset"})
+	d.Notify(webhook.EventMessageStored,
+		event.MessageMetadata{Mailbox: "signup@example.com", Subject: "reset password"})
+	d.Notify(webhook.EventMessageStored, event.MessageMetadata{Mailbox: "other", Subject: "reset"})
+	d.Notify(webhook.EventMessageStored, event.MessageMetadata{Mailbox: "alerts", Subject: "hello"})
+
+	var mailboxes []string
+	for _, p := range d.Status().Pending {
+		mailboxes = append(mailboxes, p.Mailbox)
+	}
+	assert.ElementsMatch(t, []string{"alerts", "signup@example.com"}, mailboxes)
+}
+
+func TestRetries(t *testing.T) {
+	ep := startEndpoint(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	d, extHost := startDispatcher(t, config.Webhook{
+		URLs:          []string{ep.URL},
+		RetryInterval: 10 * time.Millisecond,
+		MaxAttempts:   3,
+	})
+
+	extHost.Events.AfterMessageStored.Emit(&event.MessageMetadata{Mailbox: "m", ID: "1"})
+	first := ep.wait(t)
+	ep.wait(t)
+	third := ep.wait(t)
+	assert.Equal(t, first.body, third.body)
+	assert.Equal(t, first.header.Get(webhook.HeaderDelivery), third.header.Get(webhook.HeaderDelivery))
+	require.Eventually(t, func() bool { return d.Status().Delivered == 1 },
+		5*time.Second, 10*time.Millisecond)
+	status := d.Status()
+	assert.Empty(t, status.Pending)
+	assert.Empty(t, status.DeadLetters)
+}
+
+func TestPermanentFailure(t *testing.T) {
+	ep := startEndpoint(t, http.StatusBadRequest)
+	d, extHost := startDispatcher(t, config.Webhook{
+		URLs:           []string{ep.URL},
+		RetryInterval:  10 * time.Millisecond,
+		MaxAttempts:    3,
+		DeadLetterSize: 10,
+	})
+
+	extHost.Events.AfterMessageDeleted.Emit(&event.MessageMetadata{Mailbox: "m", ID: "1"})
+	ep.wait(t)
+	require.Eventually(t, func() bool { return d.Status().Failed == 1 },
+		5*time.Second, 10*time.Millisecond)
+	status := d.Status()
+	assert.Empty(t, status.Pending)
+	require.Len(t, status.DeadLetters, 1)
+	dead := status.DeadLetters[0]
+	assert.Equal(t, ep.URL, dead.URL)
+	assert.Equal(t, webhook.EventMessageDeleted, dead.Event)
+	assert.Equal(t, 1, dead.Attempts)
+	assert.Contains(t, dead.LastError, "400")
+	select {
+	case <-ep.posts:
+		t.Error("Rejected event should not be retried")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	d, extHost := startDispatcher(t, config.Webhook{
+		URLs:           []string{"http://127.0.0.1:1/hook"},
+		RetryInterval:  time.Millisecond,
+		MaxAttempts:    2,
+		DeadLetterSize: 2,
+	})
+
+	for _, id := range []string{"1", "2", "3"} {
+		extHost.Events.AfterMessageStored.Emit(&event.MessageMetadata{Mailbox: "m", ID: id})
+		require.Eventually(t, func() bool { return len(d.Status().Pending) == 0 },
+			5*time.Second, 10*time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return d.Status().Failed == 3 },
+		5*time.Second, 10*time.Millisecond)
+
+	// Oldest entries are discarded.
+	dead := d.Status().DeadLetters
+	require.Len(t, dead, 2)
+	assert.Equal(t, "2", dead[0].MessageID)
+	assert.Equal(t, "3", dead[1].MessageID)
+	assert.Equal(t, 2, dead[1].Attempts)
+	assert.NotEmpty(t, dead[1].LastError)
+
+	d.ClearDeadLetters()
+	assert.Empty(t, d.Status().DeadLetters)
+}
+
+func TestQueueFull(t *testing.T) {
+	d, err := webhook.New(config.Webhook{
+		URLs:      []string{"http://127.0.0.1:1/a", "http://127.0.0.1:1/b"},
+		QueueSize: 3,
+	}, extension.NewHost(), test.NewManager())
+	require.NoError(t, err)
+
+	d.Notify(webhook.EventMessageStored, event.MessageMetadata{Mailbox: "m", ID: "1"})
+	d.Notify(webhook.EventMessageStored, event.MessageMetadata{Mailbox: "m", ID: "2"})
+
+	status := d.Status()
+	assert.Len(t, status.Pending, 3)
+	assert.Equal(t, int64(1), status.Dropped)
+}
+
+func TestSign(t *testing.T) {
+	// Reference value from: printf 'body' | openssl dgst -sha256 -hmac key
+	assert.Equal(t,
+		"sha256=515aae133b435d4000956731f68ae5cf5eb85d4f0dc6a546d2bfcd3595ec1ae1",
+		webhook.Sign([]byte("key"), []byte("body")))
+}
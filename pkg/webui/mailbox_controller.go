@@ -48,6 +48,17 @@ func MailboxMessage(w http.ResponseWriter, req *http.Request, ctx *web.Context)
 		})
 	}
 
+	authResults := make([]*jsonAuthResult, 0)
+	for _, ar := range msg.AuthResults {
+		authResults = append(authResults, &jsonAuthResult{
+			Method:   ar.Method,
+			Result:   ar.Result,
+			Domain:   ar.Domain,
+			Selector: ar.Selector,
+			Reason:   ar.Reason,
+		})
+	}
+
 	// Sanitize HTML body.
 	htmlBody := ""
 	if msg.HTML() != "" {
@@ -76,6 +87,8 @@ func MailboxMessage(w http.ResponseWriter, req *http.Request, ctx *web.Context)
 			HTML:        htmlBody,
 			Attachments: attachments,
 			Errors:      mimeErrors,
+			Transcript:  msg.Session != nil && msg.Session.Transcript != "",
+			AuthResults: authResults,
 		})
 }
 
@@ -125,6 +138,33 @@ func MailboxSource(w http.ResponseWriter, req *http.Request, ctx *web.Context) (
 	return err
 }
 
+// MailboxTranscript displays the SMTP session transcript of a message. Renders text/plain
+func MailboxTranscript(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := ctx.Manager.MailboxForAddress(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	msg, err := ctx.Manager.GetMessage(name, id)
+	if err == storage.ErrNotExist {
+		http.NotFound(w, req)
+		return nil
+	}
+	if err != nil {
+		// This doesn't indicate missing, likely an IO error
+		return fmt.Errorf("GetMessage(%q) failed: %v", id, err)
+	}
+	if msg == nil || msg.Session == nil || msg.Session.Transcript == "" {
+		http.NotFound(w, req)
+		return nil
+	}
+	// Output session transcript
+	w.Header().Set("Content-Type", "text/plain")
+	_, err = io.WriteString(w, msg.Session.Transcript)
+	return err
+}
+
 // MailboxViewAttach sends the attachment to the client for online viewing
 func MailboxViewAttach(w http.ResponseWriter, req *http.Request, ctx *web.Context) (err error) {
 	// Don't have to validate these aren't empty, Gorilla returns 404
@@ -18,6 +18,8 @@ type jsonMessage struct {
 	HTML        string              `json:"html"`
 	Attachments []*jsonAttachment   `json:"attachments"`
 	Errors      []*jsonMIMEError    `json:"errors"`
+	Transcript  bool                `json:"transcript"`
+	AuthResults []*jsonAuthResult   `json:"auth-results"`
 }
 
 // jsonAttachment formats attachment data for the UI.
@@ -32,3 +34,12 @@ type jsonMIMEError struct {
 	Detail string `json:"detail"`
 	Severe bool   `json:"severe"`
 }
+
+// jsonAuthResult formats message authentication results for the UI.
+type jsonAuthResult struct {
+	Method   string `json:"method"`
+	Result   string `json:"result"`
+	Domain   string `json:"domain"`
+	Selector string `json:"selector"`
+	Reason   string `json:"reason"`
+}
@@ -18,6 +18,8 @@ func SetupRoutes(r *mux.Router) {
 		web.Handler(MailboxHTML)).Name("MailboxHTML").Methods("GET")
 	r.Path("/mailbox/{name}/{id}/source").Handler(
 		web.Handler(MailboxSource)).Name("MailboxSource").Methods("GET")
+	r.Path("/mailbox/{name}/{id}/transcript").Handler(
+		web.Handler(MailboxTranscript)).Name("MailboxTranscript").Methods("GET")
 	r.Path("/mailbox/{name}/{id}/attach/{num}/{file}").Handler(
 		web.Handler(MailboxViewAttach)).Name("MailboxViewAttach").Methods("GET")
 }
@@ -1,4 +1,4 @@
-module Data.Message exposing (Attachment, Message, attachmentDecoder, decoder)
+module Data.Message exposing (Attachment, AuthResult, Message, attachmentDecoder, decoder)
 
 import Data.Date exposing (date)
 import Json.Decode exposing (Decoder, bool, int, list, string, succeed)
@@ -19,6 +19,8 @@ type alias Message =
     , html : String
     , attachments : List Attachment
     , errors : List Error
+    , transcript : Bool
+    , authResults : List AuthResult
     }
 
 
@@ -29,6 +31,15 @@ type alias Attachment =
     }
 
 
+type alias AuthResult =
+    { method : String
+    , result : String
+    , domain : String
+    , selector : String
+    , reason : String
+    }
+
+
 type alias Error =
     { name : String
     , detail : String
@@ -51,6 +62,8 @@ decoder =
         |> required "html" string
         |> required "attachments" (list attachmentDecoder)
         |> required "errors" (list errorDecoder)
+        |> optional "transcript" bool False
+        |> optional "auth-results" (list authResultDecoder) []
 
 
 attachmentDecoder : Decoder Attachment
@@ -67,3 +80,13 @@ errorDecoder =
         |> required "name" string
         |> required "detail" string
         |> required "severe" bool
+
+
+authResultDecoder : Decoder AuthResult
+authResultDecoder =
+    succeed AuthResult
+        |> required "method" string
+        |> required "result" string
+        |> optional "domain" string ""
+        |> optional "selector" string ""
+        |> optional "reason" string ""
@@ -599,6 +599,9 @@ viewMessage serveUrl zone message bodyMode =
         sourceUrl =
             serveUrl [ "mailbox", message.mailbox, message.id, "source" ]
 
+        transcriptUrl =
+            serveUrl [ "mailbox", message.mailbox, message.id, "transcript" ]
+
         htmlButton =
             if message.html == "" then
                 text ""
@@ -606,6 +609,14 @@ viewMessage serveUrl zone message bodyMode =
             else
                 a [ href htmlUrl, target "_blank" ]
                     [ button [ tabindex -1 ] [ text "Raw HTML" ] ]
+
+        transcriptButton =
+            if message.transcript then
+                a [ href transcriptUrl, target "_blank" ]
+                    [ button [ tabindex -1 ] [ text "Transcript" ] ]
+
+            else
+                text ""
     in
     div []
         [ div [ class "button-bar" ]
@@ -615,23 +626,52 @@ viewMessage serveUrl zone message bodyMode =
             , a [ href sourceUrl, target "_blank" ]
                 [ button [ tabindex -1 ] [ text "Source" ] ]
             , htmlButton
+            , transcriptButton
             ]
         , dl [ class "message-header" ]
-            [ dt [] [ text "From:" ]
-            , dd [] [ text message.from ]
-            , dt [] [ text "To:" ]
-            , dd [] [ text (String.join ", " message.to) ]
-            , dt [] [ text "Date:" ]
-            , dd [] [ verboseDate zone message.date ]
-            , dt [] [ text "Subject:" ]
-            , dd [] [ text message.subject ]
-            ]
+            ([ dt [] [ text "From:" ]
+             , dd [] [ text message.from ]
+             , dt [] [ text "To:" ]
+             , dd [] [ text (String.join ", " message.to) ]
+             , dt [] [ text "Date:" ]
+             , dd [] [ verboseDate zone message.date ]
+             , dt [] [ text "Subject:" ]
+             , dd [] [ text message.subject ]
+             ]
+                ++ authResults message
+            )
         , messageErrors message
         , messageBody message bodyMode
         , attachments serveUrl message
         ]
 
 
+authResults : Message -> List (Html Msg)
+authResults message =
+    let
+        result auth =
+            li []
+                [ span
+                    [ classList [ ( "message-warn-severe", auth.result /= "pass" ) ] ]
+                    [ text (auth.method ++ "=" ++ auth.result) ]
+                , text (" " ++ auth.domain)
+                , if auth.reason == "" then
+                    text ""
+
+                  else
+                    text (" (" ++ auth.reason ++ ")")
+                ]
+    in
+    case message.authResults of
+        [] ->
+            []
+
+        results ->
+            [ dt [] [ text "Auth:" ]
+            , dd [] [ ul [ class "auth-results" ] (List.map result results) ]
+            ]
+
+
 messageErrors : Message -> Html Msg
 messageErrors message =
     let